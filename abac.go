@@ -0,0 +1,78 @@
+package authz
+
+import (
+	"fmt"
+	"go/token"
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+// abacFields are the fields every ABAC subject has, besides the configured
+// attributes.
+var abacFields = []string{"Name", "Domain", "Path", "Method", "IP"}
+
+// checkABAC checks the ABAC attributes. Their names become fields of the
+// subject, so they must be exported Go identifiers, the only fields Casbin's
+// matchers can access.
+func (a *Authorizer) checkABAC() error {
+	if !a.AuthConfig.ABAC {
+		if len(a.AuthConfig.ABACAttributes) > 0 {
+			return fmt.Errorf("abac attributes require abac")
+		}
+		return nil
+	}
+	for name, source := range a.AuthConfig.ABACAttributes {
+		if !token.IsIdentifier(name) || !token.IsExported(name) {
+			return fmt.Errorf("invalid abac attribute %q, expected an identifier starting with an upper case letter", name)
+		}
+		for _, field := range abacFields {
+			if name == field {
+				return fmt.Errorf("abac attribute %q is a field of the subject already", name)
+			}
+		}
+		if !validRequestSource(source) {
+			return fmt.Errorf("invalid source %q of abac attribute %s, expected header:<name> or query:<name>", source, name)
+		}
+	}
+	return nil
+}
+
+// abacAttributes returns the values of the ABAC attributes of r.
+func (a *Authorizer) abacAttributes(r *http.Request) map[string]string {
+	attrs := make(map[string]string, len(a.AuthConfig.ABACAttributes))
+	for name, source := range a.AuthConfig.ABACAttributes {
+		attrs[name] = requestValue(r, source)
+	}
+	return attrs
+}
+
+// abacSubject returns the struct passed to the enforcer as the only request
+// argument in ABAC mode: the subject and args as the fields of abacFields,
+// and a string field for each attribute. Matchers access them like
+// r.sub.Path or r.sub.Dept.
+func (a *Authorizer) abacSubject(subject string, args enforceArgs) interface{} {
+	fields := make([]reflect.StructField, 0, len(abacFields)+len(args.attrs))
+	for _, name := range abacFields {
+		fields = append(fields, reflect.StructField{Name: name, Type: reflect.TypeOf("")})
+	}
+	names := make([]string, 0, len(args.attrs))
+	for name := range args.attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names) // Equal attributes give equal types, which reflect caches.
+	for _, name := range names {
+		fields = append(fields, reflect.StructField{Name: name, Type: reflect.TypeOf("")})
+	}
+
+	v := reflect.New(reflect.StructOf(fields)).Elem()
+	v.FieldByName("Name").SetString(subject)
+	v.FieldByName("Domain").SetString(args.domain)
+	v.FieldByName("Path").SetString(args.path)
+	v.FieldByName("Method").SetString(args.method)
+	v.FieldByName("IP").SetString(args.ip)
+	for _, name := range names {
+		v.FieldByName(name).SetString(args.attrs[name])
+	}
+	return v.Interface()
+}
@@ -0,0 +1,84 @@
+package authz
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const abacModel = `
+		[request_definition]
+		r = sub
+
+		[policy_definition]
+		p = sub, obj, act
+
+		[policy_effect]
+		e = some(where (p.eft == allow))
+
+		[matchers]
+		m = r.sub.Dept == "eng" && r.sub.Name == p.sub && keyMatch(r.sub.Path, p.obj) && r.sub.Method == p.act
+	`
+
+func TestABAC(t *testing.T) {
+	handler, _ := loadCaddyfile(t, "authz {\n"+
+		"model_text `"+abacModel+"`\n"+
+		`policy_text "p, alice, /repo/*, GET"
+		password_file bcrypt.pass
+		abac
+		abac_attribute Dept header:X-Dept
+	}`)
+	defer caddy.Stop()
+
+	for _, test := range []struct {
+		user, path, dept string
+		code             int
+	}{
+		{"alice", "/repo/1", "eng", 200},
+		{"alice", "/repo/1", "sales", 403},
+		{"alice", "/repo/1", "", 403},
+		{"alice", "/other", "eng", 403},
+		{"bob", "/repo/1", "eng", 403},
+	} {
+		r, _ := http.NewRequest("GET", test.path, nil)
+		r.SetBasicAuth(test.user, "123")
+		if test.dept != "" {
+			r.Header.Set("X-Dept", test.dept)
+		}
+		if w := serve(*handler, r); w.Code != test.code {
+			t.Errorf("%s, %s, dept %q: %d, supposed to be %d", test.user, test.path, test.dept, w.Code, test.code)
+		}
+	}
+}
+
+func TestABACConfig(t *testing.T) {
+	modelJSON, _ := json.Marshal(abacModel)
+	inline := `"model_text": ` + string(modelJSON) + `, "policy_text": "p, alice, /repo/*, GET", `
+	for _, test := range []struct {
+		settings, err string
+	}{
+		{inline + `"abac_attributes": {"Dept": "header:X-Dept"}`, "require abac"},
+		{inline + `"abac": true, "abac_attributes": {"dept": "header:X-Dept"}`, "invalid abac attribute"},
+		{inline + `"abac": true, "abac_attributes": {"Path": "header:X-Path"}`, "field of the subject"},
+		{inline + `"abac": true, "abac_attributes": {"Dept": "cookie:dept"}`, "invalid source"},
+		{`"model_path": "authz_model.conf", "policy_path": "authz_policy.csv", "abac": true`, "single request argument"},
+	} {
+		config := `{
+			"admin": {"disabled": true, "config": {"persist": false}},
+			"apps": {"authz_provision_test": {"handler": {"auth_config": {
+				"password_file": "bcrypt.pass",
+				` + test.settings + `
+			}}}}
+		}`
+		err := caddy.Load([]byte(config), true)
+		if err == nil {
+			caddy.Stop()
+			t.Errorf("%s accepted", test.settings)
+		} else if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: %s", test.settings, err)
+		}
+	}
+}
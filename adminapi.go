@@ -0,0 +1,219 @@
+package authz
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/dafanasiev/caddy-authz/v2/authfile"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminServices are the password checks of the handlers with the admin API
+// enabled, by the absolute path of their password file.
+var adminServices = struct {
+	sync.Mutex
+	byFile map[string]*adminService
+}{byFile: make(map[string]*adminService)}
+
+// adminService is a password check managed through the admin API.
+type adminService struct {
+	service   *authfile.InMemoryService
+	backend   *authfile.FileBackend
+	shared    *sharedPasswordCheck // the handlers using the password check.
+	lowercase bool                 // user names are case-insensitive.
+}
+
+// username returns the user name as stored.
+func (s *adminService) username(name string) string {
+	if s.lowercase {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// adminFileKey returns the key of a password file in adminServices.
+func adminFileKey(file string) string {
+	if abs, err := filepath.Abs(file); err == nil {
+		return abs
+	}
+	return filepath.Clean(file)
+}
+
+// registerAdminService makes the password check of file available to the
+// admin API, replacing the one of a previous configuration.
+func registerAdminService(file string, s *adminService) {
+	adminServices.Lock()
+	defer adminServices.Unlock()
+	adminServices.byFile[adminFileKey(file)] = s
+}
+
+// unregisterAdminService removes the password check of file from the admin
+// API, unless it has been replaced already.
+func unregisterAdminService(file string, s *adminService) {
+	adminServices.Lock()
+	defer adminServices.Unlock()
+	key := adminFileKey(file)
+	if adminServices.byFile[key] == s {
+		delete(adminServices.byFile, key)
+	}
+}
+
+// lookupAdminService returns the password check of file. Without a file, it
+// returns the only registered password check.
+func lookupAdminService(file string) (*adminService, error) {
+	adminServices.Lock()
+	defer adminServices.Unlock()
+	if file != "" {
+		s, ok := adminServices.byFile[adminFileKey(file)]
+		if !ok {
+			return nil, caddy.APIError{Code: http.StatusNotFound, Err: fmt.Errorf("no handler with the admin api manages password file %s", file)}
+		}
+		return s, nil
+	}
+	switch len(adminServices.byFile) {
+	case 0:
+		return nil, caddy.APIError{Code: http.StatusNotFound, Err: fmt.Errorf("no handler has the admin api enabled")}
+	case 1:
+		for _, s := range adminServices.byFile {
+			return s, nil
+		}
+	}
+	return nil, caddy.APIError{Code: http.StatusBadRequest, Err: fmt.Errorf("several password files are managed, select one with the file parameter")}
+}
+
+// adminAPI is a module of Caddy's admin endpoint managing the users of the
+// password files of handlers with the admin API enabled. It is served
+// where Caddy's admin endpoint listens, localhost:2019 by default, and
+// guarded like the rest of the admin endpoint.
+//
+//	POST   /authz/users         {"username": "...", "password": "..."}
+//	PUT    /authz/users/<name>  {"password": "...", "old_password": "..."}
+//	DELETE /authz/users/<name>
+//
+// The password file is selected with the query parameter file, which may be
+// left out if a single file is managed. Changes are written to the file at
+// once.
+type adminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.authz",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/authz/users", Handler: caddy.AdminHandlerFunc(serveAdminUsers)},
+		{Pattern: "/authz/users/", Handler: caddy.AdminHandlerFunc(serveAdminUsers)},
+	}
+}
+
+// adminUserRequest is the body of requests adding or modifying a user.
+type adminUserRequest struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	OldPassword string `json:"old_password"`
+}
+
+// serveAdminUsers adds, modifies and deletes users.
+func serveAdminUsers(w http.ResponseWriter, r *http.Request) error {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/authz/users"), "/")
+	s, err := lookupAdminService(r.URL.Query().Get("file"))
+	if err != nil {
+		return err
+	}
+	name = s.username(name)
+	// The password file is being read; writing it now races the read.
+	if s.service.LoadInProgress() {
+		return caddy.APIError{Code: http.StatusConflict, Err: fmt.Errorf("reloading the password file, retry: %v", authfile.ErrLoadInProgress)}
+	}
+
+	var req adminUserRequest
+	var status int
+	switch {
+	case r.Method == http.MethodPost && name == "":
+		if req, err = decodeAdminUserRequest(r); err != nil {
+			return err
+		}
+		if !s.backend.UsernameIsValid(req.Username) {
+			return caddy.APIError{Code: http.StatusBadRequest, Err: fmt.Errorf("invalid username %q", req.Username)}
+		}
+		err = s.service.Add(s.username(req.Username), req.Password)
+		status = http.StatusCreated
+	case r.Method == http.MethodPut && name != "":
+		if req, err = decodeAdminUserRequest(r); err != nil {
+			return err
+		}
+		if s.backend.UserIsReadOnly(name) {
+			return adminError(authfile.ErrReadOnlyUser)
+		}
+		if req.OldPassword != "" {
+			err = s.service.VerifyModify(name, req.OldPassword, req.Password)
+		} else {
+			err = s.service.Modify(name, req.Password)
+		}
+		status = http.StatusNoContent
+	case r.Method == http.MethodDelete && name != "":
+		if s.backend.UserIsReadOnly(name) {
+			return adminError(authfile.ErrReadOnlyUser)
+		}
+		err = s.service.Delete(name)
+		status = http.StatusNoContent
+	default:
+		return caddy.APIError{Code: http.StatusMethodNotAllowed, Err: fmt.Errorf("method %s not allowed", r.Method)}
+	}
+	if err != nil {
+		return adminError(err)
+	}
+	if r.Method != http.MethodPost {
+		// Written without a reload, which would drop the cached old password.
+		s.shared.removeUser(name)
+	}
+	if err := s.service.Sync(); err != nil {
+		return caddy.APIError{Code: http.StatusInternalServerError, Err: fmt.Errorf("writing the password file: %v", err)}
+	}
+	w.WriteHeader(status)
+	return nil
+}
+
+// decodeAdminUserRequest decodes the body of r. A password is required.
+func decodeAdminUserRequest(r *http.Request) (adminUserRequest, error) {
+	var req adminUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, caddy.APIError{Code: http.StatusBadRequest, Err: fmt.Errorf("decoding request: %v", err)}
+	}
+	if req.Password == "" {
+		return req, caddy.APIError{Code: http.StatusBadRequest, Err: fmt.Errorf("password missing")}
+	}
+	return req, nil
+}
+
+// adminError maps an error of the password check to an API error.
+func adminError(err error) error {
+	code := http.StatusInternalServerError
+	switch err {
+	case authfile.ErrUserExists, authfile.ErrReadOnlyUser:
+		code = http.StatusConflict
+	case authfile.ErrUserDoesNotExist:
+		code = http.StatusNotFound
+	case authfile.ErrAuthenticationFailed:
+		code = http.StatusForbidden
+	case authfile.ErrTooManyUsers:
+		code = http.StatusInsufficientStorage
+	}
+	return caddy.APIError{Code: code, Err: err}
+}
+
+// Interface guards
+var _ caddy.AdminRouter = adminAPI{}
@@ -0,0 +1,132 @@
+package authz
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestAdminAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	passwords, err := ioutil.ReadFile("bcrypt.pass")
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	passwordFile := filepath.Join(dir, "users.pass")
+	if err := ioutil.WriteFile(passwordFile, passwords, 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	config := fmt.Sprintf(`{
+		"admin": {"disabled": true, "config": {"persist": false}},
+		"apps": {"authz_provision_test": {"handler": {"auth_config": {
+			"model_path": "authz_model.conf",
+			"policy_path": "authz_policy.csv",
+			"password_file": %q,
+			"users": {"frank": "secret"},
+			"auth_cache_ttl": "1h",
+			"admin_api": true
+		}}}}
+	}`, passwordFile)
+	if err := caddy.Load([]byte(config), true); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	defer caddy.Stop()
+	handler := provisionedHandler.(*Authorizer)
+	authenticates := func(user, password string) bool {
+		return handler.PasswordCheck.Authenticate(user, password) == nil
+	}
+	request := func(method, path, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		if err := serveAdminUsers(w, r); err != nil {
+			if apiErr, ok := err.(caddy.APIError); ok {
+				return apiErr.Code
+			}
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+		return w.Code
+	}
+	for _, test := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/authz/users", `{"username": "dave", "password": "secret"}`, http.StatusCreated},
+		{"POST", "/authz/users", `{"username": "dave", "password": "secret"}`, http.StatusConflict},
+		{"POST", "/authz/users", `{"username": "bad:name", "password": "secret"}`, http.StatusBadRequest},
+		{"POST", "/authz/users", `{"username": "erin"}`, http.StatusBadRequest},
+		{"PUT", "/authz/users/bob", `{"password": "changed"}`, http.StatusNoContent},
+		{"PUT", "/authz/users/cathy", `{"password": "changed", "old_password": "wrong"}`, http.StatusForbidden},
+		{"PUT", "/authz/users/cathy", `{"password": "changed", "old_password": "123"}`, http.StatusNoContent},
+		{"PUT", "/authz/users/nobody", `{"password": "changed"}`, http.StatusNotFound},
+		{"PUT", "/authz/users/frank", `{"password": "changed"}`, http.StatusConflict},
+		{"DELETE", "/authz/users/frank", "", http.StatusConflict},
+		{"DELETE", "/authz/users/alice", "", http.StatusNoContent},
+		{"DELETE", "/authz/users/alice", "", http.StatusNotFound},
+		{"GET", "/authz/users", "", http.StatusMethodNotAllowed},
+		{"POST", "/authz/users?file=other.pass", `{"username": "erin", "password": "secret"}`, http.StatusNotFound},
+	} {
+		if code := request(test.method, test.path, test.body); code != test.code {
+			t.Errorf("%s %s %s: %d, supposed to be %d", test.method, test.path, test.body, code, test.code)
+		}
+	}
+
+	if !authenticates("dave", "secret") || !authenticates("bob", "changed") || !authenticates("cathy", "changed") || authenticates("alice", "123") || !authenticates("frank", "secret") {
+		t.Errorf("changes not applied to the password check")
+	}
+	written, err := ioutil.ReadFile(passwordFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	if !strings.Contains(string(written), "\ndave:") || strings.Contains(string(written), "\nalice:") {
+		t.Errorf("changes not written to the password file:\n%s", written)
+	}
+
+	// Cached passwords stop working once changed or deleted.
+	checks := func(user, password string) bool {
+		return handler.checkPassword(context.Background(), user, password)
+	}
+	if !checks("dave", "secret") {
+		t.Fatalf("password of dave not accepted")
+	}
+	if code := request("PUT", "/authz/users/dave", `{"password": "changed"}`); code != http.StatusNoContent {
+		t.Fatalf("PUT dave: %d", code)
+	}
+	if checks("dave", "secret") || !checks("dave", "changed") {
+		t.Errorf("cached old password accepted after PUT")
+	}
+	if code := request("DELETE", "/authz/users/dave", ""); code != http.StatusNoContent {
+		t.Fatalf("DELETE dave: %d", code)
+	}
+	if checks("dave", "changed") {
+		t.Errorf("cached password of a deleted user accepted")
+	}
+
+	// Changes are refused while the password file is being read.
+	handler.PasswordCheck.StartLoad()
+	if code := request("POST", "/authz/users", `{"username": "erin", "password": "secret"}`); code != http.StatusConflict {
+		t.Errorf("request during a load: %d, supposed to be %d", code, http.StatusConflict)
+	}
+	handler.PasswordCheck.Rollback()
+	if authenticates("erin", "secret") {
+		t.Errorf("change during a load applied")
+	}
+
+	// The API is unavailable once the handler is cleaned up.
+	caddy.Stop()
+	if code := request("DELETE", "/authz/users/bob", ""); code != http.StatusNotFound {
+		t.Errorf("request after cleanup: %d, supposed to be %d", code, http.StatusNotFound)
+	}
+}
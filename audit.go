@@ -0,0 +1,138 @@
+package authz
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// AuditLogCaddy is the value of AuditLog sending audit records to the
+	// Caddy logger named "http.handlers.authz.audit".
+	AuditLogCaddy = "log"
+	// auditQueueLength is the number of audit records queued for writing.
+	// Records are dropped if the queue is full.
+	auditQueueLength = 1024
+)
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time     time.Time `json:"ts"`
+	User     string    `json:"user"`
+	RemoteIP string    `json:"remote_ip"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Decision string    `json:"decision"`
+}
+
+// auditLog writes audit records in the background, so the request path never
+// blocks on the output.
+type auditLog struct {
+	records chan auditRecord
+	done    chan struct{}
+	dropped uint64
+}
+
+// openAuditLog appends audit records as JSON lines to the file at path, or
+// sends them to logger if path is AuditLogCaddy.
+func openAuditLog(path string, logger *zap.Logger) (*auditLog, error) {
+	l := &auditLog{
+		records: make(chan auditRecord, auditQueueLength),
+		done:    make(chan struct{}),
+	}
+	if path == AuditLogCaddy {
+		go l.runLogger(logger)
+		return l, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	go l.runFile(f, logger)
+	return l, nil
+}
+
+// runFile writes records to f, flushing whenever the queue runs empty.
+func (l *auditLog) runFile(f *os.File, logger *zap.Logger) {
+	defer close(l.done)
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for rec := range l.records {
+		if err := enc.Encode(rec); err != nil {
+			logger.Error("writing audit log", zap.Error(err))
+		}
+		if len(l.records) == 0 {
+			if err := w.Flush(); err != nil {
+				logger.Error("writing audit log", zap.Error(err))
+			}
+		}
+	}
+	w.Flush()
+	f.Close()
+}
+
+// runLogger sends records to logger.
+func (l *auditLog) runLogger(logger *zap.Logger) {
+	defer close(l.done)
+	for rec := range l.records {
+		logger.Info("authorization",
+			zap.Time("ts", rec.Time),
+			zap.String("user", rec.User),
+			zap.String("remote_ip", rec.RemoteIP),
+			zap.String("method", rec.Method),
+			zap.String("path", rec.Path),
+			zap.String("decision", rec.Decision))
+	}
+}
+
+// record queues rec for writing. If the queue is full, the record is dropped
+// and counted.
+func (l *auditLog) record(rec auditRecord) {
+	select {
+	case l.records <- rec:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+// close writes the queued records and closes the output.
+func (l *auditLog) close() {
+	close(l.records)
+	<-l.done
+}
+
+// audit records the decision on r if an audit log is configured.
+func (a *Authorizer) audit(r *http.Request, user string, decision int) {
+	if a.auditLog == nil {
+		return
+	}
+	a.auditLog.record(auditRecord{
+		Time:     a.getClock().Now().UTC(),
+		User:     user,
+		RemoteIP: a.clientIP(r),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Decision: decisionName(decision),
+	})
+}
+
+// decisionName returns the name of a decision in the audit log.
+func decisionName(decision int) string {
+	switch decision {
+	case AccessAllowed:
+		return "allowed"
+	case AccessDenied:
+		return "denied"
+	case InvalidCredentials:
+		return "invalid_credentials"
+	case Unavailable:
+		return "unavailable"
+	default:
+		return "must_authenticate"
+	}
+}
@@ -0,0 +1,126 @@
+package authz
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/casbin/casbin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func auditRequests(t *testing.T, handler Authorizer) {
+	requests := []struct {
+		user, method, path string
+	}{
+		{"alice", "GET", "/dataset1/resource1"},
+		{"alice", "DELETE", "/dataset1/resource1"},
+		{"", "GET", "/dataset1/resource1"},
+	}
+	for _, req := range requests {
+		r, _ := http.NewRequest(req.method, req.path, nil)
+		r.RemoteAddr = "[2001:db8::1]:51234"
+		if req.user != "" {
+			r.SetBasicAuth(req.user, "123")
+		}
+		serve(handler, r)
+	}
+	if err := handler.Cleanup(); err != nil {
+		t.Fatalf("Cleanup: %s", err)
+	}
+}
+
+var expectedAudit = []auditRecord{
+	{User: "alice", RemoteIP: "2001:db8::1", Method: "GET", Path: "/dataset1/resource1", Decision: "allowed"},
+	{User: "alice", RemoteIP: "2001:db8::1", Method: "DELETE", Path: "/dataset1/resource1", Decision: "denied"},
+	{User: "", RemoteIP: "2001:db8::1", Method: "GET", Path: "/dataset1/resource1", Decision: "must_authenticate"},
+}
+
+func TestAuditLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+	if handler.auditLog, err = openAuditLog(path, zap.NewNop()); err != nil {
+		t.Fatalf("openAuditLog: %s", err)
+	}
+	auditRequests(t, handler)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer f.Close()
+	var records []auditRecord
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("audit line %q: %s", scanner.Text(), err)
+		}
+		if rec.Time.IsZero() {
+			t.Errorf("audit line without time: %q", scanner.Text())
+		}
+		rec.Time = expectedAudit[0].Time
+		records = append(records, rec)
+	}
+	if len(records) != len(expectedAudit) {
+		t.Fatalf("audit records: %+v, supposed to be %+v", records, expectedAudit)
+	}
+	for i := range records {
+		if records[i] != expectedAudit[i] {
+			t.Errorf("audit record %d: %+v, supposed to be %+v", i, records[i], expectedAudit[i])
+		}
+	}
+}
+
+func TestAuditLogCaddy(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+	var err error
+	if handler.auditLog, err = openAuditLog(AuditLogCaddy, zap.New(core)); err != nil {
+		t.Fatalf("openAuditLog: %s", err)
+	}
+	auditRequests(t, handler)
+
+	entries := logs.All()
+	if len(entries) != len(expectedAudit) {
+		t.Fatalf("audit entries: %d, supposed to be %d", len(entries), len(expectedAudit))
+	}
+	for i, entry := range entries {
+		fields := entry.ContextMap()
+		if fields["user"] != expectedAudit[i].User || fields["decision"] != expectedAudit[i].Decision ||
+			fields["remote_ip"] != expectedAudit[i].RemoteIP || fields["path"] != expectedAudit[i].Path {
+			t.Errorf("audit entry %d: %v, supposed to be %+v", i, fields, expectedAudit[i])
+		}
+	}
+}
+
+func TestCaddyfileAuditLog(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		audit_log /var/log/authz-audit.log
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if a.AuthConfig.AuditLog != "/var/log/authz-audit.log" {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+}
@@ -0,0 +1,214 @@
+package authz
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dafanasiev/caddy-authz/v2/authfile"
+)
+
+// authCacheMaxEntries bounds the number of cached verifications.
+const authCacheMaxEntries = 10000
+
+// DefaultAuthCacheTTL is the ttl of the auth cache if it is enabled in the
+// Caddyfile without a ttl.
+const DefaultAuthCacheTTL = 30 * time.Second
+
+// authCache is a short-lived cache of successful credential verifications,
+// sparing the password hash comparison for repeated requests.
+//
+// Entries are keyed by an HMAC-SHA256 of user name and password under a
+// random key generated per process. The key never leaves the cache, so
+// cache keys can't be used to recover or test passwords.
+type authCache struct {
+	hits      uint64 // accessed atomically
+	misses    uint64 // accessed atomically
+	evictions uint64 // accessed atomically
+
+	key     []byte
+	ttl     time.Duration
+	clock   Clock
+	mutex   sync.Mutex
+	entries map[string]authCacheEntry
+	// hashes are fingerprints of the password hashes of the last load,
+	// by user, to find users whose password changed.
+	hashes map[string][sha256.Size]byte
+}
+
+// AuthCacheStats are the counters of the auth cache.
+type AuthCacheStats struct {
+	// Hits is the number of credentials found in the cache.
+	Hits uint64
+	// Misses is the number of credentials not found in the cache.
+	Misses uint64
+	// Evictions is the number of entries removed because they expired, the
+	// cache was full or the password of their user changed.
+	Evictions uint64
+}
+
+// HitRatio returns the share of lookups that were hits, between 0 and 1. It
+// is 0 if there were no lookups.
+func (s AuthCacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type authCacheEntry struct {
+	user    string
+	expires time.Time
+}
+
+// newAuthCache creates a cache keeping verifications for ttl.
+func newAuthCache(ttl time.Duration, clock Clock) (*authCache, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &authCache{
+		key:     key,
+		ttl:     ttl,
+		clock:   clock,
+		entries: make(map[string]authCacheEntry),
+	}, nil
+}
+
+// cacheKey derives the cache key of user and password. The user name is
+// length-prefixed so that no two user/password pairs share an input.
+func (c *authCache) cacheKey(user, password string) string {
+	var length [binary.MaxVarintLen64]byte
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(length[:binary.PutUvarint(length[:], uint64(len(user)))])
+	mac.Write([]byte(user))
+	mac.Write([]byte(password))
+	return string(mac.Sum(nil))
+}
+
+// get returns true if user and password have been verified within the ttl.
+func (c *authCache) get(user, password string) bool {
+	_, ok := c.lookup(c.cacheKey(user, password))
+	return ok
+}
+
+// put records a successful verification of user and password.
+func (c *authCache) put(user, password string) {
+	c.store(c.cacheKey(user, password), user)
+}
+
+// getToken returns the user of a token verified within the ttl. Tokens are
+// keyed with an empty user name, which no user has.
+func (c *authCache) getToken(token string) (string, bool) {
+	return c.lookup(c.cacheKey("", token))
+}
+
+// putToken records a successful verification of token as user.
+func (c *authCache) putToken(token, user string) {
+	c.store(c.cacheKey("", token), user)
+}
+
+// lookup returns the user of an unexpired entry.
+func (c *authCache) lookup(key string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		c.countMiss()
+		return "", false
+	}
+	if !c.clock.Now().Before(entry.expires) {
+		delete(c.entries, key)
+		c.countEvictions(1)
+		c.countMiss()
+		return "", false
+	}
+	c.countHit()
+	return entry.user, true
+}
+
+// store adds an entry of user.
+func (c *authCache) store(key, user string) {
+	now := c.clock.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.entries) >= authCacheMaxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = authCacheEntry{user: user, expires: now.Add(c.ttl)}
+}
+
+// evict removes expired entries, or all entries if none has expired. The
+// mutex must be held.
+func (c *authCache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+			c.countEvictions(1)
+		}
+	}
+	if len(c.entries) >= authCacheMaxEntries {
+		c.countEvictions(len(c.entries))
+		c.entries = make(map[string]authCacheEntry)
+	}
+}
+
+// stats returns the counters of the cache.
+func (c *authCache) stats() AuthCacheStats {
+	return AuthCacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+}
+
+func (c *authCache) countHit() {
+	atomic.AddUint64(&c.hits, 1)
+	atomic.AddUint64(&authCacheTotals.Hits, 1)
+}
+
+func (c *authCache) countMiss() {
+	atomic.AddUint64(&c.misses, 1)
+	atomic.AddUint64(&authCacheTotals.Misses, 1)
+}
+
+func (c *authCache) countEvictions(n int) {
+	atomic.AddUint64(&c.evictions, uint64(n))
+	atomic.AddUint64(&authCacheTotals.Evictions, uint64(n))
+}
+
+// loaded removes the entries of users whose password hash changed or who are
+// gone since the last load, so a changed password takes effect at once. It is
+// the load handler of the password file backend.
+func (c *authCache) loaded(entries []authfile.Entry) {
+	hashes := make(map[string][sha256.Size]byte, len(entries))
+	for _, e := range entries {
+		hashes[e.Username] = sha256.Sum256(e.PasswordHash)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, entry := range c.entries {
+		if hash, ok := hashes[entry.user]; !ok || hash != c.hashes[entry.user] {
+			delete(c.entries, key)
+			c.countEvictions(1)
+		}
+	}
+	c.hashes = hashes
+}
+
+// removeUser removes all entries of user, whose password changed or who was
+// deleted without a load of the password file, through the admin API.
+func (c *authCache) removeUser(user string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, entry := range c.entries {
+		if entry.user == user {
+			delete(c.entries, key)
+			c.countEvictions(1)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package authz
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/dafanasiev/caddy-authz/v2/authfile"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthCacheKey(t *testing.T) {
+	c, err := newAuthCache(time.Minute, realClock{})
+	if err != nil {
+		t.Fatalf("newAuthCache: %s", err)
+	}
+	if c.cacheKey("alice", "secret1") == c.cacheKey("alice", "secret2") {
+		t.Errorf("different passwords share a key")
+	}
+	if c.cacheKey("alice", "secret") != c.cacheKey("alice", "secret") {
+		t.Errorf("key is not stable")
+	}
+	if c.cacheKey("ab", "c") == c.cacheKey("a", "bc") {
+		t.Errorf("user/password boundary is ambiguous")
+	}
+
+	key := c.cacheKey("alice", "secret")
+	if strings.Contains(key, "secret") || strings.Contains(key, "alice") {
+		t.Errorf("key contains its input")
+	}
+	for _, plain := range []string{"alicesecret", "alice:secret", "\x05alicesecret"} {
+		if sum := sha256.Sum256([]byte(plain)); key == string(sum[:]) {
+			t.Errorf("key is a plain hash of %q", plain)
+		}
+	}
+
+	other, err := newAuthCache(time.Minute, realClock{})
+	if err != nil {
+		t.Fatalf("newAuthCache: %s", err)
+	}
+	if other.cacheKey("alice", "secret") == key {
+		t.Errorf("keys do not depend on the per-process secret")
+	}
+}
+
+func TestAuthCache(t *testing.T) {
+	clock := newFakeClock()
+	c, err := newAuthCache(time.Minute, clock)
+	if err != nil {
+		t.Fatalf("newAuthCache: %s", err)
+	}
+	if c.get("alice", "secret") {
+		t.Errorf("hit on empty cache")
+	}
+	c.put("alice", "secret")
+	c.put("bob", "secret")
+	if !c.get("alice", "secret") {
+		t.Errorf("miss after put")
+	}
+	if c.get("alice", "wrong") {
+		t.Errorf("hit with wrong password")
+	}
+
+	c.removeUser("alice")
+	if c.get("alice", "secret") || !c.get("bob", "secret") {
+		t.Errorf("removeUser removed the wrong entries")
+	}
+	if evictions := c.stats().Evictions; evictions != 1 {
+		t.Errorf("%d evictions after removeUser, supposed to be 1", evictions)
+	}
+
+	clock.Advance(time.Minute)
+	if c.get("bob", "secret") {
+		t.Errorf("hit after expiry")
+	}
+}
+
+func TestAuthCacheStats(t *testing.T) {
+	clock := newFakeClock()
+	c, err := newAuthCache(time.Minute, clock)
+	if err != nil {
+		t.Fatalf("newAuthCache: %s", err)
+	}
+	totals := authCacheSnapshot()
+
+	c.get("alice", "secret") // miss
+	c.put("alice", "secret")
+	c.get("alice", "secret") // hit
+	c.get("alice", "secret") // hit
+	c.get("alice", "wrong")  // miss
+	c.putToken("tok", "bob")
+	c.getToken("tok") // hit
+	clock.Advance(time.Minute)
+	c.get("alice", "secret") // expired: eviction and miss
+
+	stats := c.stats()
+	if stats != (AuthCacheStats{Hits: 3, Misses: 3, Evictions: 1}) {
+		t.Errorf("stats: %+v", stats)
+	}
+	if ratio := stats.HitRatio(); ratio != 0.5 {
+		t.Errorf("hit ratio: %f, supposed to be 0.5", ratio)
+	}
+	if (AuthCacheStats{}).HitRatio() != 0 {
+		t.Errorf("hit ratio without lookups is not 0")
+	}
+
+	after := authCacheSnapshot()
+	if after.Hits-totals.Hits != 3 || after.Misses-totals.Misses != 3 || after.Evictions-totals.Evictions != 1 {
+		t.Errorf("process totals not counted: before %+v, after %+v", totals, after)
+	}
+
+	a := Authorizer{authCache: c}
+	if a.AuthCacheStats() != stats {
+		t.Errorf("AuthCacheStats: %+v, supposed to be %+v", a.AuthCacheStats(), stats)
+	}
+	if (&Authorizer{}).AuthCacheStats() != (AuthCacheStats{}) {
+		t.Errorf("AuthCacheStats without cache is not zero")
+	}
+}
+
+func TestAuthCacheLoaded(t *testing.T) {
+	c, err := newAuthCache(time.Minute, newFakeClock())
+	if err != nil {
+		t.Fatalf("newAuthCache: %s", err)
+	}
+	entry := func(user, hash string) authfile.Entry {
+		return authfile.Entry{Username: user, PasswordHash: []byte(hash)}
+	}
+	c.loaded([]authfile.Entry{entry("alice", "hash1"), entry("bob", "hash1"), entry("carol", "hash1")})
+	c.put("alice", "secret")
+	c.put("bob", "secret")
+	c.putToken("token", "carol")
+
+	c.loaded([]authfile.Entry{entry("alice", "hash2"), entry("bob", "hash1")})
+	if c.get("alice", "secret") {
+		t.Errorf("entry kept after the password changed")
+	}
+	if !c.get("bob", "secret") {
+		t.Errorf("entry dropped though the password is unchanged")
+	}
+	if _, ok := c.getToken("token"); ok {
+		t.Errorf("token entry kept after the user was removed")
+	}
+}
+
+func TestAuthCachePasswordChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.pass")
+	hashes := make(map[string][]byte)
+	for _, password := range []string{"old", "new", "123"} {
+		if hashes[password], err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost); err != nil {
+			t.Fatalf("GenerateFromPassword: %s", err)
+		}
+	}
+	// The hash of bob is written unchanged, as rehashing changes the salt.
+	writeUsers := func(alicePassword string) {
+		content := fmt.Sprintf("alice:%s\nbob:%s\n", hashes[alicePassword], hashes["123"])
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+	}
+	writeUsers("old")
+
+	var a Authorizer
+	a.AuthConfig.PasswordFile = path
+	a.AuthConfig.WatchInterval = caddy.Duration(time.Hour)
+	if a.authCache, err = newAuthCache(time.Hour, realClock{}); err != nil {
+		t.Fatalf("newAuthCache: %s", err)
+	}
+	service, _, err := a.newPasswordCheck(&sharedPasswordCheck{handlers: []*Authorizer{&a}})
+	if err != nil {
+		t.Fatalf("newPasswordCheck: %s", err)
+	}
+	a.PasswordCheck = service
+	if !waitFor(time.Second, func() bool { return service.Authenticate("alice", "old") == nil }) {
+		t.Fatalf("password file not loaded")
+	}
+	if !a.checkPassword(context.Background(), "alice", "old") || !a.checkPassword(context.Background(), "bob", "123") {
+		t.Fatalf("passwords not accepted")
+	}
+
+	writeUsers("new")
+	service.Update()
+	if !waitFor(time.Second, func() bool { return service.Authenticate("alice", "new") == nil }) {
+		t.Fatalf("password file not reloaded")
+	}
+	if a.checkPassword(context.Background(), "alice", "old") {
+		t.Errorf("old password accepted from the cache after the change")
+	}
+	hits := a.AuthCacheStats().Hits
+	if !a.checkPassword(context.Background(), "bob", "123") || a.AuthCacheStats().Hits != hits+1 {
+		t.Errorf("unchanged password not served from the cache")
+	}
+}
@@ -0,0 +1,90 @@
+// Package authfile implements a library and provider for simple password management.
+// It handles files that contain lines of username/password and provides an API to create, verify, update and delete entries.
+// username:hashed_password
+// An optional third field lists roles of the user, separated by commas: username:hashed_password:role1,role2
+// Lines starting with # are comments. They are kept with the entry that follows them when the file is rewritten.
+// Lines starting with $ set the cost of the bcrypt. otherwise the default cost of the bcrypt implementation is used.
+// Password hashes are bcrypt hashes, or argon2id hashes in the PHC string format ($argon2id$...), which may be
+// mixed in one file. A Hasher passed to NewInMemoryService selects the algorithm of new hashes.
+// Service. Reader/writer
+package authfile
+
+import (
+	"context"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// IAuthenticationService is the interface of an authentication service
+type IAuthenticationService interface {
+	// Authenticate checks if a username is present and the password matches. Returns nil on success.
+	Authenticate(username, password string) error
+	// AuthenticateContext is Authenticate, giving up with the error of ctx once ctx is done.
+	AuthenticateContext(ctx context.Context, username, password string) error
+	// Delete a user, return nil on success.
+	Delete(username string) error
+	// Add a user with password. Return nil on success.
+	Add(username, password string) error
+	// Modify a user to use a new password. Return nil on success.
+	Modify(username, password string) error
+	// VerifyModify modifies the password of a user only after verifying that the old password is correct.
+	VerifyModify(username, oldpassword, newpassword string) error
+	// StartLoad creates a new loading transaction.
+	StartLoad()
+	// Load a user with a password hash.
+	Load(username string, passwordHash []byte) error
+	// Commit newly loaded data as the authoritative data. Returns ErrNoTransaction if there is no
+	// load transaction, e.g. after it timed out.
+	Commit() error
+	// Rollback a current load transaction.
+	Rollback()
+	// LoadInProgress reports whether a load transaction is pending.
+	LoadInProgress() bool
+	// ReplaceAll atomically replaces all users with entries.
+	ReplaceAll(entries []Entry) error
+	// SetCost updates the bcrypt cost that is required.
+	SetCost(cost int)
+	// SetMaxUsers limits the number of users, 0 is unlimited.
+	SetMaxUsers(maxUsers int)
+	// GetCost returns the current target bcrypt cost of the system.
+	GetCost() int
+	// List all entries of the service. There is no defined order.
+	List() []Entry
+	// Exists reports whether a user exists, without checking a password.
+	Exists(username string) bool
+	// Update triggers the authentication service to request a reload from the backend storage.
+	Update()
+	// Sync writes the entries to the backend, returning the error of the write.
+	Sync() error
+	// Shutdown the authentication service, updating the backend.
+	Shutdown()
+	// Kill the authentication service.
+	Kill()
+}
+
+// IOProvider implements reading/writing services for the authentication service.
+// The authentication service requests reads/writes, and the IOProvider is expected
+// to use the API to get the serialized data from the provider or push serialized data
+// to the provider.
+type IOProvider interface {
+	RequestRead(authservice IAuthenticationService)        // Called when the auth provider wants to read the backend data.
+	RequestWrite(authservice IAuthenticationService) error // Called when the auth provider wants to write to the backend.
+	UsernameIsValid(username string) bool                  // Returns true if the username is safe, false if not.
+}
+
+// Entry defines a single entry.
+type Entry struct {
+	Username     string // The username.
+	PasswordHash []byte // The password hash.
+}
+
+// Cost returns the bcrypt cost embedded in the password hash, 0 if it is not a bcrypt hash. It
+// may differ from the cost line of a file, which is the cost new hashes get: hashes of a lower
+// cost are upgraded on the next authentication, hashes of a higher cost are kept.
+func (e Entry) Cost() int {
+	cost, err := bcrypt.Cost(e.PasswordHash)
+	if err != nil {
+		return 0
+	}
+	return cost
+}
@@ -0,0 +1,273 @@
+package authfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrUserDoesNotExist is returned if operating on a user that does not exist.
+	ErrUserDoesNotExist = errors.New("authfile: User does not exist")
+	// ErrUserExists is returned if trying to add a user that already exists.
+	ErrUserExists = errors.New("authfile: User exists")
+	// ErrAuthenticationFailed is returnd if the password does not match the user.
+	ErrAuthenticationFailed = errors.New("authfile: Authentication failure")
+	// ErrTooManyUsers is returned if adding or loading a user would exceed the maximum number of users.
+	ErrTooManyUsers = errors.New("authfile: Too many users")
+
+	// errHashChanged is returned by setChecked if the hash an old password was verified against
+	// has changed.
+	errHashChanged = errors.New("authfile: Hash changed")
+)
+
+type authData struct {
+	data     map[string][]byte
+	cost     uint64
+	maxUsers uint64 // 0 is unlimited.
+	hasher   Hasher // hasher of new hashes, bcrypt with the cost if nil.
+	m        *sync.RWMutex
+}
+
+func newAuthData(hasher Hasher) *authData {
+	return &authData{
+		data:   make(map[string][]byte),
+		hasher: hasher,
+		m:      new(sync.RWMutex),
+	}
+}
+
+// defaultHasher returns the hasher of new hashes.
+func (ad *authData) defaultHasher() Hasher {
+	if ad.hasher != nil {
+		return ad.hasher
+	}
+	return BcryptHasher{Cost: int(ad.getCost())}
+}
+
+// algorithm returns the name of the hash algorithm of h.
+func algorithm(h Hasher) string {
+	switch h.(type) {
+	case BcryptHasher, *BcryptHasher:
+		return "bcrypt"
+	case Argon2idHasher, *Argon2idHasher:
+		return "argon2id"
+	}
+	return fmt.Sprintf("%T", h)
+}
+
+// hasherOf returns the hasher of an existing hash, detected by its prefix, so entries hashed
+// by different algorithms can be mixed. Hashes other than argon2id, $apr1$ and {SHA} are taken
+// as bcrypt hashes.
+func (ad *authData) hasherOf(hash []byte) Hasher {
+	if bytes.HasPrefix(hash, []byte(apr1Prefix)) {
+		return apr1Hasher{}
+	}
+	if bytes.HasPrefix(hash, []byte(shaPrefix)) {
+		return shaHasher{}
+	}
+	if bytes.HasPrefix(hash, []byte(argon2idPrefix)) {
+		switch h := ad.hasher.(type) {
+		case Argon2idHasher:
+			return h
+		case *Argon2idHasher:
+			return *h
+		}
+		return Argon2idHasher{}
+	}
+	return BcryptHasher{Cost: int(ad.getCost())}
+}
+
+func (ad *authData) setCost(cost uint64) {
+	atomic.StoreUint64(&ad.cost, cost)
+}
+
+func (ad *authData) getCost() uint64 {
+	return atomic.LoadUint64(&ad.cost)
+}
+
+func (ad *authData) setMaxUsers(maxUsers uint64) {
+	atomic.StoreUint64(&ad.maxUsers, maxUsers)
+}
+
+// full returns true if no more users can be added.
+func (ad *authData) full() bool {
+	ad.m.RLock()
+	defer ad.m.RUnlock()
+	return ad.fullLocked()
+}
+
+// fullLocked is full, with ad.m held.
+func (ad *authData) fullLocked() bool {
+	maxUsers := atomic.LoadUint64(&ad.maxUsers)
+	return maxUsers != 0 && uint64(len(ad.data)) >= maxUsers
+}
+
+func (ad *authData) get(username string) []byte {
+	ad.m.RLock()
+	defer ad.m.RUnlock()
+	if pass, ok := ad.data[username]; ok {
+		return pass
+	}
+	return nil
+}
+
+// entries returns the entries of the users whose name starts with prefix. Workers may be
+// modifying the data meanwhile.
+func (ad *authData) entries(prefix string) []Entry {
+	ad.m.RLock()
+	defer ad.m.RUnlock()
+	ret := make([]Entry, 0, len(ad.data))
+	for user, passHash := range ad.data {
+		if strings.HasPrefix(user, prefix) {
+			ret = append(ret, Entry{Username: user, PasswordHash: passHash})
+		}
+	}
+	return ret
+}
+
+func (ad *authData) set(username string, passwordHash []byte) {
+	ad.m.Lock()
+	defer ad.m.Unlock()
+	ad.data[username] = passwordHash
+	return
+}
+
+// replace sets the hash of username to hash if it is still old, so a hash computed from a stale
+// read never overwrites a modification or revives a deleted user. It reports whether it did.
+func (ad *authData) replace(username string, old, hash []byte) bool {
+	ad.m.Lock()
+	defer ad.m.Unlock()
+	if current, ok := ad.data[username]; !ok || !bytes.Equal(current, old) {
+		return false
+	}
+	ad.data[username] = hash
+	return true
+}
+
+func (ad *authData) delete(username string) error {
+	ad.m.Lock()
+	defer ad.m.Unlock()
+	if _, ok := ad.data[username]; !ok {
+		return ErrUserDoesNotExist
+	}
+	delete(ad.data, username)
+	return nil
+}
+
+// setChecked sets the hash of m if the checks of its modification still hold: an added user may
+// not exist and must fit in the maximum number of users, a modified user must exist, and the
+// hash a verified old password was checked against must be unchanged. Workers check before
+// hashing already, but only the runner sets, so concurrent modifications are checked and set one
+// at a time.
+func (ad *authData) setChecked(m msgSet) error {
+	ad.m.Lock()
+	defer ad.m.Unlock()
+	current, ok := ad.data[m.username]
+	switch m.op.(type) {
+	case msgAdd:
+		if ok {
+			return ErrUserExists
+		}
+		if ad.fullLocked() {
+			return ErrTooManyUsers
+		}
+	case msgModify:
+		if !ok {
+			return ErrUserDoesNotExist
+		}
+	case msgVerifyModify:
+		if !ok {
+			return ErrUserDoesNotExist
+		}
+		if !bytes.Equal(current, m.old) {
+			return errHashChanged
+		}
+	}
+	ad.data[m.username] = m.hash
+	return nil
+}
+
+// add hashes the password of m and passes the hash to set, to be checked and set by the runner.
+func (ad *authData) add(m msgAdd, set func(msgSet)) {
+	if ad.get(m.username) != nil {
+		m.r <- ErrUserExists
+		return
+	}
+	if ad.full() {
+		m.r <- ErrTooManyUsers
+		return
+	}
+	hash, err := ad.defaultHasher().Hash(m.password)
+	if err != nil {
+		m.r <- err
+		return
+	}
+	set(msgSet{op: m, username: m.username, hash: hash, r: m.r})
+}
+
+// modify hashes the password of m and passes the hash to set, to be checked and set by the
+// runner.
+func (ad *authData) modify(m msgModify, set func(msgSet)) {
+	if ad.get(m.username) == nil {
+		m.r <- ErrUserDoesNotExist
+		return
+	}
+	hash, err := ad.defaultHasher().Hash(m.password)
+	if err != nil {
+		m.r <- err
+		return
+	}
+	set(msgSet{op: m, username: m.username, hash: hash, r: m.r})
+}
+
+// verifyModify verifies the old password of m and hashes its new password, passing the hash to
+// set, to be checked and set by the runner.
+func (ad *authData) verifyModify(m msgVerifyModify, set func(msgSet)) {
+	pass := ad.get(m.username)
+	if pass == nil {
+		m.r <- ErrUserDoesNotExist
+		return
+	}
+	if ad.hasherOf(pass).Compare(pass, m.oldpassword) != nil {
+		m.r <- ErrAuthenticationFailed
+		return
+	}
+	hash, err := ad.defaultHasher().Hash(m.newpassword)
+	if err != nil {
+		m.r <- err
+		return
+	}
+	set(msgSet{op: m, username: m.username, old: pass, hash: hash, r: m.r})
+}
+
+func (ad *authData) authenticate(m msgAuthenticate) {
+	pass := ad.get(m.username)
+	if pass == nil {
+		m.reply(ErrUserDoesNotExist)
+		return
+	}
+	hasher := ad.hasherOf(pass)
+	if hasher.Compare(pass, m.password) != nil {
+		m.reply(ErrAuthenticationFailed)
+		return
+	}
+	m.reply(nil) // Return early, allow session to continue.
+	// Upgrade weak hashes, and migrate hashes of another algorithm to the default hasher.
+	target := ad.defaultHasher()
+	if hasher.NeedsRehash(pass) || algorithm(hasher) != algorithm(target) {
+		hash, err := target.Hash(m.password)
+		if err != nil {
+			return
+		}
+		if m.rehashed != nil {
+			m.rehashed(pass, hash)
+		} else {
+			ad.replace(m.username, pass, hash)
+		}
+	}
+	return
+}
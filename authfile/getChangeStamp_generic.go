@@ -0,0 +1,19 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris,!windows
+
+package authfile
+
+import (
+	"fmt"
+	"os"
+)
+
+// getChangeStamp returns a byteslice that changes when the file has been touched for modification.
+// Without a file identity on this platform, it combines size and mod-time only.
+func getChangeStamp(f *os.File) ([]byte, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%d.%d", stat.Size(), stat.ModTime().UnixNano())), nil
+}
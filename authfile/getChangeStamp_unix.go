@@ -0,0 +1,25 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package authfile
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// getChangeStamp returns a byteslice that changes when the file has been touched for modification.
+// It combines device and inode, which change when the file is replaced, with size and mod-time,
+// so a rewrite within the mod-time granularity is still noticed if it changes the size.
+func getChangeStamp(f *os.File) ([]byte, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var dev, inode uint64
+	if nt, ok := stat.Sys().(*syscall.Stat_t); ok {
+		dev, inode = uint64(nt.Dev), uint64(nt.Ino)
+	}
+	return []byte(fmt.Sprintf("%d.%d.%d.%d", dev, inode, stat.Size(), stat.ModTime().UnixNano())), nil
+}
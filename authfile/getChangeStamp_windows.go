@@ -0,0 +1,20 @@
+package authfile
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// getChangeStamp returns a byteslice that changes when the file has been touched for modification.
+// It combines volume serial number and file index, the Windows counterpart of the inode, with
+// size and last write time from GetFileInformationByHandle.
+func getChangeStamp(f *os.File) ([]byte, error) {
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(syscall.Handle(f.Fd()), &info); err != nil {
+		return nil, &os.PathError{Op: "GetFileInformationByHandle", Path: f.Name(), Err: err}
+	}
+	return []byte(fmt.Sprintf("%d.%d.%d.%d.%d.%d",
+		info.VolumeSerialNumber, info.FileIndexHigh, info.FileIndexLow,
+		info.FileSizeHigh, info.FileSizeLow, info.LastWriteTime.Nanoseconds())), nil
+}
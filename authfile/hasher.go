@@ -0,0 +1,292 @@
+package authfile
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidHash is returned if a password hash can't be parsed by its hasher.
+var ErrInvalidHash = errors.New("authfile: Invalid password hash")
+
+// Hasher hashes passwords and verifies passwords against hashes of one algorithm.
+type Hasher interface {
+	// Hash returns the hash of password, encoded with algorithm, parameters and salt.
+	Hash(password string) ([]byte, error)
+	// Compare returns nil if password matches hash, an error otherwise.
+	Compare(hash []byte, password string) error
+	// NeedsRehash returns true if hash was created with weaker parameters than the hasher's.
+	NeedsRehash(hash []byte) bool
+}
+
+// BcryptHasher hashes with bcrypt, $2a$, $2b$ and $2y$ hashes.
+type BcryptHasher struct {
+	Cost int // The cost of new hashes, bcrypt.DefaultCost if 0.
+}
+
+func (h BcryptHasher) cost() int {
+	if h.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+// Hash returns the bcrypt hash of password.
+func (h BcryptHasher) Hash(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), h.cost())
+}
+
+// Compare returns nil if password matches the bcrypt hash.
+func (h BcryptHasher) Compare(hash []byte, password string) error {
+	return bcrypt.CompareHashAndPassword(hash, []byte(password))
+}
+
+// NeedsRehash returns true if hash has a lower cost than the hasher.
+func (h BcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err == nil && cost < h.cost()
+}
+
+// argon2idPrefix starts the hashes of Argon2idHasher.
+const argon2idPrefix = "$argon2id$"
+
+// Default parameters of Argon2idHasher, the recommendation of the argon2 package.
+const (
+	DefaultArgon2idTime    = 1
+	DefaultArgon2idMemory  = 64 * 1024 // in KiB
+	DefaultArgon2idThreads = 4
+	argon2idSaltLen        = 16
+	argon2idKeyLen         = 32
+)
+
+// Argon2idHasher hashes with argon2id. The hashes are encoded in the PHC string format,
+// $argon2id$v=19$m=65536,t=1,p=4$salt$key, with salt and key in unpadded base64.
+type Argon2idHasher struct {
+	Time    uint32 // The number of passes, DefaultArgon2idTime if 0.
+	Memory  uint32 // The memory in KiB, DefaultArgon2idMemory if 0.
+	Threads uint8  // The parallelism, DefaultArgon2idThreads if 0.
+}
+
+func (h Argon2idHasher) params() (time, memory uint32, threads uint8) {
+	time, memory, threads = h.Time, h.Memory, h.Threads
+	if time == 0 {
+		time = DefaultArgon2idTime
+	}
+	if memory == 0 {
+		memory = DefaultArgon2idMemory
+	}
+	if threads == 0 {
+		threads = DefaultArgon2idThreads
+	}
+	return
+}
+
+// Hash returns the argon2id hash of password with a random salt.
+func (h Argon2idHasher) Hash(password string) ([]byte, error) {
+	salt := make([]byte, argon2idSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	time, memory, threads := h.params()
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, argon2idKeyLen)
+	return []byte(fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		memory, time, threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// Compare returns nil if password matches the argon2id hash.
+func (h Argon2idHasher) Compare(hash []byte, password string) error {
+	p, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	key := argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	if subtle.ConstantTimeCompare(key, p.key) != 1 {
+		return ErrAuthenticationFailed
+	}
+	return nil
+}
+
+// NeedsRehash returns true if hash was created with fewer passes, less memory or less
+// parallelism than the hasher uses.
+func (h Argon2idHasher) NeedsRehash(hash []byte) bool {
+	p, err := parseArgon2id(hash)
+	if err != nil {
+		return false
+	}
+	time, memory, threads := h.params()
+	return p.time < time || p.memory < memory || p.threads < threads
+}
+
+// argon2idHash is a parsed argon2id hash.
+type argon2idHash struct {
+	time, memory uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+// parseArgon2id parses an argon2id hash in the PHC string format.
+func parseArgon2id(hash []byte) (argon2idHash, error) {
+	var p argon2idHash
+	fields := bytes.Split(hash, []byte("$"))
+	if len(fields) != 6 || !bytes.HasPrefix(hash, []byte(argon2idPrefix)) {
+		return p, ErrInvalidHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(string(fields[2]), "v=%d", &version); err != nil || version != argon2.Version {
+		return p, ErrInvalidHash
+	}
+	if _, err := fmt.Sscanf(string(fields[3]), "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil ||
+		p.time == 0 || p.threads == 0 {
+		return p, ErrInvalidHash
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(string(fields[4])); err != nil {
+		return p, ErrInvalidHash
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(string(fields[5])); err != nil || len(p.key) == 0 {
+		return p, ErrInvalidHash
+	}
+	return p, nil
+}
+
+// Prefixes of the insecure hashes of htpasswd files.
+const (
+	apr1Prefix = "$apr1$"
+	shaPrefix  = "{SHA}"
+)
+
+// insecureHash returns true for the $apr1$ (MD5) and {SHA} (SHA-1) hashes of htpasswd files,
+// which are fast to brute-force.
+func insecureHash(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte(apr1Prefix)) || bytes.HasPrefix(hash, []byte(shaPrefix))
+}
+
+// apr1Hasher verifies the $apr1$ MD5 hashes of Apache htpasswd files. As they are insecure,
+// they always need a rehash.
+type apr1Hasher struct{}
+
+func (apr1Hasher) Hash(password string) ([]byte, error) {
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	for i := range salt {
+		salt[i] = itoa64[salt[i]&0x3f]
+	}
+	return apr1([]byte(password), salt), nil
+}
+
+func (apr1Hasher) Compare(hash []byte, password string) error {
+	if !bytes.HasPrefix(hash, []byte(apr1Prefix)) {
+		return ErrInvalidHash
+	}
+	fields := bytes.SplitN(hash[len(apr1Prefix):], []byte("$"), 2)
+	if len(fields) != 2 {
+		return ErrInvalidHash
+	}
+	if subtle.ConstantTimeCompare(apr1([]byte(password), fields[0]), hash) != 1 {
+		return ErrAuthenticationFailed
+	}
+	return nil
+}
+
+func (apr1Hasher) NeedsRehash(hash []byte) bool {
+	return true
+}
+
+// itoa64 is the alphabet of the crypt base64 encoding.
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 computes the Apache variant of the MD5-based crypt of password with salt.
+func apr1(password, salt []byte) []byte {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	h := md5.New()
+	h.Write(password)
+	h.Write([]byte(apr1Prefix))
+	h.Write(salt)
+	alt := md5.New()
+	alt.Write(password)
+	alt.Write(salt)
+	alt.Write(password)
+	altSum := alt.Sum(nil)
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(altSum)
+		} else {
+			h.Write(altSum[:i])
+		}
+	}
+	for i := len(password); i != 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(password[:1])
+		}
+	}
+	sum := h.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(password)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write(salt)
+		}
+		if i%7 != 0 {
+			h.Write(password)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(password)
+		}
+		sum = h.Sum(nil)
+	}
+
+	out := append(append([]byte(apr1Prefix), salt...), '$')
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(sum[i[0]])<<16|uint32(sum[i[1]])<<8|uint32(sum[i[2]]), 4)
+	}
+	encode(uint32(sum[11]), 2)
+	return out
+}
+
+// shaHasher verifies the {SHA} unsalted SHA-1 hashes of Apache htpasswd files. As they are
+// insecure, they always need a rehash.
+type shaHasher struct{}
+
+func (shaHasher) Hash(password string) ([]byte, error) {
+	sum := sha1.Sum([]byte(password))
+	return []byte(shaPrefix + base64.StdEncoding.EncodeToString(sum[:])), nil
+}
+
+func (h shaHasher) Compare(hash []byte, password string) error {
+	expected, _ := h.Hash(password)
+	if subtle.ConstantTimeCompare(expected, hash) != 1 {
+		return ErrAuthenticationFailed
+	}
+	return nil
+}
+
+func (shaHasher) NeedsRehash(hash []byte) bool {
+	return true
+}
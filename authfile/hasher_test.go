@@ -0,0 +1,140 @@
+package authfile
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2id is an argon2id hasher with little memory to keep the tests fast.
+var testArgon2id = Argon2idHasher{Memory: 1024, Threads: 1}
+
+func Test_Argon2idHasher(t *testing.T) {
+	hash, err := testArgon2id.Hash("secret")
+	if err != nil {
+		t.Fatalf("Hash: %s", err)
+	}
+	if !strings.HasPrefix(string(hash), "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("unexpected hash format: %s", hash)
+	}
+	if err := testArgon2id.Compare(hash, "secret"); err != nil {
+		t.Errorf("Compare: %s", err)
+	}
+	if err := testArgon2id.Compare(hash, "wrong"); err != ErrAuthenticationFailed {
+		t.Errorf("wrong password: %v", err)
+	}
+	if err := testArgon2id.Compare([]byte("$argon2id$v=19$m=1024$salt$key"), "secret"); err != ErrInvalidHash {
+		t.Errorf("malformed hash: %v", err)
+	}
+	if testArgon2id.NeedsRehash(hash) {
+		t.Errorf("hash of the same parameters needs rehash")
+	}
+	if !(Argon2idHasher{Memory: 2048, Threads: 1}).NeedsRehash(hash) {
+		t.Errorf("hash of less memory needs no rehash")
+	}
+}
+
+func Test_MixedHashes(t *testing.T) {
+	bhash, err := bcrypt.GenerateFromPassword([]byte("alicePass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	ahash, err := testArgon2id.Hash("bobPass")
+	if err != nil {
+		t.Fatalf("Hash: %s", err)
+	}
+	filename := tempPasswordFile(t, "$4\nalice:"+string(bhash)+"\nbob:"+string(ahash)+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	fb, err := NewFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewFileBackend: %s", err)
+	}
+	defer fb.Close()
+	authProvider := NewInMemoryService(fb, time.Second, testArgon2id)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 2 }) {
+		t.Fatalf("file not loaded")
+	}
+	for user, password := range map[string]string{"alice": "alicePass", "bob": "bobPass"} {
+		if err := authProvider.Authenticate(user, password); err != nil {
+			t.Errorf("Authenticate %s: %s", user, err)
+		}
+		if err := authProvider.Authenticate(user, "wrong"); err == nil {
+			t.Errorf("Authenticate %s with a wrong password succeeded", user)
+		}
+	}
+
+	if err := authProvider.Add("cathy", "cathyPass"); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	for _, e := range authProvider.List() {
+		if e.Username == "cathy" && !strings.HasPrefix(string(e.PasswordHash), argon2idPrefix) {
+			t.Errorf("new entry not hashed by the default hasher: %s", e.PasswordHash)
+		}
+	}
+	if err := authProvider.Authenticate("cathy", "cathyPass"); err != nil {
+		t.Errorf("Authenticate cathy: %s", err)
+	}
+}
+
+func Test_MigrateToDefaultHasher(t *testing.T) {
+	bhash, err := bcrypt.GenerateFromPassword([]byte("alicePass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	ahash, err := testArgon2id.Hash("bobPass")
+	if err != nil {
+		t.Fatalf("Hash: %s", err)
+	}
+	filename := tempPasswordFile(t, "$4\nalice:"+string(bhash)+"\nbob:"+string(ahash)+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	fb, err := NewFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewFileBackend: %s", err)
+	}
+	defer fb.Close()
+	authProvider := NewInMemoryService(fb, time.Second, testArgon2id)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 2 }) {
+		t.Fatalf("file not loaded")
+	}
+	hashOf := func(user string) string {
+		for _, e := range authProvider.List() {
+			if e.Username == user {
+				return string(e.PasswordHash)
+			}
+		}
+		return ""
+	}
+
+	if err := authProvider.Authenticate("alice", "wrong"); err == nil {
+		t.Fatalf("Authenticate with a wrong password succeeded")
+	}
+	time.Sleep(50 * time.Millisecond) // a rehash happens after authentication returns
+	if hashOf("alice") != string(bhash) {
+		t.Errorf("hash migrated after a failed authentication")
+	}
+	if err := authProvider.Authenticate("alice", "alicePass"); err != nil {
+		t.Fatalf("Authenticate: %s", err)
+	}
+	if !waitFor(time.Second, func() bool { return strings.HasPrefix(hashOf("alice"), argon2idPrefix) }) {
+		t.Errorf("bcrypt hash not migrated to argon2id: %s", hashOf("alice"))
+	}
+	if err := authProvider.Authenticate("alice", "alicePass"); err != nil {
+		t.Errorf("Authenticate after migration: %s", err)
+	}
+
+	if err := authProvider.Authenticate("bob", "bobPass"); err != nil {
+		t.Fatalf("Authenticate: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if hashOf("bob") != string(ahash) {
+		t.Errorf("hash of the default hasher rehashed")
+	}
+}
@@ -0,0 +1,35 @@
+package authfile
+
+import (
+	"os"
+	"time"
+)
+
+// HtpasswdFileBackend implements a backend on Apache htpasswd files, as created by htpasswd -B.
+// Lines are username:hash, with bcrypt hashes. The insecure $apr1$ (MD5) and {SHA} (SHA-1) hashes
+// are skipped with an error unless allowed with SetAllowInsecureHashes; if allowed, they are
+// migrated to the default hasher on the next successful authentication. Comment lines are kept
+// as with FileBackend. Written files have no cost line and no roles, which htpasswd doesn't know.
+type HtpasswdFileBackend struct {
+	*FileBackend
+}
+
+// NewHtpasswdFileBackend returns a new htpasswd file based IO backend, see NewFileBackend.
+func NewHtpasswdFileBackend(filename string, perm os.FileMode, update time.Duration) (*HtpasswdFileBackend, error) {
+	return newHtpasswdFileBackend(filename, os.O_RDWR|os.O_CREATE, perm, update)
+}
+
+// NewROHtpasswdFileBackend returns a new Read-Only htpasswd file based IO backend, see
+// NewROFileBackend.
+func NewROHtpasswdFileBackend(filename string, perm os.FileMode, update time.Duration) (*HtpasswdFileBackend, error) {
+	return newHtpasswdFileBackend(filename, os.O_RDONLY, perm, update)
+}
+
+func newHtpasswdFileBackend(filename string, flag int, perm os.FileMode, update time.Duration) (*HtpasswdFileBackend, error) {
+	fb, err := newFileBackend(filename, flag, perm, update)
+	if err != nil {
+		return nil, err
+	}
+	fb.htpasswd = true
+	return &HtpasswdFileBackend{FileBackend: fb}, nil
+}
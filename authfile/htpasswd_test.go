@@ -0,0 +1,106 @@
+package authfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hashes of the password "secret", created with openssl passwd -apr1 and the SHA-1 of htpasswd -s.
+const (
+	testAPR1Hash = "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/"
+	testSHAHash  = "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="
+)
+
+func Test_InsecureHashers(t *testing.T) {
+	for _, test := range []struct {
+		hasher Hasher
+		hash   string
+	}{
+		{apr1Hasher{}, testAPR1Hash},
+		{shaHasher{}, testSHAHash},
+	} {
+		if err := test.hasher.Compare([]byte(test.hash), "secret"); err != nil {
+			t.Errorf("%s: %s", test.hash, err)
+		}
+		if err := test.hasher.Compare([]byte(test.hash), "wrong"); err != ErrAuthenticationFailed {
+			t.Errorf("%s with a wrong password: %v", test.hash, err)
+		}
+		hash, err := test.hasher.Hash("secret")
+		if err != nil || test.hasher.Compare(hash, "secret") != nil {
+			t.Errorf("%s: new hash %s not verified: %v", test.hash, hash, err)
+		}
+		if !test.hasher.NeedsRehash([]byte(test.hash)) {
+			t.Errorf("%s needs no rehash", test.hash)
+		}
+	}
+	if err := (apr1Hasher{}).Compare([]byte("$apr1"), "secret"); err != ErrInvalidHash {
+		t.Errorf("truncated hash: %v", err)
+	}
+}
+
+func Test_Htpasswd(t *testing.T) {
+	bhash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	filename := tempPasswordFile(t, "# managed by ops\nalice:"+string(bhash)+"\nbob:"+testAPR1Hash+"\ncathy:"+testSHAHash+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	hb, err := NewHtpasswdFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewHtpasswdFileBackend: %s", err)
+	}
+	defer hb.Close()
+	errs := make(chan error, 10)
+	hb.SetErrorHandler(func(err error) { errs <- err })
+	authProvider := NewInMemoryService(hb, time.Second)
+	authProvider.Update()
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "bob, cathy") || !strings.Contains(err.Error(), "insecure") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("insecure hashes not reported")
+	}
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 1 }) {
+		t.Fatalf("insecure hashes loaded: %v", authProvider.List())
+	}
+	if err := authProvider.Authenticate("alice", "secret"); err != nil {
+		t.Errorf("Authenticate: %s", err)
+	}
+
+	if err := authProvider.Add("dave", "davePass"); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	if err := authProvider.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	data, _ := ioutil.ReadFile(filename)
+	written := string(data)
+	if strings.HasPrefix(written, "$") || strings.Contains(written, "\n$") {
+		t.Errorf("htpasswd file written with a cost line:\n%s", written)
+	}
+	for _, line := range []string{"# managed by ops\nalice:", "bob:" + testAPR1Hash + "\n", "cathy:" + testSHAHash + "\n", "dave:$2a$"} {
+		if !strings.Contains(written, line) {
+			t.Errorf("%q not written:\n%s", line, written)
+		}
+	}
+
+	hb.SetAllowInsecureHashes(true)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 4 }) {
+		t.Fatalf("allowed insecure hashes not loaded: %v", authProvider.List())
+	}
+	for _, user := range []string{"bob", "cathy"} {
+		if err := authProvider.Authenticate(user, "secret"); err != nil {
+			t.Errorf("Authenticate %s: %s", user, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package authfile
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrAccountLocked is returned by Authenticate while a user is locked out after too many failures.
+var ErrAccountLocked = errors.New("authfile: Account locked")
+
+// lockout tracks the recent authentication failures of users. It is checked by the runner
+// goroutine of the service and recorded by the workers, under its mutex.
+type lockout struct {
+	mutex       sync.Mutex
+	maxFailures int // failures within window that lock a user, 0 disables the lockout.
+	window      time.Duration
+	cooldown    time.Duration
+	users       map[string]*lockoutState
+}
+
+// lockoutState is the failure record of a user.
+type lockoutState struct {
+	failures    []time.Time // times of the failures within the window, oldest first.
+	lockedUntil time.Time
+}
+
+// setPolicy replaces the policy and forgets all failures.
+func (l *lockout) setPolicy(maxFailures int, window, cooldown time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.maxFailures = maxFailures
+	l.window = window
+	l.cooldown = cooldown
+	l.users = nil
+}
+
+// locked returns true if username is locked out at now. The record of a user whose cooldown
+// is over is removed, so the user starts with no failures.
+func (l *lockout) locked(username string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.maxFailures <= 0 {
+		return false
+	}
+	state, ok := l.users[username]
+	if !ok || state.lockedUntil.IsZero() {
+		return false
+	}
+	if now.Before(state.lockedUntil) {
+		return true
+	}
+	delete(l.users, username)
+	return false
+}
+
+// record records the result of an authentication of username at now. A success resets the
+// failures, a wrong password counts as failure and locks the user once there are maxFailures
+// within the window. Unknown users are not tracked, so their number doesn't grow the record.
+func (l *lockout) record(username string, err error, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.maxFailures <= 0 {
+		return
+	}
+	switch err {
+	case nil:
+		delete(l.users, username)
+		return
+	case ErrAuthenticationFailed:
+	default:
+		return
+	}
+	if l.users == nil {
+		l.users = make(map[string]*lockoutState)
+	}
+	state, ok := l.users[username]
+	if !ok {
+		state = new(lockoutState)
+		l.users[username] = state
+	}
+	failures := state.failures[:0]
+	for _, t := range state.failures {
+		if now.Sub(t) < l.window {
+			failures = append(failures, t)
+		}
+	}
+	state.failures = append(failures, now)
+	if len(state.failures) >= l.maxFailures {
+		state.failures = nil
+		state.lockedUntil = now.Add(l.cooldown)
+	}
+}
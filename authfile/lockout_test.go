@@ -0,0 +1,122 @@
+package authfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func Test_Lockout(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	filename := tempPasswordFile(t, "$4\nalice:"+string(hash)+"\nbob:"+string(hash)+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	fb, err := NewROFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewROFileBackend: %s", err)
+	}
+	defer fb.Close()
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.SetLockoutPolicy(3, time.Minute, time.Minute)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 2 }) {
+		t.Fatalf("file not loaded")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := authProvider.Authenticate("alice", "wrong"); err != ErrAuthenticationFailed {
+			t.Errorf("failure %d: %v", i+1, err)
+		}
+	}
+	if err := authProvider.Authenticate("alice", "123"); err != ErrAccountLocked {
+		t.Errorf("correct password while locked: %v, supposed to be %v", err, ErrAccountLocked)
+	}
+	if err := authProvider.Authenticate("bob", "123"); err != nil {
+		t.Errorf("other user locked: %s", err)
+	}
+
+	// A success resets the failures.
+	for _, password := range []string{"wrong", "wrong", "123", "wrong", "wrong", "123"} {
+		authProvider.Authenticate("bob", password)
+	}
+	if err := authProvider.Authenticate("bob", "123"); err != nil {
+		t.Errorf("failures not reset by a success: %s", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := authProvider.Authenticate("nobody", "wrong"); err != ErrUserDoesNotExist {
+			t.Errorf("unknown user: %v", err)
+		}
+	}
+}
+
+func Test_LockoutCooldown(t *testing.T) {
+	var l lockout
+	l.setPolicy(2, time.Minute, 5*time.Minute)
+	now := time.Unix(1700000000, 0)
+
+	// Failures further apart than the window don't add up.
+	l.record("alice", ErrAuthenticationFailed, now)
+	now = now.Add(2 * time.Minute)
+	l.record("alice", ErrAuthenticationFailed, now)
+	if l.locked("alice", now) {
+		t.Errorf("locked by failures outside the window")
+	}
+
+	now = now.Add(30 * time.Second)
+	l.record("alice", ErrAuthenticationFailed, now)
+	if !l.locked("alice", now) {
+		t.Fatalf("not locked after two failures within the window")
+	}
+	if !l.locked("alice", now.Add(5*time.Minute-time.Second)) {
+		t.Errorf("lock expired before the cooldown")
+	}
+	now = now.Add(5 * time.Minute)
+	if l.locked("alice", now) {
+		t.Errorf("still locked after the cooldown")
+	}
+	l.record("alice", ErrAuthenticationFailed, now)
+	if l.locked("alice", now) {
+		t.Errorf("failures before the lock counted after the cooldown")
+	}
+
+	l.setPolicy(0, time.Minute, time.Minute)
+	for i := 0; i < 5; i++ {
+		l.record("alice", ErrAuthenticationFailed, now)
+	}
+	if l.locked("alice", now) || len(l.users) != 0 {
+		t.Errorf("disabled lockout tracks failures")
+	}
+}
+
+func Test_LockoutKilled(t *testing.T) {
+	// A hash slow enough for the service to be killed while it is compared.
+	hash, err := bcrypt.GenerateFromPassword([]byte("123"), 10)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	authProvider := NewInMemoryService(nil, time.Second)
+	authProvider.SetLockoutPolicy(3, time.Minute, time.Minute)
+	if err := authProvider.ReplaceAll([]Entry{{Username: "alice", PasswordHash: hash}}); err != nil {
+		t.Fatalf("ReplaceAll: %s", err)
+	}
+	result := make(chan error, 1)
+	go func() { result <- authProvider.Authenticate("alice", "wrong") }()
+	time.Sleep(10 * time.Millisecond)
+	authProvider.Kill()
+	select {
+	case err := <-result:
+		// ErrServiceClosed if killed before the authentication was taken.
+		if err != ErrAuthenticationFailed && err != ErrServiceClosed {
+			t.Errorf("Authenticate: %v, supposed to be %v", err, ErrAuthenticationFailed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("result lost by the kill")
+	}
+}
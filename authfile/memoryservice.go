@@ -0,0 +1,820 @@
+package authfile
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrNoTransaction is returned if trying to load without a transaction
+	ErrNoTransaction = errors.New("authfile: No transaction")
+	// ErrLoadInProgress is returned by callers refusing to act while a load transaction is pending,
+	// see LoadInProgress.
+	ErrLoadInProgress = errors.New("authfile: Load in progress")
+	// ErrServiceClosed is returned if the service has been killed.
+	ErrServiceClosed = errors.New("authfile: Service closed")
+)
+
+// InMemoryService implements an authentication service.
+type InMemoryService struct {
+	backend IOProvider // The IO provider to read/write the backend data.
+	hasher  Hasher     // The hasher of new entries, bcrypt with the cost if nil.
+	c       chan interface{}
+	ready   chan struct{} // Closed once the first load has been committed.
+	done    chan struct{} // Closed by Kill.
+
+	// mutex guards closing c: messages are sent under the read lock, and Kill closes c under
+	// the write lock once closed is set, so no message is sent on a closed channel.
+	mutex  sync.RWMutex
+	closed bool
+}
+
+// NewInMemoryService provides a new authentication service that keeps all accounts in memory.
+// loadTimeout is the time until a load from backend must succeed (during which modifications via api are blocked).
+// An optional hasher hashes the passwords of new and modified entries, by default they are hashed
+// with bcrypt at the configured cost. Existing entries are verified with the hasher matching their hash,
+// and rehashed by the default hasher on their next successful authentication if they were hashed by
+// another algorithm or with weaker parameters.
+func NewInMemoryService(backend IOProvider, loadTimeout time.Duration, hasher ...Hasher) *InMemoryService {
+	service := &InMemoryService{
+		backend: backend,
+		c:       make(chan interface{}, 10),
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if len(hasher) > 0 {
+		service.hasher = hasher[0]
+	}
+	go service.runner(loadTimeout)
+	return service
+}
+
+type msgAuthenticate struct {
+	username, password string
+	r                  chan error
+	result             func(error)            // if set, is called with the result before it is returned.
+	rehashed           func(old, hash []byte) // if set, receives the rehash of the password.
+}
+
+func (m msgAuthenticate) Copy() msgAuthenticate {
+	return msgAuthenticate{
+		username: m.username,
+		password: m.password,
+		r:        m.r,
+		result:   m.result,
+		rehashed: m.rehashed,
+	}
+}
+
+// reply returns the result of the authentication.
+func (m msgAuthenticate) reply(err error) {
+	if m.result != nil {
+		m.result(err)
+	}
+	m.r <- err
+}
+
+// msgRehash passes the rehash of a password back to the runner, to be written to the current
+// data unless the hash it replaces has changed in the meantime.
+type msgRehash struct {
+	username  string
+	old, hash []byte
+}
+
+type msgSetLockout struct {
+	maxFailures      int
+	window, cooldown time.Duration
+}
+
+type msgDelete struct {
+	username string
+	r        chan error
+}
+
+type msgAdd struct {
+	username, password string
+	r                  chan error
+}
+
+func (m msgAdd) Copy() msgAdd {
+	return msgAdd{
+		username: m.username,
+		password: m.password,
+		r:        m.r,
+	}
+}
+
+type msgModify struct {
+	username, password string
+	r                  chan error
+}
+
+func (m msgModify) Copy() msgModify {
+	return msgModify{
+		username: m.username,
+		password: m.password,
+		r:        m.r,
+	}
+}
+
+type msgVerifyModify struct {
+	username, oldpassword, newpassword string
+	r                                  chan error
+}
+
+func (m msgVerifyModify) Copy() msgVerifyModify {
+	return msgVerifyModify{
+		username:    m.username,
+		oldpassword: m.oldpassword,
+		newpassword: m.newpassword,
+		r:           m.r,
+	}
+}
+
+// msgSet passes the hash of an added or modified user, computed by a worker, back to the runner
+// to be checked and set.
+type msgSet struct {
+	op        interface{} // the msgAdd, msgModify or msgVerifyModify.
+	username  string
+	old, hash []byte // old is the hash the old password of a msgVerifyModify was verified against.
+	r         chan error
+}
+
+type msgStartLoad struct{}
+
+type msgLoad struct {
+	username     string
+	passwordHash []byte
+	r            chan error
+}
+
+type msgCommit struct {
+	r chan error
+}
+
+type msgRollback struct {
+	txid int64
+}
+
+type msgReplaceAll struct {
+	entries []Entry
+	r       chan error
+}
+
+type msgSetMaxUsers struct {
+	maxUsers int
+}
+
+type msgGetCost struct {
+	r chan int
+}
+
+type msgSetCost struct {
+	cost int
+}
+
+type msgList struct {
+	r chan []Entry
+}
+
+type msgSetAutoSync struct {
+	interval time.Duration
+	r        chan chan struct{} // the done channel of the stopped writer, nil if none.
+}
+
+// msgTakeDirty reports whether there have been modifications since it was last sent.
+type msgTakeDirty struct {
+	r chan bool
+}
+
+type msgMarkDirty struct{}
+
+type msgLoadStatus struct {
+	r chan bool
+}
+
+type msgExists struct {
+	username string
+	r        chan bool
+}
+
+type msgListPage struct {
+	prefix        string
+	offset, limit int
+	r             chan listPage
+}
+
+// listPage is the result of a msgListPage.
+type listPage struct {
+	entries []Entry
+	total   int
+}
+
+func (service *InMemoryService) runner(loadTimeout time.Duration) {
+	var inLoad bool
+	var loadData *authData
+	var txid int64
+	var pool *WorkPool
+	var maxUsers uint64
+	var lock lockout
+	var loaded bool
+	// dirty is set by modifications that are not in the backend yet, see SetAutoSync.
+	var dirty bool
+	var stopAutoSync, autoSyncDone chan struct{}
+	// hashed passes a hash computed by a worker back to the runner. In a goroutine, the runner
+	// may be blocked dispatching to the worker. If the service has been killed in the meantime,
+	// the caller gets ErrServiceClosed.
+	hashed := func(m msgSet) {
+		go func() {
+			if err := service.send(context.Background(), m); err != nil {
+				m.r <- err
+			}
+		}()
+	}
+	// committed marks the service ready after the first committed load.
+	committed := func() {
+		if !loaded {
+			loaded = true
+			close(service.ready)
+		}
+	}
+	// Set worker pool
+	cpus := runtime.NumCPU()
+	if cpus > 1 {
+		cpus--
+	}
+	pool = NewWorkPool(cpus)
+
+	curData := newAuthData(service.hasher)
+	// Modifications during a load are applied to the current data at once, and replayed on the
+	// loaded data when it is committed, so they aren't lost with the data they were applied to.
+	// Only modifications that succeeded are replayed, a failed one must not take effect later.
+	// The replay runs in the runner, so the modifications are in place before the next message,
+	// such as a List or an Authenticate, is handled.
+	var replay []interface{}
+	replayOn := func(data *authData) {
+		for _, m := range replay { // In order, the results have been returned already.
+			switch e := m.(type) {
+			case msgDelete:
+				data.delete(e.username)
+			case msgSet:
+				data.setChecked(e)
+			}
+		}
+		replay = nil
+	}
+	curData.setCost(uint64(bcrypt.DefaultCost))
+	for m := range service.c {
+		switch e := m.(type) {
+		case msgAuthenticate:
+			if lock.locked(e.username, time.Now()) {
+				e.r <- ErrAccountLocked
+				break
+			}
+			job := e.Copy()
+			job.rehashed = func(old, hash []byte) {
+				// In a goroutine, the runner may be blocked dispatching to this worker. Fails if
+				// the service has been killed in the meantime.
+				go service.send(context.Background(), msgRehash{username: e.username, old: old, hash: hash})
+			}
+			job.result = func(err error) {
+				// Recorded by the worker, so the result is returned even if the service is
+				// killed meanwhile.
+				lock.record(e.username, err, time.Now())
+			}
+			data := curData // The job must not see curData replaced by a commit.
+			pool.Dispatch(func() { data.authenticate(job) })
+		case msgRehash:
+			if curData.replace(e.username, e.old, e.hash) {
+				dirty = true
+			}
+		case msgSetLockout:
+			lock.setPolicy(e.maxFailures, e.window, e.cooldown)
+		case msgDelete:
+			err := curData.delete(e.username)
+			if err == nil {
+				dirty = true
+				if inLoad {
+					replay = append(replay, m)
+				}
+			}
+			e.r <- err
+		case msgAdd:
+			// Hashed by a worker, then checked and set by the runner, see msgSet.
+			job, data := e.Copy(), curData
+			pool.Dispatch(func() { data.add(job, hashed) })
+		case msgModify:
+			job, data := e.Copy(), curData
+			pool.Dispatch(func() { data.modify(job, hashed) })
+		case msgVerifyModify:
+			job, data := e.Copy(), curData
+			pool.Dispatch(func() { data.verifyModify(job, hashed) })
+		case msgSet:
+			err := curData.setChecked(e)
+			if op, ok := e.op.(msgVerifyModify); ok && err == errHashChanged {
+				// Modified or rehashed since the old password was verified, verify it again.
+				job, data := op.Copy(), curData
+				pool.Dispatch(func() { data.verifyModify(job, hashed) })
+				break
+			}
+			if err == nil {
+				dirty = true
+				if inLoad {
+					replay = append(replay, m)
+				}
+			}
+			e.r <- err
+		case msgStartLoad:
+			inLoad = true
+			loadData = newAuthData(service.hasher)
+			loadData.setCost(uint64(bcrypt.DefaultCost))
+			loadData.setMaxUsers(maxUsers)
+			txid = time.Now().UnixNano()
+			id := txid
+			time.AfterFunc(loadTimeout, func() { // Initialize automatic rollback call. Old Rollbacks are ineffective since they have a wrong txid
+				service.send(context.Background(), msgRollback{txid: id}) // Fails if the service has been killed.
+			})
+		case msgRollback:
+			if inLoad && (e.txid == 0 || (e.txid == txid && txid != 0)) {
+				inLoad = false
+				loadData = nil
+				txid = 0
+				replay = nil // The current data has the modifications already.
+			}
+		case msgCommit:
+			if !inLoad {
+				e.r <- ErrNoTransaction
+				break
+			}
+			curData = loadData
+			replayOn(curData)
+			inLoad = false
+			txid = 0
+			committed()
+			e.r <- nil
+		case msgLoad:
+			if inLoad {
+				if _, ok := loadData.data[e.username]; !ok && loadData.full() {
+					e.r <- ErrTooManyUsers
+					break
+				}
+				loadData.data[e.username] = e.passwordHash
+				e.r <- nil
+			} else {
+				e.r <- ErrNoTransaction
+			}
+		case msgReplaceAll:
+			// A complete load transaction in a single step, so it needs no load timeout. It
+			// supersedes any pending load.
+			inLoad = false
+			txid = 0
+			loadData = newAuthData(service.hasher)
+			loadData.setCost(curData.getCost())
+			loadData.setMaxUsers(maxUsers)
+			var err error
+			for _, entry := range e.entries {
+				if _, ok := loadData.data[entry.Username]; !ok && loadData.full() {
+					err = ErrTooManyUsers
+					continue
+				}
+				loadData.data[entry.Username] = entry.PasswordHash
+			}
+			curData = loadData
+			loadData = nil
+			replayOn(curData)
+			committed()
+			e.r <- err
+		case msgSetMaxUsers:
+			maxUsers = uint64(e.maxUsers)
+			curData.setMaxUsers(maxUsers)
+			if inLoad {
+				loadData.setMaxUsers(maxUsers)
+			}
+		case msgGetCost:
+			e.r <- int(curData.getCost())
+		case msgSetCost:
+			if inLoad {
+				loadData.setCost(uint64(e.cost))
+			} else {
+				curData.setCost(uint64(e.cost))
+			}
+		case msgList:
+			e.r <- curData.entries("")
+		case msgSetAutoSync:
+			if stopAutoSync != nil {
+				close(stopAutoSync)
+			}
+			e.r <- autoSyncDone
+			stopAutoSync, autoSyncDone = nil, nil
+			if e.interval > 0 {
+				stopAutoSync, autoSyncDone = make(chan struct{}), make(chan struct{})
+				go service.autoSync(e.interval, stopAutoSync, autoSyncDone)
+			}
+		case msgTakeDirty:
+			e.r <- dirty
+			dirty = false
+		case msgMarkDirty:
+			dirty = true
+		case msgLoadStatus:
+			e.r <- inLoad
+		case msgExists:
+			e.r <- curData.get(e.username) != nil
+		case msgListPage:
+			ret := curData.entries(e.prefix)
+			sort.Slice(ret, func(i, j int) bool { return ret[i].Username < ret[j].Username })
+			total := len(ret)
+			if e.offset > total {
+				e.offset = total
+			}
+			ret = ret[e.offset:]
+			if e.limit > 0 && e.limit < len(ret) {
+				ret = ret[:e.limit]
+			}
+			e.r <- listPage{entries: ret, total: total}
+		default:
+			panic("Unimplemented!")
+		}
+	}
+	if stopAutoSync != nil {
+		close(stopAutoSync)
+	}
+	pool.Shutdown()
+}
+
+// Authenticate checks if a username is present and the password matches. Returns nil on success.
+func (service *InMemoryService) Authenticate(username, password string) error {
+	return service.AuthenticateContext(context.Background(), username, password)
+}
+
+// AuthenticateContext is Authenticate, giving up with the error of ctx once ctx is done. It
+// returns ErrServiceClosed if the service has been killed.
+func (service *InMemoryService) AuthenticateContext(ctx context.Context, username, password string) error {
+	r := make(chan error, 1) // Not closed, the result may arrive after ctx is done.
+	err := service.send(ctx, msgAuthenticate{
+		username: username,
+		password: password,
+		r:        r,
+	})
+	if err != nil {
+		return err
+	}
+	return service.result(ctx, r)
+}
+
+// result waits for the result of an authentication on r. It gives up with the error of ctx once
+// ctx is done, or with ErrServiceClosed once the service is killed and there is no result yet.
+func (service *InMemoryService) result(ctx context.Context, r chan error) error {
+	select {
+	case err := <-r:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-service.done:
+		select {
+		case err := <-r:
+			return err
+		default:
+			return ErrServiceClosed
+		}
+	}
+}
+
+// TryAuthenticate is Authenticate for use under extreme load: if the service is overloaded and
+// can't take the request at once, it returns false without queueing it, so that callers may fail
+// fast instead of waiting. Once taken, it returns true and the result of the authentication, or
+// ErrServiceClosed if the service is killed before the result.
+func (service *InMemoryService) TryAuthenticate(username, password string) (ok bool, err error) {
+	r := make(chan error, 1)
+	service.mutex.RLock()
+	if service.closed {
+		service.mutex.RUnlock()
+		return true, ErrServiceClosed
+	}
+	select {
+	case service.c <- msgAuthenticate{username: username, password: password, r: r}:
+		service.mutex.RUnlock()
+	default:
+		service.mutex.RUnlock()
+		return false, nil
+	}
+	return true, service.result(context.Background(), r)
+}
+
+// send sends m to the runner unless ctx is done first. It returns ErrServiceClosed if the
+// service has been killed. A message that is sent is handled, even if the service is killed
+// right after, as the runner drains the channel.
+func (service *InMemoryService) send(ctx context.Context, m interface{}) error {
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+	if service.closed {
+		return ErrServiceClosed
+	}
+	select {
+	case service.c <- m:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Delete a user, return nil on success.
+func (service *InMemoryService) Delete(username string) error {
+	r := make(chan error, 1)
+	if err := service.send(context.Background(), msgDelete{
+		username: username,
+		r:        r,
+	}); err != nil {
+		return err
+	}
+	e := <-r
+	close(r)
+	return e
+}
+
+// Add a user with password. Return nil on success.
+func (service *InMemoryService) Add(username, password string) error {
+	r := make(chan error, 1)
+	if err := service.send(context.Background(), msgAdd{
+		username: username,
+		password: password,
+		r:        r,
+	}); err != nil {
+		return err
+	}
+	e := <-r
+	close(r)
+	return e
+}
+
+// Modify a user to use a new password. Return nil on success.
+func (service *InMemoryService) Modify(username, password string) error {
+	r := make(chan error, 1)
+	if err := service.send(context.Background(), msgModify{
+		username: username,
+		password: password,
+		r:        r,
+	}); err != nil {
+		return err
+	}
+	e := <-r
+	close(r)
+	return e
+}
+
+// VerifyModify modifies the password of a user only after verifying that the old password is correct.
+func (service *InMemoryService) VerifyModify(username, oldpassword, newpassword string) error {
+	r := make(chan error, 1)
+	if err := service.send(context.Background(), msgVerifyModify{
+		username:    username,
+		oldpassword: oldpassword,
+		newpassword: newpassword,
+		r:           r,
+	}); err != nil {
+		return err
+	}
+	e := <-r
+	close(r)
+	return e
+}
+
+// StartLoad starts a new loading transaction. Only one loading transaction can exist at any time.
+// If the loading transaction times out before the Commit() call, loaded data is lost.
+// During a load transaction, modifying calls and authentication calls operate on the old data. The
+// modifications that succeed are replayed on the loaded data as part of the commit, before any later
+// call sees it; failed ones are not.
+// Calling StartLoad silently rolls back any previous uncommitted load transaction!
+func (service *InMemoryService) StartLoad() {
+	service.send(context.Background(), msgStartLoad{})
+}
+
+// Load a user with a password hash. It requires a transaction started with StartLoad which needs to be
+// committed with Commit.
+func (service *InMemoryService) Load(username string, passwordHash []byte) error {
+	r := make(chan error, 1)
+	if err := service.send(context.Background(), msgLoad{
+		username:     username,
+		passwordHash: passwordHash,
+		r:            r,
+	}); err != nil {
+		return err
+	}
+	err := <-r
+	close(r)
+	return err
+}
+
+// Rollback current load transaction, if there is any.
+func (service *InMemoryService) Rollback() {
+	service.send(context.Background(), msgRollback{})
+}
+
+// LoadInProgress reports whether a load transaction started with StartLoad is pending, i.e. the
+// backend is being read. It ends with Commit, Rollback, ReplaceAll or the load timeout. Modifications
+// during a load are not lost, but a caller about to write the backend, e.g. a bulk import, may wait
+// or fail with ErrLoadInProgress instead. A killed service has no load in progress.
+func (service *InMemoryService) LoadInProgress() bool {
+	r := make(chan bool, 1)
+	if service.send(context.Background(), msgLoadStatus{r: r}) != nil {
+		return false
+	}
+	return <-r
+}
+
+// Commit newly loaded data as the authoritative data. It returns ErrNoTransaction if there is no
+// load transaction, because it has timed out, has been rolled back or superseded by ReplaceAll,
+// or was never started.
+func (service *InMemoryService) Commit() error {
+	r := make(chan error, 1)
+	if err := service.send(context.Background(), msgCommit{r: r}); err != nil {
+		return err
+	}
+	err := <-r
+	close(r)
+	return err
+}
+
+// ReplaceAll atomically replaces all users with entries, in a load transaction of its own.
+// Authentication calls see either the old or the new users, never a mix. A pending load
+// transaction is rolled back. Unlike a transaction of StartLoad, Load and Commit, it is not
+// subject to the load timeout, however many entries there are, so a slow producer of the entries
+// is never rolled back. Entries beyond the maximum number of users are left out, and
+// ErrTooManyUsers is returned.
+func (service *InMemoryService) ReplaceAll(entries []Entry) error {
+	r := make(chan error, 1)
+	if err := service.send(context.Background(), msgReplaceAll{
+		entries: entries,
+		r:       r,
+	}); err != nil {
+		return err
+	}
+	err := <-r
+	close(r)
+	return err
+}
+
+// SetCost updates the bcrypt cost that is required.
+func (service *InMemoryService) SetCost(cost int) {
+	service.send(context.Background(), msgSetCost{
+		cost: cost,
+	})
+}
+
+// SetMaxUsers limits the number of users. Adding or loading users beyond the limit fails with
+// ErrTooManyUsers, users already present are kept. A limit of 0, the default, is unlimited.
+func (service *InMemoryService) SetMaxUsers(maxUsers int) {
+	service.send(context.Background(), msgSetMaxUsers{
+		maxUsers: maxUsers,
+	})
+}
+
+// SetLockoutPolicy locks a user out for cooldown after maxFailures authentications with a wrong
+// password within window. While locked out, Authenticate returns ErrAccountLocked even for the
+// correct password. A successful authentication resets the failures of the user. Failures for
+// unknown users are not counted. A maxFailures of 0, the default, disables the lockout.
+func (service *InMemoryService) SetLockoutPolicy(maxFailures int, window, cooldown time.Duration) {
+	service.send(context.Background(), msgSetLockout{
+		maxFailures: maxFailures,
+		window:      window,
+		cooldown:    cooldown,
+	})
+}
+
+// GetCost returns the current target bcrypt cost of the system.
+func (service *InMemoryService) GetCost() int {
+	r := make(chan int, 1)
+	if service.send(context.Background(), msgGetCost{r: r}) != nil {
+		return 0
+	}
+	c := <-r
+	close(r)
+	return c
+}
+
+// List all entries of the service. There is no defined order. A killed service has no entries.
+func (service *InMemoryService) List() []Entry {
+	r := make(chan []Entry, 1)
+	if service.send(context.Background(), msgList{r: r}) != nil {
+		return nil
+	}
+	ret := <-r
+	return ret
+}
+
+// SetAutoSync writes the entries to the backend every interval if they have been modified since
+// the last write by it, so modifications survive a crash. Loads from the backend are not
+// modifications, neither is ReplaceAll. A failed write is tried again after the next interval.
+// An interval of 0, the default, stops the writes. A write already started by the previous
+// interval is done when SetAutoSync returns.
+func (service *InMemoryService) SetAutoSync(interval time.Duration) {
+	r := make(chan chan struct{}, 1)
+	if service.send(context.Background(), msgSetAutoSync{interval: interval, r: r}) != nil {
+		return
+	}
+	// Wait outside of the runner, which the stopped writer may still need to finish.
+	if done := <-r; done != nil {
+		<-done
+	}
+}
+
+// autoSync writes the entries every interval if they are dirty, until stop is closed or the
+// service is killed. It closes done when it returns.
+func (service *InMemoryService) autoSync(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		r := make(chan bool, 1)
+		if service.send(context.Background(), msgTakeDirty{r: r}) != nil {
+			return
+		}
+		if <-r && service.Sync() != nil {
+			if service.send(context.Background(), msgMarkDirty{}) != nil {
+				return
+			}
+		}
+	}
+}
+
+// Exists reports whether the user exists, without checking a password or returning hashes. A load
+// in progress isn't seen until it is committed. A killed service has no users.
+func (service *InMemoryService) Exists(username string) bool {
+	r := make(chan bool, 1)
+	if service.send(context.Background(), msgExists{username: username, r: r}) != nil {
+		return false
+	}
+	return <-r
+}
+
+// Ready returns a channel that is closed once the first load has been committed, by Commit or
+// ReplaceAll. Until then the service has no users, and every authentication fails.
+func (service *InMemoryService) Ready() <-chan struct{} {
+	return service.ready
+}
+
+// WaitReady waits until the first load has been committed, see Ready, or returns the error of
+// ctx once ctx is done.
+func (service *InMemoryService) WaitReady(ctx context.Context) error {
+	select {
+	case <-service.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ListPage returns the entries whose username starts with prefix, sorted by username, skipping
+// the first offset entries and returning at most limit entries, all if limit is 0 or less. The total
+// number of entries with the prefix is returned as well, to page through them. An offset beyond
+// the entries returns no entries. A killed service has no entries.
+func (service *InMemoryService) ListPage(prefix string, offset, limit int) ([]Entry, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	r := make(chan listPage, 1)
+	if service.send(context.Background(), msgListPage{prefix: prefix, offset: offset, limit: limit, r: r}) != nil {
+		return nil, 0
+	}
+	page := <-r
+	return page.entries, page.total
+}
+
+// Update triggers the authentication service to request a reload from the backend storage.
+func (service *InMemoryService) Update() {
+	service.backend.RequestRead(service)
+}
+
+// Sync writes the entries to the backend, returning the error of the write.
+func (service *InMemoryService) Sync() error {
+	return service.backend.RequestWrite(service)
+}
+
+// Shutdown the authentication service, updating the backend. An error of the write, such as
+// ErrReadOnly of a read-only backend, is dropped; call Sync before to check it.
+func (service *InMemoryService) Shutdown() {
+	service.backend.RequestWrite(service)
+	service.Kill()
+}
+
+// Kill the authentication service. Calls after Kill fail with ErrServiceClosed, or do nothing if
+// they return no error. Killing a killed service does nothing.
+func (service *InMemoryService) Kill() {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if service.closed {
+		return
+	}
+	service.closed = true
+	close(service.c)
+	close(service.done)
+}
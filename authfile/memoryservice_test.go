@@ -0,0 +1,658 @@
+package authfile
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func xTest_Short(t *testing.T) {
+	fb, err := NewFileBackend("/tmp/authfile.test", 0600, time.Second*5)
+	if err != nil {
+		t.Fatalf("NewFileBackend: %s", err)
+	}
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.SetCost(13)
+	if err := authProvider.Add("test", "testPass"); err != nil {
+		t.Errorf("Add: %s", err)
+	}
+	if err := authProvider.Authenticate("test", "testPass"); err != nil {
+		t.Errorf("Authenticate: %s", err)
+	}
+	if err := authProvider.Authenticate("test", "testPassWrong"); err == nil {
+		t.Errorf("Authenticate did not throw error when using wrong password")
+	}
+	authProvider.Sync()
+	time.Sleep(time.Second)
+}
+
+func Test_ReplaceAll(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("123"), 4)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	filename := tempPasswordFile(t, "$4\nalice:"+string(hash)+"\nbob:"+string(hash)+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	fb, err := NewFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewFileBackend: %s", err)
+	}
+	defer fb.Close()
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 2 }) {
+		t.Fatalf("file not loaded")
+	}
+
+	newHash, err := bcrypt.GenerateFromPassword([]byte("secret"), 4)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	if err := authProvider.ReplaceAll([]Entry{
+		{Username: "cathy", PasswordHash: newHash},
+		{Username: "dave", PasswordHash: hash},
+	}); err != nil {
+		t.Fatalf("ReplaceAll: %s", err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if err := authProvider.Authenticate(user, "123"); err == nil {
+			t.Errorf("replaced user %s still authenticates", user)
+		}
+	}
+	if err := authProvider.Authenticate("cathy", "secret"); err != nil {
+		t.Errorf("Authenticate cathy: %s", err)
+	}
+	if err := authProvider.Authenticate("dave", "123"); err != nil {
+		t.Errorf("Authenticate dave: %s", err)
+	}
+	if entries := authProvider.List(); len(entries) != 2 {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+	if cost := authProvider.GetCost(); cost != 4 {
+		t.Errorf("cost %d, supposed to be kept at 4", cost)
+	}
+
+	// A pending load transaction is superseded.
+	authProvider.StartLoad()
+	if err := authProvider.ReplaceAll(nil); err != nil {
+		t.Fatalf("ReplaceAll: %s", err)
+	}
+	if err := authProvider.Load("alice", hash); err != ErrNoTransaction {
+		t.Errorf("Load after ReplaceAll: %v, supposed to be %v", err, ErrNoTransaction)
+	}
+	if entries := authProvider.List(); len(entries) != 0 {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+}
+
+func Test_ReplaceAllNoTimeout(t *testing.T) {
+	// A load of this size takes longer than the load timeout.
+	authProvider := NewInMemoryService(nil, time.Nanosecond)
+	entries := make([]Entry, 10000)
+	for i := range entries {
+		entries[i] = Entry{Username: fmt.Sprintf("user%d", i), PasswordHash: []byte("$2y$04$hash")}
+	}
+	time.Sleep(time.Millisecond)
+	if err := authProvider.ReplaceAll(entries); err != nil {
+		t.Fatalf("ReplaceAll: %s", err)
+	}
+	if n := len(authProvider.List()); n != len(entries) {
+		t.Errorf("%d users, supposed to be %d", n, len(entries))
+	}
+}
+
+func Test_MaxUsers(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("123"), 4)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	filename := tempPasswordFile(t, "$4\nalice:"+string(hash)+"\nbob:"+string(hash)+"\ncathy:"+string(hash)+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	fb, err := NewFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewFileBackend: %s", err)
+	}
+	defer fb.Close()
+	errs := make(chan error, 1)
+	fb.SetErrorHandler(func(err error) { errs <- err })
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.SetMaxUsers(2)
+	authProvider.Update()
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "1 entries rejected") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("rejected entries not reported")
+	}
+	if entries := authProvider.List(); len(entries) != 2 {
+		t.Errorf("entries beyond the limit loaded: %v", entries)
+	}
+	if err := authProvider.Authenticate("alice", "123"); err != nil {
+		t.Errorf("Authenticate: %s", err)
+	}
+	if err := authProvider.Add("dave", "secret"); err != ErrTooManyUsers {
+		t.Errorf("Add beyond the limit: %v, supposed to be %v", err, ErrTooManyUsers)
+	}
+
+	err = authProvider.ReplaceAll([]Entry{
+		{Username: "dave", PasswordHash: hash},
+		{Username: "erin", PasswordHash: hash},
+		{Username: "frank", PasswordHash: hash},
+	})
+	if err != ErrTooManyUsers {
+		t.Errorf("ReplaceAll beyond the limit: %v, supposed to be %v", err, ErrTooManyUsers)
+	}
+	if entries := authProvider.List(); len(entries) != 2 {
+		t.Errorf("entries beyond the limit replaced: %v", entries)
+	}
+
+	authProvider.SetMaxUsers(0)
+	if err := authProvider.Add("frank", "secret"); err != nil {
+		t.Errorf("Add without limit: %s", err)
+	}
+}
+
+func Test_ConcurrentModifications(t *testing.T) {
+	authProvider := NewInMemoryService(nil, time.Second)
+	defer authProvider.Kill()
+	authProvider.SetCost(bcrypt.MinCost)
+	authProvider.SetMaxUsers(1)
+	if err := authProvider.ReplaceAll(nil); err != nil {
+		t.Fatalf("ReplaceAll: %s", err)
+	}
+
+	// Concurrent adds are checked one at a time against the limit.
+	const n = 8
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) { errs <- authProvider.Add(fmt.Sprintf("user%d", i), "secret") }(i)
+	}
+	added := 0
+	for i := 0; i < n; i++ {
+		if err := <-errs; err == nil {
+			added++
+		} else if err != ErrTooManyUsers {
+			t.Errorf("Add: %s", err)
+		}
+	}
+	if entries := authProvider.List(); added != 1 || len(entries) != 1 {
+		t.Errorf("%d users added beyond the limit: %v", added, entries)
+	}
+
+	// A modification hashed before a delete doesn't revive the user.
+	user := authProvider.List()[0].Username
+	modified := make(chan error, 1)
+	go func() { modified <- authProvider.Modify(user, "changed") }()
+	deleted := authProvider.Delete(user)
+	if err := <-modified; deleted != nil || (err != nil && err != ErrUserDoesNotExist) {
+		t.Fatalf("Delete: %v, Modify: %v", deleted, err)
+	}
+	if authProvider.Exists(user) {
+		t.Errorf("deleted user revived by a modification")
+	}
+}
+
+func Test_AuthenticateContext(t *testing.T) {
+	// A service without runner never answers.
+	wedged := &InMemoryService{c: make(chan interface{})}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := wedged.AuthenticateContext(ctx, "alice", "123"); err != context.DeadlineExceeded {
+		t.Errorf("wedged service: %v, supposed to be %v", err, context.DeadlineExceeded)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	filename := tempPasswordFile(t, "$4\nalice:"+string(hash)+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+	fb, err := NewROFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewROFileBackend: %s", err)
+	}
+	defer fb.Close()
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 1 }) {
+		t.Fatalf("file not loaded")
+	}
+	if err := authProvider.AuthenticateContext(context.Background(), "alice", "123"); err != nil {
+		t.Errorf("AuthenticateContext: %s", err)
+	}
+	authProvider.Kill()
+	if err := authProvider.AuthenticateContext(context.Background(), "alice", "123"); err != ErrServiceClosed {
+		t.Errorf("killed service: %v, supposed to be %v", err, ErrServiceClosed)
+	}
+}
+
+func Test_Ready(t *testing.T) {
+	filename := tempPasswordFile(t, "alice:$2y$04$lcPirp7mnYIYBROnwnMvSu8hw2FBWKeHfFX63NtJ2ISoAK7s8PHNm\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+	fb, err := NewROFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewROFileBackend: %s", err)
+	}
+	defer fb.Close()
+	authProvider := NewInMemoryService(fb, time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := authProvider.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("WaitReady before the first load: %v, supposed to be %v", err, context.DeadlineExceeded)
+	}
+
+	authProvider.Update()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := authProvider.WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady: %s", err)
+	}
+	if entries := authProvider.List(); len(entries) != 1 {
+		t.Errorf("unexpected entries when ready: %v", entries)
+	}
+	select {
+	case <-authProvider.Ready():
+	default:
+		t.Errorf("Ready not closed after the first load")
+	}
+
+	// A rolled back load doesn't make the service ready.
+	rolledBack := NewInMemoryService(fb, time.Second)
+	rolledBack.StartLoad()
+	rolledBack.Rollback()
+	rolledBack.List()
+	select {
+	case <-rolledBack.Ready():
+		t.Errorf("Ready closed after a rolled back load")
+	default:
+	}
+}
+
+func Test_ListPage(t *testing.T) {
+	filename := tempPasswordFile(t, "")
+	defer os.RemoveAll(filepath.Dir(filename))
+	fb, err := NewROFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewROFileBackend: %s", err)
+	}
+	defer fb.Close()
+	authProvider := NewInMemoryService(fb, time.Second)
+	var entries []Entry
+	for _, user := range []string{"bob", "alice2", "carol", "alice10", "alice1", "alice"} {
+		entries = append(entries, Entry{Username: user, PasswordHash: []byte("$2y$04$" + user)})
+	}
+	if err := authProvider.ReplaceAll(entries); err != nil {
+		t.Fatalf("ReplaceAll: %s", err)
+	}
+
+	names := func(entries []Entry) string {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Username)
+		}
+		return strings.Join(names, ",")
+	}
+	for _, test := range []struct {
+		prefix        string
+		offset, limit int
+		names         string
+		total         int
+	}{
+		{"", 0, 0, "alice,alice1,alice10,alice2,bob,carol", 6},
+		{"alice", 0, 0, "alice,alice1,alice10,alice2", 4},
+		{"alice", 1, 2, "alice1,alice10", 4},
+		{"alice", 3, 2, "alice2", 4},
+		{"alice", 4, 2, "", 4},
+		{"alice", 10, 2, "", 4},
+		{"alice", -1, 1, "alice", 4},
+		{"b", 0, 10, "bob", 1},
+		{"dave", 0, 10, "", 0},
+	} {
+		// Pages are the same every time, whatever the order of the map.
+		for i := 0; i < 3; i++ {
+			page, total := authProvider.ListPage(test.prefix, test.offset, test.limit)
+			if names(page) != test.names || total != test.total {
+				t.Errorf("ListPage(%q, %d, %d): %s of %d, supposed to be %s of %d",
+					test.prefix, test.offset, test.limit, names(page), total, test.names, test.total)
+				break
+			}
+		}
+	}
+	if page, _ := authProvider.ListPage("bob", 0, 1); len(page) != 1 || string(page[0].PasswordHash) != "$2y$04$bob" {
+		t.Errorf("unexpected entry %v", page)
+	}
+
+	authProvider.Kill()
+	if page, total := authProvider.ListPage("", 0, 0); page != nil || total != 0 {
+		t.Errorf("killed service listed %v of %d", page, total)
+	}
+}
+
+func Test_TryAuthenticate(t *testing.T) {
+	// A service without runner whose buffer is full is overloaded.
+	wedged := &InMemoryService{c: make(chan interface{}, 10)}
+	for i := 0; i < cap(wedged.c); i++ {
+		wedged.c <- msgStartLoad{}
+	}
+	done := make(chan bool, 1)
+	go func() {
+		ok, _ := wedged.TryAuthenticate("alice", "123")
+		done <- ok
+	}()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Errorf("overloaded service took the request")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TryAuthenticate blocked on an overloaded service")
+	}
+
+	// A request taken by a service that never answers it returns once the service is killed.
+	unanswered := &InMemoryService{c: make(chan interface{}, 10), done: make(chan struct{})}
+	result := make(chan error, 1)
+	go func() {
+		_, err := unanswered.TryAuthenticate("alice", "123")
+		result <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	unanswered.Kill()
+	select {
+	case err := <-result:
+		if err != ErrServiceClosed {
+			t.Errorf("killed service: %v, supposed to be %v", err, ErrServiceClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TryAuthenticate blocked on a killed service")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	filename := tempPasswordFile(t, "")
+	defer os.RemoveAll(filepath.Dir(filename))
+	fb, err := NewROFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewROFileBackend: %s", err)
+	}
+	defer fb.Close()
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.SetCost(bcrypt.MinCost) // No rehash pending when the service is killed.
+	if err := authProvider.ReplaceAll([]Entry{{Username: "alice", PasswordHash: hash}}); err != nil {
+		t.Fatalf("ReplaceAll: %s", err)
+	}
+	if ok, err := authProvider.TryAuthenticate("alice", "123"); !ok || err != nil {
+		t.Errorf("TryAuthenticate: %t, %v", ok, err)
+	}
+	if ok, err := authProvider.TryAuthenticate("alice", "wrong"); !ok || err != ErrAuthenticationFailed {
+		t.Errorf("TryAuthenticate with a wrong password: %t, %v", ok, err)
+	}
+	authProvider.Kill()
+	if ok, err := authProvider.TryAuthenticate("alice", "123"); !ok || err != ErrServiceClosed {
+		t.Errorf("killed service: %t, %v, supposed to be %v", ok, err, ErrServiceClosed)
+	}
+}
+
+func Test_RehashStale(t *testing.T) {
+	ad := newAuthData(nil)
+	ad.set("alice", []byte("old"))
+	if !ad.replace("alice", []byte("old"), []byte("rehashed")) || string(ad.get("alice")) != "rehashed" {
+		t.Errorf("rehash of the current hash not written")
+	}
+	// A modification between the authentication and its rehash wins.
+	ad.set("alice", []byte("modified"))
+	if ad.replace("alice", []byte("rehashed"), []byte("stale")) || string(ad.get("alice")) != "modified" {
+		t.Errorf("stale rehash overwrote a modification")
+	}
+	// A deleted user is not revived.
+	ad.delete("alice")
+	if ad.replace("alice", []byte("modified"), []byte("stale")) || ad.get("alice") != nil {
+		t.Errorf("stale rehash revived a deleted user")
+	}
+}
+
+// benchmarkService returns a service with a single user alice of password 123, hashed at the
+// minimum bcrypt cost.
+func benchmarkService(b *testing.B) *InMemoryService {
+	hash, err := bcrypt.GenerateFromPassword([]byte("123"), bcrypt.MinCost)
+	if err != nil {
+		b.Fatalf("GenerateFromPassword: %s", err)
+	}
+	service := NewInMemoryService(nil, time.Second)
+	service.SetCost(bcrypt.MinCost)
+	if err := service.ReplaceAll([]Entry{{Username: "alice", PasswordHash: hash}}); err != nil {
+		b.Fatalf("ReplaceAll: %s", err)
+	}
+	return service
+}
+
+// BenchmarkAuthenticate authenticates one login at a time.
+func BenchmarkAuthenticate(b *testing.B) {
+	service := benchmarkService(b)
+	defer service.Kill()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := service.Authenticate("alice", "123"); err != nil {
+			b.Fatalf("Authenticate: %s", err)
+		}
+	}
+}
+
+// BenchmarkAuthenticateParallel authenticates concurrent logins, which are verified by the
+// workers in parallel instead of one after the other by the runner.
+func BenchmarkAuthenticateParallel(b *testing.B) {
+	service := benchmarkService(b)
+	defer service.Kill()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := service.Authenticate("alice", "123"); err != nil {
+				b.Errorf("Authenticate: %s", err)
+				return
+			}
+		}
+	})
+}
+
+func Test_ModifyDuringLoad(t *testing.T) {
+	const loadTimeout = time.Second
+	authProvider := NewInMemoryService(nil, loadTimeout)
+	authProvider.SetCost(bcrypt.MinCost)
+	if err := authProvider.ReplaceAll([]Entry{{Username: "bob", PasswordHash: []byte("$2y$04$bob")}}); err != nil {
+		t.Fatalf("ReplaceAll: %s", err)
+	}
+	authProvider.StartLoad()
+	authProvider.SetCost(bcrypt.MinCost) // Of the loaded data, like the cost line of a file.
+	if err := authProvider.Load("bob", []byte("$2y$04$bob")); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if err := authProvider.Load("carol", []byte("$2y$04$carol")); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if err := authProvider.Add("alice", "123"); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	if err := authProvider.Delete("bob"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if err := authProvider.Add("dave", "123"); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	if err := authProvider.Delete("dave"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	authProvider.Commit()
+
+	users := func() string {
+		var names []string
+		for _, e := range authProvider.List() {
+			names = append(names, e.Username)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+	// The replay is done before the next message is handled.
+	if users() != "alice,carol" {
+		t.Errorf("users %s after commit, supposed to be alice,carol", users())
+	}
+	if err := authProvider.Authenticate("alice", "123"); err != nil {
+		t.Errorf("Authenticate: %s", err)
+	}
+	// Nothing is replayed once more later.
+	time.Sleep(loadTimeout + 100*time.Millisecond)
+	if users() != "alice,carol" {
+		t.Errorf("users %s after the load timeout, supposed to be alice,carol", users())
+	}
+
+	// Failed modifications are not replayed: erin exists and frank doesn't in the current data,
+	// the other way around in the loaded data.
+	if err := authProvider.ReplaceAll([]Entry{{Username: "erin", PasswordHash: []byte("$2y$04$erin")}}); err != nil {
+		t.Fatalf("ReplaceAll: %s", err)
+	}
+	authProvider.StartLoad()
+	if err := authProvider.Load("frank", []byte("$2y$04$frank")); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if err := authProvider.Add("erin", "123"); err != ErrUserExists {
+		t.Errorf("Add of an existing user: %v, supposed to be %v", err, ErrUserExists)
+	}
+	if err := authProvider.Modify("frank", "123"); err != ErrUserDoesNotExist {
+		t.Errorf("Modify of a missing user: %v, supposed to be %v", err, ErrUserDoesNotExist)
+	}
+	if err := authProvider.Delete("frank"); err != ErrUserDoesNotExist {
+		t.Errorf("Delete of a missing user: %v, supposed to be %v", err, ErrUserDoesNotExist)
+	}
+	authProvider.Commit()
+	if users() != "frank" {
+		t.Errorf("users %s after commit, supposed to be frank", users())
+	}
+	if err := authProvider.Authenticate("frank", "123"); err != ErrAuthenticationFailed {
+		t.Errorf("Authenticate with the password of a failed Modify: %v, supposed to be %v", err, ErrAuthenticationFailed)
+	}
+}
+
+func Test_Exists(t *testing.T) {
+	authProvider := NewInMemoryService(nil, time.Minute)
+	authProvider.SetCost(bcrypt.MinCost)
+	if err := authProvider.ReplaceAll([]Entry{{Username: "alice", PasswordHash: []byte("$2y$04$alice")}}); err != nil {
+		t.Fatalf("ReplaceAll: %s", err)
+	}
+	if !authProvider.Exists("alice") || authProvider.Exists("bob") {
+		t.Errorf("Exists: alice %t, bob %t, supposed to be true and false", authProvider.Exists("alice"), authProvider.Exists("bob"))
+	}
+
+	// The committed users count during a load.
+	authProvider.StartLoad()
+	if err := authProvider.Load("bob", []byte("$2y$04$bob")); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if !authProvider.Exists("alice") || authProvider.Exists("bob") {
+		t.Errorf("Exists during load: alice %t, bob %t, supposed to be true and false", authProvider.Exists("alice"), authProvider.Exists("bob"))
+	}
+	authProvider.Commit()
+	if authProvider.Exists("alice") || !authProvider.Exists("bob") {
+		t.Errorf("Exists after commit: alice %t, bob %t, supposed to be false and true", authProvider.Exists("alice"), authProvider.Exists("bob"))
+	}
+
+	authProvider.Kill()
+	if authProvider.Exists("bob") {
+		t.Errorf("user exists in a killed service")
+	}
+}
+
+func Test_AutoSync(t *testing.T) {
+	filename := tempPasswordFile(t, "$4\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+	fb, err := NewFileBackend(filename, 0600, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileBackend: %s", err)
+	}
+	defer fb.Close()
+	authProvider := NewInMemoryService(fb, time.Minute)
+	defer authProvider.Kill()
+	authProvider.Update()
+	if err := authProvider.WaitReady(context.Background()); err != nil {
+		t.Fatalf("WaitReady: %s", err)
+	}
+
+	const interval = 20 * time.Millisecond
+	authProvider.SetAutoSync(interval)
+	stamp := func() string {
+		s, err := ChangeStamp(filename)
+		if err != nil {
+			t.Fatalf("ChangeStamp: %s", err)
+		}
+		return string(s)
+	}
+	idle := stamp()
+	time.Sleep(5 * interval)
+	if stamp() != idle {
+		t.Errorf("file rewritten without modifications")
+	}
+
+	if err := authProvider.Add("alice", "123"); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	written := func() bool {
+		content, err := ioutil.ReadFile(filename)
+		return err == nil && strings.Contains(string(content), "alice:")
+	}
+	if !waitFor(time.Second, written) {
+		t.Fatalf("added user not written")
+	}
+	synced := stamp()
+	time.Sleep(5 * interval)
+	if stamp() != synced {
+		t.Errorf("file rewritten again without modifications")
+	}
+
+	authProvider.SetAutoSync(0)
+	if err := authProvider.Delete("alice"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	time.Sleep(5 * interval)
+	if !written() {
+		t.Errorf("file written after auto sync was stopped")
+	}
+}
+
+func Test_LoadInProgress(t *testing.T) {
+	authProvider := NewInMemoryService(nil, time.Minute)
+	if authProvider.LoadInProgress() {
+		t.Errorf("load in progress before StartLoad")
+	}
+	authProvider.StartLoad()
+	if !authProvider.LoadInProgress() {
+		t.Errorf("no load in progress after StartLoad")
+	}
+	authProvider.Commit()
+	if authProvider.LoadInProgress() {
+		t.Errorf("load in progress after Commit")
+	}
+
+	authProvider.StartLoad()
+	authProvider.Rollback()
+	if authProvider.LoadInProgress() {
+		t.Errorf("load in progress after Rollback")
+	}
+
+	authProvider.StartLoad()
+	authProvider.Kill()
+	if authProvider.LoadInProgress() {
+		t.Errorf("load in progress in a killed service")
+	}
+}
@@ -0,0 +1,754 @@
+package authfile
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Default provider implementation
+
+var (
+	// ErrNoEntries is reported if a password file contains no entries.
+	ErrNoEntries = errors.New("authfile: No entries")
+	// ErrReadOnly is returned by a write to a read-only backend.
+	ErrReadOnly = errors.New("authfile: Read-only backend")
+	// ErrReadOnlyUser is returned for a modification of a user loaded from an additional file or
+	// an extra entry, which are never written, see UserIsReadOnly.
+	ErrReadOnlyUser = errors.New("authfile: User of a read-only file or extra entry")
+)
+
+// DuplicateUsersError is reported if users are in several files of a backend. The entry of the
+// last file is used.
+type DuplicateUsersError struct {
+	Users []string // the users, quoted.
+}
+
+func (e *DuplicateUsersError) Error() string {
+	return fmt.Sprintf("authfile: users %s are in several files, using the entries of the last file", strings.Join(e.Users, ", "))
+}
+
+// FileBackend implements a file based backend.
+// Comment lines directly preceding an entry are kept with that entry and written back
+// in front of it, as long as the entry exists. Comments before the cost line and after
+// the last entry are kept as file header and trailer.
+// An entry may carry a third field with a comma separated list of roles, username:hash:role1,role2.
+// The roles are reported to the roles handler after every load and written back with the entry.
+//
+// Additional read-only files can be added with AddFile. Every file is watched on its own,
+// and a change re-reads only the changed file. The entries of all files are then merged
+// into one load, later files replacing entries of the same name of earlier files. Such users
+// are reported with a DuplicateUsersError.
+//
+// Entries of the primary file that are not loaded, for an invalid username, an insecure
+// hash or exceeding the maximum number of users, are written back as they are. So are the
+// entries of the primary file replaced by an additional file or an extra entry.
+type FileBackend struct {
+	sources     []*fileSource // the files, the first one is the primary file that is written.
+	authservice IAuthenticationService
+	extra       []Entry                   // entries loaded with every read, but never written.
+	unloaded    map[string]bool           // users of the primary file not loaded, kept as they are by writes.
+	readOnlyOf  map[string]bool           // users loaded from an additional file or an extra entry.
+	readOnly    bool                      // the file is opened read-only.
+	keepGood    bool                      // keep the last loaded entries if a read fails or yields no entries.
+	htpasswd    bool                      // the files are Apache htpasswd files, written without cost line and roles.
+	insecure    bool                      // load entries with insecure $apr1$ and {SHA} hashes.
+	lowercase   bool                      // usernames are case-insensitive and lowercased on load.
+	cost        int                       // cost overriding the cost line of the primary file, 0 if none.
+	onError     func(error)               // called with errors of background reads and writes.
+	onRoles     func(map[string][]string) // called with the roles of every committed load.
+	onLoad      func([]Entry)             // called with the entries of every committed load.
+	mutex       *sync.Mutex               // mutex protecting the structure.
+	done        chan struct{}             // closed by Close to stop the file change monitor.
+}
+
+// fileSource is a file of the backend, with the content of its last read.
+type fileSource struct {
+	handle     *os.File
+	lastHash   []byte      // hash of the file inode at least check
+	parsedHash []byte      // hash of the file inode at last read
+	content    fileContent // content of the last read
+	readErr    error       // error of the last read
+	reads      int         // number of reads
+}
+
+// fileContent is the parsed content of a password file.
+type fileContent struct {
+	entries  []Entry
+	cost     int                 // the cost parameter, 0 if none.
+	comments map[string][]string // comment lines preceding an entry, by username.
+	roles    map[string][]string // roles of an entry, by username.
+	header   []string            // comment lines preceding the cost line.
+	trailer  []string            // comment lines following the last entry.
+}
+
+// NewFileBackend returns a new file based IO backend. The backend will also start
+// a file change monitor if the update parameter is >0. In this case the authservice
+// update function will be called if the file has changed.
+func NewFileBackend(filename string, perm os.FileMode, update time.Duration) (*FileBackend, error) {
+	return newFileBackend(filename, os.O_RDWR|os.O_CREATE, perm, update)
+}
+
+// NewROFileBackend returns a new Read-Only file based IO backend. The backend will also start
+// a file change monitor if the update parameter is >0. In this case the authservice
+// update function will be called if the file has changed.
+// Add, Modify and Delete of the authentication service succeed in memory, but are never
+// persisted: a write request fails with ErrReadOnly, so Sync returns it.
+func NewROFileBackend(filename string, perm os.FileMode, update time.Duration) (*FileBackend, error) {
+	return newFileBackend(filename, os.O_RDONLY, perm, update)
+}
+
+func newFileBackend(filename string, flag int, perm os.FileMode, update time.Duration) (*FileBackend, error) {
+	f, err := os.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fb := &FileBackend{
+		sources:  []*fileSource{{handle: f}},
+		readOnly: flag == os.O_RDONLY,
+		mutex:    new(sync.Mutex),
+		done:     make(chan struct{}),
+	}
+	if update > 0 {
+		go fb.updateCheck(update)
+	}
+	return fb, nil
+}
+
+// AddFile adds a file that is read in addition to the primary file. It is opened read-only,
+// and its entries are never written.
+func (filebackend *FileBackend) AddFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	filebackend.mutex.Lock()
+	defer filebackend.mutex.Unlock()
+	filebackend.sources = append(filebackend.sources, &fileSource{handle: f})
+	return nil
+}
+
+// UsernameIsValid checks if a username is valid. It may not be empty or blank, may not start
+// with "$" or "#", and may not contain a ":" or control characters such as line breaks, which
+// would break the line of the entry.
+func (filebackend *FileBackend) UsernameIsValid(username string) bool {
+	l := strings.TrimSpace(username)
+	if l == "" || l[0] == '$' || l[0] == '#' {
+		return false
+	}
+	if strings.Index(l, ":") != -1 || strings.IndexFunc(username, unicode.IsControl) != -1 {
+		return false
+	}
+	return true
+}
+
+// hashIsWritable checks if a password hash fits in the line of an entry: it may not contain a ":"
+// or control characters.
+func hashIsWritable(hash []byte) bool {
+	return bytes.IndexByte(hash, ':') == -1 && bytes.IndexFunc(hash, unicode.IsControl) == -1
+}
+
+// ReadOnly returns true if the backend never writes to the file.
+func (filebackend *FileBackend) ReadOnly() bool {
+	return filebackend.readOnly
+}
+
+// UserIsReadOnly returns true if the last load took username from an additional file or an
+// extra entry. Modifications of such a user are not written, and are lost with the next load;
+// callers should refuse them with ErrReadOnlyUser.
+func (filebackend *FileBackend) UserIsReadOnly(username string) bool {
+	filebackend.mutex.Lock()
+	defer filebackend.mutex.Unlock()
+	return filebackend.readOnlyOf[filebackend.username(username)]
+}
+
+// SetCostOverride makes the backend require cost instead of the cost of the primary file.
+// Since passwords are only rehashed to a higher cost, a cost below the cost of existing
+// hashes leaves them alone. The primary file keeps its own cost line when written.
+// A zero cost restores the cost of the file.
+func (filebackend *FileBackend) SetCostOverride(cost int) {
+	filebackend.mutex.Lock()
+	defer filebackend.mutex.Unlock()
+	filebackend.cost = cost
+}
+
+// SetExtraEntries sets entries that are loaded in addition to the entries of the file on every
+// read, replacing file entries of the same name. They are never written to the file.
+func (filebackend *FileBackend) SetExtraEntries(entries []Entry) {
+	filebackend.mutex.Lock()
+	defer filebackend.mutex.Unlock()
+	filebackend.extra = entries
+}
+
+// SetKeepLastGood makes the backend roll back a load that fails to read the file or that
+// yields no entries, so the previously loaded entries stay authoritative. By default
+// every load is committed.
+func (filebackend *FileBackend) SetKeepLastGood(keep bool) {
+	filebackend.mutex.Lock()
+	defer filebackend.mutex.Unlock()
+	filebackend.keepGood = keep
+}
+
+// SetLowercaseUsernames makes usernames case-insensitive: they are lowercased when the files are
+// read, together with the extra entries, so Alice and alice are the same user. Written files
+// have lowercase usernames. If several entries differ in case only, the last one is loaded.
+func (filebackend *FileBackend) SetLowercaseUsernames(lowercase bool) {
+	filebackend.mutex.Lock()
+	defer filebackend.mutex.Unlock()
+	filebackend.lowercase = lowercase
+	for _, src := range filebackend.sources {
+		src.reads = 0 // re-read with the new setting.
+	}
+}
+
+// username returns the username of an entry as loaded.
+func (filebackend *FileBackend) username(username string) string {
+	if filebackend.lowercase {
+		return strings.ToLower(username)
+	}
+	return username
+}
+
+// SetAllowInsecureHashes allows entries with the insecure $apr1$ (MD5) and {SHA} (SHA-1)
+// hashes of htpasswd files. They are skipped by default, with an error reported.
+func (filebackend *FileBackend) SetAllowInsecureHashes(allow bool) {
+	filebackend.mutex.Lock()
+	defer filebackend.mutex.Unlock()
+	filebackend.insecure = allow
+}
+
+// SetErrorHandler sets a function that is called with errors of background reads and writes.
+func (filebackend *FileBackend) SetErrorHandler(handler func(error)) {
+	filebackend.mutex.Lock()
+	defer filebackend.mutex.Unlock()
+	filebackend.onError = handler
+}
+
+// SetRolesHandler sets a function that is called with the roles of all entries, by username,
+// after every load that is committed. Entries without roles are not included.
+func (filebackend *FileBackend) SetRolesHandler(handler func(map[string][]string)) {
+	filebackend.mutex.Lock()
+	defer filebackend.mutex.Unlock()
+	filebackend.onRoles = handler
+}
+
+// SetLoadHandler sets a function that is called with the loaded entries after every load
+// that is committed, e.g. to drop state derived from entries that changed.
+func (filebackend *FileBackend) SetLoadHandler(handler func([]Entry)) {
+	filebackend.mutex.Lock()
+	defer filebackend.mutex.Unlock()
+	filebackend.onLoad = handler
+}
+
+// reportError passes err to the error handler, if any. The mutex must be held.
+func (filebackend *FileBackend) reportError(err error) {
+	if filebackend.onError != nil {
+		filebackend.onError(err)
+	}
+}
+
+// closed returns true if the backend has been closed.
+func (filebackend *FileBackend) closed() bool {
+	select {
+	case <-filebackend.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close the backend files and stop the file change monitor.
+func (filebackend *FileBackend) Close() {
+	filebackend.mutex.Lock()
+	defer filebackend.mutex.Unlock()
+	if !filebackend.closed() {
+		close(filebackend.done)
+	}
+	for _, src := range filebackend.sources {
+		if src.handle != nil {
+			src.handle.Close()
+			src.handle = nil
+		}
+	}
+}
+
+// updateCheck goroutine. The inner loop (timed) continues until the backend file handle is nil.
+func (filebackend *FileBackend) updateCheck(update time.Duration) {
+	t := time.NewTicker(update)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if !filebackend.updateCheckInner() {
+				return
+			}
+		case <-filebackend.done:
+			return
+		}
+	}
+}
+
+// updateCheckInner tests if the inode hash of any file has changed, if yes it triggers an update of the
+// authentication service. It returns false in case of error (like if the file handle has gone away) which
+// stops the update check loop.
+func (filebackend *FileBackend) updateCheckInner() bool {
+	filebackend.mutex.Lock()
+	defer filebackend.mutex.Unlock()
+	if filebackend.authservice == nil {
+		return true
+	}
+	changed := false
+	for _, src := range filebackend.sources {
+		if src.handle == nil {
+			return false
+		}
+		nhash, err := getChangeStamp(src.handle)
+		if err != nil {
+			return false
+		}
+		if !bytes.Equal(nhash, src.lastHash) {
+			src.lastHash = nhash
+			changed = true
+		}
+	}
+	if changed {
+		go filebackend.authservice.Update()
+	}
+	return true
+}
+
+// ChangeStamp returns a byteslice that changes when the file at path is modified or replaced, the
+// stamp the file backend detects changes of password files with.
+func ChangeStamp(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return getChangeStamp(f)
+}
+
+// RequestRead is called by the authentication service when it requests a read.
+func (filebackend *FileBackend) RequestRead(authservice IAuthenticationService) {
+	// Go through the lines, call cost/modify
+	filebackend.mutex.Lock()
+	defer filebackend.mutex.Unlock()
+	if filebackend.authservice == nil {
+		filebackend.authservice = authservice
+	}
+	for _, src := range filebackend.sources {
+		src.lastHash, _ = getChangeStamp(src.handle) // preempt the update timer.
+	}
+	go filebackend.readFile()
+}
+
+// Reload reopens the files by name and reads them at once, whether they appear changed or not,
+// loading them into the authentication service that requested the last read. Unlike the file
+// change monitor, which watches the open files, it picks up files replaced by a rename. The load
+// is done when Reload returns. A file that can't be reopened is read through its old handle, and
+// the first such error is returned.
+func (filebackend *FileBackend) Reload() error {
+	filebackend.mutex.Lock()
+	if filebackend.closed() {
+		filebackend.mutex.Unlock()
+		return os.ErrClosed
+	}
+	var reopenErr error
+	for i, src := range filebackend.sources {
+		var f *os.File
+		var err error
+		if i == 0 && !filebackend.readOnly {
+			f, err = os.OpenFile(src.handle.Name(), os.O_RDWR, 0)
+		} else {
+			f, err = os.Open(src.handle.Name())
+		}
+		if err != nil {
+			if reopenErr == nil {
+				reopenErr = err
+			}
+		} else {
+			src.handle.Close()
+			src.handle = f
+		}
+		src.parsedHash = nil // read even if the stamp is unchanged.
+		src.lastHash, _ = getChangeStamp(src.handle)
+	}
+	requested := filebackend.authservice != nil
+	filebackend.mutex.Unlock()
+	if requested {
+		filebackend.readFile()
+	}
+	return reopenErr
+}
+
+// readFile re-reads the files that have changed since their last read, and loads the merged
+// entries of all files.
+func (filebackend *FileBackend) readFile() {
+	filebackend.mutex.Lock()
+	defer filebackend.mutex.Unlock()
+	if filebackend.closed() {
+		return
+	}
+	var readErr error
+	var loaded int
+	for _, src := range filebackend.sources {
+		src.refresh(filebackend.lowercase)
+		if src.readErr != nil && readErr == nil {
+			readErr = fmt.Errorf("reading %s failed: %v", src.handle.Name(), src.readErr)
+		}
+		loaded += len(src.content.entries)
+	}
+	if filebackend.keepGood && (readErr != nil || loaded == 0) {
+		if readErr == nil {
+			readErr = ErrNoEntries
+		}
+		filebackend.reportError(fmt.Errorf("authfile: keeping last good entries, %v", readErr))
+		return
+	}
+	if readErr != nil {
+		filebackend.reportError(fmt.Errorf("authfile: %v", readErr))
+	}
+
+	roles := make(map[string][]string)
+	filebackend.authservice.StartLoad()
+	if filebackend.cost > 0 {
+		filebackend.authservice.SetCost(filebackend.cost)
+	} else if cost := filebackend.sources[0].content.cost; cost > 0 {
+		filebackend.authservice.SetCost(cost)
+	}
+	// abort ends a load that failed, e.g. for the load timeout, keeping the entries loaded before.
+	// The file change monitor tries again at its next check.
+	abort := func(err error) {
+		filebackend.authservice.Rollback()
+		if err != ErrServiceClosed {
+			filebackend.sources[0].lastHash = nil
+		}
+		filebackend.reportError(fmt.Errorf("authfile: load failed, keeping the last loaded entries: %v", err))
+	}
+	var rejected int
+	var insecure, invalid, duplicate []string
+	hashes := make(map[string][]byte)
+	fileOf := make(map[string]int) // index of the source of a user.
+	unloaded := make(map[string]bool)
+	for i, src := range filebackend.sources {
+		for _, e := range src.content.entries {
+			if !filebackend.UsernameIsValid(e.Username) {
+				invalid = append(invalid, strconv.Quote(e.Username))
+				unloaded[e.Username] = unloaded[e.Username] || i == 0
+				continue
+			}
+			if !filebackend.insecure && insecureHash(e.PasswordHash) {
+				insecure = append(insecure, e.Username)
+				unloaded[e.Username] = unloaded[e.Username] || i == 0
+				continue
+			}
+			if err := filebackend.authservice.Load(e.Username, e.PasswordHash); err == ErrTooManyUsers {
+				rejected++
+				unloaded[e.Username] = unloaded[e.Username] || i == 0
+				continue
+			} else if err != nil {
+				abort(err)
+				return
+			}
+			if j, ok := fileOf[e.Username]; ok && j != i {
+				duplicate = append(duplicate, strconv.Quote(e.Username))
+			}
+			fileOf[e.Username] = i
+			hashes[e.Username] = e.PasswordHash
+			delete(roles, e.Username)
+			if r := src.content.roles[e.Username]; len(r) > 0 {
+				roles[e.Username] = r
+			}
+		}
+	}
+	for _, e := range filebackend.extra {
+		username := filebackend.username(e.Username)
+		if !filebackend.UsernameIsValid(username) {
+			invalid = append(invalid, strconv.Quote(username))
+			continue
+		}
+		if err := filebackend.authservice.Load(username, e.PasswordHash); err == ErrTooManyUsers {
+			rejected++
+			continue
+		} else if err != nil {
+			abort(err)
+			return
+		}
+		hashes[username] = e.PasswordHash
+		fileOf[username] = -1
+	}
+	if err := filebackend.authservice.Commit(); err != nil {
+		abort(err)
+		return
+	}
+	filebackend.unloaded = unloaded
+	filebackend.readOnlyOf = make(map[string]bool)
+	for username, i := range fileOf {
+		if i != 0 {
+			filebackend.readOnlyOf[username] = true
+		}
+	}
+	if len(invalid) > 0 {
+		filebackend.reportError(fmt.Errorf("authfile: skipped entries with invalid usernames %s", strings.Join(invalid, ", ")))
+	}
+	if len(insecure) > 0 {
+		filebackend.reportError(fmt.Errorf("authfile: skipped users %s with insecure $apr1$ (MD5) or {SHA} hashes, "+
+			"rehash their passwords with bcrypt or allow insecure hashes", strings.Join(insecure, ", ")))
+	}
+	if len(duplicate) > 0 {
+		filebackend.reportError(&DuplicateUsersError{Users: duplicate})
+	}
+	if rejected > 0 {
+		filebackend.reportError(fmt.Errorf("authfile: %d entries rejected, exceeding the maximum number of users", rejected))
+	}
+	if filebackend.onRoles != nil {
+		filebackend.onRoles(copyRoles(roles))
+	}
+	if filebackend.onLoad != nil {
+		entries := make([]Entry, 0, len(hashes))
+		for username, hash := range hashes {
+			entries = append(entries, Entry{Username: username, PasswordHash: append([]byte(nil), hash...)})
+		}
+		filebackend.onLoad(entries)
+	}
+}
+
+// refresh reads the file if it has changed since the last read, lowercasing the usernames if
+// lowercase is set.
+func (src *fileSource) refresh(lowercase bool) {
+	stamp, err := getChangeStamp(src.handle)
+	if err == nil && src.reads > 0 && bytes.Equal(stamp, src.parsedHash) {
+		return
+	}
+	src.handle.Seek(0, 0) // Point to beginning of file
+	src.content, src.readErr = parseFile(src.handle)
+	if lowercase {
+		src.content.lowercaseUsernames()
+	}
+	src.parsedHash = stamp
+	src.reads++
+}
+
+// lowercaseUsernames lowercases the usernames of the entries, and the keys of their comments and
+// roles.
+func (content *fileContent) lowercaseUsernames() {
+	for i := range content.entries {
+		content.entries[i].Username = strings.ToLower(content.entries[i].Username)
+	}
+	for _, m := range []map[string][]string{content.comments, content.roles} {
+		for username, values := range m {
+			if lower := strings.ToLower(username); lower != username {
+				delete(m, username)
+				m[lower] = values
+			}
+		}
+	}
+}
+
+// parseFile parses a password file. On a read error, the content read so far is returned
+// with the error.
+func parseFile(rd io.Reader) (fileContent, error) {
+	var line, lineTrimmed string
+	var err error
+	var pending []string
+	content := fileContent{
+		comments: make(map[string][]string),
+		roles:    make(map[string][]string),
+	}
+	r := bufio.NewReader(rd)
+	for eof := false; !eof; {
+		line, err = r.ReadString('\n')
+		if err == io.EOF { // Process a last line without newline, then stop.
+			eof = true
+		} else if err != nil {
+			content.trailer = pending
+			return content, err
+		}
+		lineTrimmed = strings.TrimSpace(line)
+		if len(lineTrimmed) < 2 { // Ignore empty or single char lines.
+			continue
+		}
+		if lineTrimmed[0] == '#' { // Keep comments for the next entry.
+			pending = append(pending, lineTrimmed)
+			continue
+		}
+		if lineTrimmed[0] == '$' { // Set cost, a cost line is never an entry.
+			content.header = append(content.header, pending...)
+			pending = nil
+			if cost, err := strconv.Atoi(lineTrimmed[1:]); err == nil { // We ignore lines with bad cost parameter.
+				content.cost = cost
+			}
+			continue
+		}
+		fields := strings.Split(lineTrimmed, ":")
+		if len(fields) != 2 && len(fields) != 3 { // Skip lines that have the wrong format
+			continue
+		}
+		if len(pending) > 0 {
+			content.comments[fields[0]] = pending
+			pending = nil
+		}
+		if len(fields) == 3 {
+			if r := parseRoles(fields[2]); len(r) > 0 {
+				content.roles[fields[0]] = r
+			}
+		}
+		content.entries = append(content.entries, Entry{Username: fields[0], PasswordHash: []byte(fields[1])})
+	}
+	content.trailer = pending
+	return content, nil
+}
+
+// parseRoles splits a comma separated list of roles, dropping empty ones.
+func parseRoles(field string) []string {
+	var roles []string
+	for _, role := range strings.Split(field, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func copyRoles(roles map[string][]string) map[string][]string {
+	c := make(map[string][]string, len(roles))
+	for username, r := range roles {
+		c[username] = append([]string(nil), r...)
+	}
+	return c
+}
+
+// RequestWrite is called by the authentication service when it requests a write. It returns
+// once the primary file is written, with the error of the write, if any.
+func (filebackend *FileBackend) RequestWrite(authservice IAuthenticationService) error {
+	// Request list, format and write
+	filebackend.mutex.Lock()
+	if filebackend.authservice == nil {
+		filebackend.authservice = authservice
+	}
+	filebackend.mutex.Unlock()
+	return filebackend.writeFile()
+}
+
+// wrapWriter wraps the writer of the temporary file, to inject write errors in tests.
+var wrapWriter = func(w io.Writer) io.Writer { return w }
+
+// writeFile writes the entries to the primary file, except for users loaded from extra entries
+// and additional files, whose entries in the primary file, if any, are kept as they are. The entries are written to a temporary file in the same directory, which
+// then replaces the primary file by a rename, so the file is never left half-written. On an
+// error the primary file is untouched. Entries with an invalid username or a hash that doesn't fit
+// in a line are left out and reported, so they can't inject lines into the file.
+func (filebackend *FileBackend) writeFile() error {
+	filebackend.mutex.Lock()
+	defer filebackend.mutex.Unlock()
+	if filebackend.readOnly {
+		return ErrReadOnly
+	}
+	if filebackend.closed() {
+		return os.ErrClosed
+	}
+	primary := filebackend.sources[0]
+	filename := primary.handle.Name()
+	stat, err := primary.handle.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err := tmp.Chmod(stat.Mode().Perm()); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(wrapWriter(tmp))
+	writeComments(w, primary.content.header)
+	switch {
+	case filebackend.htpasswd: // htpasswd files have no cost line.
+	case filebackend.cost == 0:
+		w.WriteString("$" + strconv.Itoa(filebackend.authservice.GetCost()) + "\n") // Save cost parameter.
+	case primary.content.cost > 0:
+		w.WriteString("$" + strconv.Itoa(primary.content.cost) + "\n") // Keep the cost of the file.
+	}
+	// Users loaded from additional files or extra entries are not written.
+	var entries []Entry
+	listed := make(map[string]bool)
+	for _, e := range filebackend.authservice.List() {
+		listed[e.Username] = true
+		if !filebackend.readOnlyOf[e.Username] {
+			entries = append(entries, e)
+		}
+	}
+	// Entries not loaded, or replaced by the entries of other files, are kept in the file as
+	// they are.
+	kept := make(map[string]bool)
+	for _, e := range primary.content.entries {
+		if !listed[e.Username] && filebackend.unloaded[e.Username] || filebackend.readOnlyOf[e.Username] && !kept[e.Username] {
+			listed[e.Username] = true
+			kept[e.Username] = true
+			entries = append(entries, e)
+		}
+	}
+	var invalid []string
+	for _, e := range entries {
+		if !kept[e.Username] && (!filebackend.UsernameIsValid(e.Username) || !hashIsWritable(e.PasswordHash)) {
+			invalid = append(invalid, strconv.Quote(e.Username))
+			continue
+		}
+		writeComments(w, primary.content.comments[e.Username])
+		line := e.Username + ":" + string(e.PasswordHash)
+		if roles := primary.content.roles[e.Username]; len(roles) > 0 && !filebackend.htpasswd {
+			line += ":" + strings.Join(roles, ",")
+		}
+		w.WriteString(line + "\n")
+	}
+	writeComments(w, primary.content.trailer)
+	if err := w.Flush(); err != nil { // A failed write fails all following writes and the flush.
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	committed = true
+
+	// The handle refers to the replaced file, open the new one.
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	primary.handle.Close()
+	primary.handle = f
+	primary.lastHash, _ = getChangeStamp(f) // preempt the update timer.
+	if len(invalid) > 0 {
+		filebackend.reportError(fmt.Errorf("authfile: did not write entries with invalid usernames or hashes %s", strings.Join(invalid, ", ")))
+	}
+	return nil
+}
+
+func writeComments(w *bufio.Writer, comments []string) {
+	for _, c := range comments {
+		w.WriteString(c + "\n")
+	}
+}
@@ -0,0 +1,871 @@
+package authfile
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// waitFor polls cond until it returns true or the timeout expires.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func tempPasswordFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "authfile")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	filename := filepath.Join(dir, "passwd")
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	return filename
+}
+
+func Test_CommentsRoundTrip(t *testing.T) {
+	const hash = "$2y$04$lcPirp7mnYIYBROnwnMvSu8hw2FBWKeHfFX63NtJ2ISoAK7s8PHNm"
+	filename := tempPasswordFile(t, "# password file\n"+
+		"$4\n"+
+		"# created 2023, owner teamX\n"+
+		"alice:"+hash+"\n"+
+		"# service account\n"+
+		"# rotate yearly\n"+
+		"bob:"+hash+"\n"+
+		"cathy:"+hash+"\n"+
+		"# end of file\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	fb, err := NewFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewFileBackend: %s", err)
+	}
+	defer fb.Close()
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 3 }) {
+		t.Fatalf("file not loaded")
+	}
+	if err := authProvider.Delete("cathy"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if err := authProvider.Add("dave", "davePass"); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	authProvider.Sync()
+
+	var written string
+	if !waitFor(time.Second, func() bool {
+		data, _ := ioutil.ReadFile(filename)
+		written = string(data)
+		return strings.Contains(written, "dave:")
+	}) {
+		t.Fatalf("file not written: %q", written)
+	}
+	for _, expect := range []string{
+		"# password file\n$4\n",
+		"# created 2023, owner teamX\nalice:" + hash + "\n",
+		"# service account\n# rotate yearly\nbob:" + hash + "\n",
+	} {
+		if !strings.Contains(written, expect) {
+			t.Errorf("comment block %q lost in:\n%s", expect, written)
+		}
+	}
+	if !strings.HasSuffix(written, "# end of file\n") {
+		t.Errorf("trailing comment lost in:\n%s", written)
+	}
+	if strings.Contains(written, "cathy") {
+		t.Errorf("deleted entry written:\n%s", written)
+	}
+}
+
+func Test_KeepLastGood(t *testing.T) {
+	const hash = "$2y$04$lcPirp7mnYIYBROnwnMvSu8hw2FBWKeHfFX63NtJ2ISoAK7s8PHNm"
+	for _, keep := range []bool{true, false} {
+		filename := tempPasswordFile(t, "$4\nalice:"+hash+"\nbob:"+hash)
+		defer os.RemoveAll(filepath.Dir(filename))
+
+		fb, err := NewROFileBackend(filename, 0600, 0)
+		if err != nil {
+			t.Fatalf("NewROFileBackend: %s", err)
+		}
+		defer fb.Close()
+		reported := make(chan error, 1)
+		fb.SetKeepLastGood(keep)
+		fb.SetErrorHandler(func(err error) { reported <- err })
+		authProvider := NewInMemoryService(fb, time.Second)
+		authProvider.Update()
+		if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 2 }) {
+			t.Fatalf("file not loaded: %v", authProvider.List())
+		}
+
+		if err := ioutil.WriteFile(filename, []byte("# emptied by accident\n"), 0600); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		authProvider.Update()
+		if keep {
+			select {
+			case err := <-reported:
+				if !strings.Contains(err.Error(), ErrNoEntries.Error()) {
+					t.Errorf("unexpected error: %s", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("failed reload not reported")
+			}
+			if len(authProvider.List()) != 2 {
+				t.Errorf("last good entries not kept: %v", authProvider.List())
+			}
+		} else if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 0 }) {
+			t.Errorf("empty file not applied: %v", authProvider.List())
+		}
+	}
+}
+
+func Test_Roles(t *testing.T) {
+	const hash = "$2y$04$lcPirp7mnYIYBROnwnMvSu8hw2FBWKeHfFX63NtJ2ISoAK7s8PHNm"
+	filename := tempPasswordFile(t, "$4\n"+
+		"alice:"+hash+":admin, editor\n"+
+		"bob:"+hash+"\n"+
+		"cathy:"+hash+":\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	fb, err := NewFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewFileBackend: %s", err)
+	}
+	defer fb.Close()
+	reported := make(chan map[string][]string, 2)
+	fb.SetRolesHandler(func(roles map[string][]string) { reported <- roles })
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.Update()
+	select {
+	case roles := <-reported:
+		if len(roles) != 1 || strings.Join(roles["alice"], ",") != "admin,editor" {
+			t.Errorf("unexpected roles: %v", roles)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("roles not reported")
+	}
+	if len(authProvider.List()) != 3 {
+		t.Errorf("entries with and without roles not loaded: %v", authProvider.List())
+	}
+
+	authProvider.Sync()
+	var written string
+	if !waitFor(time.Second, func() bool {
+		data, _ := ioutil.ReadFile(filename)
+		written = string(data)
+		return strings.Contains(written, "alice:"+hash+":admin,editor\n")
+	}) {
+		t.Errorf("roles not written:\n%s", written)
+	}
+	if !strings.Contains(written, "bob:"+hash+"\n") || !strings.Contains(written, "cathy:"+hash+"\n") {
+		t.Errorf("entries without roles not written as two fields:\n%s", written)
+	}
+}
+
+func Test_LowercaseUsernames(t *testing.T) {
+	generated, err := bcrypt.GenerateFromPassword([]byte("123"), 4)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	hash := string(generated)
+	filename := tempPasswordFile(t, "$4\n"+
+		"# Alice's account\n"+
+		"Alice:"+hash+":Admin\n"+
+		"BOB:"+hash+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	fb, err := NewFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewFileBackend: %s", err)
+	}
+	defer fb.Close()
+	fb.SetLowercaseUsernames(true)
+	fb.SetExtraEntries([]Entry{{Username: "Cathy", PasswordHash: []byte(hash)}})
+	reported := make(chan map[string][]string, 2)
+	fb.SetRolesHandler(func(roles map[string][]string) { reported <- roles })
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.Update()
+	select {
+	case roles := <-reported:
+		if len(roles) != 1 || strings.Join(roles["alice"], ",") != "Admin" {
+			t.Errorf("unexpected roles: %v", roles)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("roles not reported")
+	}
+	for _, user := range []string{"alice", "bob", "cathy"} {
+		if err := authProvider.Authenticate(user, "123"); err != nil {
+			t.Errorf("Authenticate %s: %s", user, err)
+		}
+	}
+
+	if err := authProvider.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	written := string(data)
+	if !strings.Contains(written, "# Alice's account\nalice:"+hash+":Admin\n") || !strings.Contains(written, "\nbob:"+hash+"\n") {
+		t.Errorf("entries not written lowercase with comments and roles:\n%s", written)
+	}
+	if strings.Contains(written, "cathy") {
+		t.Errorf("extra entry written:\n%s", written)
+	}
+}
+
+func Test_ReloadChangedFileOnly(t *testing.T) {
+	const hash = "$2y$04$lcPirp7mnYIYBROnwnMvSu8hw2FBWKeHfFX63NtJ2ISoAK7s8PHNm"
+	primary := tempPasswordFile(t, "$4\nalice:"+hash+"\n")
+	defer os.RemoveAll(filepath.Dir(primary))
+	teamA := tempPasswordFile(t, "bob:"+hash+"\n")
+	defer os.RemoveAll(filepath.Dir(teamA))
+	teamB := tempPasswordFile(t, "cathy:"+hash+"\n")
+	defer os.RemoveAll(filepath.Dir(teamB))
+
+	fb, err := NewROFileBackend(primary, 0600, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewROFileBackend: %s", err)
+	}
+	defer fb.Close()
+	for _, filename := range []string{teamA, teamB} {
+		if err := fb.AddFile(filename); err != nil {
+			t.Fatalf("AddFile: %s", err)
+		}
+	}
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 3 }) {
+		t.Fatalf("files not loaded: %v", authProvider.List())
+	}
+
+	time.Sleep(10 * time.Millisecond) // make sure the modification time changes
+	if err := ioutil.WriteFile(teamB, []byte("cathy:"+hash+"\ndave:"+hash+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 4 }) {
+		t.Fatalf("changed file not reloaded: %v", authProvider.List())
+	}
+
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	for i, reads := range []int{1, 1} {
+		if fb.sources[i].reads != reads {
+			t.Errorf("file %d read %d times, supposed to be %d", i, fb.sources[i].reads, reads)
+		}
+	}
+	// The watcher may also catch the truncated file in the middle of the write.
+	if reads := fb.sources[2].reads; reads < 2 {
+		t.Errorf("changed file read %d times, supposed to be at least 2", reads)
+	}
+}
+
+func Test_DuplicateUsers(t *testing.T) {
+	hash := func(password string) string {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("GenerateFromPassword: %s", err)
+		}
+		return string(hash)
+	}
+	primary := tempPasswordFile(t, "$4\nalice:"+hash("first")+"\nbob:"+hash("123")+"\n")
+	defer os.RemoveAll(filepath.Dir(primary))
+	team := tempPasswordFile(t, "alice:"+hash("last")+"\ncathy:"+hash("123")+"\n")
+	defer os.RemoveAll(filepath.Dir(team))
+
+	fb, err := NewROFileBackend(primary, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewROFileBackend: %s", err)
+	}
+	defer fb.Close()
+	if err := fb.AddFile(team); err != nil {
+		t.Fatalf("AddFile: %s", err)
+	}
+	errs := make(chan error, 10)
+	fb.SetErrorHandler(func(err error) { errs <- err })
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 3 }) {
+		t.Fatalf("files not loaded: %v", authProvider.List())
+	}
+	if err := authProvider.Authenticate("alice", "last"); err != nil {
+		t.Errorf("entry of the last file: %s", err)
+	}
+	if err := authProvider.Authenticate("alice", "first"); err == nil {
+		t.Errorf("entry of the first file authenticates")
+	}
+	select {
+	case err := <-errs:
+		if dup, ok := err.(*DuplicateUsersError); !ok || len(dup.Users) != 1 || dup.Users[0] != `"alice"` {
+			t.Errorf("reported %v, supposed to be the duplicate alice", err)
+		}
+	default:
+		t.Errorf("duplicate user not reported")
+	}
+}
+
+func Test_MixedCostRoundTrip(t *testing.T) {
+	hash := func(cost int) string {
+		hash, err := bcrypt.GenerateFromPassword([]byte("123"), cost)
+		if err != nil {
+			t.Fatalf("GenerateFromPassword: %s", err)
+		}
+		return string(hash)
+	}
+	filename := tempPasswordFile(t, "$5\nalice:"+hash(6)+"\nbob:"+hash(4)+"\ncathy:"+hash(5)+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+	fb, err := NewFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewFileBackend: %s", err)
+	}
+	defer fb.Close()
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 3 }) {
+		t.Fatalf("file not loaded")
+	}
+	costs := func() map[string]int {
+		costs := make(map[string]int)
+		for _, e := range authProvider.List() {
+			costs[e.Username] = e.Cost()
+		}
+		return costs
+	}
+	if c := costs(); c["alice"] != 6 || c["bob"] != 4 || c["cathy"] != 5 {
+		t.Errorf("loaded costs %v", c)
+	}
+
+	// Authentication upgrades bob to the cost of the file, and keeps the higher cost of alice.
+	for _, user := range []string{"alice", "bob"} {
+		if err := authProvider.Authenticate(user, "123"); err != nil {
+			t.Fatalf("Authenticate %s: %s", user, err)
+		}
+	}
+	if !waitFor(time.Second, func() bool { return costs()["bob"] == 5 }) {
+		t.Fatalf("bob not rehashed: %v", costs())
+	}
+	if err := authProvider.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	content, err := parseFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("parseFile: %s", err)
+	}
+	if content.cost != 5 {
+		t.Errorf("cost line %d, supposed to be 5", content.cost)
+	}
+	for _, e := range content.entries {
+		if want := map[string]int{"alice": 6, "bob": 5, "cathy": 5}[e.Username]; e.Cost() != want {
+			t.Errorf("%s written with cost %d, supposed to be %d", e.Username, e.Cost(), want)
+		}
+	}
+	if cost := (Entry{PasswordHash: []byte("$argon2id$v=19$m=65536,t=1,p=4$c2FsdA$aGFzaA")}).Cost(); cost != 0 {
+		t.Errorf("cost %d of an argon2id hash, supposed to be 0", cost)
+	}
+}
+
+func Test_CostOverride(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	filename := tempPasswordFile(t, "$10\nalice:"+string(hash)+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	fb, err := NewFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewFileBackend: %s", err)
+	}
+	defer fb.Close()
+	fb.SetCostOverride(bcrypt.MinCost)
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 1 }) {
+		t.Fatalf("file not loaded")
+	}
+	if cost := authProvider.GetCost(); cost != bcrypt.MinCost {
+		t.Errorf("cost %d, supposed to be %d", cost, bcrypt.MinCost)
+	}
+	if err := authProvider.Authenticate("alice", "123"); err != nil {
+		t.Fatalf("Authenticate: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond) // a rehash happens after authentication returns
+	if entries := authProvider.List(); string(entries[0].PasswordHash) != string(hash) {
+		t.Errorf("hash was rehashed to the cost of the file")
+	}
+
+	authProvider.Sync()
+	var written string
+	if !waitFor(time.Second, func() bool {
+		data, _ := ioutil.ReadFile(filename)
+		written = string(data)
+		return strings.HasPrefix(written, "$10\n")
+	}) {
+		t.Errorf("cost of the file not kept:\n%s", written)
+	}
+}
+
+func Test_ChangeWithinModTimeGranularity(t *testing.T) {
+	const hash = "$2y$04$lcPirp7mnYIYBROnwnMvSu8hw2FBWKeHfFX63NtJ2ISoAK7s8PHNm"
+	filename := tempPasswordFile(t, "alice:"+hash+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+	stat, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+	modTime := stat.ModTime()
+
+	fb, err := NewROFileBackend(filename, 0600, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewROFileBackend: %s", err)
+	}
+	defer fb.Close()
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 1 }) {
+		t.Fatalf("file not loaded: %v", authProvider.List())
+	}
+
+	// Both edits keep the mod-time of the first write, as if they happened
+	// within one tick of a coarse file system clock.
+	for i, content := range []string{
+		"alice:" + hash + "\nbob:" + hash + "\n",
+		"alice:" + hash + "\nbob:" + hash + "\ncathy:" + hash + "\n",
+	} {
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatalf("Chtimes: %s", err)
+		}
+		if !waitFor(time.Second, func() bool { return len(authProvider.List()) == i+2 }) {
+			t.Fatalf("edit %d not noticed: %v", i+1, authProvider.List())
+		}
+	}
+}
+
+// failingWriter fails once more than n bytes are written.
+type failingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > fw.n {
+		return 0, errors.New("disk full")
+	}
+	fw.n -= len(p)
+	return fw.w.Write(p)
+}
+
+func Test_AtomicWrite(t *testing.T) {
+	const hash = "$2y$04$lcPirp7mnYIYBROnwnMvSu8hw2FBWKeHfFX63NtJ2ISoAK7s8PHNm"
+	original := "$4\nalice:" + hash + "\nbob:" + hash + "\n"
+	filename := tempPasswordFile(t, original)
+	defer os.RemoveAll(filepath.Dir(filename))
+	if err := os.Chmod(filename, 0640); err != nil {
+		t.Fatalf("Chmod: %s", err)
+	}
+
+	fb, err := NewFileBackend(filename, 0600, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewFileBackend: %s", err)
+	}
+	defer fb.Close()
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 2 }) {
+		t.Fatalf("file not loaded")
+	}
+	if err := authProvider.Add("cathy", "cathyPass"); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+
+	wrapWriter = func(w io.Writer) io.Writer { return &failingWriter{w: w, n: 10} }
+	err = authProvider.Sync()
+	wrapWriter = func(w io.Writer) io.Writer { return w }
+	if err == nil {
+		t.Fatalf("failed write not reported")
+	}
+	if data, _ := ioutil.ReadFile(filename); string(data) != original {
+		t.Errorf("file changed by a failed write:\n%s", data)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Dir(filename)); len(files) != 1 {
+		t.Errorf("temporary file left behind: %d files", len(files))
+	}
+
+	if err := authProvider.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	data, _ := ioutil.ReadFile(filename)
+	if !strings.Contains(string(data), "cathy:") {
+		t.Errorf("file not written:\n%s", data)
+	}
+	if stat, err := os.Stat(filename); err != nil || stat.Mode().Perm() != 0640 {
+		t.Errorf("file mode not kept: %v %v", stat.Mode(), err)
+	}
+
+	// The backend follows the replaced file.
+	time.Sleep(10 * time.Millisecond) // make sure the modification time changes
+	if err := ioutil.WriteFile(filename, []byte(original), 0640); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 2 }) {
+		t.Errorf("replaced file not reloaded: %v", authProvider.List())
+	}
+}
+
+func Test_UsernameIsValid(t *testing.T) {
+	var fb FileBackend
+	for _, test := range []struct {
+		username string
+		valid    bool
+	}{
+		{"", false},
+		{"   ", false},
+		{"$foo", false},
+		{"#foo", false},
+		{"a:b", false},
+		{"alice\nbob", false},
+		{"alice\r", false},
+		{"a\tb", false},
+		{"alice", true},
+	} {
+		if valid := fb.UsernameIsValid(test.username); valid != test.valid {
+			t.Errorf("%q: %v, supposed to be %v", test.username, valid, test.valid)
+		}
+	}
+}
+
+func Test_AdversarialLines(t *testing.T) {
+	const hash = "$2y$04$lcPirp7mnYIYBROnwnMvSu8hw2FBWKeHfFX63NtJ2ISoAK7s8PHNm"
+	content, err := parseFile(strings.NewReader("$10:extra\n" +
+		"$:" + hash + "\n" +
+		"$5:" + hash + ":admin\n" +
+		"$6\n" +
+		"#bob:" + hash + "\n" +
+		"alice:" + hash + "\n"))
+	if err != nil {
+		t.Fatalf("parseFile: %s", err)
+	}
+	if len(content.entries) != 1 || content.entries[0].Username != "alice" {
+		t.Errorf("cost lines parsed as entries: %v", content.entries)
+	}
+	if content.cost != 6 {
+		t.Errorf("cost %d, supposed to be 6", content.cost)
+	}
+
+	filename := tempPasswordFile(t, "$4\n"+
+		":"+hash+"\n"+
+		"  :"+hash+"\n"+
+		"alice:"+hash+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+	fb, err := NewROFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewROFileBackend: %s", err)
+	}
+	defer fb.Close()
+	var reported []error
+	fb.SetErrorHandler(func(err error) { reported = append(reported, err) })
+	fb.SetExtraEntries([]Entry{{Username: "$bob", PasswordHash: []byte(hash)}})
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) > 0 }) {
+		t.Fatalf("file not loaded")
+	}
+	if entries := authProvider.List(); len(entries) != 1 || entries[0].Username != "alice" {
+		t.Errorf("invalid usernames loaded: %v", entries)
+	}
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	if len(reported) != 1 || !strings.Contains(reported[0].Error(), `invalid usernames "", "", "$bob"`) {
+		t.Errorf("unexpected errors %v", reported)
+	}
+}
+
+func Test_ReadOnlySync(t *testing.T) {
+	const hash = "$2y$04$lcPirp7mnYIYBROnwnMvSu8hw2FBWKeHfFX63NtJ2ISoAK7s8PHNm"
+	original := "$4\nalice:" + hash + "\n"
+	filename := tempPasswordFile(t, original)
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	fb, err := NewROFileBackend(filename, 0600, 0)
+	if err != nil {
+		t.Fatalf("NewROFileBackend: %s", err)
+	}
+	defer fb.Close()
+	authProvider := NewInMemoryService(fb, time.Second)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 1 }) {
+		t.Fatalf("file not loaded")
+	}
+	if err := authProvider.Add("bob", "bobPass"); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	if err := authProvider.Authenticate("bob", "bobPass"); err != nil {
+		t.Errorf("entry added in memory not usable: %s", err)
+	}
+	if err := authProvider.Sync(); err != ErrReadOnly {
+		t.Errorf("Sync: %v, supposed to be %v", err, ErrReadOnly)
+	}
+	if data, _ := ioutil.ReadFile(filename); string(data) != original {
+		t.Errorf("read-only file changed:\n%s", data)
+	}
+}
+
+func Test_Reload(t *testing.T) {
+	const hash = "$2y$06$lcPirp7mnYIYBROnwnMvSu8hw2FBWKeHfFX63NtJ2ISoAK7s8PHNm" // 123
+	filename := tempPasswordFile(t, "$6\nalice:"+hash+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	fb, err := NewROFileBackend(filename, 0600, time.Hour)
+	if err != nil {
+		t.Fatalf("NewROFileBackend: %s", err)
+	}
+	defer fb.Close()
+	authProvider := NewInMemoryService(fb, time.Second)
+	defer authProvider.Kill()
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return authProvider.Authenticate("alice", "123") == nil }) {
+		t.Fatalf("password file not loaded")
+	}
+
+	// Replace the file by a rename, which the open file never shows.
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte("$6\nalice:"+hash+"\nbob:"+hash+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+	if err := fb.Reload(); err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+	if err := authProvider.Authenticate("bob", "123"); err != nil {
+		t.Errorf("new user not authenticated after the reload: %s", err)
+	}
+
+	fb.Close()
+	if err := fb.Reload(); err != os.ErrClosed {
+		t.Errorf("Reload of a closed backend: %v, supposed to be %v", err, os.ErrClosed)
+	}
+}
+
+func Test_WriteInvalidEntries(t *testing.T) {
+	const hash = "$2y$04$lcPirp7mnYIYBROnwnMvSu8hw2FBWKeHfFX63NtJ2ISoAK7s8PHNm"
+	filename := tempPasswordFile(t, "$4\nalice:"+hash+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+	fb, err := NewFileBackend(filename, 0600, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileBackend: %s", err)
+	}
+	defer fb.Close()
+	reported := make(chan error, 1)
+	fb.SetErrorHandler(func(err error) { reported <- err })
+	authProvider := NewInMemoryService(fb, time.Second)
+	defer authProvider.Kill()
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return authProvider.Exists("alice") }) {
+		t.Fatalf("password file not loaded")
+	}
+
+	// Entries of a service that doesn't validate, crafted to forge a root entry.
+	if err := authProvider.ReplaceAll([]Entry{
+		{Username: "alice", PasswordHash: []byte(hash)},
+		{Username: "mallory\nroot", PasswordHash: []byte(hash)},
+		{Username: "eve", PasswordHash: []byte(hash + "\nroot:" + hash)},
+		{Username: "trudy", PasswordHash: []byte(hash + ":admin")},
+	}); err != nil {
+		t.Fatalf("ReplaceAll: %s", err)
+	}
+	if err := authProvider.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	select {
+	case err := <-reported:
+		for _, user := range []string{`"mallory\nroot"`, `"eve"`, `"trudy"`} {
+			if !strings.Contains(err.Error(), user) {
+				t.Errorf("%s not reported: %s", user, err)
+			}
+		}
+	default:
+		t.Errorf("invalid entries not reported")
+	}
+
+	written, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	if string(written) != "$4\nalice:"+hash+"\n" {
+		t.Errorf("unexpected file content:\n%s", written)
+	}
+}
+
+func Test_WriteUnloadedEntries(t *testing.T) {
+	const hash = "$2y$04$lcPirp7mnYIYBROnwnMvSu8hw2FBWKeHfFX63NtJ2ISoAK7s8PHNm"
+	filename := tempPasswordFile(t, "$4\nalice:"+hash+"\nbob:"+hash+"\n# cathy\ncathy:"+hash+":admin\nbad\tname:"+hash+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+	fb, err := NewFileBackend(filename, 0600, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileBackend: %s", err)
+	}
+	defer fb.Close()
+	fb.SetErrorHandler(func(error) {})
+	authProvider := NewInMemoryService(fb, time.Second)
+	defer authProvider.Kill()
+	authProvider.SetMaxUsers(2)
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 2 }) {
+		t.Fatalf("password file not loaded")
+	}
+
+	// cathy exceeds the maximum number of users and "bad\tname" is invalid,
+	// neither is loaded, but both stay in the file.
+	if err := authProvider.Delete("bob"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if err := authProvider.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	written, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	if want := "$4\nalice:" + hash + "\n# cathy\ncathy:" + hash + ":admin\nbad\tname:" + hash + "\n"; string(written) != want {
+		t.Errorf("unexpected file content:\n%s\nsupposed to be:\n%s", written, want)
+	}
+}
+
+func Test_WriteReadOnlyUsers(t *testing.T) {
+	hash := func(password string) string {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("GenerateFromPassword: %s", err)
+		}
+		return string(hash)
+	}
+	content := "$4\nalice:" + hash("first") + "\nbob:" + hash("123") + "\n"
+	primary := tempPasswordFile(t, content)
+	defer os.RemoveAll(filepath.Dir(primary))
+	team := tempPasswordFile(t, "alice:"+hash("last")+"\ncathy:"+hash("123")+"\n")
+	defer os.RemoveAll(filepath.Dir(team))
+
+	fb, err := NewFileBackend(primary, 0600, time.Hour)
+	if err != nil {
+		t.Fatalf("NewFileBackend: %s", err)
+	}
+	defer fb.Close()
+	if err := fb.AddFile(team); err != nil {
+		t.Fatalf("AddFile: %s", err)
+	}
+	fb.SetExtraEntries([]Entry{{Username: "dave", PasswordHash: []byte(hash("123"))}})
+	fb.SetErrorHandler(func(error) {})
+	authProvider := NewInMemoryService(fb, time.Second)
+	defer authProvider.Kill()
+	authProvider.Update()
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == 4 }) {
+		t.Fatalf("files not loaded: %v", authProvider.List())
+	}
+	for user, readOnly := range map[string]bool{"alice": true, "bob": false, "cathy": true, "dave": true, "nobody": false} {
+		if fb.UserIsReadOnly(user) != readOnly {
+			t.Errorf("UserIsReadOnly(%s): %t, supposed to be %t", user, !readOnly, readOnly)
+		}
+	}
+
+	// The entry of alice replaced by the additional file stays in the primary file.
+	if err := authProvider.Sync(); err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	written, err := ioutil.ReadFile(primary)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	lines := strings.Split(string(written), "\n")
+	sort.Strings(lines)
+	want := strings.Split(content, "\n")
+	sort.Strings(want)
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected file content:\n%s\nsupposed to be:\n%s", written, content)
+	}
+}
+
+// rolledBackService rolls back the load transaction before the Load of user, or before the
+// Commit if user is empty, like the load timeout.
+type rolledBackService struct {
+	*InMemoryService
+	user string
+}
+
+func (s rolledBackService) Load(username string, passwordHash []byte) error {
+	if username == s.user {
+		s.Rollback()
+	}
+	return s.InMemoryService.Load(username, passwordHash)
+}
+
+func (s rolledBackService) Commit() error {
+	if s.user == "" {
+		s.Rollback()
+	}
+	return s.InMemoryService.Commit()
+}
+
+func Test_FailedLoad(t *testing.T) {
+	const hash = "$2y$04$lcPirp7mnYIYBROnwnMvSu8hw2FBWKeHfFX63NtJ2ISoAK7s8PHNm"
+	filename := tempPasswordFile(t, "$4\nalice:"+hash+"\nbob:"+hash+":admin\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+	for _, user := range []string{"bob", ""} {
+		fb, err := NewROFileBackend(filename, 0600, 0)
+		if err != nil {
+			t.Fatalf("NewROFileBackend: %s", err)
+		}
+		errs := make(chan error, 1)
+		fb.SetErrorHandler(func(err error) { errs <- err })
+		var published bool
+		fb.SetRolesHandler(func(map[string][]string) { published = true })
+		fb.SetLoadHandler(func([]Entry) { published = true })
+		service := NewInMemoryService(nil, time.Second)
+		fb.RequestRead(rolledBackService{InMemoryService: service, user: user})
+		select {
+		case err := <-errs:
+			if !strings.Contains(err.Error(), ErrNoTransaction.Error()) {
+				t.Errorf("rolled back before %q: unexpected error %s", user, err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("rolled back before %q: failed load not reported", user)
+		}
+		fb.mutex.Lock() // The read is done.
+		if published || fb.readOnlyOf != nil {
+			t.Errorf("rolled back before %q: load published", user)
+		}
+		fb.mutex.Unlock()
+		if entries := service.List(); len(entries) != 0 {
+			t.Errorf("rolled back before %q: entries %v loaded", user, entries)
+		}
+		service.Kill()
+		fb.Close()
+	}
+}
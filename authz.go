@@ -1,16 +1,27 @@
 package authz
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/casbin/casbin"
-	"github.com/dafanasiev/authfile"
+	"github.com/casbin/casbin/util"
+	"github.com/dafanasiev/caddy-authz/v2/authfile"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func init() {
@@ -20,14 +31,326 @@ func init() {
 
 type Authorizer struct {
 	AuthConfig struct {
-		ModelPath  string
-		PolicyPath string
-		Realm         string
-		PasswordFile string
-	}
+		ModelPath    string `json:"model_path,omitempty"`
+		PolicyPath   string `json:"policy_path,omitempty"`
+		Realm        string `json:"realm,omitempty"`
+		PasswordFile string `json:"password_file,omitempty"`
+		// PasswordFiles are further password files merged with
+		// PasswordFile. They are read-only, only PasswordFile is written.
+		// A user in several files takes the entry of the last file.
+		PasswordFiles []string `json:"password_files,omitempty"`
+		// ModelText is the model given inline instead of ModelPath.
+		ModelText string `json:"model_text,omitempty"`
+		// PolicyText is the policy given inline instead of PolicyPath, in
+		// the format of policy files.
+		PolicyText string `json:"policy_text,omitempty"`
+
+		// ActionSource names where a custom action verb is taken from,
+		// either "header:<name>" or "query:<name>". If empty, the action
+		// is the HTTP method only.
+		ActionSource string `json:"action_source,omitempty"`
+		// ActionTemplate formats the action from {method} and {verb}.
+		// Defaults to DefaultActionTemplate.
+		ActionTemplate string `json:"action_template,omitempty"`
+		// MethodAliases maps request methods to the method they are
+		// authorized as, e.g. "HEAD" to "GET", so the policy needs no
+		// rules for the alias. Defaults to HEAD as GET if nil; an empty
+		// map disables the aliases.
+		MethodAliases map[string]string `json:"method_aliases"`
+		// AnonymousSubject is the subject checked for anonymous access.
+		// Defaults to DefaultAnonymousSubject.
+		AnonymousSubject string `json:"anonymous_subject,omitempty"`
+		// OptionalAuth treats requests with invalid credentials as
+		// anonymous requests instead of rejecting them, for resources
+		// open to anonymous access that personalize for known users.
+		OptionalAuth bool `json:"optional_auth,omitempty"`
+		// AnonymousFallback is an alias of OptionalAuth: with either set,
+		// invalid credentials fall back to anonymous access where the
+		// anonymous subject is allowed.
+		AnonymousFallback bool `json:"anonymous_fallback,omitempty"`
+		// EnforcementMode is EnforcementEnforce, the default, or
+		// EnforcementObserve to let refused requests through, logging
+		// what the decision would have been.
+		EnforcementMode string `json:"enforcement_mode,omitempty"`
+		// UserHeader names a request header set to the authenticated user
+		// for the following handlers. A value sent by the client is
+		// always removed.
+		UserHeader string `json:"user_header,omitempty"`
+		// TrailingSlash selects how a trailing slash of the path is
+		// treated, one of the TrailingSlash* modes. Defaults to
+		// TrailingSlashExact.
+		TrailingSlash string `json:"trailing_slash,omitempty"`
+
+		// SessionKey is the secret used to sign session cookies. Sessions
+		// are disabled if empty.
+		SessionKey string `json:"session_key,omitempty"`
+		// SessionCookie is the name of the session cookie. Defaults to
+		// DefaultSessionCookie.
+		SessionCookie string `json:"session_cookie,omitempty"`
+		// SessionTTL is the lifetime of a session. Defaults to
+		// DefaultSessionTTL.
+		SessionTTL caddy.Duration `json:"session_ttl,omitempty"`
+		// LoginPath is the path of the login endpoint issuing session
+		// cookies.
+		LoginPath string `json:"login_path,omitempty"`
+		// ExpiryGrace is how long an expired session is still accepted for
+		// GET and HEAD requests. Zero, the default, accepts no expired
+		// sessions.
+		ExpiryGrace caddy.Duration `json:"expiry_grace,omitempty"`
+
+		// KeepLastGood keeps the last loaded users and policy if a reload
+		// fails or yields no entries, instead of applying it.
+		KeepLastGood bool `json:"keep_last_good,omitempty"`
+		// PolicyWatchInterval is how often the model and policy files are
+		// checked for changes, reloading the policy when one changed. The
+		// files are not watched if zero.
+		PolicyWatchInterval caddy.Duration `json:"policy_watch_interval,omitempty"`
+
+		// ObjectSource selects where the object is taken from, one of
+		// the ObjectSource* sources. Defaults to ObjectSourcePath.
+		ObjectSource string `json:"object_source,omitempty"`
+		// IncludeQuery appends the query string to the object.
+		IncludeQuery bool `json:"include_query,omitempty"`
+		// NormalizePath removes duplicate slashes and resolves dot
+		// segments of the path.
+		NormalizePath bool `json:"normalize_path,omitempty"`
+		// PathNormalization is a shorthand for NormalizePath and
+		// TrailingSlash, one of the PathNormalization* modes. Defaults to
+		// PathNormalizationNone.
+		PathNormalization string `json:"path_normalization,omitempty"`
+		// StripPrefix is removed from the beginning of the path.
+		StripPrefix string `json:"strip_prefix,omitempty"`
+		// LowercaseObject lowercases the path.
+		LowercaseObject bool `json:"lowercase_object,omitempty"`
+
+		// DomainSource selects where the domain of multi-tenant models is
+		// taken from: DomainSourceHost, "header:<name>", or a literal
+		// domain. If set, the domain is passed to the enforcer following
+		// the subject, for models with a request definition like
+		// "r = sub, dom, obj, act".
+		DomainSource string `json:"domain_source,omitempty"`
+		// IncludeClientIP passes the client IP address to the enforcer as
+		// last request argument, for models with a request definition
+		// like "r = sub, obj, act, ip".
+		IncludeClientIP bool `json:"include_client_ip,omitempty"`
+		// TrustedProxies are the IP ranges of proxies whose
+		// X-Forwarded-For header is trusted to tell the client IP.
+		TrustedProxies []string `json:"trusted_proxies,omitempty"`
+		// ABAC passes the request to the enforcer as a single struct, for
+		// attribute-based models with the request definition "r = sub".
+		// Its fields are Name, Domain, Path, Method and IP, plus the
+		// ABACAttributes. Domain and IP are empty unless DomainSource and
+		// IncludeClientIP are set.
+		ABAC bool `json:"abac,omitempty"`
+		// ABACAttributes maps the names of additional fields of the ABAC
+		// subject to where their values are taken from, "header:<name>"
+		// or "query:<name>".
+		ABACAttributes map[string]string `json:"abac_attributes,omitempty"`
+
+		// RouteVar names the request variable holding the matched route
+		// pattern. If set and present, the pattern is used as the object
+		// instead of the request path.
+		RouteVar string `json:"route_var,omitempty"`
+
+		// Cost is the bcrypt cost required of password hashes, overriding
+		// the cost line of the password file. Hashes of a higher cost are
+		// kept. A cost below bcrypt.DefaultCost makes password checks
+		// fast for tests and development, and is unsafe in production.
+		// Zero uses the cost of the password file.
+		Cost int `json:"cost,omitempty"`
+
+		// LoadTimeout is the time a load of the password file may take
+		// before it is rolled back. Defaults to DefaultLoadTimeout.
+		LoadTimeout caddy.Duration `json:"load_timeout,omitempty"`
+		// WatchInterval is how often the password file is checked for
+		// changes. Defaults to DefaultWatchInterval.
+		WatchInterval caddy.Duration `json:"watch_interval,omitempty"`
+		// ReloadOnSIGHUP reloads the password files at once when the
+		// process receives SIGHUP, in addition to the change checks. The
+		// files are reopened, so files replaced by a rename are picked up.
+		ReloadOnSIGHUP bool `json:"reload_on_sighup,omitempty"`
+
+		// PasswordFormat is the format of the password file, authfile
+		// (default) or htpasswd for Apache htpasswd files.
+		PasswordFormat string `json:"password_format,omitempty"`
+		// AllowInsecureHashes accepts the $apr1$ (MD5) and {SHA}
+		// (SHA-1) hashes of htpasswd files. Entries with them are
+		// skipped and logged otherwise.
+		AllowInsecureHashes bool `json:"allow_insecure_hashes,omitempty"`
+		// CaseInsensitiveUsernames lowercases user names, those of the
+		// password file as well as those of requests, so Alice and alice
+		// are the same user. The subjects of the policy must then be
+		// lowercase.
+		CaseInsensitiveUsernames bool `json:"case_insensitive_usernames,omitempty"`
+		// AdminAPI makes the users of the password file manageable
+		// through the admin.api.authz module of Caddy's admin endpoint.
+		// Changes are written to the password file.
+		AdminAPI bool `json:"admin_api,omitempty"`
+
+		// MaxUsers limits the number of users loaded from the password
+		// file, guarding memory against huge files. Entries beyond the
+		// limit are rejected and logged. Unlimited if zero.
+		MaxUsers int `json:"max_users,omitempty"`
+
+		// Users maps user names to plaintext passwords of users that are
+		// added to the users of the password file. They are hashed at
+		// provision time and never written. For development only.
+		Users map[string]string `json:"users,omitempty"`
+
+		// UnauthorizedTemplate renders the body of 401 responses. It is
+		// ErrorTemplateJSON, ErrorTemplateHTML or the path of a template
+		// file. Responses have no body if empty.
+		UnauthorizedTemplate string `json:"unauthorized_template,omitempty"`
+		// ForbiddenTemplate renders the body of 403 responses, see
+		// UnauthorizedTemplate.
+		ForbiddenTemplate string `json:"forbidden_template,omitempty"`
+		// UnauthorizedResponse is the response to requests without valid
+		// credentials instead of a 401 without body. Exclusive with
+		// UnauthorizedTemplate.
+		UnauthorizedResponse *ErrorResponse `json:"unauthorized_response,omitempty"`
+		// DenyResponse is the response to requests the user has no access
+		// to instead of a 403 without body. Exclusive with
+		// ForbiddenTemplate.
+		DenyResponse *ErrorResponse `json:"deny_response,omitempty"`
+		// PermissionsHeader names a response header listing the implicit
+		// permissions of the user on allowed requests, for frontends
+		// adapting to what the user may do. Disabled if empty.
+		PermissionsHeader string `json:"permissions_header,omitempty"`
+		// PermissionsLimit is the maximum size in bytes of the permissions
+		// header value. Defaults to DefaultPermissionsLimit.
+		PermissionsLimit int `json:"permissions_limit,omitempty"`
+
+		// BrowserPages answers browsers with an HTML page telling to log
+		// in on 401, and that logging in won't help on 403, unless a
+		// template is configured for the status. Other clients get the
+		// status only.
+		BrowserPages bool `json:"browser_pages,omitempty"`
+
+		// MaxConcurrentRequests is the number of requests a user may have
+		// in flight at the same time. Further requests are answered with
+		// 429. Unlimited if zero.
+		MaxConcurrentRequests int `json:"max_concurrent_requests,omitempty"`
+
+		// ExcludePaths are paths that bypass the handler, neither
+		// authenticated nor authorized. A path without "*" is a prefix,
+		// a path with "*" matches whole request paths, "*" matching any
+		// characters.
+		ExcludePaths []string `json:"exclude_paths,omitempty"`
+
+		// DenyUsers are user names that never authenticate, whatever the
+		// password file or a session says.
+		DenyUsers []string `json:"deny_users,omitempty"`
+
+		// BasicAuthMode selects how HTTP basic authentication credentials
+		// are verified, one of the BasicAuth* modes. Defaults to
+		// BasicAuthUser.
+		BasicAuthMode string `json:"basic_auth_mode,omitempty"`
+
+		// IdentitySource selects where the user is taken from, one of
+		// the Identity* sources. Defaults to IdentityBasic.
+		IdentitySource string `json:"identity_source,omitempty"`
+		// JWTSecret is the shared secret verifying HMAC signed tokens of
+		// the IdentityJWT source.
+		JWTSecret string `json:"jwt_secret,omitempty"`
+		// JWKSURL is the URL of a JSON Web Key Set verifying RSA and ECDSA
+		// signed tokens of the IdentityJWT source, instead of JWTSecret.
+		JWKSURL string `json:"jwks_url,omitempty"`
+		// JWTClaim is the token claim holding the user. Defaults to
+		// DefaultJWTClaim.
+		JWTClaim string `json:"jwt_claim,omitempty"`
+
+		// TrustedUserHeader names a request header holding the user as
+		// authenticated by a proxy in front of Caddy. If set, the header
+		// is the only identity source: it is trusted without verification
+		// and credentials of the request are ignored. The proxy must
+		// always set or remove the header.
+		TrustedUserHeader string `json:"trusted_user_header,omitempty"`
+		// GroupsHeader names a request header holding the comma-separated
+		// groups of the user, as set by a proxy in front of Caddy. Each
+		// group is checked against the policy as a subject of its own,
+		// and access is allowed if the user or any of its groups is
+		// allowed. The proxy must always set or remove the header.
+		GroupsHeader string `json:"groups_header,omitempty"`
+		// MaxGroups is the number of groups of the groups header checked
+		// against the policy; the rest are ignored. Defaults to
+		// DefaultMaxGroups.
+		MaxGroups int `json:"max_groups,omitempty"`
+
+		// AuthCacheTTL is how long a successful password check is cached.
+		// Cached entries of a user are dropped when the password file
+		// is reloaded with a changed password of the user. Caching is
+		// disabled if zero.
+		AuthCacheTTL caddy.Duration `json:"auth_cache_ttl,omitempty"`
+		// CheckTimeout is the time a decision may take, mostly checking
+		// the credentials, before it is given up and answered with 503
+		// Service Unavailable. The decision is bounded only by the
+		// context of the request if zero.
+		CheckTimeout caddy.Duration `json:"check_timeout,omitempty"`
+
+		// DecisionHookRaw configures a module in the http.authz.hooks
+		// namespace that gets the final say on every decision.
+		DecisionHookRaw json.RawMessage `json:"decision_hook,omitempty" caddy:"namespace=http.authz.hooks inline_key=hook"`
+
+		// AuditLog is the file every decision is appended to as a JSON
+		// line, or AuditLogCaddy to send the records to a Caddy logger.
+		// No audit log is written if empty.
+		AuditLog string `json:"audit_log,omitempty"`
 
-	Enforcer      *casbin.Enforcer
-	PasswordCheck authfile.IAuthenticationService
+		// RedisAddress is the host:port of a Redis server the policy is
+		// kept in, instead of the policy file. Policy changes are
+		// announced to all nodes sharing the server, which reload their
+		// policy.
+		RedisAddress string `json:"redis_address,omitempty"`
+		// RedisPassword authenticates to the Redis server.
+		RedisPassword string `json:"redis_password,omitempty"`
+		// RedisDB is the number of the Redis database.
+		RedisDB int `json:"redis_db,omitempty"`
+		// RedisKey is the Redis list holding the policy rules. Defaults to
+		// DefaultRedisKey.
+		RedisKey string `json:"redis_key,omitempty"`
+		// RedisChannel is the Redis channel policy changes are announced
+		// on. Defaults to DefaultRedisChannel.
+		RedisChannel string `json:"redis_channel,omitempty"`
+
+		// SQLDriver is the name of a database/sql driver linked into the
+		// Caddy build, e.g. "postgres". If set, the policy is kept in an
+		// SQL table instead of the policy file.
+		SQLDriver string `json:"sql_driver,omitempty"`
+		// SQLDSN is the data source name passed to the driver.
+		SQLDSN string `json:"sql_dsn,omitempty"`
+		// SQLTable is the table holding the policy rules, with the schema
+		// of the Casbin gorm adapter. Defaults to DefaultSQLTable.
+		SQLTable string `json:"sql_table,omitempty"`
+	} `json:"auth_config"`
+
+	// Enforcer and PasswordCheck are set up by Provision; they are not
+	// part of the JSON configuration.
+	Enforcer      *casbin.Enforcer                `json:"-"`
+	PasswordCheck authfile.IAuthenticationService `json:"-"`
+
+	public          int32 // 1 if the policy is public, see updatePublic.
+	authCache       *authCache
+	tokens          *tokenIndex
+	passwordBackend *authfile.FileBackend
+	sharedCheck     *sharedPasswordCheck
+	adminService    *adminService
+	roles           *fileRoles
+	decisionHook    DecisionHook
+	auditLog        *auditLog
+	limiter         *userLimiter
+	jwks            *jwks
+	trustedProxies  ipRanges
+	excludedPaths   excludedPaths
+	redisWatcher    *redisWatcher
+	sqlAdapter      *sqlAdapter
+	policyWatcher   *policyWatcher
+	sighupReloader  *sighupReloader
+	policyMutex     *sync.RWMutex // guards the enforcer against reloads.
+	logger          *zap.Logger
+	clock           Clock
+
+	unauthorizedTemplate *errorTemplate
+	forbiddenTemplate    *errorTemplate
 }
 
 // CaddyModule returns the Caddy module information.
@@ -38,97 +361,1423 @@ func (Authorizer) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// DefaultActionTemplate is the action template used if an action source is
+// configured without a template.
+const DefaultActionTemplate = "{method}:{verb}"
+
+// DefaultAnonymousSubject is the subject used for anonymous access if none is
+// configured.
+const DefaultAnonymousSubject = "nobody"
+
+const (
+	// DefaultLoadTimeout is the load timeout of the password file if none
+	// is configured.
+	DefaultLoadTimeout = time.Second
+	// DefaultWatchInterval is the interval the password file is checked for
+	// changes if none is configured.
+	DefaultWatchInterval = 5 * time.Second
+)
+
+// Password file formats.
+const (
+	// PasswordFormatAuthfile is the format of the authfile package, with
+	// a cost line and roles.
+	PasswordFormatAuthfile = "authfile"
+	// PasswordFormatHtpasswd is the format of Apache htpasswd files.
+	PasswordFormatHtpasswd = "htpasswd"
+)
+
+// Basic authentication modes.
+const (
+	// BasicAuthUser verifies user name and password.
+	BasicAuthUser = "user"
+	// BasicAuthToken ignores the user name and verifies the password as a
+	// token against all entries. The user of the matching entry is the
+	// identity of the request.
+	BasicAuthToken = "token"
+)
+
 // Provision implements caddy.Provisioner.
 func (a *Authorizer) Provision(ctx caddy.Context) error {
-	filebackend, err := authfile.NewROFileBackend(a.AuthConfig.PasswordFile, 0600, time.Second*5)
-	if err != nil {
+	a.logger = ctx.Logger(a)
+
+	if a.AuthConfig.ActionSource != "" && !validRequestSource(a.AuthConfig.ActionSource) {
+		return fmt.Errorf("invalid action source %q, expected header:<name> or query:<name>", a.AuthConfig.ActionSource)
+	}
+	if err := a.checkABAC(); err != nil {
 		return err
 	}
-	authProvider := authfile.NewInMemoryService(filebackend, time.Second)
-	authProvider.Update()
+	if !validObjectSource(a.AuthConfig.ObjectSource) {
+		return fmt.Errorf("invalid object source %q", a.AuthConfig.ObjectSource)
+	}
+	switch a.AuthConfig.EnforcementMode {
+	case "", EnforcementEnforce, EnforcementObserve:
+	default:
+		return fmt.Errorf("invalid enforcement mode %q", a.AuthConfig.EnforcementMode)
+	}
+	if err := a.applyPathNormalization(); err != nil {
+		return err
+	}
+	switch a.AuthConfig.TrailingSlash {
+	case "", TrailingSlashExact, TrailingSlashStrip, TrailingSlashRequire, TrailingSlashIgnore:
+	default:
+		return fmt.Errorf("invalid trailing slash mode %q", a.AuthConfig.TrailingSlash)
+	}
+	switch a.AuthConfig.BasicAuthMode {
+	case "", BasicAuthUser, BasicAuthToken:
+	default:
+		return fmt.Errorf("invalid basic auth mode %q", a.AuthConfig.BasicAuthMode)
+	}
+	switch a.AuthConfig.PasswordFormat {
+	case "", PasswordFormatAuthfile, PasswordFormatHtpasswd:
+	default:
+		return fmt.Errorf("invalid password format %q", a.AuthConfig.PasswordFormat)
+	}
+	if err := a.provisionJWT(); err != nil {
+		return err
+	}
+	if a.AuthConfig.TrustedUserHeader != "" {
+		if a.AuthConfig.IdentitySource != "" && a.AuthConfig.IdentitySource != IdentityBasic {
+			return fmt.Errorf("trusted user header and identity source %s are mutually exclusive", a.AuthConfig.IdentitySource)
+		}
+		if a.AuthConfig.BasicAuthMode != "" || a.AuthConfig.LoginPath != "" {
+			return fmt.Errorf("trusted user header excludes reading credentials, basic auth mode and login path must not be set")
+		}
+	}
+	if a.clientCertIdentity() && (a.AuthConfig.BasicAuthMode != "" || a.AuthConfig.LoginPath != "") {
+		return fmt.Errorf("identity source %s excludes reading credentials, basic auth mode and login path must not be set", a.AuthConfig.IdentitySource)
+	}
+	if a.sessionsEnabled() && len(a.AuthConfig.SessionKey) < minSessionKeyLength {
+		return fmt.Errorf("session key must be at least %d bytes", minSessionKeyLength)
+	}
+	if a.AuthConfig.ExpiryGrace < 0 {
+		return fmt.Errorf("expiry grace must not be negative")
+	}
+	if a.AuthConfig.LoginPath != "" && !a.sessionsEnabled() {
+		return fmt.Errorf("login path requires a session key")
+	}
+
+	if a.AuthConfig.Cost != 0 {
+		if a.AuthConfig.Cost < bcrypt.MinCost || a.AuthConfig.Cost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		if a.AuthConfig.Cost < bcrypt.DefaultCost {
+			a.logger.Warn("bcrypt cost below the default is meant for tests and development, it is unsafe in production",
+				zap.Int("cost", a.AuthConfig.Cost), zap.Int("default", bcrypt.DefaultCost))
+		}
+	}
+
+	if a.AuthConfig.AuthCacheTTL < 0 {
+		return fmt.Errorf("auth cache ttl must not be negative")
+	}
+	if a.AuthConfig.CheckTimeout < 0 {
+		return fmt.Errorf("check timeout must not be negative")
+	}
+	if a.AuthConfig.MaxGroups < 0 {
+		return fmt.Errorf("max groups must not be negative")
+	}
+	if a.AuthConfig.AuthCacheTTL > 0 {
+		cache, err := newAuthCache(time.Duration(a.AuthConfig.AuthCacheTTL), a.getClock())
+		if err != nil {
+			return fmt.Errorf("creating auth cache: %v", err)
+		}
+		a.authCache = cache
+	}
+	if a.AuthConfig.BasicAuthMode == BasicAuthToken {
+		tokens, err := newTokenIndex()
+		if err != nil {
+			return fmt.Errorf("creating token index: %v", err)
+		}
+		a.tokens = tokens
+	}
+
+	if a.AuthConfig.DecisionHookRaw != nil {
+		mod, err := ctx.LoadModule(&a.AuthConfig, "DecisionHookRaw")
+		if err != nil {
+			return fmt.Errorf("loading decision hook: %v", err)
+		}
+		hook, ok := mod.(DecisionHook)
+		if !ok {
+			return fmt.Errorf("module %T is not a decision hook", mod)
+		}
+		a.decisionHook = hook
+	}
+
+	if a.AuthConfig.UnauthorizedResponse != nil {
+		if a.AuthConfig.UnauthorizedTemplate != "" {
+			return fmt.Errorf("unauthorized response and 401 template are mutually exclusive")
+		}
+		if err := a.AuthConfig.UnauthorizedResponse.check(); err != nil {
+			return fmt.Errorf("unauthorized response: %v", err)
+		}
+	}
+	if a.AuthConfig.DenyResponse != nil {
+		if a.AuthConfig.ForbiddenTemplate != "" {
+			return fmt.Errorf("deny response and 403 template are mutually exclusive")
+		}
+		if err := a.AuthConfig.DenyResponse.check(); err != nil {
+			return fmt.Errorf("deny response: %v", err)
+		}
+	}
+	if a.AuthConfig.UnauthorizedTemplate != "" {
+		et, err := loadErrorTemplate(a.AuthConfig.UnauthorizedTemplate)
+		if err != nil {
+			return fmt.Errorf("loading 401 template: %v", err)
+		}
+		a.unauthorizedTemplate = et
+	}
+	if a.AuthConfig.ForbiddenTemplate != "" {
+		et, err := loadErrorTemplate(a.AuthConfig.ForbiddenTemplate)
+		if err != nil {
+			return fmt.Errorf("loading 403 template: %v", err)
+		}
+		a.forbiddenTemplate = et
+	}
+
+	trustedProxies, err := parseIPRanges(a.AuthConfig.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("trusted proxies: %v", err)
+	}
+	a.trustedProxies = trustedProxies
 
-	e, err := casbin.NewEnforcerSafe(a.AuthConfig.ModelPath, a.AuthConfig.PolicyPath)
+	excluded, err := compileExcludedPaths(a.AuthConfig.ExcludePaths)
 	if err != nil {
 		return err
 	}
+	a.excludedPaths = excluded
+
+	if a.AuthConfig.PermissionsLimit < 0 {
+		return fmt.Errorf("permissions limit must not be negative")
+	}
+
+	if a.AuthConfig.MaxConcurrentRequests < 0 {
+		return fmt.Errorf("max concurrent requests must not be negative")
+	}
+	if a.AuthConfig.MaxConcurrentRequests > 0 {
+		a.limiter = newUserLimiter(a.AuthConfig.MaxConcurrentRequests)
+	}
+
+	if a.AuthConfig.AuditLog != "" {
+		auditLog, err := openAuditLog(a.AuthConfig.AuditLog, a.logger.Named("audit"))
+		if err != nil {
+			return fmt.Errorf("opening audit log: %v", err)
+		}
+		a.auditLog = auditLog
+	}
 
+	if a.AuthConfig.MaxUsers < 0 {
+		return fmt.Errorf("max users must not be negative")
+	}
+	if a.AuthConfig.LoadTimeout < 0 {
+		return fmt.Errorf("load timeout must not be negative")
+	}
+	if a.AuthConfig.WatchInterval < 0 {
+		return fmt.Errorf("watch interval must not be negative")
+	}
+	if a.AuthConfig.PolicyWatchInterval < 0 {
+		return fmt.Errorf("policy watch interval must not be negative")
+	}
+	if a.AuthConfig.ModelPath != "" && a.AuthConfig.ModelText != "" {
+		return fmt.Errorf("model file and inline model are mutually exclusive")
+	}
+	if a.AuthConfig.PolicyPath != "" && a.AuthConfig.PolicyText != "" {
+		return fmt.Errorf("policy file and inline policy are mutually exclusive")
+	}
+	if a.AuthConfig.RedisAddress != "" && a.AuthConfig.SQLDriver != "" {
+		return fmt.Errorf("redis and sql policies are mutually exclusive")
+	}
+	if a.AuthConfig.PolicyText != "" && (a.AuthConfig.RedisAddress != "" || a.AuthConfig.SQLDriver != "") {
+		return fmt.Errorf("inline policy and redis or sql policies are mutually exclusive")
+	}
+	if a.AuthConfig.PolicyWatchInterval > 0 && !a.policyFromFile() {
+		return fmt.Errorf("policy watch interval requires a policy file")
+	}
+	if a.AuthConfig.PolicyWatchInterval > 0 && a.AuthConfig.ModelText != "" {
+		return fmt.Errorf("policy watch interval requires a model file")
+	}
+	a.policyMutex = new(sync.RWMutex)
+	a.roles = &fileRoles{policy: a.policyMutex, logger: a.logger}
+	shared, err := a.acquirePasswordCheck()
+	if err != nil {
+		return err
+	}
+	// Set at once, so Cleanup releases it if provisioning fails.
+	a.sharedCheck, a.passwordBackend = shared, shared.backend
+	authProvider := shared.service
 	a.PasswordCheck = authProvider
+	if a.AuthConfig.AdminAPI {
+		a.adminService = &adminService{
+			service:   authProvider,
+			backend:   a.passwordBackend,
+			shared:    shared,
+			lowercase: a.AuthConfig.CaseInsensitiveUsernames,
+		}
+		registerAdminService(a.AuthConfig.PasswordFile, a.adminService)
+	}
+
+	var e *casbin.Enforcer
+	if a.AuthConfig.RedisAddress != "" {
+		if e, err = a.newRedisEnforcer(); err != nil {
+			return err
+		}
+	} else if a.AuthConfig.SQLDriver != "" {
+		if e, err = a.newSQLEnforcer(); err != nil {
+			return err
+		}
+	} else if e, err = a.newEnforcer(); err != nil {
+		return err
+	}
+
+	registerMatchFunctions(e)
+
+	if err := a.checkModel(e); err != nil {
+		return err
+	}
+
 	a.Enforcer = e
+	a.roles.attach(e)
+	a.updatePublic()
+
+	if a.AuthConfig.ReloadOnSIGHUP {
+		a.sighupReloader = newSIGHUPReloader(a.passwordBackend.Reload, a.logger)
+	}
+	if a.AuthConfig.PolicyWatchInterval > 0 {
+		a.policyWatcher = newPolicyWatcher([]string{a.AuthConfig.ModelPath, a.AuthConfig.PolicyPath},
+			time.Duration(a.AuthConfig.PolicyWatchInterval), a.ReloadPolicy, a.logger)
+	}
+
+	// The password file is loaded in the background. Wait for it, so the
+	// first requests aren't rejected for lack of users.
+	readyCtx, cancel := context.WithTimeout(ctx, a.loadTimeout())
+	defer cancel()
+	if err := authProvider.WaitReady(readyCtx); err != nil {
+		a.getLogger().Warn("password file not loaded yet, users can't authenticate until it is",
+			zap.String("file", a.AuthConfig.PasswordFile), zap.Error(err))
+	}
+
+	return nil
+}
+
+// matchFunctions are the built-in Casbin functions available to matchers.
+// Casbin itself registers all but keyMatch3.
+var matchFunctions = map[string]func(args ...interface{}) (interface{}, error){
+	"keyMatch":   util.KeyMatchFunc,
+	"keyMatch2":  util.KeyMatch2Func,
+	"keyMatch3":  util.KeyMatch3Func,
+	"regexMatch": util.RegexMatchFunc,
+	"ipMatch":    util.IPMatchFunc,
+}
 
+// registerMatchFunctions registers the built-in matcher functions on e.
+func registerMatchFunctions(e *casbin.Enforcer) {
+	for name, function := range matchFunctions {
+		e.AddFunction(name, function)
+	}
+}
+
+// requestArgs returns the names of the request arguments the handler passes
+// to the enforcer, in order.
+func (a *Authorizer) requestArgs() []string {
+	if a.AuthConfig.ABAC {
+		return []string{"subject"}
+	}
+	args := []string{"subject"}
+	if a.AuthConfig.DomainSource != "" {
+		args = append(args, "domain")
+	}
+	args = append(args, "object", "action")
+	if a.AuthConfig.IncludeClientIP {
+		args = append(args, "client ip")
+	}
+	return args
+}
+
+var (
+	// matcherFields matches the request and policy fields in a matcher,
+	// which Casbin turns from r.sub into r_sub.
+	matcherFields = regexp.MustCompile(`\b[rp]_\w+`)
+	// quotedStrings matches the string literals of a matcher.
+	quotedStrings = regexp.MustCompile(`"[^"]*"`)
+)
+
+// fieldNames returns the names of the tokens of section sec of a model, as
+// written in the model: sub for r_sub.
+func fieldNames(tokens []string, sec string) []string {
+	names := make([]string, len(tokens))
+	for i, token := range tokens {
+		names[i] = strings.TrimPrefix(token, sec+"_")
+	}
+	return names
+}
+
+// checkModel checks that the request definition of the model takes the
+// request arguments of the handler and that the matcher uses only defined
+// fields, and probes the matcher with the arguments, so a model that doesn't
+// fit fails provisioning rather than every request.
+func (a *Authorizer) checkModel(e *casbin.Enforcer) error {
+	want := a.requestArgs()
+	tokens := e.GetModel()["r"]["r"].Tokens
+	definition := "r = " + strings.Join(fieldNames(tokens, "r"), ", ")
+	if a.AuthConfig.ABAC && len(tokens) != 1 {
+		return fmt.Errorf("abac requires a model with a single request argument, got %d: %s", len(tokens), definition)
+	}
+	if len(tokens) != len(want) {
+		return fmt.Errorf("the handler passes %d request arguments (%s), but the model has %d (%s); "+
+			"the domain source and client ip settings add one each",
+			len(want), strings.Join(want, ", "), len(tokens), definition)
+	}
+
+	// Casbin only notices an unknown field once the matcher gets to it.
+	known := make(map[string]bool)
+	for _, sec := range []string{"r", "p"} {
+		for _, token := range e.GetModel()[sec][sec].Tokens {
+			known[token] = true
+		}
+	}
+	matcher := quotedStrings.ReplaceAllString(e.GetModel()["m"]["m"].Value, `""`)
+	for _, field := range matcherFields.FindAllString(matcher, -1) {
+		if !known[field] {
+			sec := field[:1]
+			return fmt.Errorf("the matcher of the model uses %s.%s, which the definition %s = %s doesn't have",
+				sec, field[2:], sec, strings.Join(fieldNames(e.GetModel()[sec][sec].Tokens, sec), ", "))
+		}
+	}
+
+	probe := enforceArgs{domain: "probe", path: "/probe", method: "GET", ip: "127.0.0.1"}
+	if a.AuthConfig.ABAC {
+		probe.attrs = make(map[string]string, len(a.AuthConfig.ABACAttributes))
+		for name := range a.AuthConfig.ABACAttributes {
+			probe.attrs[name] = ""
+		}
+	}
+	if _, err := e.EnforceSafe(a.requestValues("probe", probe)...); err != nil {
+		return fmt.Errorf("the matcher of the model fails with the request arguments %s (%s): %v",
+			strings.Join(want, ", "), definition, err)
+	}
 	return nil
 }
 
+// newPasswordCheck creates the authentication service reading the password
+// file, with the configured users added. The roles, loads and errors of the
+// password file go to shared.
+func (a *Authorizer) newPasswordCheck(shared *sharedPasswordCheck) (*authfile.InMemoryService, *authfile.FileBackend, error) {
+	var filebackend *authfile.FileBackend
+	var err error
+	// The password file is only written to if users are managed through
+	// the admin API.
+	newHtpasswd, newFile := authfile.NewROHtpasswdFileBackend, authfile.NewROFileBackend
+	if a.AuthConfig.AdminAPI {
+		newHtpasswd, newFile = authfile.NewHtpasswdFileBackend, authfile.NewFileBackend
+	}
+	if a.AuthConfig.PasswordFormat == PasswordFormatHtpasswd {
+		var htpasswd *authfile.HtpasswdFileBackend
+		htpasswd, err = newHtpasswd(a.AuthConfig.PasswordFile, 0600, a.watchInterval())
+		if err == nil {
+			filebackend = htpasswd.FileBackend
+		}
+	} else {
+		filebackend, err = newFile(a.AuthConfig.PasswordFile, 0600, a.watchInterval())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range a.AuthConfig.PasswordFiles {
+		if err := filebackend.AddFile(file); err != nil {
+			filebackend.Close()
+			return nil, nil, err
+		}
+	}
+	filebackend.SetAllowInsecureHashes(a.AuthConfig.AllowInsecureHashes)
+	filebackend.SetKeepLastGood(a.AuthConfig.KeepLastGood)
+	filebackend.SetLowercaseUsernames(a.AuthConfig.CaseInsensitiveUsernames)
+	filebackend.SetCostOverride(a.AuthConfig.Cost)
+	filebackend.SetErrorHandler(shared.reportError)
+	filebackend.SetRolesHandler(shared.setRoles)
+	filebackend.SetLoadHandler(shared.loaded)
+	if len(a.AuthConfig.Users) > 0 {
+		cost := bcrypt.DefaultCost
+		if a.AuthConfig.Cost != 0 {
+			cost = a.AuthConfig.Cost
+		}
+		users := make([]authfile.Entry, 0, len(a.AuthConfig.Users))
+		names := make([]string, 0, len(a.AuthConfig.Users))
+		for name, password := range a.AuthConfig.Users {
+			hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+			if err != nil {
+				filebackend.Close()
+				return nil, nil, fmt.Errorf("hashing password of user %s: %v", name, err)
+			}
+			users = append(users, authfile.Entry{Username: name, PasswordHash: hash})
+			names = append(names, name)
+		}
+		filebackend.SetExtraEntries(users)
+		if !filebackend.ReadOnly() {
+			a.getLogger().Warn("users with plaintext passwords configured together with a persistent backend, "+
+				"they are meant for development and are not written to the password file",
+				zap.Strings("users", names))
+		}
+	}
+	authProvider := authfile.NewInMemoryService(filebackend, a.loadTimeout())
+	authProvider.SetMaxUsers(a.AuthConfig.MaxUsers)
+	authProvider.Update()
+	return authProvider, filebackend, nil
+}
+
+// loadTimeout returns the load timeout of the password file.
+func (a *Authorizer) loadTimeout() time.Duration {
+	if a.AuthConfig.LoadTimeout == 0 {
+		return DefaultLoadTimeout
+	}
+	return time.Duration(a.AuthConfig.LoadTimeout)
+}
+
+// watchInterval returns the interval the password file is checked for changes.
+func (a *Authorizer) watchInterval() time.Duration {
+	if a.AuthConfig.WatchInterval == 0 {
+		return DefaultWatchInterval
+	}
+	return time.Duration(a.AuthConfig.WatchInterval)
+}
+
 // Validate implements caddy.Validator.
 func (a *Authorizer) Validate() error {
 	if a.Enforcer == nil {
 		return fmt.Errorf("no Enforcer")
 	}
+	if a.PasswordCheck == nil {
+		return fmt.Errorf("no PasswordCheck")
+	}
 	return nil
 }
 
+// newRedisEnforcer returns an enforcer with the policy kept in Redis, and a
+// watcher reloading the policy when another node announces a change. If
+// Redis can't be reached, the enforcer starts with an empty policy, which is
+// loaded once the watcher gets through.
+func (a *Authorizer) newRedisEnforcer() (*casbin.Enforcer, error) {
+	opts := redisOptions{
+		address:  a.AuthConfig.RedisAddress,
+		password: a.AuthConfig.RedisPassword,
+		db:       a.AuthConfig.RedisDB,
+	}
+	m, err := a.newModel()
+	if err != nil {
+		return nil, err
+	}
+	e, err := casbin.NewEnforcerSafe(m)
+	if err != nil {
+		return nil, err
+	}
+	adapter := newRedisAdapter(opts, a.redisKey())
+	e.SetAdapter(adapter)
+	if err := loadPolicy(e); err != nil {
+		a.getLogger().Error("policy not loaded", zap.String("address", opts.address), zap.Error(err))
+	}
+	watcher, err := newRedisWatcher(opts, a.redisChannel(), a.getLogger())
+	if err != nil {
+		return nil, err
+	}
+	e.SetWatcher(watcher)
+	watcher.SetUpdateCallback(func(string) {
+		if err := a.reloadRedisPolicy(e, adapter); err != nil {
+			a.getLogger().Error("policy reload failed, keeping last loaded policy",
+				zap.String("address", opts.address), zap.Error(err))
+		}
+	})
+	a.redisWatcher = watcher
+	return e, nil
+}
+
+// redisKey returns the Redis list holding the policy.
+func (a *Authorizer) redisKey() string {
+	if a.AuthConfig.RedisKey == "" {
+		return DefaultRedisKey
+	}
+	return a.AuthConfig.RedisKey
+}
+
+// redisChannel returns the Redis channel policy changes are announced on.
+func (a *Authorizer) redisChannel() string {
+	if a.AuthConfig.RedisChannel == "" {
+		return DefaultRedisChannel
+	}
+	return a.AuthConfig.RedisChannel
+}
+
+// Cleanup implements caddy.CleanerUpper.
+// It shuts the password check down and closes the password file, so a
+// config reload doesn't leak goroutines and file descriptors.
+func (a *Authorizer) Cleanup() error {
+	if a.adminService != nil {
+		unregisterAdminService(a.AuthConfig.PasswordFile, a.adminService)
+	}
+	if a.sighupReloader != nil {
+		a.sighupReloader.Close()
+	}
+	if a.sharedCheck != nil {
+		a.releasePasswordCheck(a.sharedCheck)
+		a.sharedCheck = nil
+	}
+	if a.redisWatcher != nil {
+		a.redisWatcher.Close()
+	}
+	if a.sqlAdapter != nil {
+		a.sqlAdapter.Close()
+	}
+	if a.policyWatcher != nil {
+		a.policyWatcher.Close()
+	}
+	if a.auditLog != nil {
+		a.auditLog.close()
+		if dropped := atomic.LoadUint64(&a.auditLog.dropped); dropped > 0 {
+			a.getLogger().Warn("audit records dropped, the audit log could not keep up", zap.Uint64("dropped", dropped))
+		}
+	}
+	return nil
+}
+
+// errEmptyPolicy is returned by ReloadPolicy if the new policy has no rules.
+var errEmptyPolicy = fmt.Errorf("policy is empty")
+
+// ReloadPolicy reloads the policy from the policy file. If KeepLastGood is
+// set, the new policy is loaded into a scratch enforcer first, and the current
+// policy stays in place if that fails or yields no rules. Requests wait for
+// the reload, so none is checked against a partly loaded policy.
+func (a *Authorizer) ReloadPolicy() error {
+	if a.AuthConfig.KeepLastGood && a.policyFromFile() {
+		if err := a.checkPolicy(); err != nil {
+			a.getLogger().Error("policy reload failed, keeping last good policy",
+				zap.String("policy", a.AuthConfig.PolicyPath),
+				zap.Error(err))
+			return err
+		}
+	}
+	if a.policyMutex != nil {
+		a.policyMutex.Lock()
+		defer a.policyMutex.Unlock()
+	}
+	// Even after a failed load, which may leave the policy partly loaded.
+	defer a.updatePublic()
+	if err := loadPolicy(a.Enforcer); err != nil {
+		return err
+	}
+	if a.roles != nil {
+		a.roles.reapply()
+	}
+	return nil
+}
+
+// rlockPolicy read-locks the policy against reloads and returns the unlock
+// function.
+func (a *Authorizer) rlockPolicy() func() {
+	if a.policyMutex == nil {
+		return func() {}
+	}
+	a.policyMutex.RLock()
+	return a.policyMutex.RUnlock
+}
+
+// policyFromFile reports whether the policy is loaded from the policy file.
+func (a *Authorizer) policyFromFile() bool {
+	return a.AuthConfig.RedisAddress == "" && a.AuthConfig.SQLDriver == "" && a.AuthConfig.PolicyText == ""
+}
+
+// checkPolicy loads model and policy into a new enforcer and verifies that
+// the policy has rules.
+func (a *Authorizer) checkPolicy() error {
+	e, err := a.newEnforcer()
+	if err != nil {
+		return err
+	}
+	for _, sec := range []string{"p", "g"} {
+		for _, ast := range e.GetModel()[sec] {
+			if len(ast.Policy) > 0 {
+				return nil
+			}
+		}
+	}
+	return errEmptyPolicy
+}
+
+// loadPolicy reloads the policy of e, returning a panic as error.
+func loadPolicy(e *casbin.Enforcer) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%v", rec)
+		}
+	}()
+	return e.LoadPolicy()
+}
+
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
-func (a Authorizer) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	switch a.CheckPermission(r) {
+func (a *Authorizer) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if a.excludedPaths.match(r) {
+		return next.ServeHTTP(w, r)
+	}
+	if a.AuthConfig.LoginPath != "" && r.URL.Path == a.AuthConfig.LoginPath {
+		return a.serveLogin(w, r)
+	}
+	start := time.Now()
+	if a.servePublic(r) {
+		observeDecision(AccessAllowed, false, time.Since(start))
+		return next.ServeHTTP(w, r)
+	}
+	user, attempted, decision := a.checkPermission(r)
+	observeDecision(decision, user != "", time.Since(start))
+	a.audit(r, user, decision)
+	if decision != AccessAllowed && a.observeOnly() {
+		a.observeRefusal(r, user, decision)
+		a.identify(r, user)
+		return next.ServeHTTP(w, r)
+	}
+	switch decision {
 	case AccessDenied:
-		w.WriteHeader(403)
+		a.writeError(w, r, http.StatusForbidden, user, reasonAccessDenied)
 		return nil
 	case AccessAllowed:
+		if a.limiter != nil && user != "" {
+			if !a.limiter.acquire(user) {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return nil
+			}
+			defer a.limiter.release(user)
+		}
+		a.setPermissionsHeader(w, user)
+		a.identify(r, user)
 		return next.ServeHTTP(w, r)
+	case Unavailable:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return nil
 	default:
-		w.Header().Set("WWW-Authenticate", "Basic realm=\""+a.AuthConfig.Realm+"\"")
-		w.WriteHeader(401)
+		if challenge := a.challenge(r); challenge != "" {
+			w.Header().Set("WWW-Authenticate", challenge)
+		}
+		reason := reasonAuthenticationRequired
+		if attempted && user == "" {
+			reason = reasonInvalidCredentials
+		}
+		a.writeError(w, r, http.StatusUnauthorized, user, reason)
 		return nil
 	}
 }
 
-// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler. The model, policy,
+// realm and password file are given either as four arguments in this order,
+// as three arguments without the realm, or as the subdirectives model,
+// policy, realm and password_file.
 func (a *Authorizer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
-		if !d.NextArg() {
+		switch args := d.RemainingArgs(); len(args) {
+		case 0:
+		case 3:
+			a.AuthConfig.ModelPath = args[0]
+			a.AuthConfig.PolicyPath = args[1]
+			a.AuthConfig.PasswordFile = args[2]
+		case 4:
+			a.AuthConfig.ModelPath = args[0]
+			a.AuthConfig.PolicyPath = args[1]
+			a.AuthConfig.Realm = args[2]
+			a.AuthConfig.PasswordFile = args[3]
+		default:
 			return d.ArgErr()
 		}
-		a.AuthConfig.ModelPath = d.Val()
-		if !d.NextArg() {
-			return d.ArgErr()
-		}
-		a.AuthConfig.PolicyPath = d.Val()
 
-		if !d.NextArg() {
-			return d.ArgErr()
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "model":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.ModelPath = d.Val()
+			case "policy":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.PolicyPath = d.Val()
+			case "model_text":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.ModelText = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "policy_text":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.PolicyText = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "realm":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.Realm = d.Val()
+			case "password_file":
+				files := d.RemainingArgs()
+				if len(files) == 0 {
+					return d.ArgErr()
+				}
+				if a.AuthConfig.PasswordFile == "" {
+					a.AuthConfig.PasswordFile, files = files[0], files[1:]
+				}
+				a.AuthConfig.PasswordFiles = append(a.AuthConfig.PasswordFiles, files...)
+			case "action_source":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.ActionSource = d.Val()
+			case "action_template":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.ActionTemplate = d.Val()
+			case "anonymous_subject":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.AnonymousSubject = d.Val()
+			case "optional_auth":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.OptionalAuth = true
+			case "anonymous_fallback":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.AnonymousFallback = true
+			case "user_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.UserHeader = d.Val()
+			case "trailing_slash":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.TrailingSlash = d.Val()
+			case "object_source":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.ObjectSource = d.Val()
+			case "include_query":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.IncludeQuery = true
+			case "normalize_path":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.NormalizePath = true
+			case "path_normalization":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.PathNormalization = d.Val()
+			case "strip_prefix":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.StripPrefix = d.Val()
+			case "lowercase_object":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.LowercaseObject = true
+			case "session_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.SessionKey = d.Val()
+			case "session_cookie":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.SessionCookie = d.Val()
+			case "session_ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ttl, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid session_ttl '%s': %v", d.Val(), err)
+				}
+				a.AuthConfig.SessionTTL = caddy.Duration(ttl)
+			case "login_path":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.LoginPath = d.Val()
+			case "expiry_grace":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				grace, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid expiry_grace '%s': %v", d.Val(), err)
+				}
+				a.AuthConfig.ExpiryGrace = caddy.Duration(grace)
+			case "keep_last_good":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.KeepLastGood = true
+			case "policy_watch_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid policy_watch_interval '%s': %v", d.Val(), err)
+				}
+				a.AuthConfig.PolicyWatchInterval = caddy.Duration(interval)
+			case "route_var":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.RouteVar = d.Val()
+			case "password_format":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.PasswordFormat = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "allow_insecure_hashes":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.AllowInsecureHashes = true
+			case "case_insensitive_usernames":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.CaseInsensitiveUsernames = true
+			case "admin_api":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.AdminAPI = true
+			case "max_users":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxUsers, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_users '%s': %v", d.Val(), err)
+				}
+				a.AuthConfig.MaxUsers = maxUsers
+			case "load_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				timeout, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid load_timeout '%s': %v", d.Val(), err)
+				}
+				a.AuthConfig.LoadTimeout = caddy.Duration(timeout)
+			case "watch_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid watch_interval '%s': %v", d.Val(), err)
+				}
+				a.AuthConfig.WatchInterval = caddy.Duration(interval)
+			case "reload_on_sighup":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.ReloadOnSIGHUP = true
+			case "cost":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				cost, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid cost '%s': %v", d.Val(), err)
+				}
+				a.AuthConfig.Cost = cost
+			case "auth_cache_ttl":
+				if !d.NextArg() {
+					a.AuthConfig.AuthCacheTTL = caddy.Duration(DefaultAuthCacheTTL)
+					break
+				}
+				ttl, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid auth_cache_ttl '%s': %v", d.Val(), err)
+				}
+				a.AuthConfig.AuthCacheTTL = caddy.Duration(ttl)
+			case "check_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				timeout, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid check_timeout '%s': %v", d.Val(), err)
+				}
+				a.AuthConfig.CheckTimeout = caddy.Duration(timeout)
+			case "decision_hook":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if a.AuthConfig.DecisionHookRaw != nil {
+					return d.Err("decision hook already specified")
+				}
+				name := d.Val()
+				mod, err := caddy.GetModule("http.authz.hooks." + name)
+				if err != nil {
+					return d.Errf("getting decision hook '%s': %v", name, err)
+				}
+				unm, ok := mod.New().(caddyfile.Unmarshaler)
+				if !ok {
+					return d.Errf("decision hook '%s' is not a Caddyfile unmarshaler", name)
+				}
+				if err := unm.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+					return err
+				}
+				a.AuthConfig.DecisionHookRaw = caddyconfig.JSONModuleObject(unm, "hook", name, nil)
+			case "error_template":
+				var status, source string
+				if !d.Args(&status, &source) {
+					return d.ArgErr()
+				}
+				switch status {
+				case "401":
+					a.AuthConfig.UnauthorizedTemplate = source
+				case "403":
+					a.AuthConfig.ForbiddenTemplate = source
+				default:
+					return d.Errf("error_template status must be 401 or 403, not '%s'", status)
+				}
+			case "unauthorized_response", "deny_response":
+				directive := d.Val()
+				response, err := parseErrorResponse(d)
+				if err != nil {
+					return err
+				}
+				if directive == "unauthorized_response" {
+					a.AuthConfig.UnauthorizedResponse = response
+				} else {
+					a.AuthConfig.DenyResponse = response
+				}
+			case "policy_redis":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.RedisAddress = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for d.NextBlock(1) {
+					switch d.Val() {
+					case "password":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						a.AuthConfig.RedisPassword = d.Val()
+					case "db":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						db, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("invalid db '%s': %v", d.Val(), err)
+						}
+						a.AuthConfig.RedisDB = db
+					case "key":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						a.AuthConfig.RedisKey = d.Val()
+					case "channel":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						a.AuthConfig.RedisChannel = d.Val()
+					default:
+						return d.Errf("unrecognized policy_redis subdirective '%s'", d.Val())
+					}
+				}
+			case "policy_sql":
+				if !d.Args(&a.AuthConfig.SQLDriver, &a.AuthConfig.SQLDSN) {
+					return d.ArgErr()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for d.NextBlock(1) {
+					switch d.Val() {
+					case "table":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						a.AuthConfig.SQLTable = d.Val()
+					default:
+						return d.Errf("unrecognized policy_sql subdirective '%s'", d.Val())
+					}
+				}
+			case "permissions_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.PermissionsHeader = d.Val()
+				if d.NextArg() {
+					limit, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("invalid permissions limit '%s': %v", d.Val(), err)
+					}
+					a.AuthConfig.PermissionsLimit = limit
+				}
+			case "browser_pages":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.BrowserPages = true
+			case "max_concurrent_requests":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_concurrent_requests '%s': %v", d.Val(), err)
+				}
+				a.AuthConfig.MaxConcurrentRequests = n
+			case "exclude_paths":
+				paths := d.RemainingArgs()
+				if len(paths) == 0 {
+					return d.ArgErr()
+				}
+				a.AuthConfig.ExcludePaths = append(a.AuthConfig.ExcludePaths, paths...)
+			case "method_alias":
+				args := d.RemainingArgs()
+				switch {
+				case len(args) == 1 && args[0] == "off":
+					a.AuthConfig.MethodAliases = map[string]string{}
+				case len(args) == 2:
+					if a.AuthConfig.MethodAliases == nil {
+						a.AuthConfig.MethodAliases = make(map[string]string)
+						for method, alias := range defaultMethodAliases {
+							a.AuthConfig.MethodAliases[method] = alias
+						}
+					}
+					a.AuthConfig.MethodAliases[strings.ToUpper(args[0])] = strings.ToUpper(args[1])
+				default:
+					return d.ArgErr()
+				}
+			case "deny_user":
+				users := d.RemainingArgs()
+				if len(users) == 0 {
+					return d.ArgErr()
+				}
+				a.AuthConfig.DenyUsers = append(a.AuthConfig.DenyUsers, users...)
+			case "basic_auth_mode":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.BasicAuthMode = d.Val()
+			case "identity_source":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.IdentitySource = d.Val()
+			case "jwt_secret":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.JWTSecret = d.Val()
+			case "jwks_url":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.JWKSURL = d.Val()
+			case "jwt_claim":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.JWTClaim = d.Val()
+			case "trusted_user_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.TrustedUserHeader = d.Val()
+			case "groups_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.GroupsHeader = d.Val()
+			case "max_groups":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				maxGroups, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_groups '%s': %v", d.Val(), err)
+				}
+				a.AuthConfig.MaxGroups = maxGroups
+			case "domain_source":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.DomainSource = d.Val()
+			case "include_client_ip":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.IncludeClientIP = true
+			case "enforcement_mode":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.EnforcementMode = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "abac":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.ABAC = true
+			case "abac_attribute":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if a.AuthConfig.ABACAttributes == nil {
+					a.AuthConfig.ABACAttributes = make(map[string]string)
+				}
+				a.AuthConfig.ABACAttributes[args[0]] = args[1]
+			case "trusted_proxies":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				a.AuthConfig.TrustedProxies = append(a.AuthConfig.TrustedProxies, args...)
+			case "audit_log":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				a.AuthConfig.AuditLog = d.Val()
+			case "user":
+				var name, password string
+				if !d.Args(&name, &password) {
+					return d.ArgErr()
+				}
+				if a.AuthConfig.Users == nil {
+					a.AuthConfig.Users = make(map[string]string)
+				}
+				a.AuthConfig.Users[name] = password
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
 		}
-		a.AuthConfig.Realm = d.Val()
 
-		if !d.NextArg() {
-			return d.ArgErr()
+		switch {
+		case a.AuthConfig.ModelPath == "" && a.AuthConfig.ModelText == "":
+			return d.Err("missing model")
+		case a.AuthConfig.PolicyPath == "" && a.policyFromFile():
+			return d.Err("missing policy")
+		case a.AuthConfig.PasswordFile == "":
+			return d.Err("missing password_file")
 		}
-		a.AuthConfig.PasswordFile = d.Val()
 	}
 	return nil
 }
 
 // parseCaddyfile unmarshals tokens from h into a new Authorizer.
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
-	var m Authorizer
+	m := new(Authorizer)
 	err := m.UnmarshalCaddyfile(h.Dispenser)
 	return m, err
 }
 
-// getUserName gets the user name from the request.
-// Currently, only HTTP basic authentication is supported
+// getUserName gets the user name from the request, from the trusted user
+// header if one is configured, from the verified TLS client certificate with
+// the tls identity sources, from HTTP basic authentication otherwise.
 func (a *Authorizer) getUserName(r *http.Request) string {
+	if a.AuthConfig.TrustedUserHeader != "" {
+		return strings.TrimSpace(r.Header.Get(a.AuthConfig.TrustedUserHeader))
+	}
+	if a.clientCertIdentity() {
+		return a.clientCertUser(r)
+	}
 	username, _, _ := r.BasicAuth()
 	return username
 }
 
-// checkEnforce verifies if the user has access to the resource. If no
-// username is given, the check will be against "nobody" only.
-func (a *Authorizer) checkEnforce(user, path, method string) (int, bool) {
+// getAction gets the casbin action from the request. It is the HTTP method,
+// combined with the verb from the configured action source if there is one.
+func (a *Authorizer) getAction(r *http.Request) string {
+	method := a.getMethod(r)
+	if a.AuthConfig.ActionSource == "" {
+		return method
+	}
+	verb := requestValue(r, a.AuthConfig.ActionSource)
+	if verb == "" {
+		return method
+	}
+	template := a.AuthConfig.ActionTemplate
+	if template == "" {
+		template = DefaultActionTemplate
+	}
+	return strings.NewReplacer("{method}", method, "{verb}", verb).Replace(template)
+}
+
+// defaultMethodAliases are the method aliases used if none are configured.
+var defaultMethodAliases = map[string]string{http.MethodHead: http.MethodGet}
+
+// getMethod returns the method the request is authorized as, the request
+// method with the method aliases applied.
+func (a *Authorizer) getMethod(r *http.Request) string {
+	aliases := a.AuthConfig.MethodAliases
+	if aliases == nil {
+		aliases = defaultMethodAliases
+	}
+	if alias, ok := aliases[r.Method]; ok {
+		return alias
+	}
+	return r.Method
+}
+
+// validRequestSource reports whether source is of the form "header:<name>"
+// or "query:<name>".
+func validRequestSource(source string) bool {
+	kind := strings.SplitN(source, ":", 2)
+	if len(kind) != 2 || kind[1] == "" {
+		return false
+	}
+	return kind[0] == "header" || kind[0] == "query"
+}
+
+// requestValue returns the value of the request header or query parameter
+// named by source, see validRequestSource.
+func requestValue(r *http.Request, source string) string {
+	kind := strings.SplitN(source, ":", 2)
+	if len(kind) != 2 {
+		return ""
+	}
+	switch kind[0] {
+	case "header":
+		return r.Header.Get(kind[1])
+	case "query":
+		return r.URL.Query().Get(kind[1])
+	}
+	return ""
+}
+
+// getLogger returns the provisioned logger, or a no-op logger if the
+// Authorizer was not provisioned.
+func (a *Authorizer) getLogger() *zap.Logger {
+	if a.logger == nil {
+		return zap.NewNop()
+	}
+	return a.logger
+}
+
+// enforce calls the enforcer. A panic inside the enforcer, e.g. caused by a
+// malformed matcher, is logged and treated as a denial.
+func (a *Authorizer) enforce(rvals ...interface{}) bool {
+	defer a.rlockPolicy()()
+	return a.enforceLocked(rvals...)
+}
+
+// enforceLocked is enforce with the policy locked by the caller.
+func (a *Authorizer) enforceLocked(rvals ...interface{}) (allowed bool) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			a.getLogger().Error("enforcer panicked, denying access",
+				zap.Any("request", rvals),
+				zap.Any("error", rec))
+			allowed = false
+		}
+	}()
+	return a.Enforcer.Enforce(rvals...)
+}
+
+// anonymousSubject returns the subject used for anonymous access.
+func (a *Authorizer) anonymousSubject() string {
+	if a.AuthConfig.AnonymousSubject == "" {
+		return DefaultAnonymousSubject
+	}
+	return a.AuthConfig.AnonymousSubject
+}
+
+// enforceArgs are the request arguments passed to the enforcer with the
+// subject. The domain and the client IP are only passed if configured, the
+// attributes only in ABAC mode. The groups of the user are checked as
+// subjects of their own.
+type enforceArgs struct {
+	domain string
+	path   string
+	method string
+	ip     string
+	attrs  map[string]string
+	groups []string
+}
+
+// enforceRequest checks subject and args, in the order of the request
+// definition "sub, [dom,] obj, act[, ip]", or as a single struct in ABAC
+// mode.
+func (a *Authorizer) enforceRequest(subject string, args enforceArgs) bool {
+	return a.enforce(a.requestValues(subject, args)...)
+}
+
+// requestValues returns the request arguments of subject and args passed to
+// the enforcer, see requestArgs.
+func (a *Authorizer) requestValues(subject string, args enforceArgs) []interface{} {
+	if a.AuthConfig.ABAC {
+		return []interface{}{a.abacSubject(subject, args)}
+	}
+	rvals := []interface{}{subject}
+	if a.AuthConfig.DomainSource != "" {
+		rvals = append(rvals, args.domain)
+	}
+	rvals = append(rvals, args.path, args.method)
+	if a.AuthConfig.IncludeClientIP {
+		rvals = append(rvals, args.ip)
+	}
+	return rvals
+}
+
+// enforcePath checks subject and args. In TrailingSlashIgnore mode the path
+// with the trailing slash toggled is checked as well.
+func (a *Authorizer) enforcePath(subject string, args enforceArgs) bool {
+	if a.enforceRequest(subject, args) {
+		return true
+	}
+	if a.AuthConfig.TrailingSlash != TrailingSlashIgnore {
+		return false
+	}
+	toggled, ok := toggleTrailingSlash(args.path)
+	if !ok {
+		return false
+	}
+	args.path = toggled
+	return a.enforceRequest(subject, args)
+}
+
+// checkEnforce verifies if the user, or one of its groups, has access to the
+// resource. If no username is given, the check will be against the anonymous
+// subject only.
+func (a *Authorizer) checkEnforce(user string, args enforceArgs) (int, bool) {
 	if user != "" {
-		if a.Enforcer.Enforce(user, path, method) {
+		if a.enforcePath(user, args) {
 			return IdentifiedAccess, true
 		}
+		for _, group := range args.groups {
+			if a.enforcePath(group, args) {
+				return IdentifiedAccess, true
+			}
+		}
 	}
-	if a.Enforcer.Enforce("nobody", path, method) {
+	if a.enforcePath(a.anonymousSubject(), args) {
 		if user != "" {
 			return IdentifiedAccess, true
 		}
@@ -144,6 +1793,14 @@ const (
 	AccessAllowed = 1
 	// AccessDenied is returned if the user has no access to the resource.
 	AccessDenied = 2
+	// InvalidCredentials is returned if the request carried credentials
+	// that are not valid. Like MustAuthenticate, it is answered with 401
+	// and a challenge, prompting the client to authenticate again.
+	InvalidCredentials = 3
+	// Unavailable is returned if no decision was made because the
+	// context of the request was done, or the check timeout passed, before
+	// the credentials were checked. It is answered with 503.
+	Unavailable = 4
 	// AnonymousAccess is returned if the access is authorized for anonymous access.
 	AnonymousAccess = 1
 	// IdentifiedAccess is returned if the access is authorized for an identified user.
@@ -151,36 +1808,232 @@ const (
 )
 
 // CheckPermission checks the user/method/path combination from the request.
-// Returns true (permission granted) or false (permission forbidden)
+// A request without credentials gets MustAuthenticate unless anonymous access
+// is allowed. A request with invalid credentials gets InvalidCredentials, or
+// is treated like one without credentials if OptionalAuth or its alias
+// AnonymousFallback is set. A request
+// with a valid identity gets AccessDenied if neither the user nor the
+// anonymous subject is allowed. The decision hook, if any, gets
+// the final say. A request whose context is done before the decision is made
+// gets Unavailable; the policy and the decision hook are not consulted then.
 func (a *Authorizer) CheckPermission(r *http.Request) int {
-	var goodAuthentication bool
-	user, password, authenticated := r.BasicAuth()
+	_, _, decision := a.checkPermission(r)
+	return decision
+}
+
+// checkPermission returns the authenticated user, if any, whether the request
+// carried credentials, and the decision on the request, see CheckPermission.
+func (a *Authorizer) checkPermission(r *http.Request) (string, bool, int) {
+	if a.AuthConfig.CheckTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(a.AuthConfig.CheckTimeout))
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	user, authenticated, attempted := a.authenticate(r)
+	decision, level := Unavailable, 0
+	// A password check given up because the context is done looks like
+	// invalid credentials, so the context decides.
+	if r.Context().Err() == nil {
+		decision, level = a.checkRequest(r, user, authenticated, attempted)
+		decision = a.decide(r, user, decision)
+	}
+	a.logDecision(r, user, authenticated, level, decision)
+	return user, attempted, decision
+}
+
+// logDecision logs the inputs and the outcome of a decision at debug level,
+// to find out why a request was denied. Credentials are never logged.
+func (a *Authorizer) logDecision(r *http.Request, user string, authenticated bool, level, decision int) {
+	ce := a.getLogger().Check(zap.DebugLevel, "authorization decision")
+	if ce == nil {
+		return
+	}
+	subject := user
+	if subject == "" {
+		subject = a.anonymousSubject()
+	}
+	ce.Write(
+		zap.String("subject", subject),
+		zap.String("path", r.URL.Path),
+		zap.String("method", r.Method),
+		zap.Bool("authenticated", authenticated),
+		zap.String("authorize_level", levelName(level)),
+		zap.String("decision", decisionName(decision)),
+	)
+}
+
+// levelName returns the name of an access level of checkEnforce in the
+// decision log.
+func levelName(level int) string {
+	switch level {
+	case AnonymousAccess:
+		return "anonymous"
+	case IdentifiedAccess:
+		return "identified"
+	default:
+		return "none"
+	}
+}
+
+// anonymousFallback reports whether invalid credentials fall back to
+// anonymous access, set by OptionalAuth or AnonymousFallback.
+func (a *Authorizer) anonymousFallback() bool {
+	return a.AuthConfig.OptionalAuth || a.AuthConfig.AnonymousFallback
+}
+
+// checkRequest returns the decision of the policy for the request, see
+// CheckPermission, and the access level the policy allows.
+func (a *Authorizer) checkRequest(r *http.Request, user string, authenticated, attempted bool) (int, int) {
+	if attempted && !authenticated && !a.anonymousFallback() {
+		return InvalidCredentials, 0
+	}
+
+	args := enforceArgs{path: a.getPath(r), method: a.getAction(r)}
+	if a.AuthConfig.DomainSource != "" {
+		args.domain = a.getDomain(r)
+	}
+	if a.AuthConfig.IncludeClientIP {
+		args.ip = a.clientIP(r)
+	}
+	if a.AuthConfig.ABAC {
+		args.attrs = a.abacAttributes(r)
+	}
+	if user != "" {
+		args.groups = a.requestGroups(r)
+	}
+
+	if level, authorized := a.checkEnforce(user, args); authorized {
+		return AccessAllowed, level
+	}
 	if authenticated {
-		if err := a.PasswordCheck.Authenticate(user, password); err != nil {
-			goodAuthentication = false
-		} else {
-			goodAuthentication = true
+		return AccessDenied, 0
+	}
+	return MustAuthenticate, 0
+}
+
+// authenticate gets the user from the identity source or the session cookie
+// of the request and verifies the credentials. With a trusted user header or
+// a TLS client certificate, the header or the certificate alone identifies
+// the user.
+// attempted reports whether the request carried credentials at all, and
+// authenticated whether they are valid. The user is empty unless
+// authenticated.
+func (a *Authorizer) authenticate(r *http.Request) (user string, authenticated, attempted bool) {
+	if a.AuthConfig.TrustedUserHeader != "" || a.clientCertIdentity() {
+		user := a.normalizeUser(a.getUserName(r))
+		if user == "" {
+			return "", false, false
+		}
+		if a.userDenied(user) {
+			return "", false, true
 		}
+		return user, true, true
 	}
+	if a.AuthConfig.IdentitySource == IdentityJWT {
+		if token, ok := bearerToken(r); ok {
+			if user, ok := a.checkJWT(r, token); ok {
+				return a.normalizeUser(user), true, true
+			}
+			return "", false, true
+		}
+	} else if user, password, ok := r.BasicAuth(); ok {
+		if user, ok := a.checkBasicAuth(r.Context(), user, password); ok {
+			return user, true, true
+		}
+		return "", false, true
+	}
+	if a.sessionsEnabled() {
+		if sessionUser, ok := a.getSessionUser(r); ok {
+			return a.normalizeUser(sessionUser), true, true
+		}
+	}
+	return "", false, false
+}
 
-	method := r.Method
-	path := r.URL.Path
+// identify passes the authenticated user on to the following handlers, in
+// the placeholder {http.auth.user.id} and the user header, if configured.
+func (a *Authorizer) identify(r *http.Request, user string) {
+	if a.AuthConfig.UserHeader != "" {
+		r.Header.Del(a.AuthConfig.UserHeader)
+		if user != "" {
+			r.Header.Set(a.AuthConfig.UserHeader, user)
+		}
+	}
+	if user == "" {
+		return
+	}
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set("http.auth.user.id", user)
+	}
+}
 
-	authorizeLevel, authorized := a.checkEnforce(user, path, method)
-	if authorized {
-		switch authorizeLevel {
-		case AnonymousAccess:
-			return AccessAllowed
-		case IdentifiedAccess:
-			if !authenticated || !goodAuthentication {
-				return MustAuthenticate
-			}
-			if authenticated && goodAuthentication {
-				return AccessAllowed
-			}
+// checkBasicAuth verifies HTTP basic authentication credentials according to
+// the basic auth mode and returns the identified user. The verification is
+// given up once ctx, the context of the request, is done.
+func (a *Authorizer) checkBasicAuth(ctx context.Context, user, password string) (string, bool) {
+	if a.AuthConfig.BasicAuthMode == BasicAuthToken {
+		return a.checkToken(ctx, password)
+	}
+	user = a.normalizeUser(user)
+	if user == "" || !a.checkPassword(ctx, user, password) {
+		return "", false
+	}
+	return user, true
+}
+
+// AuthCacheStats returns the counters of the auth cache. They are zero if the
+// cache is disabled.
+func (a *Authorizer) AuthCacheStats() AuthCacheStats {
+	if a.authCache == nil {
+		return AuthCacheStats{}
+	}
+	return a.authCache.stats()
+}
+
+// userDenied reports whether user is on the deny list. User names are
+// compared ignoring case and surrounding white space.
+func (a *Authorizer) userDenied(user string) bool {
+	user = strings.TrimSpace(user)
+	for _, denied := range a.AuthConfig.DenyUsers {
+		if strings.EqualFold(user, strings.TrimSpace(denied)) {
+			return true
 		}
-	} else if !authenticated {
-		return MustAuthenticate
 	}
-	return AccessDenied
+	return false
 }
+
+// normalizeUser lowercases user if user names are case-insensitive.
+func (a *Authorizer) normalizeUser(user string) string {
+	if a.AuthConfig.CaseInsensitiveUsernames {
+		return strings.ToLower(user)
+	}
+	return user
+}
+
+// checkPassword verifies user and password against the password check,
+// consulting the auth cache first if one is configured. Users on the deny
+// list always fail.
+func (a *Authorizer) checkPassword(ctx context.Context, user, password string) bool {
+	if a.userDenied(user) {
+		return false
+	}
+	if a.authCache != nil && a.authCache.get(user, password) {
+		return true
+	}
+	if a.PasswordCheck.AuthenticateContext(ctx, user, password) != nil {
+		return false
+	}
+	if a.authCache != nil {
+		a.authCache.put(user, password)
+	}
+	return true
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Authorizer)(nil)
+	_ caddy.Validator             = (*Authorizer)(nil)
+	_ caddy.CleanerUpper          = (*Authorizer)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Authorizer)(nil)
+	_ caddyfile.Unmarshaler       = (*Authorizer)(nil)
+)
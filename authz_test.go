@@ -1,28 +1,64 @@
 package authz
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/casbin/casbin"
-	"github.com/dafanasiev/authfile"
+	fileadapter "github.com/casbin/casbin/persist/file-adapter"
+	"github.com/dafanasiev/caddy-authz/v2/authfile"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
 
-func testRequest(t *testing.T, handler Authorizer, user string, path string, method string, code int) {
-	r, _ := http.NewRequest(method, path, nil)
-	r.SetBasicAuth(user, "123")
+func serve(handler Authorizer, r *http.Request) *httptest.ResponseRecorder {
 	w := httptest.NewRecorder()
 	handler.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) error {
 		return nil
 	}))
+	return w
+}
+
+func testRequest(t *testing.T, handler Authorizer, user string, path string, method string, code int) {
+	r, _ := http.NewRequest(method, path, nil)
+	r.SetBasicAuth(user, "123")
+	w := serve(handler, r)
 
 	if w.Code != code {
 		t.Errorf("%s, %s, %s: %d, supposed to be %d", user, path, method, w.Code, code)
 	}
 }
 
+func testAuthProvider(t *testing.T) *authfile.InMemoryService {
+	filebackend, err := authfile.NewROFileBackend("bcrypt.pass", 0600, time.Second*5)
+	if err != nil {
+		t.Fatalf("NewROFileBackend: %s", err)
+	}
+	authProvider := authfile.NewInMemoryService(filebackend, time.Second)
+	authProvider.Update()
+	for deadline := time.Now().Add(time.Second); len(authProvider.List()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("password file not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return authProvider
+}
+
 func TestBasic(t *testing.T) {
 	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
 
@@ -33,10 +69,12 @@ func TestBasic(t *testing.T) {
 	}
 	authProvider := authfile.NewInMemoryService(filebackend, time.Second)
 	authProvider.Update()
-
+	if err := authProvider.WaitReady(context.Background()); err != nil {
+		t.Fatalf("WaitReady: %s", err)
+	}
 
 	handler := Authorizer{
-		Enforcer: e,
+		Enforcer:      e,
 		PasswordCheck: authProvider,
 	}
 
@@ -46,6 +84,23 @@ func TestBasic(t *testing.T) {
 	testRequest(t, handler, "alice", "/dataset1/resource2", "POST", 403)
 }
 
+func TestAuthenticationChallenge(t *testing.T) {
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+	handler.AuthConfig.Realm = "Test"
+
+	r, _ := http.NewRequest("GET", "/dataset1/resource1", nil)
+	w := serve(handler, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("no credentials: %d, supposed to be 401", w.Code)
+	}
+	if got := w.Header().Get("WWW-Authenticate"); got != `Basic realm="Test"` {
+		t.Errorf("challenge %q", got)
+	}
+}
+
 func TestPathWildcard(t *testing.T) {
 	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
 
@@ -56,9 +111,12 @@ func TestPathWildcard(t *testing.T) {
 	}
 	authProvider := authfile.NewInMemoryService(filebackend, time.Second)
 	authProvider.Update()
+	if err := authProvider.WaitReady(context.Background()); err != nil {
+		t.Fatalf("WaitReady: %s", err)
+	}
 
 	handler := Authorizer{
-		Enforcer: e,
+		Enforcer:      e,
 		PasswordCheck: authProvider,
 	}
 
@@ -87,9 +145,12 @@ func TestRBAC(t *testing.T) {
 	}
 	authProvider := authfile.NewInMemoryService(filebackend, time.Second)
 	authProvider.Update()
+	if err := authProvider.WaitReady(context.Background()); err != nil {
+		t.Fatalf("WaitReady: %s", err)
+	}
 
 	handler := Authorizer{
-		Enforcer: e,
+		Enforcer:      e,
 		PasswordCheck: authProvider,
 	}
 
@@ -111,3 +172,1042 @@ func TestRBAC(t *testing.T) {
 	testRequest(t, handler, "cathy", "/dataset2/item", "POST", 403)
 	testRequest(t, handler, "cathy", "/dataset2/item", "DELETE", 403)
 }
+
+func TestComposedAction(t *testing.T) {
+	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	e.AddPolicy("alice", "^/api$", "POST:archive", "allow")
+	e.AddPolicy("alice", "^/api$", "GET", "allow")
+
+	handler := Authorizer{
+		Enforcer:      e,
+		PasswordCheck: testAuthProvider(t),
+	}
+	handler.AuthConfig.ActionSource = "header:X-Action"
+
+	testAction := func(verb string, method string, code int) {
+		r, _ := http.NewRequest(method, "/api", nil)
+		r.SetBasicAuth("alice", "123")
+		if verb != "" {
+			r.Header.Set("X-Action", verb)
+		}
+		if w := serve(handler, r); w.Code != code {
+			t.Errorf("%s %q: %d, supposed to be %d", method, verb, w.Code, code)
+		}
+	}
+	testAction("archive", "POST", 200)
+	testAction("delete", "POST", 403)
+	testAction("", "POST", 403)
+	testAction("", "GET", 200)
+
+	handler.AuthConfig.ActionSource = "query:op"
+	handler.AuthConfig.ActionTemplate = "{verb}-{method}"
+	e.AddPolicy("alice", "^/api$", "archive-POST", "allow")
+	r, _ := http.NewRequest("POST", "/api?op=archive", nil)
+	r.SetBasicAuth("alice", "123")
+	if w := serve(handler, r); w.Code != 200 {
+		t.Errorf("query action: %d, supposed to be 200", w.Code)
+	}
+}
+
+func TestCaddyfileActionSource(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		action_source header:X-Action
+		action_template "{method}/{verb}"
+		anonymous_subject guest
+		trailing_slash strip
+		keep_last_good
+		route_var route_pattern
+		user dave secret
+		user erin "two words"
+		auth_cache_ttl 30s
+		check_timeout 5s
+		basic_auth_mode token
+		cost 4
+		max_users 1000
+		optional_auth
+		user_header X-User
+		include_client_ip
+		trusted_proxies 10.0.0.0/8 192.0.2.1
+		trusted_proxies 2001:db8::/32
+		groups_header X-Remote-Groups
+		max_groups 8
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if a.AuthConfig.ActionSource != "header:X-Action" || a.AuthConfig.ActionTemplate != "{method}/{verb}" ||
+		a.AuthConfig.AnonymousSubject != "guest" || a.AuthConfig.TrailingSlash != TrailingSlashStrip ||
+		!a.AuthConfig.KeepLastGood || a.AuthConfig.RouteVar != "route_pattern" ||
+		a.AuthConfig.Users["dave"] != "secret" || a.AuthConfig.Users["erin"] != "two words" ||
+		time.Duration(a.AuthConfig.AuthCacheTTL) != 30*time.Second || time.Duration(a.AuthConfig.CheckTimeout) != 5*time.Second ||
+		a.AuthConfig.BasicAuthMode != BasicAuthToken ||
+		a.AuthConfig.Cost != 4 || a.AuthConfig.MaxUsers != 1000 || !a.AuthConfig.OptionalAuth || a.AuthConfig.UserHeader != "X-User" ||
+		!a.AuthConfig.IncludeClientIP || strings.Join(a.AuthConfig.TrustedProxies, " ") != "10.0.0.0/8 192.0.2.1 2001:db8::/32" ||
+		a.AuthConfig.GroupsHeader != "X-Remote-Groups" || a.AuthConfig.MaxGroups != 8 {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+
+	d = caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		bogus
+	}`)
+	if err := a.UnmarshalCaddyfile(d); err == nil {
+		t.Errorf("unknown subdirective accepted")
+	}
+}
+
+func TestCaddyfileBlockSyntax(t *testing.T) {
+	for _, input := range []string{
+		`authz /etc/caddy/model.conf /etc/caddy/policy.csv "My Realm" /etc/caddy/users.pass`,
+		`authz {
+			model /etc/caddy/model.conf
+			policy /etc/caddy/policy.csv
+			realm "My Realm"
+			password_file /etc/caddy/users.pass
+		}`,
+	} {
+		var a Authorizer
+		if err := a.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+			t.Errorf("%s: %s", input, err)
+			continue
+		}
+		if a.AuthConfig.ModelPath != "/etc/caddy/model.conf" || a.AuthConfig.PolicyPath != "/etc/caddy/policy.csv" ||
+			a.AuthConfig.Realm != "My Realm" || a.AuthConfig.PasswordFile != "/etc/caddy/users.pass" {
+			t.Errorf("%s: unexpected config: %+v", input, a.AuthConfig)
+		}
+	}
+
+	var a Authorizer
+	d := caddyfile.NewTestDispenser(`authz {
+		model model.conf
+		password_file users.pass
+		policy_redis redis.internal:6379
+	}`)
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Errorf("policy_redis without policy: %s", err)
+	}
+
+	for input, message := range map[string]string{
+		`authz model.conf policy.csv`:                                "argument count",
+		`authz model.conf policy.csv Realm users.pass extra`:         "argument count",
+		"authz {\n policy policy.csv\n password_file users.pass\n }": "missing model",
+		"authz {\n model model.conf\n password_file users.pass\n }":  "missing policy",
+		"authz {\n model model.conf\n policy policy.csv\n }":         "missing password_file",
+		"authz {\n model model.conf\n modle typo.conf\n }":           "'modle'",
+		"authz {\n model\n }":                                        "argument count",
+	} {
+		var a Authorizer
+		err := a.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input))
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%q: error %v, supposed to contain %q", input, err, message)
+		}
+	}
+}
+
+func TestEnforcerPanic(t *testing.T) {
+	m := casbin.NewModel(`
+[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act, eft
+
+[policy_effect]
+e = some(where (p.eft == allow)) && !some(where (p.eft == deny))
+
+[matchers]
+m = r.sub == p.sub && boom(r.obj)
+`)
+	e := casbin.NewEnforcer(m, fileadapter.NewAdapter("authz_policy.csv"))
+	e.AddFunction("boom", func(args ...interface{}) (interface{}, error) {
+		panic("boom")
+	})
+
+	core, logs := observer.New(zapcore.ErrorLevel)
+	handler := Authorizer{
+		Enforcer:      e,
+		PasswordCheck: testAuthProvider(t),
+		logger:        zap.New(core),
+	}
+
+	testRequest(t, handler, "alice", "/dataset1/resource1", "GET", 403)
+	// Once for alice and once for the anonymous subject.
+	if n := logs.FilterMessage("enforcer panicked, denying access").Len(); n != 2 {
+		t.Errorf("%d panics logged, supposed to be 2", n)
+	}
+}
+
+func TestAnonymousSubject(t *testing.T) {
+	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	e.AddPolicy("guest", "^/public/", "GET", "allow")
+
+	handler := Authorizer{
+		Enforcer:      e,
+		PasswordCheck: testAuthProvider(t),
+	}
+
+	testAnonymous := func(path string, code int) {
+		r, _ := http.NewRequest("GET", path, nil)
+		if w := serve(handler, r); w.Code != code {
+			t.Errorf("anonymous %s: %d, supposed to be %d", path, w.Code, code)
+		}
+	}
+
+	testAnonymous("/public/index.html", 401)
+
+	handler.AuthConfig.AnonymousSubject = "guest"
+	testAnonymous("/public/index.html", 200)
+	testAnonymous("/dataset1/resource1", 401)
+	testRequest(t, handler, "alice", "/public/index.html", "GET", 200)
+}
+
+func TestTrailingSlash(t *testing.T) {
+	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	e.AddPolicy("alice", "^/admin$", "GET", "allow")
+	e.AddPolicy("alice", "^/files/$", "GET", "allow")
+
+	handler := Authorizer{
+		Enforcer:      e,
+		PasswordCheck: testAuthProvider(t),
+	}
+
+	for _, test := range []struct {
+		mode              string
+		admin, adminSlash int
+		files, filesSlash int
+	}{
+		{"", 200, 403, 403, 200},
+		{TrailingSlashExact, 200, 403, 403, 200},
+		{TrailingSlashStrip, 200, 200, 403, 403},
+		{TrailingSlashRequire, 403, 403, 200, 200},
+		{TrailingSlashIgnore, 200, 200, 200, 200},
+	} {
+		handler.AuthConfig.TrailingSlash = test.mode
+		testRequest(t, handler, "alice", "/admin", "GET", test.admin)
+		testRequest(t, handler, "alice", "/admin/", "GET", test.adminSlash)
+		testRequest(t, handler, "alice", "/files", "GET", test.files)
+		testRequest(t, handler, "alice", "/files/", "GET", test.filesSlash)
+	}
+
+	handler.AuthConfig.TrailingSlash = TrailingSlashStrip
+	r, _ := http.NewRequest("GET", "/", nil)
+	if path := handler.getPath(r); path != "/" {
+		t.Errorf("root path stripped to %q", path)
+	}
+	r.URL.Path = "//"
+	if path := handler.getPath(r); path != "/" {
+		t.Errorf("// stripped to %q", path)
+	}
+}
+
+func TestReloadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	policyPath := filepath.Join(dir, "policy.csv")
+	writePolicy := func(policy string) {
+		if err := ioutil.WriteFile(policyPath, []byte(policy), 0600); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+	}
+
+	for _, keep := range []bool{true, false} {
+		writePolicy("p, alice, ^/dataset1/, GET, allow\n")
+		handler := Authorizer{
+			Enforcer:      casbin.NewEnforcer("authz_model.conf", policyPath),
+			PasswordCheck: testAuthProvider(t),
+		}
+		handler.AuthConfig.ModelPath = "authz_model.conf"
+		handler.AuthConfig.PolicyPath = policyPath
+		handler.AuthConfig.KeepLastGood = keep
+		testRequest(t, handler, "alice", "/dataset1/resource1", "GET", 200)
+
+		writePolicy("broken line\np, alice, ^/dataset1/, GET, allow\n")
+		if err := handler.ReloadPolicy(); err == nil {
+			t.Errorf("keep %t: broken policy reloaded without error", keep)
+		}
+		if keep {
+			testRequest(t, handler, "alice", "/dataset1/resource1", "GET", 200)
+		} else {
+			testRequest(t, handler, "alice", "/dataset1/resource1", "GET", 403)
+		}
+
+		writePolicy("")
+		err := handler.ReloadPolicy()
+		if keep {
+			if err != errEmptyPolicy {
+				t.Errorf("empty policy: %v, supposed to be %v", err, errEmptyPolicy)
+			}
+			testRequest(t, handler, "alice", "/dataset1/resource1", "GET", 200)
+		} else {
+			testRequest(t, handler, "alice", "/dataset1/resource1", "GET", 403)
+		}
+
+		writePolicy("p, alice, ^/dataset1/, GET, allow\np, alice, ^/dataset2/, GET, allow\n")
+		if err := handler.ReloadPolicy(); err != nil {
+			t.Errorf("keep %t: reload: %s", keep, err)
+		}
+		testRequest(t, handler, "alice", "/dataset2/resource1", "GET", 200)
+	}
+}
+
+func TestRouteVar(t *testing.T) {
+	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	e.AddPolicy("alice", "^/users/:id$", "GET", "allow")
+
+	handler := Authorizer{
+		Enforcer:      e,
+		PasswordCheck: testAuthProvider(t),
+	}
+	handler.AuthConfig.RouteVar = "route_pattern"
+
+	testRoute := func(path string, pattern interface{}, code int) {
+		r, _ := http.NewRequest("GET", path, nil)
+		r.SetBasicAuth("alice", "123")
+		vars := map[string]interface{}{}
+		if pattern != nil {
+			vars["route_pattern"] = pattern
+		}
+		r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, vars))
+		if w := serve(handler, r); w.Code != code {
+			t.Errorf("%s (%v): %d, supposed to be %d", path, pattern, w.Code, code)
+		}
+	}
+	testRoute("/users/123", "/users/:id", 200)
+	testRoute("/users/456", "/users/:id", 200)
+	testRoute("/users/456", nil, 403)
+	testRoute("/users/456", "", 403)
+	testRoute("/dataset1/resource1", nil, 200)
+
+	// Without vars in the context, the path is used.
+	testRequest(t, handler, "alice", "/dataset1/resource1", "GET", 200)
+}
+
+func TestBootstrapUsers(t *testing.T) {
+	handler := Authorizer{
+		Enforcer: casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+	}
+	handler.AuthConfig.PasswordFile = "bcrypt.pass"
+	handler.AuthConfig.Users = map[string]string{"dave": "secret", "alice": "changed"}
+	authProvider, _, err := handler.newPasswordCheck(&sharedPasswordCheck{handlers: []*Authorizer{&handler}})
+	if err != nil {
+		t.Fatalf("newPasswordCheck: %s", err)
+	}
+	handler.PasswordCheck = authProvider
+	handler.Enforcer.AddPolicy("dave", "^/dataset1/", "GET", "allow")
+
+	deadline := time.Now().Add(time.Second)
+	for len(authProvider.List()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, e := range authProvider.List() {
+		if e.Username == "dave" && bytes.Contains(e.PasswordHash, []byte("secret")) {
+			t.Errorf("plaintext password stored")
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "/dataset1/resource1", nil)
+	r.SetBasicAuth("dave", "secret")
+	if w := serve(handler, r); w.Code != 200 {
+		t.Errorf("bootstrap user: %d, supposed to be 200", w.Code)
+	}
+	r.SetBasicAuth("alice", "changed")
+	if w := serve(handler, r); w.Code != 200 {
+		t.Errorf("bootstrap user replacing file user: %d, supposed to be 200", w.Code)
+	}
+	testRequest(t, handler, "bob", "/dataset2/resource1", "GET", 200)
+}
+
+func TestDecisionTable(t *testing.T) {
+	e := casbin.NewEnforcer("authz_model.conf")
+	e.AddPolicy("alice", "^/private$", "GET", "allow")
+	e.AddPolicy("nobody", "^/public$", "GET", "allow")
+
+	handler := Authorizer{
+		Enforcer:      e,
+		PasswordCheck: testAuthProvider(t),
+	}
+
+	for _, test := range []struct {
+		user, password string
+		path           string
+		decision       int
+		code           int
+	}{
+		// No credentials.
+		{"", "", "/public", AccessAllowed, 200},
+		{"", "", "/private", MustAuthenticate, 401},
+		{"", "", "/other", MustAuthenticate, 401},
+		// Invalid credentials, even for resources the user could access.
+		{"alice", "wrong", "/public", InvalidCredentials, 401},
+		{"alice", "wrong", "/private", InvalidCredentials, 401},
+		{"alice", "wrong", "/other", InvalidCredentials, 401},
+		{"mallory", "123", "/other", InvalidCredentials, 401},
+		// Valid credentials.
+		{"alice", "123", "/public", AccessAllowed, 200},
+		{"alice", "123", "/private", AccessAllowed, 200},
+		{"alice", "123", "/other", AccessDenied, 403},
+		{"bob", "123", "/private", AccessDenied, 403},
+	} {
+		r, _ := http.NewRequest("GET", test.path, nil)
+		if test.user != "" {
+			r.SetBasicAuth(test.user, test.password)
+		}
+		if decision := handler.CheckPermission(r); decision != test.decision {
+			t.Errorf("%q/%q %s: decision %d, supposed to be %d", test.user, test.password, test.path, decision, test.decision)
+		}
+		w := serve(handler, r)
+		if w.Code != test.code {
+			t.Errorf("%q/%q %s: %d, supposed to be %d", test.user, test.password, test.path, w.Code, test.code)
+		}
+		// Only 401 responses prompt the client to authenticate again.
+		if challenged := w.Header().Get("WWW-Authenticate") != ""; challenged != (test.code == 401) {
+			t.Errorf("%q/%q %s: challenge %q", test.user, test.password, test.path, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestBasicAuthToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var users string
+	for user, token := range map[string]string{"ci-bot": "tok-ci", "deploy-bot": "tok-deploy"} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("GenerateFromPassword: %s", err)
+		}
+		users += user + ":" + string(hash) + "\n"
+	}
+	passwordPath := filepath.Join(dir, "tokens")
+	if err := ioutil.WriteFile(passwordPath, []byte(users), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	e.AddPolicy("ci-bot", "^/builds/", "GET", "allow")
+	e.AddPolicy("deploy-bot", "^/deploy$", "POST", "allow")
+	handler := Authorizer{Enforcer: e}
+	handler.AuthConfig.PasswordFile = passwordPath
+	handler.AuthConfig.BasicAuthMode = BasicAuthToken
+	if handler.authCache, err = newAuthCache(time.Minute, realClock{}); err != nil {
+		t.Fatalf("newAuthCache: %s", err)
+	}
+	if handler.tokens, err = newTokenIndex(); err != nil {
+		t.Fatalf("newTokenIndex: %s", err)
+	}
+	authProvider, _, err := handler.newPasswordCheck(&sharedPasswordCheck{handlers: []*Authorizer{&handler}})
+	if err != nil {
+		t.Fatalf("newPasswordCheck: %s", err)
+	}
+	handler.PasswordCheck = authProvider
+	for deadline := time.Now().Add(time.Second); len(authProvider.List()) != 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("password file not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	request := func(user, token, method, path string) int {
+		r, _ := http.NewRequest(method, path, nil)
+		r.SetBasicAuth(user, token)
+		return serve(handler, r).Code
+	}
+	for i := 0; i < 2; i++ { // the second round is answered from the auth cache
+		if code := request("", "tok-ci", "GET", "/builds/1"); code != 200 {
+			t.Errorf("token with empty user: %d, supposed to be 200", code)
+		}
+		if code := request("ignored", "tok-deploy", "POST", "/deploy"); code != 200 {
+			t.Errorf("token with ignored user: %d, supposed to be 200", code)
+		}
+		if code := request("", "tok-ci", "POST", "/deploy"); code != 403 {
+			t.Errorf("token of other identity: %d, supposed to be 403", code)
+		}
+		if code := request("ci-bot", "wrong", "GET", "/builds/1"); code != 401 {
+			t.Errorf("unknown token: %d, supposed to be 401", code)
+		}
+		if code := request("ci-bot", "", "GET", "/builds/1"); code != 401 {
+			t.Errorf("empty token: %d, supposed to be 401", code)
+		}
+	}
+
+	handler.AuthConfig.BasicAuthMode = BasicAuthUser
+	if code := request("", "tok-ci", "GET", "/builds/1"); code != 401 {
+		t.Errorf("token in user mode: %d, supposed to be 401", code)
+	}
+	if code := request("ci-bot", "tok-ci", "GET", "/builds/1"); code != 200 {
+		t.Errorf("user and password in user mode: %d, supposed to be 200", code)
+	}
+}
+
+func TestOptionalAuth(t *testing.T) {
+	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	e.AddPolicy("guest", "^/public", "GET", "allow")
+	handler := Authorizer{Enforcer: e, PasswordCheck: testAuthProvider(t)}
+	handler.AuthConfig.AnonymousSubject = "guest"
+	handler.AuthConfig.OptionalAuth = true
+	handler.AuthConfig.UserHeader = "X-User"
+
+	tests := []struct {
+		name, user, password, path string
+		code                       int
+		identified                 string
+	}{
+		{"anonymous", "", "", "/public", 200, ""},
+		{"valid user", "alice", "123", "/public", 200, "alice"},
+		{"invalid credentials", "alice", "wrong", "/public", 200, ""},
+		{"invalid credentials on protected resource", "alice", "wrong", "/dataset1/resource1", 401, ""},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", test.path, nil)
+		if test.user != "" {
+			r.SetBasicAuth(test.user, test.password)
+		}
+		r.Header.Set("X-User", "root")
+		repl := caddy.NewReplacer()
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+		var header string
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			header = r.Header.Get("X-User")
+			return nil
+		}))
+		if w.Code != test.code {
+			t.Errorf("%s: %d, supposed to be %d", test.name, w.Code, test.code)
+			continue
+		}
+		placeholder, _ := repl.GetString("http.auth.user.id")
+		if test.code == 200 && (header != test.identified || placeholder != test.identified) {
+			t.Errorf("%s: user header %q, placeholder %q, supposed to be %q", test.name, header, placeholder, test.identified)
+		}
+	}
+
+	handler.AuthConfig.OptionalAuth = false
+	r, _ := http.NewRequest("GET", "/public", nil)
+	r.SetBasicAuth("alice", "wrong")
+	if w := serve(handler, r); w.Code != 401 {
+		t.Errorf("invalid credentials without optional auth: %d, supposed to be 401", w.Code)
+	}
+}
+
+func TestAnonymousFallback(t *testing.T) {
+	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	e.AddPolicy("guest", "^/public", "GET", "allow")
+	for _, fallback := range []bool{false, true} {
+		config := "authz authz_model.conf authz_policy.csv Realm bcrypt.pass {\n\tanonymous_subject guest\n"
+		if fallback {
+			config += "\tanonymous_fallback\n"
+		}
+		d := caddyfile.NewTestDispenser(config + "}")
+		var handler Authorizer
+		if err := handler.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("UnmarshalCaddyfile: %s", err)
+		}
+		if handler.AuthConfig.AnonymousFallback != fallback || handler.AuthConfig.OptionalAuth {
+			t.Fatalf("unexpected config: %+v", handler.AuthConfig)
+		}
+		raw, err := json.Marshal(handler.AuthConfig)
+		if err != nil {
+			t.Fatalf("Marshal: %s", err)
+		}
+		if strings.Contains(string(raw), `"anonymous_fallback":true`) != fallback {
+			t.Errorf("anonymous_fallback %t not in JSON: %s", fallback, raw)
+		}
+		handler.Enforcer = e
+		handler.PasswordCheck = testAuthProvider(t)
+
+		invalid := 401
+		if fallback {
+			invalid = 200
+		}
+		for _, test := range []struct {
+			user, password, path string
+			code                 int
+		}{
+			{"", "", "/public", 200},
+			{"alice", "123", "/public", 200},
+			{"alice", "wrong", "/public", invalid},
+			{"alice", "wrong", "/dataset1/resource1", 401},
+		} {
+			r, _ := http.NewRequest("GET", test.path, nil)
+			if test.user != "" {
+				r.SetBasicAuth(test.user, test.password)
+			}
+			if w := serve(handler, r); w.Code != test.code {
+				t.Errorf("anonymous_fallback %t, %q/%q %s: %d, supposed to be %d",
+					fallback, test.user, test.password, test.path, w.Code, test.code)
+			}
+		}
+	}
+}
+
+func TestTrustedUserHeader(t *testing.T) {
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+	handler.AuthConfig.TrustedUserHeader = "X-Remote-User"
+	handler.AuthConfig.DenyUsers = []string{"root"}
+
+	tests := []struct {
+		name, header, basicUser, path string
+		code                          int
+	}{
+		{"trusted user", "alice", "", "/dataset1/resource1", 200},
+		{"forbidden", "alice", "", "/dataset2/resource1", 403},
+		{"no header", "", "", "/dataset1/resource1", 401},
+		{"basic auth ignored", "", "alice", "/dataset1/resource1", 401},
+		{"header wins over basic auth", "bob", "alice", "/dataset1/resource1", 403},
+		{"denied user", "root", "", "/dataset1/resource1", 401},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", test.path, nil)
+		if test.header != "" {
+			r.Header.Set("X-Remote-User", test.header)
+		}
+		if test.basicUser != "" {
+			r.SetBasicAuth(test.basicUser, "123")
+		}
+		w := serve(handler, r)
+		if w.Code != test.code {
+			t.Errorf("%s: %d, supposed to be %d", test.name, w.Code, test.code)
+		}
+		if w.Header().Get("WWW-Authenticate") != "" {
+			t.Errorf("%s: challenge %q", test.name, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestIncludeClientIP(t *testing.T) {
+	m := casbin.NewModel(`
+[request_definition]
+r = sub, obj, act, ip
+
+[policy_definition]
+p = sub, obj, act, ip
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = r.sub == p.sub && keyMatch(r.obj, p.obj) && r.act == p.act && ipMatch(r.ip, p.ip)
+`)
+	e := casbin.NewEnforcer(m)
+	e.AddPolicy("alice", "/admin/*", "GET", "10.0.0.0/8")
+	handler := Authorizer{Enforcer: e, PasswordCheck: testAuthProvider(t)}
+	handler.AuthConfig.IncludeClientIP = true
+	handler.trustedProxies, _ = parseIPRanges([]string{"192.0.2.1"})
+
+	tests := []struct {
+		remote, forwarded string
+		code              int
+	}{
+		{"10.1.2.3:5000", "", 200},
+		{"198.51.100.7:5000", "", 403},
+		{"198.51.100.7:5000", "10.1.2.3", 403},
+		{"192.0.2.1:5000", "10.1.2.3", 200},
+		{"192.0.2.1:5000", "198.51.100.7", 403},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/admin/users", nil)
+		r.SetBasicAuth("alice", "123")
+		r.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if w := serve(handler, r); w.Code != test.code {
+			t.Errorf("%s %q: %d, supposed to be %d", test.remote, test.forwarded, w.Code, test.code)
+		}
+	}
+}
+
+func TestLargePasswordFile(t *testing.T) {
+	const users = 50000
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var content bytes.Buffer
+	content.WriteString("$6\n")
+	for i := 0; i < users; i++ {
+		fmt.Fprintf(&content, "user%d:$2y$06$lcPirp7mnYIYBROnwnMvSu8hw2FBWKeHfFX63NtJ2ISoAK7s8PHNm\n", i)
+	}
+	path := filepath.Join(dir, "users.pass")
+	if err := ioutil.WriteFile(path, content.Bytes(), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	var a Authorizer
+	a.AuthConfig.PasswordFile = path
+	a.AuthConfig.LoadTimeout = caddy.Duration(time.Minute)
+	a.AuthConfig.WatchInterval = caddy.Duration(time.Hour)
+	service, _, err := a.newPasswordCheck(&sharedPasswordCheck{handlers: []*Authorizer{&a}})
+	if err != nil {
+		t.Fatalf("newPasswordCheck: %s", err)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for len(service.List()) < users && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := len(service.List()); n != users {
+		t.Fatalf("%d users loaded, supposed to be %d", n, users)
+	}
+	if err := service.Authenticate(fmt.Sprintf("user%d", users-1), "123"); err != nil {
+		t.Errorf("last user: %s", err)
+	}
+}
+
+func TestCaddyfileLoadTimeout(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		load_timeout 30s
+		watch_interval 1m
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if a.loadTimeout() != 30*time.Second || a.watchInterval() != time.Minute {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+	var defaults Authorizer
+	if defaults.loadTimeout() != DefaultLoadTimeout || defaults.watchInterval() != DefaultWatchInterval {
+		t.Errorf("unexpected defaults: %s, %s", defaults.loadTimeout(), defaults.watchInterval())
+	}
+
+	d = caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		load_timeout soon
+	}`)
+	if err := a.UnmarshalCaddyfile(d); err == nil {
+		t.Errorf("invalid load_timeout accepted")
+	}
+}
+
+func TestDenyUsers(t *testing.T) {
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+	handler.AuthConfig.DenyUsers = []string{"root", " ALICE "}
+	handler.AuthConfig.SessionKey = "0123456789abcdef0123456789abcdef"
+
+	testRequest(t, handler, "alice", "/dataset1/resource1", "GET", 401)
+	testRequest(t, handler, "bob", "/dataset2/resource1", "GET", 200)
+
+	r, _ := http.NewRequest("GET", "/dataset1/resource1", nil)
+	r.AddCookie(&http.Cookie{Name: DefaultSessionCookie, Value: handler.signSession("alice", time.Now().Add(time.Hour))})
+	if w := serve(handler, r); w.Code != 401 {
+		t.Errorf("session of denied user: %d, supposed to be 401", w.Code)
+	}
+
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		deny_user root admin
+		deny_user svc-old
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if strings.Join(a.AuthConfig.DenyUsers, ",") != "root,admin,svc-old" {
+		t.Errorf("unexpected deny list: %v", a.AuthConfig.DenyUsers)
+	}
+}
+
+func TestHtpasswdFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	hash, err := bcrypt.GenerateFromPassword([]byte("123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	path := filepath.Join(dir, ".htpasswd")
+	// The password of bob is "secret", hashed with htpasswd -m.
+	content := "alice:" + string(hash) + "\nbob:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	for _, allow := range []bool{false, true} {
+		var a Authorizer
+		a.AuthConfig.PasswordFile = path
+		a.AuthConfig.PasswordFormat = PasswordFormatHtpasswd
+		a.AuthConfig.AllowInsecureHashes = allow
+		service, _, err := a.newPasswordCheck(&sharedPasswordCheck{handlers: []*Authorizer{&a}})
+		if err != nil {
+			t.Fatalf("newPasswordCheck: %s", err)
+		}
+		if !waitFor(time.Second, func() bool { return service.Authenticate("alice", "123") == nil }) {
+			t.Fatalf("htpasswd file not loaded")
+		}
+		if ok := service.Authenticate("bob", "secret") == nil; ok != allow {
+			t.Errorf("allow insecure hashes %v: md5 hash accepted %v", allow, ok)
+		}
+	}
+
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm .htpasswd {
+		password_format htpasswd
+		allow_insecure_hashes
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if a.AuthConfig.PasswordFormat != PasswordFormatHtpasswd || !a.AuthConfig.AllowInsecureHashes {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	handler := &Authorizer{Enforcer: casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")}
+	handler.AuthConfig.TrustedUserHeader = "X-Remote-User"
+	r, _ := http.NewRequest("GET", "/dataset1/resource1", nil)
+	r.Header.Set("X-Remote-User", "alice")
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r, next)
+		if w.Code != 200 {
+			b.Fatalf("%d, supposed to be 200", w.Code)
+		}
+	}
+}
+
+func TestDecisionLog(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+		logger:        zap.New(core),
+	}
+	r, _ := http.NewRequest("DELETE", "/dataset2/resource1", nil)
+	r.SetBasicAuth("alice", "123")
+	if w := serve(handler, r); w.Code != 403 {
+		t.Fatalf("%d, supposed to be 403", w.Code)
+	}
+
+	entries := logs.FilterMessage("authorization decision").All()
+	if len(entries) != 1 {
+		t.Fatalf("%d decision log entries, supposed to be 1", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	expected := map[string]interface{}{
+		"subject":         "alice",
+		"path":            "/dataset2/resource1",
+		"method":          "DELETE",
+		"authenticated":   true,
+		"authorize_level": "none",
+		"decision":        "denied",
+	}
+	for key, value := range expected {
+		if fields[key] != value {
+			t.Errorf("%s: %v, supposed to be %v", key, fields[key], value)
+		}
+	}
+	for _, field := range entries[0].Context {
+		if strings.Contains(field.String, "123") {
+			t.Errorf("password logged in field %s", field.Key)
+		}
+	}
+}
+
+func TestCostOverride(t *testing.T) {
+	var a Authorizer
+	a.AuthConfig.PasswordFile = "bcrypt.pass"
+	a.AuthConfig.Cost = 12
+	service, _, err := a.newPasswordCheck(&sharedPasswordCheck{handlers: []*Authorizer{&a}})
+	if err != nil {
+		t.Fatalf("newPasswordCheck: %s", err)
+	}
+	defer a.Cleanup()
+	if !waitFor(2*time.Second, func() bool { return len(service.List()) > 0 }) {
+		t.Fatalf("password file not loaded")
+	}
+	if cost := service.GetCost(); cost != 12 {
+		t.Errorf("cost %d, supposed to be 12", cost)
+	}
+	if err := service.Add("dave", "secret"); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	for _, entry := range service.List() {
+		if entry.Username != "dave" {
+			continue
+		}
+		if cost, err := bcrypt.Cost(entry.PasswordHash); err != nil || cost != 12 {
+			t.Errorf("added user has cost %d (%v), supposed to be 12", cost, err)
+		}
+		return
+	}
+	t.Errorf("added user not listed")
+}
+
+func TestMethodAliases(t *testing.T) {
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+	// HEAD is allowed wherever GET is.
+	testRequest(t, handler, "alice", "/dataset1/resource1", "HEAD", 200)
+	testRequest(t, handler, "alice", "/dataset1/resource2", "HEAD", 200)
+	testRequest(t, handler, "alice", "/dataset2/resource1", "HEAD", 403)
+	testRequest(t, handler, "bob", "/dataset2/resource2", "HEAD", 200)
+
+	handler.AuthConfig.MethodAliases = map[string]string{}
+	testRequest(t, handler, "alice", "/dataset1/resource1", "HEAD", 403)
+	testRequest(t, handler, "alice", "/dataset1/resource1", "GET", 200)
+
+	handler.AuthConfig.MethodAliases = map[string]string{"PATCH": "POST"}
+	testRequest(t, handler, "alice", "/dataset1/resource1", "PATCH", 200)
+	testRequest(t, handler, "alice", "/dataset1/resource2", "PATCH", 403)
+	testRequest(t, handler, "alice", "/dataset1/resource1", "HEAD", 403)
+}
+
+func TestCaddyfileMethodAlias(t *testing.T) {
+	for _, test := range []struct {
+		block   string
+		aliases map[string]string
+	}{
+		{"", nil},
+		{"method_alias patch post", map[string]string{"HEAD": "GET", "PATCH": "POST"}},
+		{"method_alias off", map[string]string{}},
+		{"method_alias off\nmethod_alias PATCH POST", map[string]string{"PATCH": "POST"}},
+	} {
+		d := caddyfile.NewTestDispenser("authz model.conf policy.csv Realm bcrypt.pass {\n" + test.block + "\n}")
+		var a Authorizer
+		if err := a.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("%q: UnmarshalCaddyfile: %s", test.block, err)
+		}
+		if fmt.Sprint(a.AuthConfig.MethodAliases) != fmt.Sprint(test.aliases) ||
+			(a.AuthConfig.MethodAliases == nil) != (test.aliases == nil) {
+			t.Errorf("%q: %v, supposed to be %v", test.block, a.AuthConfig.MethodAliases, test.aliases)
+		}
+	}
+}
+
+func TestKeyMatchModel(t *testing.T) {
+	config := `{
+		"admin": {"disabled": true, "config": {"persist": false}},
+		"apps": {"authz_provision_test": {"handler": {"auth_config": {
+			"model_path": "authz_keymatch_model.conf",
+			"policy_path": "authz_keymatch_policy.csv",
+			"password_file": "bcrypt.pass"
+		}}}}
+	}`
+	if err := caddy.Load([]byte(config), true); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	defer caddy.Stop()
+	handler := provisionedHandler.(*Authorizer)
+	handler.PasswordCheck = testAuthProvider(t)
+
+	testRequest(t, *handler, "alice", "/users/42", "GET", 200)
+	testRequest(t, *handler, "alice", "/users/42/posts/7", "GET", 200)
+	testRequest(t, *handler, "alice", "/users/42/posts", "GET", 403)
+	testRequest(t, *handler, "alice", "/users/42", "DELETE", 403)
+	testRequest(t, *handler, "bob", "/users/42", "DELETE", 200)
+	testRequest(t, *handler, "bob", "/users", "DELETE", 403)
+
+	// keyMatch3 is not registered by Casbin itself.
+	e := casbin.NewEnforcer(casbin.NewModel(`
+[request_definition]
+r = sub, obj, act
+[policy_definition]
+p = sub, obj, act
+[policy_effect]
+e = some(where (p.eft == allow))
+[matchers]
+m = r.sub == p.sub && keyMatch3(r.obj, p.obj) && r.act == p.act
+`))
+	e.AddPolicy("alice", "/users/{id}", "GET")
+	registerMatchFunctions(e)
+	if !e.Enforce("alice", "/users/42", "GET") || e.Enforce("alice", "/users/42/posts", "GET") {
+		t.Errorf("keyMatch3 policy not applied")
+	}
+}
+
+func TestCaseInsensitiveUsernames(t *testing.T) {
+	for _, insensitive := range []bool{false, true} {
+		input := `authz authz_model.conf authz_policy.csv Test bcrypt.pass`
+		if insensitive {
+			input += ` {
+				case_insensitive_usernames
+			}`
+		}
+		handler, _ := loadCaddyfile(t, input)
+		for _, user := range []string{"alice", "Alice", "ALICE"} {
+			code := 200
+			if user != "alice" && !insensitive {
+				code = 401
+			}
+			testRequest(t, *handler, user, "/dataset1/resource1", "GET", code)
+		}
+		// The policy is checked for the lowercased user.
+		code := 401
+		if insensitive {
+			code = 200
+		}
+		testRequest(t, *handler, "BoB", "/dataset2/resource1", "GET", code)
+		caddy.Stop()
+	}
+}
+
+// blockingCheck is a password check that doesn't answer until the context of
+// the request is done, after reporting the check on started.
+type blockingCheck struct {
+	authfile.IAuthenticationService
+	started chan struct{}
+}
+
+func (c *blockingCheck) AuthenticateContext(ctx context.Context, username, password string) error {
+	c.started <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCheckDeadline(t *testing.T) {
+	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	check := &blockingCheck{IAuthenticationService: testAuthProvider(t), started: make(chan struct{}, 1)}
+	handler := Authorizer{Enforcer: e, PasswordCheck: check}
+	handler.AuthConfig.Realm = "Test"
+
+	// The client goes away while the password is checked.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-check.started
+		cancel()
+	}()
+	r, _ := http.NewRequest("GET", "/dataset1/resource1", nil)
+	r.SetBasicAuth("alice", "123")
+	w := serve(handler, r.WithContext(ctx))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("canceled request: %d, supposed to be 503", w.Code)
+	}
+	if challenge := w.Header().Get("WWW-Authenticate"); challenge != "" {
+		t.Errorf("canceled request: challenge %q", challenge)
+	}
+
+	handler.AuthConfig.CheckTimeout = caddy.Duration(10 * time.Millisecond)
+	testRequest(t, handler, "alice", "/dataset1/resource1", "GET", http.StatusServiceUnavailable)
+	<-check.started
+	if decision := handler.CheckPermission(r); decision != Unavailable {
+		t.Errorf("timed out check: decision %d, supposed to be Unavailable", decision)
+	}
+	<-check.started
+
+	// A request already done isn't authorized, even if it needs no
+	// password check.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	r, _ = http.NewRequest("GET", "/dataset1/resource1", nil)
+	if decision := handler.CheckPermission(r.WithContext(ctx)); decision != Unavailable {
+		t.Errorf("done request: decision %d, supposed to be Unavailable", decision)
+	}
+}
@@ -0,0 +1,45 @@
+package authz
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Identity sources of TLS client certificates.
+const (
+	// IdentityTLSCN takes the user from the common name of the subject of
+	// the verified TLS client certificate.
+	IdentityTLSCN = "tls_cn"
+	// IdentityTLSSANEmail takes the user from the first email address of
+	// the subject alternative names of the verified TLS client
+	// certificate.
+	IdentityTLSSANEmail = "tls_san_email"
+)
+
+// clientCertIdentity reports whether the user is taken from the TLS client
+// certificate.
+func (a *Authorizer) clientCertIdentity() bool {
+	switch a.AuthConfig.IdentitySource {
+	case IdentityTLSCN, IdentityTLSSANEmail:
+		return true
+	}
+	return false
+}
+
+// clientCertUser returns the user of the TLS client certificate of r, empty
+// if there is none. Only a certificate verified against the trusted CAs of
+// the TLS connection counts; the certificates a client merely presents are
+// never trusted.
+func (a *Authorizer) clientCertUser(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if a.AuthConfig.IdentitySource == IdentityTLSSANEmail {
+		if len(cert.EmailAddresses) == 0 {
+			return ""
+		}
+		return strings.TrimSpace(cert.EmailAddresses[0])
+	}
+	return strings.TrimSpace(cert.Subject.CommonName)
+}
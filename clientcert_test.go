@@ -0,0 +1,142 @@
+package authz
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/casbin/casbin"
+)
+
+// testCert returns a certificate for name and email, signed by parent, or
+// self-signed if parent is nil.
+func testCert(t *testing.T, name, email string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if email != "" {
+		template.EmailAddresses = []string{email}
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	ca := testCert(t, "Test CA", "", nil)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	aliceCert := testCert(t, "alice", "alice@example.com", &ca)
+	// A certificate a client merely presents, not signed by a trusted CA.
+	forgedCert := testCert(t, "alice", "alice@example.com", nil)
+
+	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	e.AddPolicy("alice@example.com", "/dataset1/resource1", "GET", "allow")
+	handler := &Authorizer{
+		Enforcer:      e,
+		PasswordCheck: testAuthProvider(t),
+	}
+	handler.AuthConfig.Realm = "Test"
+
+	for _, test := range []struct {
+		source     string
+		clientAuth tls.ClientAuthType
+		cert       *tls.Certificate
+		basicAuth  bool
+		code       int
+	}{
+		{IdentityTLSCN, tls.VerifyClientCertIfGiven, &aliceCert, false, 200},
+		{IdentityTLSSANEmail, tls.VerifyClientCertIfGiven, &aliceCert, false, 200},
+		// Without a certificate, the request is anonymous, even with
+		// basic authentication.
+		{IdentityTLSCN, tls.VerifyClientCertIfGiven, nil, false, 401},
+		{IdentityTLSCN, tls.VerifyClientCertIfGiven, nil, true, 401},
+		// Unverified certificates are never trusted.
+		{IdentityTLSCN, tls.RequestClientCert, &forgedCert, false, 401},
+		{IdentityTLSCN, tls.RequestClientCert, &aliceCert, false, 401},
+	} {
+		handler.AuthConfig.IdentitySource = test.source
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+				return nil
+			}))
+		}))
+		server.TLS = &tls.Config{ClientAuth: test.clientAuth, ClientCAs: clientCAs}
+		server.StartTLS()
+
+		client := server.Client()
+		if test.cert != nil {
+			client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{*test.cert}
+		}
+		r, _ := http.NewRequest("GET", server.URL+"/dataset1/resource1", nil)
+		if test.basicAuth {
+			r.SetBasicAuth("alice", "123")
+		}
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatalf("%s %v: %s", test.source, test.clientAuth, err)
+		}
+		resp.Body.Close()
+		server.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%s %v, cert %t: %d, supposed to be %d", test.source, test.clientAuth, test.cert != nil, resp.StatusCode, test.code)
+		}
+		if challenge := resp.Header.Get("WWW-Authenticate"); challenge != "" {
+			t.Errorf("%s: challenge %q", test.source, challenge)
+		}
+	}
+}
+
+func TestClientCertUser(t *testing.T) {
+	cert := testCert(t, " alice ", "alice@example.com", nil)
+	var a Authorizer
+	a.AuthConfig.IdentitySource = IdentityTLSCN
+	r, _ := http.NewRequest("GET", "/", nil)
+	if user := a.clientCertUser(r); user != "" {
+		t.Errorf("user %q without TLS", user)
+	}
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}
+	if user := a.clientCertUser(r); user != "" {
+		t.Errorf("user %q of an unverified certificate", user)
+	}
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{cert.Leaf}}
+	if user := a.clientCertUser(r); user != "alice" {
+		t.Errorf("user %q, supposed to be alice", user)
+	}
+	a.AuthConfig.IdentitySource = IdentityTLSSANEmail
+	if user := a.clientCertUser(r); user != "alice@example.com" {
+		t.Errorf("user %q, supposed to be alice@example.com", user)
+	}
+}
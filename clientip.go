@@ -0,0 +1,99 @@
+package authz
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseIP parses an address as found in r.RemoteAddr or in forwarding headers.
+// The address may carry a port, IPv6 addresses may be bracketed and may carry
+// a zone identifier, which is dropped: "1.2.3.4:80", "[::1]:443", "fe80::1%eth0".
+func parseIP(addr string) (net.IP, error) {
+	host := strings.TrimSpace(addr)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else if strings.HasPrefix(host, "[") {
+		if !strings.HasSuffix(host, "]") {
+			return nil, fmt.Errorf("invalid IP address %q", addr)
+		}
+		host = host[1 : len(host)-1]
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return ip, nil
+}
+
+// ipRanges is a list of IPv4 and IPv6 networks.
+type ipRanges []*net.IPNet
+
+// parseIPRanges parses a list of CIDR ranges. Single addresses are accepted
+// and match only themselves.
+func parseIPRanges(list []string) (ipRanges, error) {
+	ranges := make(ipRanges, 0, len(list))
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			_, ipNet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP range %q: %v", s, err)
+			}
+			ranges = append(ranges, ipNet)
+			continue
+		}
+		ip, err := parseIP(s)
+		if err != nil {
+			return nil, err
+		}
+		bits := 8 * len(ip)
+		ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return ranges, nil
+}
+
+// contains reports whether ip is within any of the ranges.
+func (ranges ipRanges) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range ranges {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of r. If the peer is a trusted
+// proxy, the X-Forwarded-For header is read from the right, skipping trusted
+// proxies, and the first untrusted address is the client. Addresses left of
+// it could be forged by the client and are never used.
+func (a *Authorizer) clientIP(r *http.Request) string {
+	ip, err := parseIP(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	if !a.trustedProxies.contains(ip) {
+		return ip.String()
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := parseIP(forwarded[i])
+		if err != nil {
+			break
+		}
+		ip = hop
+		if !a.trustedProxies.contains(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
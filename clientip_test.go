@@ -0,0 +1,110 @@
+package authz
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseIP(t *testing.T) {
+	for _, test := range []struct {
+		addr string
+		ip   string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:8080", "192.0.2.1"},
+		{" 192.0.2.1 ", "192.0.2.1"},
+		{"::1", "::1"},
+		{"[::1]", "::1"},
+		{"[::1]:443", "::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]:8443", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"[fe80::1%eth0]:80", "fe80::1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+	} {
+		ip, err := parseIP(test.addr)
+		if err != nil {
+			t.Errorf("%q: %s", test.addr, err)
+			continue
+		}
+		if ip.String() != test.ip {
+			t.Errorf("%q: %s, supposed to be %s", test.addr, ip, test.ip)
+		}
+	}
+
+	for _, addr := range []string{"", "localhost", "localhost:80", "192.0.2", "[::1", "::1]", "[192.0.2.1:80", "%eth0", "999.0.0.1"} {
+		if ip, err := parseIP(addr); err == nil {
+			t.Errorf("%q: parsed as %s, supposed to fail", addr, ip)
+		}
+	}
+}
+
+func TestIPRanges(t *testing.T) {
+	ranges, err := parseIPRanges([]string{"10.0.0.0/8", "192.0.2.7", "2001:db8::/32", "::1"})
+	if err != nil {
+		t.Fatalf("parseIPRanges: %s", err)
+	}
+	for _, test := range []struct {
+		addr     string
+		contains bool
+	}{
+		{"10.1.2.3:1234", true},
+		{"11.0.0.1", false},
+		{"192.0.2.7:80", true},
+		{"192.0.2.8", false},
+		{"[2001:db8:1::5]:443", true},
+		{"2001:db9::1", false},
+		{"[::1]:80", true},
+		{"::ffff:10.0.0.1", true},
+		{"[fe80::1%eth0]:80", false},
+	} {
+		ip, err := parseIP(test.addr)
+		if err != nil {
+			t.Errorf("%q: %s", test.addr, err)
+			continue
+		}
+		if ranges.contains(ip) != test.contains {
+			t.Errorf("%q: contains %t, supposed to be %t", test.addr, !test.contains, test.contains)
+		}
+	}
+	if ranges.contains(nil) {
+		t.Errorf("nil IP must not match")
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "2001:db8::/129", "not-an-ip", "10.0.0.0/x"} {
+		if _, err := parseIPRanges([]string{bad}); err == nil {
+			t.Errorf("%q: supposed to fail", bad)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	var a Authorizer
+	var err error
+	if a.trustedProxies, err = parseIPRanges([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatalf("parseIPRanges: %s", err)
+	}
+	for _, test := range []struct {
+		remote    string
+		forwarded []string
+		ip        string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		{"192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.9", "198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		for _, value := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if ip := a.clientIP(r); ip != test.ip {
+			t.Errorf("%s %q: %s, supposed to be %s", test.remote, test.forwarded, ip, test.ip)
+		}
+	}
+}
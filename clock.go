@@ -0,0 +1,25 @@
+package authz
+
+import "time"
+
+// Clock tells the time. Time-based features read the time from the clock of
+// the Authorizer, so that tests can control it.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the wall clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// getClock returns the clock of the Authorizer, the wall clock unless another
+// one is set.
+func (a *Authorizer) getClock() Clock {
+	if a.clock == nil {
+		return realClock{}
+	}
+	return a.clock
+}
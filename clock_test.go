@@ -0,0 +1,78 @@
+package authz
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/casbin/casbin"
+)
+
+// fakeClock is a clock that only moves when advanced.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, time.January, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestFakeClockSessionExpiry(t *testing.T) {
+	clock := newFakeClock()
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+		clock:         clock,
+	}
+	handler.AuthConfig.SessionKey = "0123456789abcdef0123456789abcdef"
+	handler.AuthConfig.SessionTTL = caddy.Duration(time.Hour)
+	handler.AuthConfig.ExpiryGrace = caddy.Duration(time.Minute)
+	handler.AuthConfig.LoginPath = "/login"
+
+	r, _ := http.NewRequest("POST", "/login", nil)
+	r.SetBasicAuth("alice", "123")
+	w := serve(handler, r)
+	if w.Code != 204 || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("login: %d", w.Code)
+	}
+	cookie := w.Result().Cookies()[0]
+	if !cookie.Expires.Equal(clock.Now().Add(time.Hour).Truncate(time.Second)) {
+		t.Errorf("cookie expires %s, supposed to be an hour after %s", cookie.Expires, clock.Now())
+	}
+
+	steps := []struct {
+		advance time.Duration
+		method  string
+		code    int
+	}{
+		{59 * time.Minute, "POST", 200},
+		{time.Minute, "POST", 401},
+		{0, "GET", 200},
+		{59 * time.Second, "GET", 200},
+		{time.Second, "GET", 401},
+	}
+	for _, step := range steps {
+		clock.Advance(step.advance)
+		r := sessionRequest(cookie, "/dataset1/resource1")
+		r.Method = step.method
+		if w := serve(handler, r); w.Code != step.code {
+			t.Errorf("%s at %s: %d, supposed to be %d", step.method, clock.Now(), w.Code, step.code)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package authz
+
+import (
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// DecisionHook gets the final say on a request after the policy has been
+// evaluated. Decision hooks are Caddy modules in the http.authz.hooks
+// namespace.
+type DecisionHook interface {
+	// Decide returns the final decision, one of MustAuthenticate,
+	// AccessAllowed, AccessDenied or InvalidCredentials, given the
+	// request, the authenticated user, empty if there is none, and the
+	// decision of the policy.
+	// If an error is returned, the request is not allowed.
+	Decide(r *http.Request, user string, decision int) (int, error)
+}
+
+// decide passes the decision to the decision hook, if one is configured. The
+// hook fails closed: if it errors, panics or returns an unknown decision, an
+// allowed request is denied and any other decision is kept.
+func (a *Authorizer) decide(r *http.Request, user string, decision int) int {
+	if a.decisionHook == nil {
+		return decision
+	}
+	final, err := a.callDecisionHook(r, user, decision)
+	if err == nil {
+		switch final {
+		case MustAuthenticate, AccessAllowed, AccessDenied, InvalidCredentials:
+			return final
+		}
+		err = fmt.Errorf("unknown decision %d", final)
+	}
+	a.getLogger().Error("decision hook failed, not allowing access",
+		zap.String("user", user),
+		zap.String("path", r.URL.Path),
+		zap.Error(err))
+	if decision == AccessAllowed {
+		return AccessDenied
+	}
+	return decision
+}
+
+// callDecisionHook calls the decision hook, returning a panic as error.
+func (a *Authorizer) callDecisionHook(r *http.Request, user string, decision int) (final int, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("panic: %v", rec)
+		}
+	}()
+	return a.decisionHook.Decide(r, user, decision)
+}
@@ -0,0 +1,121 @@
+package authz
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/casbin/casbin"
+)
+
+// funcHook is a DecisionHook calling a function.
+type funcHook func(r *http.Request, user string, decision int) (int, error)
+
+func (f funcHook) Decide(r *http.Request, user string, decision int) (int, error) {
+	return f(r, user, decision)
+}
+
+func TestDecisionHook(t *testing.T) {
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+
+	// Always allow the service account bob, deny alice.
+	handler.decisionHook = funcHook(func(r *http.Request, user string, decision int) (int, error) {
+		switch user {
+		case "bob":
+			return AccessAllowed, nil
+		case "alice":
+			return AccessDenied, nil
+		}
+		return decision, nil
+	})
+	testRequest(t, handler, "bob", "/dataset1/resource1", "GET", 200)
+	testRequest(t, handler, "alice", "/dataset1/resource1", "GET", 403)
+	testRequest(t, handler, "cathy", "/dataset1/item", "GET", 200)
+	testRequest(t, handler, "", "/dataset1/resource1", "GET", 401)
+
+	// Failing hooks never allow.
+	for name, hook := range map[string]funcHook{
+		"error": func(r *http.Request, user string, decision int) (int, error) {
+			return AccessAllowed, errors.New("backend unavailable")
+		},
+		"panic": func(r *http.Request, user string, decision int) (int, error) {
+			panic("boom")
+		},
+		"unknown decision": func(r *http.Request, user string, decision int) (int, error) {
+			return 42, nil
+		},
+	} {
+		handler.decisionHook = hook
+		r, _ := http.NewRequest("GET", "/dataset1/resource1", nil)
+		r.SetBasicAuth("alice", "123")
+		if w := serve(handler, r); w.Code != 403 {
+			t.Errorf("%s: allowed request: %d, supposed to be 403", name, w.Code)
+		}
+		r, _ = http.NewRequest("GET", "/dataset1/resource1", nil)
+		if w := serve(handler, r); w.Code != 401 {
+			t.Errorf("%s: anonymous request: %d, supposed to be 401", name, w.Code)
+		}
+	}
+}
+
+func TestFreezeHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+	handler.decisionHook = &FreezeHook{FlagFile: filepath.Join(dir, "freeze"), AllowUsers: []string{"bob"}}
+
+	testRequest(t, handler, "alice", "/dataset1/resource1", "POST", 200)
+	if err := ioutil.WriteFile(filepath.Join(dir, "freeze"), nil, 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	testRequest(t, handler, "alice", "/dataset1/resource1", "POST", 403)
+	testRequest(t, handler, "alice", "/dataset1/resource1", "GET", 200)
+	testRequest(t, handler, "alice", "/dataset2/resource1", "GET", 403)
+	testRequest(t, handler, "bob", "/dataset2/resource1", "POST", 200)
+}
+
+func TestCaddyfileDecisionHook(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		decision_hook freeze {
+			flag_file /run/freeze
+			allow_user deployer ops
+		}
+		trailing_slash strip
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	var hook map[string]interface{}
+	if err := json.Unmarshal(a.AuthConfig.DecisionHookRaw, &hook); err != nil {
+		t.Fatalf("decision hook: %s", err)
+	}
+	if hook["hook"] != "freeze" || hook["flag_file"] != "/run/freeze" || len(hook["allow_users"].([]interface{})) != 2 {
+		t.Errorf("unexpected decision hook: %s", a.AuthConfig.DecisionHookRaw)
+	}
+	if a.AuthConfig.TrailingSlash != TrailingSlashStrip {
+		t.Errorf("subdirective after decision hook lost: %+v", a.AuthConfig)
+	}
+
+	d = caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		decision_hook bogus
+	}`)
+	if err := a.UnmarshalCaddyfile(d); err == nil {
+		t.Errorf("unknown decision hook accepted")
+	}
+}
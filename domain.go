@@ -0,0 +1,35 @@
+package authz
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DomainSourceHost takes the domain from the host of the request, without the
+// port.
+const DomainSourceHost = "host"
+
+// getDomain returns the casbin domain of the request according to the domain
+// source: the host, a request header for "header:<name>", or the source
+// itself as literal domain.
+func (a *Authorizer) getDomain(r *http.Request) string {
+	source := a.AuthConfig.DomainSource
+	switch {
+	case source == DomainSourceHost:
+		return hostWithoutPort(r.Host)
+	case strings.HasPrefix(source, "header:"):
+		return strings.TrimSpace(r.Header.Get(strings.TrimPrefix(source, "header:")))
+	}
+	return source
+}
+
+// hostWithoutPort strips the port from host and lowercases it. Brackets of
+// IPv6 addresses are removed.
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,99 @@
+package authz
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/casbin/casbin"
+	"go.uber.org/zap"
+)
+
+func TestDomainTenants(t *testing.T) {
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_domain_model.conf", "authz_domain_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+	handler.AuthConfig.DomainSource = DomainSourceHost
+
+	tests := []struct {
+		user, host, method, path string
+		code                     int
+	}{
+		{"alice", "tenant1.example.com", "DELETE", "/data/1", 200},
+		{"alice", "Tenant1.Example.com:8443", "POST", "/settings", 200},
+		{"alice", "tenant2.example.com", "GET", "/data/1", 200},
+		{"alice", "tenant2.example.com", "DELETE", "/data/1", 403},
+		{"alice", "tenant2.example.com", "GET", "/settings", 403},
+		{"bob", "tenant2.example.com", "DELETE", "/data/1", 200},
+		{"bob", "tenant1.example.com", "GET", "/data/1", 403},
+		{"alice", "tenant3.example.com", "GET", "/data/1", 403},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.method, test.path, nil)
+		r.Host = test.host
+		r.SetBasicAuth(test.user, "123")
+		if w := serve(handler, r); w.Code != test.code {
+			t.Errorf("%s %s %s %s: %d, supposed to be %d", test.user, test.method, test.host, test.path, w.Code, test.code)
+		}
+	}
+}
+
+func TestDomainSource(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Host = "Tenant1.Example.com:8443"
+	r.Header.Set("X-Tenant", " tenant2 ")
+	for _, test := range []struct {
+		source, domain string
+	}{
+		{DomainSourceHost, "tenant1.example.com"},
+		{"header:X-Tenant", "tenant2"},
+		{"header:X-Missing", ""},
+		{"tenant3", "tenant3"},
+	} {
+		var a Authorizer
+		a.AuthConfig.DomainSource = test.source
+		if domain := a.getDomain(r); domain != test.domain {
+			t.Errorf("%s: %q, supposed to be %q", test.source, domain, test.domain)
+		}
+	}
+
+	for _, test := range []struct {
+		host, want string
+	}{
+		{"example.com", "example.com"},
+		{"example.com:80", "example.com"},
+		{"EXAMPLE.com.", "example.com"},
+		{"192.0.2.1:8080", "192.0.2.1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+	} {
+		if host := hostWithoutPort(test.host); host != test.want {
+			t.Errorf("%q: %q, supposed to be %q", test.host, host, test.want)
+		}
+	}
+}
+
+func TestDomainFileRoles(t *testing.T) {
+	e := casbin.NewEnforcer("authz_domain_model.conf", "authz_domain_policy.csv")
+	rules := len(e.GetGroupingPolicy())
+	roles := &fileRoles{logger: zap.NewNop()}
+	roles.attach(e)
+	roles.set(map[string][]string{"carol": {"admin"}})
+	if got := len(e.GetGroupingPolicy()); got != rules {
+		t.Errorf("%d grouping rules after roles without domain, supposed to be %d", got, rules)
+	}
+}
+
+func TestCaddyfileDomainSource(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		domain_source header:X-Tenant
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if a.AuthConfig.DomainSource != "header:X-Tenant" {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+}
@@ -0,0 +1,322 @@
+package authz
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// Built-in error templates.
+const (
+	// ErrorTemplateJSON renders a JSON object.
+	ErrorTemplateJSON = "json"
+	// ErrorTemplateHTML renders a minimal HTML page.
+	ErrorTemplateHTML = "html"
+)
+
+// Reasons of a refused request.
+const (
+	reasonAuthenticationRequired = "authentication required"
+	reasonInvalidCredentials     = "invalid credentials"
+	reasonAccessDenied           = "access denied"
+)
+
+const builtinJSONTemplate = `{"status":{{.Status}},"error":{{json .Reason}},` +
+	`"user":{{json .Username}},"method":{{json .Method}},"path":{{json .Path}},` +
+	`"realm":{{json .Realm}},"time":{{json .Time}}}
+`
+
+const builtinHTMLTemplate = `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Reason}}: {{.Method}} {{.Path}}</p>
+</body>
+</html>
+`
+
+const browserUnauthorizedTemplate = `<!DOCTYPE html>
+<html>
+<head><title>Please log in</title></head>
+<body>
+<h1>Please log in</h1>
+{{if eq .Reason "` + reasonInvalidCredentials + `"}}<p>The user name or password is not correct.</p>
+{{end}}<p>You need to log in to access {{.Path}}.</p>
+{{if .LoginPath}}<p><a href="{{.LoginPath}}?redirect={{.Path}}">Log in</a></p>
+{{end}}</body>
+</html>
+`
+
+const browserForbiddenTemplate = `<!DOCTYPE html>
+<html>
+<head><title>Access denied</title></head>
+<body>
+<h1>Access denied</h1>
+<p>{{if .Username}}{{.Username}}, you{{else}}You{{end}} don't have permission to {{.Method}} {{.Path}}.</p>
+<p>Logging in again won't help, ask an administrator for access.</p>
+</body>
+</html>
+`
+
+// browserTemplates are the error templates of browser pages, by status.
+var browserTemplates = map[int]*errorTemplate{
+	http.StatusUnauthorized: mustParseErrorTemplate("browser 401", browserUnauthorizedTemplate),
+	http.StatusForbidden:    mustParseErrorTemplate("browser 403", browserForbiddenTemplate),
+}
+
+// ErrorContext is the data error templates are rendered with.
+type ErrorContext struct {
+	// Status is the HTTP status code, 401 or 403.
+	Status int
+	// StatusText is the text of the status code.
+	StatusText string
+	// Username is the authenticated user, empty if there is none.
+	Username string
+	// Path is the request path.
+	Path string
+	// Method is the request method.
+	Method string
+	// Realm is the authentication realm of the request, see the realm setting.
+	Realm string
+	// Reason tells why the request was refused.
+	Reason string
+	// LoginPath is the path of the login endpoint, empty if there is
+	// none.
+	LoginPath string
+	// Time is the time of the request.
+	Time time.Time
+}
+
+// ErrorResponse is a fixed response to refused requests, for API clients
+// that need to tell the refusals of authz from other failures.
+type ErrorResponse struct {
+	// StatusCode replaces the status code of the response if not 0.
+	StatusCode int `json:"status_code,omitempty"`
+	// Body is the body of the response. Caddy placeholders like
+	// {http.request.uri.path} are replaced, other text in braces is kept,
+	// so JSON bodies need no escaping.
+	Body string `json:"body,omitempty"`
+	// ContentType is the content type of the body, text/plain by default.
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// parseErrorResponse parses an error response of the form
+//
+//	<directive> [<status>] {
+//	    body <text>
+//	    content_type <type>
+//	}
+func parseErrorResponse(d *caddyfile.Dispenser) (*ErrorResponse, error) {
+	er := new(ErrorResponse)
+	if d.NextArg() {
+		status, err := strconv.Atoi(d.Val())
+		if err != nil {
+			return nil, d.Errf("invalid status code '%s'", d.Val())
+		}
+		er.StatusCode = status
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "body":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			er.Body = d.Val()
+		case "content_type":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			er.ContentType = d.Val()
+		default:
+			return nil, d.Errf("unknown subdirective '%s'", d.Val())
+		}
+		if d.NextArg() {
+			return nil, d.ArgErr()
+		}
+	}
+	return er, nil
+}
+
+// check checks the status code of the response.
+func (er *ErrorResponse) check() error {
+	if er.StatusCode != 0 && (er.StatusCode < 100 || er.StatusCode > 599) {
+		return fmt.Errorf("invalid status code %d", er.StatusCode)
+	}
+	return nil
+}
+
+// write writes the response to r, with status unless it is replaced.
+func (er *ErrorResponse) write(w http.ResponseWriter, r *http.Request, status int) {
+	if er.StatusCode != 0 {
+		status = er.StatusCode
+	}
+	if er.Body == "" {
+		w.WriteHeader(status)
+		return
+	}
+	repl := requestReplacer(r)
+	contentType := er.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	io.WriteString(w, repl.ReplaceKnown(er.Body, ""))
+}
+
+// errorTemplate is a parsed error template.
+type errorTemplate struct {
+	tmpl interface {
+		Execute(io.Writer, interface{}) error
+	}
+	contentType string
+}
+
+// loadErrorTemplate parses the built-in template named by source, or the
+// template file at the path source. Files ending in .html or .htm are HTML
+// templates, escaping their data. The template is rendered with sample data
+// once, so that templates referring to unknown fields fail early.
+func loadErrorTemplate(source string) (*errorTemplate, error) {
+	var et *errorTemplate
+	var err error
+	switch source {
+	case ErrorTemplateJSON:
+		et, err = parseErrorTemplate(source, builtinJSONTemplate, "application/json")
+	case ErrorTemplateHTML:
+		et, err = parseErrorTemplate(source, builtinHTMLTemplate, "text/html; charset=utf-8")
+	default:
+		var text []byte
+		if text, err = ioutil.ReadFile(source); err != nil {
+			return nil, err
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(source))
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+		et, err = parseErrorTemplate(source, string(text), contentType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sample := ErrorContext{
+		Status:     http.StatusForbidden,
+		StatusText: http.StatusText(http.StatusForbidden),
+		Username:   "user",
+		Path:       "/",
+		Method:     http.MethodGet,
+		Realm:      "realm",
+		Reason:     reasonAccessDenied,
+		LoginPath:  "/login",
+		Time:       time.Now(),
+	}
+	if err := et.tmpl.Execute(ioutil.Discard, sample); err != nil {
+		return nil, err
+	}
+	return et, nil
+}
+
+// parseErrorTemplate parses text as HTML template if contentType is HTML, as
+// text template otherwise.
+func parseErrorTemplate(name, text, contentType string) (*errorTemplate, error) {
+	funcs := map[string]interface{}{"json": templateJSON}
+	if strings.HasPrefix(contentType, "text/html") {
+		tmpl, err := htmltemplate.New(name).Funcs(funcs).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		return &errorTemplate{tmpl: tmpl, contentType: contentType}, nil
+	}
+	tmpl, err := template.New(name).Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &errorTemplate{tmpl: tmpl, contentType: contentType}, nil
+}
+
+// mustParseErrorTemplate parses a built-in HTML template, panicking on errors.
+func mustParseErrorTemplate(name, text string) *errorTemplate {
+	et, err := parseErrorTemplate(name, text, "text/html; charset=utf-8")
+	if err != nil {
+		panic(err)
+	}
+	return et
+}
+
+// acceptsHTML reports whether the client of r is a browser, accepting HTML.
+func acceptsHTML(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		if strings.Contains(accept, "text/html") {
+			return true
+		}
+	}
+	return false
+}
+
+// templateJSON encodes v as JSON for use in templates.
+func templateJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// writeError writes the status code, or the error response of the status if
+// one is configured. Otherwise the body is rendered from the error template of
+// the status, if one is configured, or browsers get a browser page if those
+// are enabled. If rendering fails, the status is written without body.
+func (a *Authorizer) writeError(w http.ResponseWriter, r *http.Request, status int, user, reason string) {
+	var er *ErrorResponse
+	var et *errorTemplate
+	switch status {
+	case http.StatusUnauthorized:
+		er, et = a.AuthConfig.UnauthorizedResponse, a.unauthorizedTemplate
+	case http.StatusForbidden:
+		er, et = a.AuthConfig.DenyResponse, a.forbiddenTemplate
+	}
+	if er != nil {
+		er.write(w, r, status)
+		return
+	}
+	if et == nil && a.AuthConfig.BrowserPages && acceptsHTML(r) {
+		et = browserTemplates[status]
+	}
+	if et == nil {
+		w.WriteHeader(status)
+		return
+	}
+	var body bytes.Buffer
+	err := et.tmpl.Execute(&body, ErrorContext{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Username:   user,
+		Path:       r.URL.Path,
+		Method:     r.Method,
+		Realm:      a.realm(r),
+		Reason:     reason,
+		LoginPath:  a.AuthConfig.LoginPath,
+		Time:       a.getClock().Now().UTC(),
+	})
+	if err != nil {
+		a.getLogger().Error("rendering error template", zap.Int("status", status), zap.Error(err))
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", et.contentType)
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
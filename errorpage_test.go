@@ -0,0 +1,261 @@
+package authz
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/casbin/casbin"
+)
+
+func TestErrorTemplates(t *testing.T) {
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+	handler.AuthConfig.Realm = "Test"
+	var err error
+	if handler.forbiddenTemplate, err = loadErrorTemplate(ErrorTemplateJSON); err != nil {
+		t.Fatalf("loading json template: %s", err)
+	}
+	if handler.unauthorizedTemplate, err = loadErrorTemplate(ErrorTemplateHTML); err != nil {
+		t.Fatalf("loading html template: %s", err)
+	}
+
+	r, _ := http.NewRequest("GET", "/dataset2/resource1", nil)
+	r.SetBasicAuth("alice", "123")
+	w := serve(handler, r)
+	if w.Code != 403 || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("403: %d, %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("403 body %q: %s", w.Body.String(), err)
+	}
+	if body["status"] != float64(403) || body["error"] != reasonAccessDenied || body["user"] != "alice" ||
+		body["path"] != "/dataset2/resource1" || body["method"] != "GET" || body["realm"] != "Test" || body["time"] == "" {
+		t.Errorf("unexpected 403 body: %v", body)
+	}
+
+	r, _ = http.NewRequest("GET", "/<script>", nil)
+	r.SetBasicAuth("alice", "wrong")
+	w = serve(handler, r)
+	if w.Code != 401 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") ||
+		w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("401: %d, %v", w.Code, w.Header())
+	}
+	if !strings.Contains(w.Body.String(), reasonInvalidCredentials) || strings.Contains(w.Body.String(), "<script>") {
+		t.Errorf("unexpected 401 body: %s", w.Body.String())
+	}
+
+	r, _ = http.NewRequest("GET", "/dataset1/resource1", nil)
+	if w := serve(handler, r); !strings.Contains(w.Body.String(), reasonAuthenticationRequired) {
+		t.Errorf("401 without credentials: %s", w.Body.String())
+	}
+}
+
+func TestErrorTemplateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, text string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		return path
+	}
+
+	et, err := loadErrorTemplate(write("403.txt", "{{.Username}} may not {{.Method}} {{.Path}}"))
+	if err != nil {
+		t.Fatalf("loadErrorTemplate: %s", err)
+	}
+	handler := Authorizer{
+		Enforcer:          casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck:     testAuthProvider(t),
+		forbiddenTemplate: et,
+	}
+	r, _ := http.NewRequest("DELETE", "/dataset1/resource1", nil)
+	r.SetBasicAuth("alice", "123")
+	w := serve(handler, r)
+	if w.Body.String() != "alice may not DELETE /dataset1/resource1" || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("unexpected response: %s %q", w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	for name, text := range map[string]string{
+		"syntax.txt":        "{{.Path",
+		"unknown_field.txt": "{{.Password}}",
+		"unknown_func.html": "{{frobnicate .Path}}",
+	} {
+		if _, err := loadErrorTemplate(write(name, text)); err == nil {
+			t.Errorf("bad template %s accepted", name)
+		}
+	}
+	if _, err := loadErrorTemplate(filepath.Join(dir, "missing.html")); err == nil {
+		t.Errorf("missing template accepted")
+	}
+}
+
+func TestBrowserPages(t *testing.T) {
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+	handler.AuthConfig.BrowserPages = true
+	handler.AuthConfig.LoginPath = "/login"
+
+	tests := []struct {
+		user, password, method, accept string
+		code                           int
+		body                           []string
+	}{
+		{"", "", "GET", "text/html,application/xhtml+xml,*/*;q=0.8", 401,
+			[]string{"Please log in", `href="/login?redirect=`}},
+		{"alice", "wrong", "GET", "text/html", 401, []string{"Please log in", "not correct"}},
+		{"alice", "123", "DELETE", "text/html", 403, []string{"alice, you don't have permission to DELETE /dataset1/resource1"}},
+		{"", "", "GET", "application/json", 401, nil},
+		{"alice", "123", "DELETE", "", 403, nil},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest(test.method, "/dataset1/resource1", nil)
+		if test.user != "" {
+			r.SetBasicAuth(test.user, test.password)
+		}
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := serve(handler, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s %q: %d, supposed to be %d", test.user, test.method, test.accept, w.Code, test.code)
+		}
+		if test.body == nil {
+			if w.Body.Len() != 0 {
+				t.Errorf("%s %s %q: body for API client: %s", test.user, test.method, test.accept, w.Body.String())
+			}
+			continue
+		}
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+			t.Errorf("%s %s %q: content type %q", test.user, test.method, test.accept, w.Header().Get("Content-Type"))
+		}
+		for _, text := range test.body {
+			if !strings.Contains(w.Body.String(), text) {
+				t.Errorf("%s %s %q: %q missing in page:\n%s", test.user, test.method, test.accept, text, w.Body.String())
+			}
+		}
+	}
+
+	et, err := loadErrorTemplate(ErrorTemplateJSON)
+	if err != nil {
+		t.Fatalf("loadErrorTemplate: %s", err)
+	}
+	handler.forbiddenTemplate = et
+	r, _ := http.NewRequest("DELETE", "/dataset1/resource1", nil)
+	r.SetBasicAuth("alice", "123")
+	r.Header.Set("Accept", "text/html")
+	if w := serve(handler, r); w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("configured template not preferred: %s", w.Body.String())
+	}
+}
+
+func TestCaddyfileErrorTemplate(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		error_template 401 html
+		error_template 403 /etc/caddy/403.json
+		browser_pages
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if a.AuthConfig.UnauthorizedTemplate != ErrorTemplateHTML || a.AuthConfig.ForbiddenTemplate != "/etc/caddy/403.json" ||
+		!a.AuthConfig.BrowserPages {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+
+	d = caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		error_template 404 html
+	}`)
+	if err := a.UnmarshalCaddyfile(d); err == nil {
+		t.Errorf("template for 404 accepted")
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	handler, _ := loadCaddyfile(t, `authz {
+		model authz_model.conf
+		policy authz_policy.csv
+		password_file bcrypt.pass
+		browser_pages
+		unauthorized_response {
+			body "{\"error\":\"unauthorized\",\"path\":\"{http.request.uri.path}\"}"
+			content_type application/json
+		}
+		deny_response 404 {
+			body "not found"
+		}
+	}`)
+	defer caddy.Stop()
+
+	for _, test := range []struct {
+		user, path, accept string
+		code               int
+		contentType, body  string
+	}{
+		{"", "/dataset1/resource1", "", 401, "application/json", `{"error":"unauthorized","path":"/dataset1/resource1"}`},
+		// The response takes precedence over browser pages.
+		{"", "/dataset1/resource1", "text/html", 401, "application/json", `{"error":"unauthorized","path":"/dataset1/resource1"}`},
+		{"alice", "/dataset2/resource1", "", 404, "text/plain; charset=utf-8", "not found"},
+	} {
+		r, _ := http.NewRequest("GET", test.path, nil)
+		if test.user != "" {
+			r.SetBasicAuth(test.user, "123")
+		}
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		r = caddyhttp.PrepareRequest(r, caddy.NewReplacer(), nil, nil)
+		w := serve(*handler, r)
+		if w.Code != test.code || w.Header().Get("Content-Type") != test.contentType || w.Body.String() != test.body {
+			t.Errorf("%q %s: %d, %q, %q, supposed to be %d, %q, %q", test.user, test.path,
+				w.Code, w.Header().Get("Content-Type"), w.Body.String(), test.code, test.contentType, test.body)
+		}
+	}
+	// Without response, the status is written without body.
+	handler.AuthConfig.DenyResponse = nil
+	r, _ := http.NewRequest("GET", "/dataset2/resource1", nil)
+	r.SetBasicAuth("alice", "123")
+	if w := serve(*handler, r); w.Code != 403 || w.Body.Len() != 0 {
+		t.Errorf("403 without response: %d, %q", w.Code, w.Body.String())
+	}
+}
+
+func TestErrorResponseConflicts(t *testing.T) {
+	for _, settings := range []string{
+		`"unauthorized_response": {"body": "x"}, "unauthorized_template": "json"`,
+		`"deny_response": {"body": "x"}, "forbidden_template": "json"`,
+		`"deny_response": {"status_code": 1000}`,
+	} {
+		config := `{
+			"admin": {"disabled": true, "config": {"persist": false}},
+			"apps": {"authz_provision_test": {"handler": {"auth_config": {
+				"model_path": "authz_model.conf",
+				"policy_path": "authz_policy.csv",
+				"password_file": "bcrypt.pass",
+				` + settings + `
+			}}}}
+		}`
+		if err := caddy.Load([]byte(config), true); err == nil {
+			caddy.Stop()
+			t.Errorf("%s accepted", settings)
+		}
+	}
+}
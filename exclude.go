@@ -0,0 +1,49 @@
+package authz
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// excludedPaths are the compiled patterns of paths that bypass the handler.
+type excludedPaths []*regexp.Regexp
+
+// compileExcludedPaths compiles the exclusion patterns. A pattern without
+// "*" is a prefix of the excluded paths. A pattern with "*" matches whole
+// paths, with "*" matching any characters including "/".
+func compileExcludedPaths(patterns []string) (excludedPaths, error) {
+	var excluded excludedPaths
+	for _, pattern := range patterns {
+		if pattern == "" || (pattern[0] != '/' && pattern[0] != '*') {
+			return nil, fmt.Errorf("invalid exclude path %q, expected a path starting with / or *", pattern)
+		}
+		parts := strings.Split(pattern, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		expr := "^" + strings.Join(parts, ".*")
+		if len(parts) > 1 {
+			expr += "$"
+		}
+		excluded = append(excluded, regexp.MustCompile(expr))
+	}
+	return excluded, nil
+}
+
+// match reports whether the path of r is excluded. The path is cleaned
+// first, so dot segments can't reach a path that isn't excluded.
+func (excluded excludedPaths) match(r *http.Request) bool {
+	if len(excluded) == 0 {
+		return false
+	}
+	p := path.Clean("/" + r.URL.Path)
+	for _, re := range excluded {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
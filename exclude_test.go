@@ -0,0 +1,65 @@
+package authz
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/casbin/casbin"
+)
+
+func TestExcludePaths(t *testing.T) {
+	excluded, err := compileExcludedPaths([]string{"/healthz", "*.ico", "/static/*.css"})
+	if err != nil {
+		t.Fatalf("compileExcludedPaths: %s", err)
+	}
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+		excludedPaths: excluded,
+	}
+	tests := []struct {
+		user, path string
+		code       int
+	}{
+		{"", "/healthz", 200},
+		{"", "/healthz/live", 200},
+		{"", "/favicon.ico", 200},
+		{"", "/static/css/site.css", 200},
+		{"", "/static/site.js", 401},
+		{"", "/healthz/../dataset1/resource1", 401},
+		{"", "/dataset1/resource1", 401},
+		{"alice", "/dataset1/resource1", 200},
+		{"alice", "/dataset2/resource1", 403},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.URL.Path = test.path
+		if test.user != "" {
+			r.SetBasicAuth(test.user, "123")
+		}
+		if w := serve(handler, r); w.Code != test.code {
+			t.Errorf("%s %s: %d, supposed to be %d", test.user, test.path, w.Code, test.code)
+		}
+	}
+
+	for _, pattern := range []string{"", "healthz"} {
+		if _, err := compileExcludedPaths([]string{pattern}); err == nil {
+			t.Errorf("exclude path %q accepted", pattern)
+		}
+	}
+}
+
+func TestCaddyfileExcludePaths(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		exclude_paths /healthz *.ico
+		exclude_paths /static/*
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if len(a.AuthConfig.ExcludePaths) != 3 || a.AuthConfig.ExcludePaths[2] != "/static/*" {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+}
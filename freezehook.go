@@ -0,0 +1,94 @@
+package authz
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(FreezeHook{})
+}
+
+// FreezeHook is a decision hook denying modifying requests during a deploy
+// freeze. The freeze is active while the flag file exists. Requests with the
+// methods GET, HEAD and OPTIONS, and requests of exempt users, are passed
+// through with the decision of the policy.
+type FreezeHook struct {
+	// FlagFile is the file whose existence activates the freeze.
+	FlagFile string `json:"flag_file,omitempty"`
+	// AllowUsers are exempt from the freeze.
+	AllowUsers []string `json:"allow_users,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (FreezeHook) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.authz.hooks.freeze",
+		New: func() caddy.Module { return new(FreezeHook) },
+	}
+}
+
+// Decide implements DecisionHook.
+func (h *FreezeHook) Decide(r *http.Request, user string, decision int) (int, error) {
+	if decision != AccessAllowed {
+		return decision, nil
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return decision, nil
+	}
+	for _, allowed := range h.AllowUsers {
+		if user != "" && user == allowed {
+			return decision, nil
+		}
+	}
+	_, err := os.Stat(h.FlagFile)
+	if os.IsNotExist(err) {
+		return decision, nil
+	}
+	if err != nil {
+		return decision, err
+	}
+	return AccessDenied, nil
+}
+
+// Validate implements caddy.Validator.
+func (h *FreezeHook) Validate() error {
+	if h.FlagFile == "" {
+		return fmt.Errorf("freeze hook requires a flag file")
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	freeze {
+//	    flag_file <path>
+//	    allow_user <name...>
+//	}
+func (h *FreezeHook) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "flag_file":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.FlagFile = d.Val()
+			case "allow_user":
+				users := d.RemainingArgs()
+				if len(users) == 0 {
+					return d.ArgErr()
+				}
+				h.AllowUsers = append(h.AllowUsers, users...)
+			default:
+				return d.Errf("unrecognized subdirective '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
@@ -5,5 +5,10 @@ go 1.12
 require (
 	github.com/caddyserver/caddy/v2 v2.3.0
 	github.com/casbin/casbin v1.9.1
-	github.com/dafanasiev/authfile v0.0.0-20190816063623-c7bcc3121dca
+	github.com/go-sql-driver/mysql v1.5.0
+	github.com/lib/pq v1.2.0
+	github.com/mattn/go-sqlite3 v1.10.0
+	github.com/prometheus/client_golang v1.9.0
+	go.uber.org/zap v1.16.0
+	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
 )
@@ -0,0 +1,43 @@
+package authz
+
+import (
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxGroups is the number of groups of the groups header checked
+// against the policy if MaxGroups is not set.
+const DefaultMaxGroups = 16
+
+// maxGroups returns the number of groups checked against the policy.
+func (a *Authorizer) maxGroups() int {
+	if a.AuthConfig.MaxGroups == 0 {
+		return DefaultMaxGroups
+	}
+	return a.AuthConfig.MaxGroups
+}
+
+// requestGroups returns the groups of the comma-separated groups header of r,
+// without empty and repeated ones. Every group costs a call to the enforcer,
+// so only the first maxGroups are returned and the rest are ignored.
+func (a *Authorizer) requestGroups(r *http.Request) []string {
+	if a.AuthConfig.GroupsHeader == "" {
+		return nil
+	}
+	var groups []string
+	seen := make(map[string]bool)
+	for _, value := range r.Header.Values(a.AuthConfig.GroupsHeader) {
+		for _, group := range strings.Split(value, ",") {
+			group = strings.TrimSpace(group)
+			if group == "" || seen[group] {
+				continue
+			}
+			if len(groups) == a.maxGroups() {
+				return groups
+			}
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
@@ -0,0 +1,62 @@
+package authz
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/casbin/casbin"
+)
+
+func TestGroupsHeader(t *testing.T) {
+	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	e.AddPolicy("eng", "^/dataset2/", "GET", "allow")
+	e.AddPolicy("admins", "^/admin$", "*", "allow")
+	handler := Authorizer{Enforcer: e, PasswordCheck: testAuthProvider(t)}
+	handler.AuthConfig.TrustedUserHeader = "X-Remote-User"
+	handler.AuthConfig.GroupsHeader = "X-Remote-Groups"
+	handler.AuthConfig.MaxGroups = 2
+
+	tests := []struct {
+		name, user, groups, path string
+		code                     int
+	}{
+		{"user allowed", "alice", "", "/dataset1/resource1", 200},
+		{"allowed via group", "alice", "eng", "/dataset2/resource1", 200},
+		{"allowed via second group", "dave", " sales, admins ", "/admin", 200},
+		{"no group allowed", "dave", "sales,ops", "/dataset2/resource1", 403},
+		{"no groups", "dave", "", "/dataset2/resource1", 403},
+		{"empty and repeated groups", "dave", ",sales,,sales,eng", "/dataset2/resource1", 200},
+		{"groups over the cap ignored", "dave", "sales,ops,eng", "/dataset2/resource1", 403},
+		{"groups without user", "", "eng", "/dataset2/resource1", 401},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", test.path, nil)
+		if test.user != "" {
+			r.Header.Set("X-Remote-User", test.user)
+		}
+		if test.groups != "" {
+			r.Header.Set("X-Remote-Groups", test.groups)
+		}
+		if w := serve(handler, r); w.Code != test.code {
+			t.Errorf("%s: %d, supposed to be %d", test.name, w.Code, test.code)
+		}
+	}
+}
+
+func TestRequestGroups(t *testing.T) {
+	var a Authorizer
+	a.AuthConfig.GroupsHeader = "X-Remote-Groups"
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Add("X-Remote-Groups", "eng, admins")
+	r.Header.Add("X-Remote-Groups", strings.Repeat("g,", 100)+"ops")
+	groups := a.requestGroups(r)
+	if strings.Join(groups, " ") != "eng admins g ops" {
+		t.Errorf("groups %q", groups)
+	}
+
+	a.AuthConfig.MaxGroups = 1
+	if groups := a.requestGroups(r); strings.Join(groups, " ") != "eng" {
+		t.Errorf("groups capped at 1: %q", groups)
+	}
+}
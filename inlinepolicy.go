@@ -0,0 +1,81 @@
+package authz
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/casbin/casbin"
+	"github.com/casbin/casbin/model"
+	"github.com/casbin/casbin/persist"
+	fileadapter "github.com/casbin/casbin/persist/file-adapter"
+)
+
+// errNotImplemented is returned by adapters that keep changes in memory only.
+// Casbin ignores it when changing the policy, like with its file adapter.
+var errNotImplemented = errors.New("not implemented")
+
+// textAdapter is a Casbin adapter loading the policy from text in the format
+// of policy files, for a policy given inline in the configuration. Changes
+// of the policy at runtime are kept in memory only.
+type textAdapter struct {
+	text string
+}
+
+// LoadPolicy implements persist.Adapter.
+func (ta textAdapter) LoadPolicy(m model.Model) error {
+	for _, line := range strings.Split(ta.text, "\n") {
+		persist.LoadPolicyLine(strings.TrimSpace(line), m)
+	}
+	return nil
+}
+
+// SavePolicy implements persist.Adapter.
+func (ta textAdapter) SavePolicy(m model.Model) error {
+	return errors.New("an inline policy can't be saved")
+}
+
+// AddPolicy implements persist.Adapter.
+func (ta textAdapter) AddPolicy(sec string, ptype string, rule []string) error {
+	return errNotImplemented
+}
+
+// RemovePolicy implements persist.Adapter.
+func (ta textAdapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	return errNotImplemented
+}
+
+// RemoveFilteredPolicy implements persist.Adapter.
+func (ta textAdapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	return errNotImplemented
+}
+
+// newModel loads the model from the model file or the inline model.
+func (a *Authorizer) newModel() (m model.Model, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("loading the model: %v", rec)
+		}
+	}()
+	if a.AuthConfig.ModelText != "" {
+		return casbin.NewModel(a.AuthConfig.ModelText), nil
+	}
+	return casbin.NewModel(a.AuthConfig.ModelPath, ""), nil
+}
+
+// newEnforcer returns an enforcer with the model and policy of the files or
+// given inline.
+func (a *Authorizer) newEnforcer() (*casbin.Enforcer, error) {
+	if a.AuthConfig.ModelText == "" && a.AuthConfig.PolicyText == "" {
+		return casbin.NewEnforcerSafe(a.AuthConfig.ModelPath, a.AuthConfig.PolicyPath)
+	}
+	m, err := a.newModel()
+	if err != nil {
+		return nil, err
+	}
+	var adapter persist.Adapter = textAdapter{text: a.AuthConfig.PolicyText}
+	if a.AuthConfig.PolicyText == "" {
+		adapter = fileadapter.NewAdapter(a.AuthConfig.PolicyPath)
+	}
+	return casbin.NewEnforcerSafe(m, adapter)
+}
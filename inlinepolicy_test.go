@@ -0,0 +1,91 @@
+package authz
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/casbin/casbin"
+)
+
+const inlineModel = `
+		[request_definition]
+		r = sub, obj, act
+
+		[policy_definition]
+		p = sub, obj, act
+
+		[policy_effect]
+		e = some(where (p.eft == allow))
+
+		[matchers]
+		m = r.sub == p.sub && keyMatch(r.obj, p.obj) && r.act == p.act
+	`
+
+func TestInlinePolicy(t *testing.T) {
+	handler, _ := loadCaddyfile(t, "authz {\n"+
+		"model_text `"+inlineModel+"`\n"+
+		`policy_text "
+			# alice reads /foo
+			p, alice, /foo, GET
+		"
+		password_file bcrypt.pass
+	}`)
+	defer caddy.Stop()
+
+	for _, test := range []struct {
+		user, method, path string
+		code               int
+	}{
+		{"alice", "GET", "/foo", 200},
+		{"alice", "POST", "/foo", 403},
+		{"alice", "GET", "/bar", 403},
+		{"bob", "GET", "/foo", 403},
+	} {
+		testRequest(t, *handler, test.user, test.path, test.method, test.code)
+	}
+
+	// The inline policy is reloaded from the configuration.
+	handler.Enforcer.AddPolicy("bob", "/foo", "GET")
+	testRequest(t, *handler, "bob", "/foo", "GET", 200)
+	if err := handler.ReloadPolicy(); err != nil {
+		t.Fatalf("ReloadPolicy: %s", err)
+	}
+	testRequest(t, *handler, "bob", "/foo", "GET", 403)
+}
+
+func TestInlinePolicyConflicts(t *testing.T) {
+	for _, test := range []struct {
+		settings, err string
+	}{
+		{`"model_path": "authz_model.conf", "model_text": "x", "policy_path": "authz_policy.csv"`, "model file and inline model"},
+		{`"model_path": "authz_model.conf", "policy_path": "authz_policy.csv", "policy_text": "x"`, "policy file and inline policy"},
+		{`"model_path": "authz_model.conf", "policy_text": "x", "sql_driver": "authztest", "sql_dsn": "x"`, "inline policy and redis or sql"},
+		{`"model_text": "no model", "policy_text": "x"`, "loading the model"},
+	} {
+		config := `{
+			"admin": {"disabled": true, "config": {"persist": false}},
+			"apps": {"authz_provision_test": {"handler": {"auth_config": {
+				"password_file": "bcrypt.pass",
+				` + test.settings + `
+			}}}}
+		}`
+		err := caddy.Load([]byte(config), true)
+		if err == nil {
+			caddy.Stop()
+			t.Errorf("%s accepted", test.settings)
+		} else if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: %s", test.settings, err)
+		}
+	}
+}
+
+func TestTextAdapter(t *testing.T) {
+	e := casbin.NewEnforcer(casbin.NewModel(inlineModel), textAdapter{text: "p, alice, /foo/*, GET\n\n  p, bob, /bar, GET  \n"})
+	if !e.Enforce("alice", "/foo/x", "GET") || !e.Enforce("bob", "/bar", "GET") || e.Enforce("bob", "/foo/x", "GET") {
+		t.Errorf("unexpected policy %v", e.GetPolicy())
+	}
+	if err := e.SavePolicy(); err == nil {
+		t.Errorf("inline policy saved")
+	}
+}
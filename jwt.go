@@ -0,0 +1,360 @@
+package authz
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // hash functions of the supported algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Identity sources.
+const (
+	// IdentityBasic takes the user from HTTP basic authentication.
+	IdentityBasic = "basic"
+	// IdentityJWT takes the user from a claim of a signed JSON Web Token
+	// sent as bearer token.
+	IdentityJWT = "jwt"
+)
+
+const (
+	// DefaultJWTClaim is the claim holding the user if none is configured.
+	DefaultJWTClaim = "sub"
+	// minJWTSecretLength is the minimum length of the shared secret, the
+	// size of the SHA-256 hash as required for HS256.
+	minJWTSecretLength = 32
+	// jwksMinRefresh limits how often the key set is fetched to find an
+	// unknown key.
+	jwksMinRefresh = time.Minute
+	// jwksFetchTimeout limits fetching the key set.
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// jwtAlgorithms maps the supported signature algorithms to their hash.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// jwtClaim returns the claim holding the user.
+func (a *Authorizer) jwtClaim() string {
+	if a.AuthConfig.JWTClaim == "" {
+		return DefaultJWTClaim
+	}
+	return a.AuthConfig.JWTClaim
+}
+
+// provisionJWT validates the JWT configuration and sets up the key set.
+func (a *Authorizer) provisionJWT() error {
+	switch a.AuthConfig.IdentitySource {
+	case "", IdentityBasic, IdentityTLSCN, IdentityTLSSANEmail:
+		return nil
+	case IdentityJWT:
+	default:
+		return fmt.Errorf("invalid identity source %q", a.AuthConfig.IdentitySource)
+	}
+	switch {
+	case a.AuthConfig.JWTSecret != "" && a.AuthConfig.JWKSURL != "":
+		return fmt.Errorf("jwt secret and jwks url are mutually exclusive")
+	case a.AuthConfig.JWTSecret != "":
+		if len(a.AuthConfig.JWTSecret) < minJWTSecretLength {
+			return fmt.Errorf("jwt secret must be at least %d bytes", minJWTSecretLength)
+		}
+	case a.AuthConfig.JWKSURL != "":
+		a.jwks = newJWKS(a.AuthConfig.JWKSURL, a.getClock())
+	default:
+		return fmt.Errorf("jwt identity source requires a jwt secret or a jwks url")
+	}
+	return nil
+}
+
+// challenge returns the WWW-Authenticate header value asking for the
+// credentials of the identity source, see realm. There is none for a trusted
+// user header, the proxy authenticates, and for client certificates, which
+// are presented during the TLS handshake.
+func (a *Authorizer) challenge(r *http.Request) string {
+	if a.AuthConfig.TrustedUserHeader != "" || a.clientCertIdentity() {
+		return ""
+	}
+	if a.AuthConfig.IdentitySource == IdentityJWT {
+		return "Bearer realm=\"" + a.realm(r) + "\""
+	}
+	return "Basic realm=\"" + a.realm(r) + "\""
+}
+
+// bearerToken returns the bearer token of the Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
+
+// checkJWT verifies the signature and the validity period of token and
+// returns the user from the configured claim.
+func (a *Authorizer) checkJWT(r *http.Request, token string) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if !decodeJWTPart(parts[0], &header) {
+		return "", false
+	}
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return "", false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", false
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if !a.verifyJWTSignature(header.Alg, header.Kid, hash, signed, signature) {
+		return "", false
+	}
+
+	var claims map[string]interface{}
+	if !decodeJWTPart(parts[1], &claims) {
+		return "", false
+	}
+	if exp, ok := claims["exp"]; ok {
+		seconds, ok := exp.(float64)
+		if !ok || !a.notExpired(r, time.Unix(int64(seconds), 0)) {
+			return "", false
+		}
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		seconds, ok := nbf.(float64)
+		if !ok || a.getClock().Now().Before(time.Unix(int64(seconds), 0)) {
+			return "", false
+		}
+	}
+	user, ok := claims[a.jwtClaim()].(string)
+	if !ok || user == "" || a.userDenied(user) {
+		return "", false
+	}
+	return user, true
+}
+
+// verifyJWTSignature checks signature with the shared secret for HMAC
+// algorithms, or with the key kid of the key set otherwise.
+func (a *Authorizer) verifyJWTSignature(alg, kid string, hash crypto.Hash, signed, signature []byte) bool {
+	if strings.HasPrefix(alg, "HS") {
+		if a.AuthConfig.JWTSecret == "" {
+			return false
+		}
+		mac := hmac.New(hash.New, []byte(a.AuthConfig.JWTSecret))
+		mac.Write(signed)
+		return hmac.Equal(signature, mac.Sum(nil))
+	}
+	if a.jwks == nil {
+		return false
+	}
+	key, ok := a.jwks.key(kid)
+	if !ok {
+		return false
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+		case "PS":
+			return rsa.VerifyPSS(key, hash, digest, signature, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// decodeJWTPart decodes a base64url encoded JSON part of a token into v.
+func decodeJWTPart(part string, v interface{}) bool {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(b, v) == nil
+}
+
+// jwks is a JSON Web Key Set fetched from a URL. It is fetched on first use
+// and again when a token names an unknown key, at most every jwksMinRefresh,
+// so rotated keys are picked up. It is safe for concurrent use. The mutex
+// isn't held while the set is fetched, so known keys are found meanwhile.
+type jwks struct {
+	url    string
+	client *http.Client
+	clock  Clock
+
+	mutex    sync.Mutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+	fetching chan struct{} // closed once the fetch in progress is done, nil if none.
+}
+
+func newJWKS(url string, clock Clock) *jwks {
+	return &jwks{url: url, client: &http.Client{Timeout: jwksFetchTimeout}, clock: clock}
+}
+
+// key returns the key kid. An empty kid selects the only key of the set. An
+// unknown kid waits for the fetch in progress, if any, instead of fetching
+// again.
+func (ks *jwks) key(kid string) (crypto.PublicKey, bool) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	if key, ok := ks.lookup(kid); ok {
+		return key, true
+	}
+	if fetching := ks.fetching; fetching != nil {
+		ks.mutex.Unlock()
+		<-fetching
+		ks.mutex.Lock()
+		return ks.lookup(kid)
+	}
+	if !ks.fetched.IsZero() && ks.clock.Now().Before(ks.fetched.Add(jwksMinRefresh)) {
+		return nil, false
+	}
+	ks.fetched = ks.clock.Now()
+	fetching := make(chan struct{})
+	ks.fetching = fetching
+	ks.mutex.Unlock()
+	keys, err := ks.fetch()
+	ks.mutex.Lock()
+	// Keep the known keys if the fetch failed, it is retried after
+	// jwksMinRefresh.
+	if err == nil {
+		ks.keys = keys
+	}
+	ks.fetching = nil
+	close(fetching)
+	return ks.lookup(kid)
+}
+
+// lookup finds kid among the known keys. The mutex must be held.
+func (ks *jwks) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+// fetch gets the key set. Keys that aren't signature keys of a supported
+// type are skipped.
+func (ks *jwks) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := ks.client.Get(ks.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching jwks: %s", resp.Status)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decoding jwks: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// jsonWebKey is a public key of a key set, see RFC 7517.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey converts the key to an *rsa.PublicKey or *ecdsa.PublicKey.
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	number := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := number(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := number(jwk.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := number(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := number(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
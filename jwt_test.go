@@ -0,0 +1,307 @@
+package authz
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/casbin/casbin"
+)
+
+const testJWTSecret = "0123456789abcdef0123456789abcdef"
+
+// signJWT creates a token of claims signed with key by alg, which is a
+// []byte secret, an *rsa.PrivateKey or an *ecdsa.PrivateKey.
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal: %s", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := encode(header) + "." + encode(claims)
+	hash := jwtAlgorithms[alg]
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		h := hash.New()
+		h.Write([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, h.Sum(nil))
+	case *ecdsa.PrivateKey:
+		h := hash.New()
+		h.Write([]byte(signed))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	}
+	if err != nil {
+		t.Fatalf("signing token: %s", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func bearerRequest(method, path, token string) *http.Request {
+	r, _ := http.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestJWTSecret(t *testing.T) {
+	clock := newFakeClock()
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+		clock:         clock,
+	}
+	handler.AuthConfig.Realm = "Test"
+	handler.AuthConfig.IdentitySource = IdentityJWT
+	handler.AuthConfig.JWTSecret = testJWTSecret
+	if err := handler.provisionJWT(); err != nil {
+		t.Fatalf("provisionJWT: %s", err)
+	}
+
+	secret := []byte(testJWTSecret)
+	exp := clock.Now().Add(time.Hour).Unix()
+	alice := signJWT(t, "HS256", "", secret, map[string]interface{}{"sub": "alice", "exp": exp})
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+
+	tests := []struct {
+		name, token, path string
+		code              int
+	}{
+		{"valid", alice, "/dataset1/resource1", 200},
+		{"forbidden", alice, "/dataset2/resource1", 403},
+		{"HS512", signJWT(t, "HS512", "", secret, map[string]interface{}{"sub": "alice"}), "/dataset1/resource1", 200},
+		{"no token", "", "/dataset1/resource1", 401},
+		{"wrong secret", signJWT(t, "HS256", "", []byte("another secret of thirty-two bytes"), map[string]interface{}{"sub": "alice"}), "/dataset1/resource1", 401},
+		{"tampered", alice[:len(alice)-2] + "xx", "/dataset1/resource1", 401},
+		{"unsigned", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice"}`)) + ".", "/dataset1/resource1", 401},
+		{"rsa without key set", signJWT(t, "RS256", "", rsaKey, map[string]interface{}{"sub": "alice"}), "/dataset1/resource1", 401},
+		{"not yet valid", signJWT(t, "HS256", "", secret, map[string]interface{}{"sub": "alice", "nbf": exp}), "/dataset1/resource1", 401},
+		{"no subject", signJWT(t, "HS256", "", secret, map[string]interface{}{"name": "alice"}), "/dataset1/resource1", 401},
+		{"malformed", "not.a.token", "/dataset1/resource1", 401},
+	}
+	for _, test := range tests {
+		w := serve(handler, bearerRequest("GET", test.path, test.token))
+		if w.Code != test.code {
+			t.Errorf("%s: %d, supposed to be %d", test.name, w.Code, test.code)
+		}
+		if w.Code == 401 && w.Header().Get("WWW-Authenticate") != `Bearer realm="Test"` {
+			t.Errorf("%s: challenge %q", test.name, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "/dataset1/resource1", nil)
+	r.SetBasicAuth("alice", "123")
+	if w := serve(handler, r); w.Code != 401 {
+		t.Errorf("basic auth with jwt identity source: %d, supposed to be 401", w.Code)
+	}
+
+	clock.Advance(2 * time.Hour)
+	if w := serve(handler, bearerRequest("GET", "/dataset1/resource1", alice)); w.Code != 401 {
+		t.Errorf("expired token: %d, supposed to be 401", w.Code)
+	}
+	handler.AuthConfig.JWTClaim = "email"
+	bob := signJWT(t, "HS256", "", secret, map[string]interface{}{"sub": "1234", "email": "bob"})
+	if w := serve(handler, bearerRequest("GET", "/dataset2/resource1", bob)); w.Code != 200 {
+		t.Errorf("configured claim: %d, supposed to be 200", w.Code)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	keys := []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+	}
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer server.Close()
+
+	clock := newFakeClock()
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+		clock:         clock,
+	}
+	handler.AuthConfig.IdentitySource = IdentityJWT
+	handler.AuthConfig.JWKSURL = server.URL
+	if err := handler.provisionJWT(); err != nil {
+		t.Fatalf("provisionJWT: %s", err)
+	}
+
+	claims := map[string]interface{}{"sub": "alice"}
+	if w := serve(handler, bearerRequest("GET", "/dataset1/resource1", signJWT(t, "RS256", "rsa1", rsaKey, claims))); w.Code != 200 {
+		t.Errorf("RS256: %d, supposed to be 200", w.Code)
+	}
+	// A token signed with the public key as HMAC secret must not pass.
+	confused := signJWT(t, "HS256", "rsa1", rsaKey.N.Bytes(), claims)
+	if w := serve(handler, bearerRequest("GET", "/dataset1/resource1", confused)); w.Code != 401 {
+		t.Errorf("HS256 with key set: %d, supposed to be 401", w.Code)
+	}
+
+	// A rotated key is fetched once it is used, but not more often than
+	// jwksMinRefresh.
+	ecToken := signJWT(t, "ES256", "ec1", ecKey, claims)
+	keys = append(keys, map[string]string{"kty": "EC", "kid": "ec1", "crv": "P-256",
+		"x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())})
+	if w := serve(handler, bearerRequest("GET", "/dataset1/resource1", ecToken)); w.Code != 401 {
+		t.Errorf("ES256 before refresh: %d, supposed to be 401", w.Code)
+	}
+	clock.Advance(jwksMinRefresh)
+	if w := serve(handler, bearerRequest("GET", "/dataset1/resource1", ecToken)); w.Code != 200 {
+		t.Errorf("ES256 after refresh: %d, supposed to be 200", w.Code)
+	}
+	unknown := signJWT(t, "ES256", "ec2", ecKey, claims)
+	serve(handler, bearerRequest("GET", "/dataset1/resource1", unknown))
+	serve(handler, bearerRequest("GET", "/dataset1/resource1", unknown))
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("key set fetched %d times, supposed to be 2", n)
+	}
+}
+
+func TestJWKSSlowFetch(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	keys := []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+	}
+	var fetches int32
+	requested, release := make(chan struct{}, 2), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first fetch is served at once, the following ones hang until released.
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			requested <- struct{}{}
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer server.Close()
+
+	clock := newFakeClock()
+	ks := newJWKS(server.URL, clock)
+	if _, ok := ks.key("rsa1"); !ok {
+		t.Fatalf("key rsa1 not fetched")
+	}
+	clock.Advance(jwksMinRefresh)
+	unknown := make(chan bool, 2)
+	go func() {
+		_, ok := ks.key("rsa2")
+		unknown <- ok
+	}()
+	<-requested
+
+	// A known key is found while the key set is fetched, and another unknown
+	// key waits for the same fetch.
+	found := make(chan bool, 1)
+	go func() {
+		_, ok := ks.key("rsa1")
+		found <- ok
+	}()
+	select {
+	case ok := <-found:
+		if !ok {
+			t.Errorf("known key not found during a fetch")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("known key blocked by a fetch")
+	}
+	go func() {
+		_, ok := ks.key("rsa3")
+		unknown <- ok
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		if <-unknown {
+			t.Errorf("unknown key found")
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("key set fetched %d times, supposed to be 2", n)
+	}
+}
+
+func TestProvisionJWT(t *testing.T) {
+	for _, test := range []struct {
+		source, secret, url string
+		ok                  bool
+	}{
+		{"", "", "", true},
+		{IdentityBasic, "", "", true},
+		{IdentityJWT, testJWTSecret, "", true},
+		{IdentityJWT, "", "https://idp.example.com/jwks.json", true},
+		{IdentityJWT, "", "", false},
+		{IdentityJWT, "short", "", false},
+		{IdentityJWT, testJWTSecret, "https://idp.example.com/jwks.json", false},
+		{"oauth", "", "", false},
+	} {
+		var a Authorizer
+		a.AuthConfig.IdentitySource = test.source
+		a.AuthConfig.JWTSecret = test.secret
+		a.AuthConfig.JWKSURL = test.url
+		if err := a.provisionJWT(); (err == nil) != test.ok {
+			t.Errorf("%q %q %q: %v", test.source, test.secret, test.url, err)
+		}
+	}
+}
+
+func TestCaddyfileJWT(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		identity_source jwt
+		jwks_url https://idp.example.com/jwks.json
+		jwt_secret ` + testJWTSecret + `
+		jwt_claim email
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if a.AuthConfig.IdentitySource != IdentityJWT || a.AuthConfig.JWKSURL != "https://idp.example.com/jwks.json" ||
+		a.AuthConfig.JWTSecret != testJWTSecret || a.AuthConfig.JWTClaim != "email" {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+}
@@ -0,0 +1,42 @@
+package authz
+
+import "sync"
+
+// userLimiter limits the number of concurrent requests per user.
+type userLimiter struct {
+	limit  int
+	mutex  sync.Mutex
+	active map[string]int
+}
+
+// newUserLimiter creates a limiter allowing limit concurrent requests per
+// user.
+func newUserLimiter(limit int) *userLimiter {
+	return &userLimiter{
+		limit:  limit,
+		active: make(map[string]int),
+	}
+}
+
+// acquire counts a request of user. It returns false if the user already has
+// the maximum number of requests in flight, in which case nothing is counted.
+func (l *userLimiter) acquire(user string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.active[user] >= l.limit {
+		return false
+	}
+	l.active[user]++
+	return true
+}
+
+// release ends a request of user counted by acquire.
+func (l *userLimiter) release(user string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.active[user] <= 1 {
+		delete(l.active, user)
+		return
+	}
+	l.active[user]--
+}
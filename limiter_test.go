@@ -0,0 +1,74 @@
+package authz
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/casbin/casbin"
+)
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+		limiter:       newUserLimiter(1),
+	}
+
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	blocking := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		entered <- struct{}{}
+		<-unblock
+		return nil
+	})
+	request := func(user, path string) *http.Request {
+		r, _ := http.NewRequest("GET", path, nil)
+		r.SetBasicAuth(user, "123")
+		return r
+	}
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request("alice", "/dataset1/resource1"), blocking)
+		done <- w.Code
+	}()
+	<-entered
+
+	if w := serve(handler, request("alice", "/dataset1/resource2")); w.Code != http.StatusTooManyRequests {
+		t.Errorf("second concurrent request: %d, supposed to be 429", w.Code)
+	}
+	if w := serve(handler, request("bob", "/dataset2/resource1")); w.Code != 200 {
+		t.Errorf("request of other user: %d, supposed to be 200", w.Code)
+	}
+	if w := serve(handler, request("alice", "/dataset2/resource1")); w.Code != 403 {
+		t.Errorf("denied request while at the limit: %d, supposed to be 403", w.Code)
+	}
+
+	close(unblock)
+	if code := <-done; code != 200 {
+		t.Errorf("first request: %d, supposed to be 200", code)
+	}
+	if w := serve(handler, request("alice", "/dataset1/resource2")); w.Code != 200 {
+		t.Errorf("request after the first completed: %d, supposed to be 200", w.Code)
+	}
+	if len(handler.limiter.active) != 0 {
+		t.Errorf("requests still counted: %v", handler.limiter.active)
+	}
+}
+
+func TestCaddyfileMaxConcurrentRequests(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		max_concurrent_requests 3
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if a.AuthConfig.MaxConcurrentRequests != 3 {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+}
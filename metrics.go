@@ -0,0 +1,87 @@
+package authz
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// authCacheTotals are the counters of all auth caches of the process.
+var authCacheTotals AuthCacheStats
+
+var (
+	// decisionsTotal counts the decisions of all handlers of the process.
+	decisionsTotal *prometheus.CounterVec
+	// checkDuration observes the time taken to decide on a request.
+	checkDuration prometheus.Histogram
+	// observedRefusalsTotal counts the requests let through in observe
+	// mode that would have been refused.
+	observedRefusalsTotal *prometheus.CounterVec
+)
+
+func init() {
+	const ns, sub = "caddy", "authz"
+
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "auth_cache_hits_total",
+		Help:      "Counter of credentials found in the auth cache.",
+	}, func() float64 { return float64(atomic.LoadUint64(&authCacheTotals.Hits)) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "auth_cache_misses_total",
+		Help:      "Counter of credentials not found in the auth cache.",
+	}, func() float64 { return float64(atomic.LoadUint64(&authCacheTotals.Misses)) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "auth_cache_evictions_total",
+		Help:      "Counter of auth cache entries removed because they expired or the cache was full.",
+	}, func() float64 { return float64(atomic.LoadUint64(&authCacheTotals.Evictions)) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "auth_cache_hit_ratio",
+		Help:      "Share of auth cache lookups that were hits.",
+	}, func() float64 { return authCacheSnapshot().HitRatio() })
+
+	decisionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "decisions_total",
+		Help:      "Counter of authorization decisions by decision and whether the request was authenticated.",
+	}, []string{"decision", "authenticated"})
+	observedRefusalsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "observed_refusals_total",
+		Help:      "Counter of requests let through in observe mode that would have been refused, by decision.",
+	}, []string{"decision"})
+	checkDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "check_duration_seconds",
+		Help:      "Time taken to authenticate and authorize a request, dominated by password hashing.",
+		Buckets:   prometheus.DefBuckets,
+	})
+}
+
+// observeDecision counts a decision and the time it took.
+func observeDecision(decision int, authenticated bool, took time.Duration) {
+	decisionsTotal.WithLabelValues(decisionName(decision), strconv.FormatBool(authenticated)).Inc()
+	checkDuration.Observe(took.Seconds())
+}
+
+// authCacheSnapshot returns the counters of all auth caches of the process.
+func authCacheSnapshot() AuthCacheStats {
+	return AuthCacheStats{
+		Hits:      atomic.LoadUint64(&authCacheTotals.Hits),
+		Misses:    atomic.LoadUint64(&authCacheTotals.Misses),
+		Evictions: atomic.LoadUint64(&authCacheTotals.Evictions),
+	}
+}
@@ -0,0 +1,74 @@
+package authz
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/casbin/casbin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrapeDecisions returns the decision counters and the number of observed
+// checks of the default registry.
+func scrapeDecisions(t *testing.T) (map[string]float64, uint64) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %s", err)
+	}
+	decisions := make(map[string]float64)
+	var checks uint64
+	for _, family := range families {
+		switch family.GetName() {
+		case "caddy_authz_decisions_total":
+			for _, m := range family.GetMetric() {
+				var key string
+				for _, label := range m.GetLabel() {
+					key += label.GetName() + "=" + label.GetValue() + ","
+				}
+				decisions[key] = m.GetCounter().GetValue()
+			}
+		case "caddy_authz_check_duration_seconds":
+			checks = family.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	return decisions, checks
+}
+
+func TestDecisionMetrics(t *testing.T) {
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+	before, checksBefore := scrapeDecisions(t)
+
+	for _, test := range []struct {
+		user, password, path string
+	}{
+		{"alice", "123", "/dataset1/resource1"},
+		{"alice", "123", "/dataset1/resource2"},
+		{"alice", "123", "/dataset2/resource1"},
+		{"alice", "wrong", "/dataset1/resource1"},
+		{"", "", "/dataset1/resource1"},
+	} {
+		r, _ := http.NewRequest("GET", test.path, nil)
+		if test.user != "" {
+			r.SetBasicAuth(test.user, test.password)
+		}
+		serve(handler, r)
+	}
+
+	after, checksAfter := scrapeDecisions(t)
+	for key, want := range map[string]float64{
+		"authenticated=true,decision=allowed,":              2,
+		"authenticated=true,decision=denied,":               1,
+		"authenticated=false,decision=must_authenticate,":   1,
+		"authenticated=false,decision=invalid_credentials,": 1,
+	} {
+		if got := after[key] - before[key]; got != want {
+			t.Errorf("%s: %v, supposed to be %v", key, got, want)
+		}
+	}
+	if got := checksAfter - checksBefore; got != 5 {
+		t.Errorf("%d checks observed, supposed to be 5", got)
+	}
+}
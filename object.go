@@ -0,0 +1,224 @@
+package authz
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Trailing slash modes.
+const (
+	// TrailingSlashExact enforces on the path as requested.
+	TrailingSlashExact = "exact"
+	// TrailingSlashStrip removes a trailing slash before enforcing.
+	TrailingSlashStrip = "strip"
+	// TrailingSlashRequire adds a trailing slash before enforcing.
+	TrailingSlashRequire = "require"
+	// TrailingSlashIgnore allows access if the path either with or
+	// without trailing slash is allowed.
+	TrailingSlashIgnore = "ignore"
+)
+
+// Path normalization modes, shorthands for normalize_path and trailing_slash.
+const (
+	// PathNormalizationNone leaves normalize_path and trailing_slash as
+	// they are.
+	PathNormalizationNone = "none"
+	// PathNormalizationClean sets normalize_path.
+	PathNormalizationClean = "clean"
+	// PathNormalizationStripTrailingSlash sets trailing_slash strip.
+	PathNormalizationStripTrailingSlash = "strip_trailing_slash"
+)
+
+// Object sources.
+const (
+	// ObjectSourcePath takes the object from the decoded request path.
+	ObjectSourcePath = "path"
+	// ObjectSourceURI takes the object from the request URI as sent by the
+	// client, with the path still escaped.
+	ObjectSourceURI = "uri"
+	// ObjectSourceSegments takes the object from the request path with
+	// every segment decoded on its own. Encoded slashes and percent signs
+	// stay encoded, so they never split a segment. Dot segments are
+	// always resolved, as decoding may produce them.
+	ObjectSourceSegments = "segments"
+)
+
+// validObjectSource reports whether source is a known object source.
+func validObjectSource(source string) bool {
+	switch source {
+	case "", ObjectSourcePath, ObjectSourceURI, ObjectSourceSegments:
+		return true
+	}
+	return false
+}
+
+// applyPathNormalization maps the path normalization mode onto
+// NormalizePath and TrailingSlash. A mode contradicting the trailing slash
+// mode is an error.
+func (a *Authorizer) applyPathNormalization() error {
+	switch a.AuthConfig.PathNormalization {
+	case "", PathNormalizationNone:
+	case PathNormalizationClean:
+		a.AuthConfig.NormalizePath = true
+	case PathNormalizationStripTrailingSlash:
+		switch a.AuthConfig.TrailingSlash {
+		case "", TrailingSlashStrip:
+			a.AuthConfig.TrailingSlash = TrailingSlashStrip
+		default:
+			return fmt.Errorf("path normalization %q conflicts with trailing slash mode %q",
+				a.AuthConfig.PathNormalization, a.AuthConfig.TrailingSlash)
+		}
+	default:
+		return fmt.Errorf("invalid path normalization %q", a.AuthConfig.PathNormalization)
+	}
+	return nil
+}
+
+// getPath gets the casbin object from the request. This is the route pattern
+// if one is configured and set for the request. Otherwise the object is built
+// from the object source in these steps:
+//
+//  1. split off the query string
+//  2. normalize the path, if enabled or the segments are decoded
+//  3. strip the prefix, if configured
+//  4. apply the trailing slash mode
+//  5. lowercase the path, if enabled
+//  6. append the query string, if included
+//
+// The root path is never changed by the trailing slash mode.
+func (a *Authorizer) getPath(r *http.Request) string {
+	if a.AuthConfig.RouteVar != "" {
+		if pattern := caddyhttp.GetVar(r.Context(), a.AuthConfig.RouteVar); pattern != nil {
+			if s := fmt.Sprint(pattern); s != "" {
+				return s
+			}
+		}
+	}
+
+	var p, query string
+	switch a.AuthConfig.ObjectSource {
+	case ObjectSourceURI:
+		uri := r.RequestURI
+		if uri == "" {
+			uri = r.URL.RequestURI()
+		}
+		p = uri
+		if i := strings.IndexByte(uri, '?'); i >= 0 {
+			p, query = uri[:i], uri[i+1:]
+		}
+	case ObjectSourceSegments:
+		p, query = decodeSegments(r.URL.EscapedPath()), r.URL.RawQuery
+	default:
+		p, query = r.URL.Path, r.URL.RawQuery
+	}
+
+	if a.AuthConfig.NormalizePath || a.AuthConfig.ObjectSource == ObjectSourceSegments {
+		p = normalizePath(p)
+	}
+	if a.AuthConfig.StripPrefix != "" {
+		p = stripPrefix(p, a.AuthConfig.StripPrefix)
+	}
+	p = a.applyTrailingSlash(p)
+	if a.AuthConfig.LowercaseObject {
+		p = strings.ToLower(p)
+	}
+	if a.AuthConfig.IncludeQuery && query != "" {
+		p += "?" + query
+	}
+	return p
+}
+
+// applyTrailingSlash applies the trailing slash mode to path.
+func (a *Authorizer) applyTrailingSlash(path string) string {
+	if path == "/" || path == "" {
+		return path
+	}
+	switch a.AuthConfig.TrailingSlash {
+	case TrailingSlashStrip:
+		return stripTrailingSlash(path)
+	case TrailingSlashRequire:
+		if !strings.HasSuffix(path, "/") {
+			return path + "/"
+		}
+	}
+	return path
+}
+
+// toggleTrailingSlash removes the trailing slash of the path of an object, or
+// adds one if there is none. The query string, if any, is kept. It returns
+// false for the root path, which is never changed.
+func toggleTrailingSlash(object string) (string, bool) {
+	p, query := object, ""
+	if i := strings.IndexByte(object, '?'); i >= 0 {
+		p, query = object[:i], object[i:]
+	}
+	if p == "/" || p == "" {
+		return object, false
+	}
+	if strings.HasSuffix(p, "/") {
+		return stripTrailingSlash(p) + query, true
+	}
+	return p + "/" + query, true
+}
+
+// stripTrailingSlash removes trailing slashes, keeping at least "/".
+func stripTrailingSlash(path string) string {
+	stripped := strings.TrimRight(path, "/")
+	if stripped == "" {
+		return "/"
+	}
+	return stripped
+}
+
+// decodeSegments decodes every segment of the escaped path p on its own. A
+// slash or percent sign in a decoded segment is encoded again, as "%2F" and
+// "%25", so the segments of the result are those of p. A segment that is not
+// validly escaped is kept as is.
+func decodeSegments(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil {
+			continue
+		}
+		segments[i] = segmentEscaper.Replace(decoded)
+	}
+	return strings.Join(segments, "/")
+}
+
+var segmentEscaper = strings.NewReplacer("%", "%25", "/", "%2F")
+
+// normalizePath removes duplicate slashes and resolves "." and ".." segments.
+// A trailing slash is kept.
+func normalizePath(p string) string {
+	if p == "" {
+		return p
+	}
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// stripPrefix removes prefix from p if p is the prefix or continues it with a
+// new segment. The result starts with "/".
+func stripPrefix(p, prefix string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(p, prefix) {
+		return p
+	}
+	rest := p[len(prefix):]
+	if rest == "" {
+		return "/"
+	}
+	if rest[0] != '/' {
+		return p
+	}
+	return rest
+}
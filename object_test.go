@@ -0,0 +1,216 @@
+package authz
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/casbin/casbin"
+)
+
+func TestObjectPipeline(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(a *Authorizer)
+		uri       string
+		object    string
+	}{
+		{"default", func(a *Authorizer) {}, "/Docs//a/../b/?x=1", "/Docs//a/../b/"},
+		{"uri source keeps escaping", func(a *Authorizer) {
+			a.AuthConfig.ObjectSource = ObjectSourceURI
+		}, "/a%2Fb?x=1", "/a%2Fb"},
+		{"path source decodes", func(a *Authorizer) {}, "/a%2Fb?x=1", "/a/b"},
+		{"segments decode unicode", func(a *Authorizer) {
+			a.AuthConfig.ObjectSource = ObjectSourceSegments
+		}, "/%D0%B4%D0%BE%D0%BA%D1%83%D0%BC%D0%B5%D0%BD%D1%82%D1%8B/%E6%96%87%E4%BB%B6", "/документы/文件"},
+		{"segments keep encoded slash", func(a *Authorizer) {
+			a.AuthConfig.ObjectSource = ObjectSourceSegments
+		}, "/docs/a%2Fb/c%2fd", "/docs/a%2Fb/c%2Fd"},
+		{"segments keep encoded percent", func(a *Authorizer) {
+			a.AuthConfig.ObjectSource = ObjectSourceSegments
+		}, "/100%25/a%252Fb", "/100%25/a%252Fb"},
+		{"segments resolve decoded dot segments", func(a *Authorizer) {
+			a.AuthConfig.ObjectSource = ObjectSourceSegments
+		}, "/public/%2E%2E/admin/%2e/x", "/admin/x"},
+		{"segments with query", func(a *Authorizer) {
+			a.AuthConfig.ObjectSource = ObjectSourceSegments
+			a.AuthConfig.IncludeQuery = true
+		}, "/%C3%A4?q=%C3%A4", "/ä?q=%C3%A4"},
+		{"include query", func(a *Authorizer) {
+			a.AuthConfig.IncludeQuery = true
+		}, "/a?x=1&y=2", "/a?x=1&y=2"},
+		{"include query from uri", func(a *Authorizer) {
+			a.AuthConfig.ObjectSource = ObjectSourceURI
+			a.AuthConfig.IncludeQuery = true
+		}, "/a?x=%20", "/a?x=%20"},
+		{"include empty query", func(a *Authorizer) {
+			a.AuthConfig.IncludeQuery = true
+		}, "/a", "/a"},
+		{"normalize", func(a *Authorizer) {
+			a.AuthConfig.NormalizePath = true
+		}, "/docs//a/./../b/", "/docs/b/"},
+		{"normalize above root", func(a *Authorizer) {
+			a.AuthConfig.NormalizePath = true
+		}, "/../../etc", "/etc"},
+		{"strip prefix", func(a *Authorizer) {
+			a.AuthConfig.StripPrefix = "/api/"
+		}, "/api/users", "/users"},
+		{"strip prefix only", func(a *Authorizer) {
+			a.AuthConfig.StripPrefix = "/api"
+		}, "/api", "/"},
+		{"strip prefix on segment boundary", func(a *Authorizer) {
+			a.AuthConfig.StripPrefix = "/api"
+		}, "/apix/users", "/apix/users"},
+		{"lowercase", func(a *Authorizer) {
+			a.AuthConfig.LowercaseObject = true
+			a.AuthConfig.IncludeQuery = true
+		}, "/Docs/A?Q=1", "/docs/a?Q=1"},
+		{"all steps in order", func(a *Authorizer) {
+			a.AuthConfig.NormalizePath = true
+			a.AuthConfig.StripPrefix = "/api"
+			a.AuthConfig.TrailingSlash = TrailingSlashStrip
+			a.AuthConfig.LowercaseObject = true
+			a.AuthConfig.IncludeQuery = true
+		}, "//api/./Users//42/?page=2", "/users/42?page=2"},
+	}
+	for _, test := range tests {
+		var a Authorizer
+		test.configure(&a)
+		r, _ := http.NewRequest("GET", test.uri, nil)
+		if object := a.getPath(r); object != test.object {
+			t.Errorf("%s: object %q, supposed to be %q", test.name, object, test.object)
+		}
+	}
+}
+
+func TestTrailingSlashIgnoreWithQuery(t *testing.T) {
+	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	e.AddPolicy("alice", "^/docs\\?page=1$", "GET", "allow")
+	handler := Authorizer{Enforcer: e, PasswordCheck: testAuthProvider(t)}
+	handler.AuthConfig.TrailingSlash = TrailingSlashIgnore
+	handler.AuthConfig.IncludeQuery = true
+
+	testRequest(t, handler, "alice", "/docs?page=1", "GET", 200)
+	testRequest(t, handler, "alice", "/docs/?page=1", "GET", 200)
+	testRequest(t, handler, "alice", "/docs/?page=2", "GET", 403)
+}
+
+func TestPathNormalizationPolicy(t *testing.T) {
+	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	e.AddPolicy("alice", "^/$", "GET", "allow")
+	e.AddPolicy("alice", "^/a$", "GET", "allow")
+	e.AddPolicy("alice", "^/public/", "GET", "allow")
+	handler := Authorizer{Enforcer: e, PasswordCheck: testAuthProvider(t)}
+	request := func(path string) int {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.URL.Path = path
+		r.SetBasicAuth("alice", "123")
+		return serve(handler, r).Code
+	}
+	tests := []struct {
+		path                  string
+		none, clean, stripped int
+	}{
+		{"/a", 200, 200, 200},
+		{"/a/", 403, 403, 200},
+		{"/b/../a", 403, 200, 200},
+		{"//a", 403, 200, 200},
+		// Dot segments are resolved before matching, so they can't escape
+		// a prefix.
+		{"/public/../a", 200, 200, 200},
+		{"/public/../dataset2/resource1", 200, 403, 403},
+		{"/", 200, 200, 200},
+		{"//", 403, 200, 200},
+	}
+	for _, test := range tests {
+		handler.AuthConfig.NormalizePath = false
+		handler.AuthConfig.TrailingSlash = ""
+		if code := request(test.path); code != test.none {
+			t.Errorf("%s without normalization: %d, supposed to be %d", test.path, code, test.none)
+		}
+		handler.AuthConfig.NormalizePath = true
+		if code := request(test.path); code != test.clean {
+			t.Errorf("%s with normalize_path: %d, supposed to be %d", test.path, code, test.clean)
+		}
+		handler.AuthConfig.TrailingSlash = TrailingSlashStrip
+		if code := request(test.path); code != test.stripped {
+			t.Errorf("%s with normalize_path and trailing_slash strip: %d, supposed to be %d", test.path, code, test.stripped)
+		}
+	}
+}
+
+func TestPathNormalizationOption(t *testing.T) {
+	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	e.AddPolicy("alice", "^/a$", "GET", "allow")
+	e.AddPolicy("alice", "^/b$", "GET", "allow")
+	tests := []struct {
+		path                  string
+		none, clean, stripped int
+	}{
+		{"/a/", 403, 403, 200},
+		{"/a/../b", 403, 200, 403},
+		{"//a", 403, 200, 403},
+	}
+	for mode, code := range map[string]func(int) int{
+		PathNormalizationNone:               func(i int) int { return tests[i].none },
+		PathNormalizationClean:              func(i int) int { return tests[i].clean },
+		PathNormalizationStripTrailingSlash: func(i int) int { return tests[i].stripped },
+	} {
+		handler := Authorizer{Enforcer: e, PasswordCheck: testAuthProvider(t)}
+		handler.AuthConfig.PathNormalization = mode
+		if err := handler.applyPathNormalization(); err != nil {
+			t.Fatalf("%s: %s", mode, err)
+		}
+		for i, test := range tests {
+			r, _ := http.NewRequest("GET", "/", nil)
+			r.URL.Path = test.path
+			r.SetBasicAuth("alice", "123")
+			if got := serve(handler, r).Code; got != code(i) {
+				t.Errorf("%s with %s: %d, supposed to be %d", test.path, mode, got, code(i))
+			}
+		}
+	}
+
+	var a Authorizer
+	a.AuthConfig.PathNormalization = PathNormalizationStripTrailingSlash
+	a.AuthConfig.TrailingSlash = TrailingSlashRequire
+	if err := a.applyPathNormalization(); err == nil {
+		t.Errorf("conflicting trailing slash mode accepted")
+	}
+	a.AuthConfig.PathNormalization = "collapse"
+	if err := a.applyPathNormalization(); err == nil {
+		t.Errorf("invalid path normalization accepted")
+	}
+}
+
+func TestSegmentsPolicy(t *testing.T) {
+	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	e.AddPolicy("alice", "^/документы/", "GET", "allow")
+	e.AddPolicy("alice", "^/public/", "GET", "allow")
+	handler := Authorizer{Enforcer: e, PasswordCheck: testAuthProvider(t)}
+	handler.AuthConfig.ObjectSource = ObjectSourceSegments
+
+	testRequest(t, handler, "alice", "/%D0%B4%D0%BE%D0%BA%D1%83%D0%BC%D0%B5%D0%BD%D1%82%D1%8B/report", "GET", 200)
+	testRequest(t, handler, "alice", "/public/%2E%2E/dataset2/resource1", "GET", 403)
+	testRequest(t, handler, "alice", "/public/..%2Fdataset2", "GET", 200)
+}
+
+func TestCaddyfileObject(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		object_source uri
+		include_query
+		normalize_path
+		path_normalization clean
+		strip_prefix /api
+		lowercase_object
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if a.AuthConfig.ObjectSource != ObjectSourceURI || !a.AuthConfig.IncludeQuery || !a.AuthConfig.NormalizePath ||
+		a.AuthConfig.PathNormalization != PathNormalizationClean || a.AuthConfig.StripPrefix != "/api" ||
+		!a.AuthConfig.LowercaseObject {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+}
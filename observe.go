@@ -0,0 +1,32 @@
+package authz
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// Enforcement modes.
+const (
+	// EnforcementEnforce refuses requests the policy doesn't allow.
+	EnforcementEnforce = "enforce"
+	// EnforcementObserve lets all requests through, logging and counting
+	// the ones that would have been refused, to try a policy on production
+	// traffic before enforcing it.
+	EnforcementObserve = "observe"
+)
+
+// observeOnly reports whether refusals are only observed.
+func (a *Authorizer) observeOnly() bool {
+	return a.AuthConfig.EnforcementMode == EnforcementObserve
+}
+
+// observeRefusal logs and counts a request that would have been refused.
+func (a *Authorizer) observeRefusal(r *http.Request, user string, decision int) {
+	observedRefusalsTotal.WithLabelValues(decisionName(decision)).Inc()
+	a.getLogger().Warn("request would have been refused",
+		zap.String("subject", user),
+		zap.String("path", a.getPath(r)),
+		zap.String("method", a.getAction(r)),
+		zap.String("decision", decisionName(decision)))
+}
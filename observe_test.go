@@ -0,0 +1,80 @@
+package authz
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/casbin/casbin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestObserveMode(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+		logger:        zap.New(core),
+	}
+	handler.AuthConfig.EnforcementMode = EnforcementObserve
+	handler.AuthConfig.UserHeader = "X-User"
+	denied := testutil.ToFloat64(observedRefusalsTotal.WithLabelValues("denied"))
+
+	var nextUser string
+	var reached bool
+	serveNext := func(r *http.Request) int {
+		reached = false
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) error {
+			reached, nextUser = true, r.Header.Get("X-User")
+			return nil
+		}))
+		return w.Code
+	}
+
+	// alice may not DELETE, but the request is let through.
+	r, _ := http.NewRequest("DELETE", "/dataset2/resource1", nil)
+	r.SetBasicAuth("alice", "123")
+	if code := serveNext(r); code != 200 || !reached || nextUser != "alice" {
+		t.Errorf("would-be-denied request: %d, reached %t as %q", code, reached, nextUser)
+	}
+	entries := logs.FilterMessage("request would have been refused").All()
+	if len(entries) == 0 {
+		t.Fatalf("would-be-denied request not logged")
+	}
+	expected := map[string]interface{}{
+		"subject":  "alice",
+		"path":     "/dataset2/resource1",
+		"method":   "DELETE",
+		"decision": "denied",
+	}
+	fields := entries[0].ContextMap()
+	for key, value := range expected {
+		if fields[key] != value {
+			t.Errorf("%s: %v, supposed to be %v", key, fields[key], value)
+		}
+	}
+	if got := testutil.ToFloat64(observedRefusalsTotal.WithLabelValues("denied")); got <= denied {
+		t.Errorf("observed denials %v, supposed to be more than %v", got, denied)
+	}
+
+	// Allowed requests aren't logged.
+	logs.TakeAll()
+	r, _ = http.NewRequest("GET", "/dataset1/resource1", nil)
+	r.SetBasicAuth("alice", "123")
+	if code := serveNext(r); code != 200 || !reached || logs.Len() != 0 {
+		t.Errorf("allowed request: %d, reached %t, %d log entries", code, reached, logs.Len())
+	}
+
+	// Enforced, the request is refused.
+	handler.AuthConfig.EnforcementMode = EnforcementEnforce
+	r, _ = http.NewRequest("DELETE", "/dataset2/resource1", nil)
+	r.SetBasicAuth("alice", "123")
+	if code := serveNext(r); code != 403 || reached {
+		t.Errorf("enforced request: %d, reached %t", code, reached)
+	}
+}
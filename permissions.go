@@ -0,0 +1,66 @@
+package authz
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// DefaultPermissionsLimit is the default maximum size in bytes of the
+// permissions header value.
+const DefaultPermissionsLimit = 2048
+
+// permissionsLimit returns the maximum size of the permissions header value.
+func (a *Authorizer) permissionsLimit() int {
+	if a.AuthConfig.PermissionsLimit == 0 {
+		return DefaultPermissionsLimit
+	}
+	return a.AuthConfig.PermissionsLimit
+}
+
+// setPermissionsHeader lists the implicit permissions of user, the rules of
+// the user and of all roles the user has, in the permissions header if one is
+// configured. Every permission is a JSON array of the rule fields following
+// the subject. Permissions that don't fit the size limit are left out, which
+// is flagged by the header with the suffix "-Truncated".
+func (a *Authorizer) setPermissionsHeader(w http.ResponseWriter, user string) {
+	if a.AuthConfig.PermissionsHeader == "" || user == "" {
+		return
+	}
+	unlock := a.rlockPolicy()
+	rules := a.Enforcer.GetImplicitPermissionsForUser(user)
+	unlock()
+	seen := make(map[string]bool)
+	var permissions []string
+	for _, rule := range rules {
+		if len(rule) < 2 {
+			continue
+		}
+		b, err := json.Marshal(rule[1:])
+		if err != nil || seen[string(b)] {
+			continue
+		}
+		seen[string(b)] = true
+		permissions = append(permissions, string(b))
+	}
+	sort.Strings(permissions)
+
+	limit := a.permissionsLimit()
+	size := len("[]")
+	n := 0
+	for ; n < len(permissions); n++ {
+		added := len(permissions[n])
+		if n > 0 {
+			added++ // the separating comma
+		}
+		if size+added > limit {
+			break
+		}
+		size += added
+	}
+	w.Header().Set(a.AuthConfig.PermissionsHeader, "["+strings.Join(permissions[:n], ",")+"]")
+	if n < len(permissions) {
+		w.Header().Set(a.AuthConfig.PermissionsHeader+"-Truncated", "true")
+	}
+}
@@ -0,0 +1,65 @@
+package authz
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/casbin/casbin"
+)
+
+func TestPermissionsHeader(t *testing.T) {
+	e := casbin.NewEnforcer(casbin.NewModel(rbacModel))
+	e.AddPolicy("editor", "^/dataset1/", "GET", "allow")
+	e.AddPolicy("alice", "^/dataset1/", "GET", "allow")
+	e.AddPolicy("alice", "^/dataset1/resource1", "POST", "allow")
+	e.AddPolicy("bob", "^/dataset2/", "GET", "allow")
+	e.AddGroupingPolicy("alice", "editor")
+	handler := Authorizer{Enforcer: e, PasswordCheck: testAuthProvider(t)}
+
+	request := func(method string) *http.Request {
+		r, _ := http.NewRequest(method, "/dataset1/resource1", nil)
+		r.SetBasicAuth("alice", "123")
+		return r
+	}
+	if w := serve(handler, request("GET")); w.Header().Get("X-Permissions") != "" {
+		t.Errorf("permissions header without configuration: %q", w.Header().Get("X-Permissions"))
+	}
+
+	handler.AuthConfig.PermissionsHeader = "X-Permissions"
+	const first = `["^/dataset1/","GET","allow"]`
+	const second = `["^/dataset1/resource1","POST","allow"]`
+	w := serve(handler, request("GET"))
+	if got := w.Header().Get("X-Permissions"); got != "["+first+","+second+"]" {
+		t.Errorf("permissions header: %s", got)
+	}
+	if w.Header().Get("X-Permissions-Truncated") != "" {
+		t.Errorf("permissions header flagged as truncated")
+	}
+	if w := serve(handler, request("DELETE")); w.Code != 403 || w.Header().Get("X-Permissions") != "" {
+		t.Errorf("permissions header on denied request: %d %q", w.Code, w.Header().Get("X-Permissions"))
+	}
+
+	handler.AuthConfig.PermissionsLimit = len(first) + len(second) + 2
+	w = serve(handler, request("GET"))
+	if got := w.Header().Get("X-Permissions"); got != "["+first+"]" || w.Header().Get("X-Permissions-Truncated") != "true" {
+		t.Errorf("truncated permissions header: %s, %q", got, w.Header().Get("X-Permissions-Truncated"))
+	}
+	handler.AuthConfig.PermissionsLimit = 1
+	if got := serve(handler, request("GET")).Header().Get("X-Permissions"); got != "[]" {
+		t.Errorf("permissions header over limit: %s", got)
+	}
+}
+
+func TestCaddyfilePermissionsHeader(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		permissions_header X-Permissions 512
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if a.AuthConfig.PermissionsHeader != "X-Permissions" || a.AuthConfig.PermissionsLimit != 512 {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+}
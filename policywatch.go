@@ -0,0 +1,79 @@
+package authz
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/dafanasiev/caddy-authz/v2/authfile"
+	"go.uber.org/zap"
+)
+
+// policyWatcher polls the model and policy files and reloads the policy when
+// one of them changes. The files are stamped by path, so files replaced by an
+// editor are noticed as well.
+type policyWatcher struct {
+	paths  []string
+	stamps [][]byte
+	reload func() error
+	logger *zap.Logger
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newPolicyWatcher(paths []string, interval time.Duration, reload func() error, logger *zap.Logger) *policyWatcher {
+	pw := &policyWatcher{
+		paths:  paths,
+		stamps: make([][]byte, len(paths)),
+		reload: reload,
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+	pw.changed()
+	go pw.run(interval)
+	return pw
+}
+
+// run checks the files every interval until the watcher is closed.
+func (pw *policyWatcher) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pw.done:
+			return
+		case <-ticker.C:
+		}
+		if !pw.changed() {
+			continue
+		}
+		if err := pw.reload(); err != nil {
+			pw.logger.Error("policy reload failed", zap.Strings("files", pw.paths), zap.Error(err))
+		} else {
+			pw.logger.Info("policy reloaded", zap.Strings("files", pw.paths))
+		}
+	}
+}
+
+// changed updates the stamps of the files and reports whether one of them
+// changed. A file that can't be stamped, e.g. while it is being replaced,
+// keeps its last stamp and is checked again on the next tick.
+func (pw *policyWatcher) changed() bool {
+	changed := false
+	for i, path := range pw.paths {
+		stamp, err := authfile.ChangeStamp(path)
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(stamp, pw.stamps[i]) {
+			pw.stamps[i] = stamp
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Close stops the watcher.
+func (pw *policyWatcher) Close() {
+	pw.once.Do(func() { close(pw.done) })
+}
@@ -0,0 +1,80 @@
+package authz
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestPolicyWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policy, err := ioutil.ReadFile("authz_policy.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policyPath := filepath.Join(dir, "policy.csv")
+	if err := ioutil.WriteFile(policyPath, policy, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := `{
+		"admin": {"disabled": true, "config": {"persist": false}},
+		"apps": {"authz_provision_test": {"handler": {"auth_config": {
+			"model_path": "authz_model.conf",
+			"policy_path": ` + strconv.Quote(policyPath) + `,
+			"password_file": "bcrypt.pass",
+			"policy_watch_interval": 10000000
+		}}}}
+	}`
+	if err := caddy.Load([]byte(config), true); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	defer caddy.Stop()
+
+	request := func() int {
+		r, _ := http.NewRequest("GET", "/dataset2/resource1", nil)
+		r.SetBasicAuth("alice", "123")
+		w := httptest.NewRecorder()
+		provisionedHandler.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+			return nil
+		}))
+		return w.Code
+	}
+	if code := request(); code != 403 {
+		t.Fatalf("%d before the policy change, supposed to be 403", code)
+	}
+
+	policy = append(policy, "\np, alice, /dataset2/resource1, GET, allow\n"...)
+	if err := ioutil.WriteFile(policyPath, policy, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(2*time.Second, func() bool { return request() == 200 }) {
+		t.Errorf("%d after the policy change, supposed to be 200", request())
+	}
+}
+
+func TestCaddyfilePolicyWatchInterval(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		policy_watch_interval 2s
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if a.AuthConfig.PolicyWatchInterval != caddy.Duration(2*time.Second) {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+}
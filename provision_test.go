@@ -0,0 +1,432 @@
+package authz
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/casbin/casbin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	caddy.RegisterModule(provisionTestApp{})
+}
+
+// provisionedHandler and provisionedHandlers are the handlers loaded by the
+// last provisionTestApp.
+var (
+	provisionedHandler  caddyhttp.MiddlewareHandler
+	provisionedHandlers []caddyhttp.MiddlewareHandler
+)
+
+// provisionTestApp is an app loading the handlers from its configuration, so
+// Caddy provisions and validates them like in a server, without starting one.
+type provisionTestApp struct {
+	Handler  json.RawMessage   `json:"handler,omitempty"`
+	Handlers []json.RawMessage `json:"handlers,omitempty"`
+}
+
+func (provisionTestApp) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "authz_provision_test",
+		New: func() caddy.Module { return new(provisionTestApp) },
+	}
+}
+
+func (app *provisionTestApp) Provision(ctx caddy.Context) error {
+	if app.Handler != nil {
+		mod, err := ctx.LoadModuleByID("http.handlers.authz", app.Handler)
+		if err != nil {
+			return err
+		}
+		provisionedHandler = mod.(caddyhttp.MiddlewareHandler)
+	}
+	provisionedHandlers = nil
+	for _, handler := range app.Handlers {
+		mod, err := ctx.LoadModuleByID("http.handlers.authz", handler)
+		if err != nil {
+			return err
+		}
+		provisionedHandlers = append(provisionedHandlers, mod.(caddyhttp.MiddlewareHandler))
+	}
+	return nil
+}
+
+func (app *provisionTestApp) Start() error { return nil }
+func (app *provisionTestApp) Stop() error  { return nil }
+
+func TestProvisionedHandler(t *testing.T) {
+	config := `{
+		"admin": {"disabled": true, "config": {"persist": false}},
+		"apps": {"authz_provision_test": {"handler": {
+			"auth_config": {
+				"model_path": "authz_model.conf",
+				"policy_path": "authz_policy.csv",
+				"realm": "Test",
+				"password_file": "bcrypt.pass"
+			}
+		}}}
+	}`
+	if err := caddy.Load([]byte(config), true); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	defer caddy.Stop()
+
+	request := func(user, password, path string) int {
+		r, _ := http.NewRequest("GET", path, nil)
+		if user != "" {
+			r.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		provisionedHandler.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+			return nil
+		}))
+		return w.Code
+	}
+
+	tests := []struct {
+		user, password, path string
+		code                 int
+	}{
+		{"alice", "123", "/dataset1/resource1", 200},
+		{"alice", "123", "/dataset2/resource1", 403},
+		{"alice", "wrong", "/dataset1/resource1", 401},
+		{"", "", "/dataset1/resource1", 401},
+	}
+	for _, test := range tests {
+		if code := request(test.user, test.password, test.path); code != test.code {
+			t.Errorf("%s %s: %d, supposed to be %d", test.user, test.path, code, test.code)
+		}
+	}
+}
+
+// loadCaddyfile parses the Caddyfile block of the handler and loads it
+// through its JSON config, returning the provisioned handler and its JSON
+// config. The caller stops Caddy.
+func loadCaddyfile(t *testing.T, input string) (*Authorizer, []byte) {
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	handlerJSON, err := json.Marshal(a)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	config := `{
+		"admin": {"disabled": true, "config": {"persist": false}},
+		"apps": {"authz_provision_test": {"handler": ` + string(handlerJSON) + `}}
+	}`
+	if err := caddy.Load([]byte(config), true); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	return provisionedHandler.(*Authorizer), handlerJSON
+}
+
+func TestJSONConfig(t *testing.T) {
+	handler, handlerJSON := loadCaddyfile(t, `authz {
+		model authz_model.conf
+		policy authz_policy.csv
+		password_file bcrypt.pass
+		realm Test
+		method_alias off
+		session_ttl 30m
+	}`)
+	defer caddy.Stop()
+	want := `{"auth_config":{"model_path":"authz_model.conf","policy_path":"authz_policy.csv","realm":"Test",` +
+		`"password_file":"bcrypt.pass","method_aliases":{},"session_ttl":1800000000000}}`
+	if string(handlerJSON) != want {
+		t.Errorf("JSON config %s, supposed to be %s", handlerJSON, want)
+	}
+	if handler.AuthConfig.Realm != "Test" || handler.AuthConfig.PasswordFile != "bcrypt.pass" ||
+		len(handler.AuthConfig.MethodAliases) != 0 || handler.AuthConfig.MethodAliases == nil {
+		t.Errorf("unexpected config %+v", handler.AuthConfig)
+	}
+
+	r, _ := http.NewRequest("GET", "/dataset1/resource1", nil)
+	r.SetBasicAuth("alice", "123")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if w.Code != 200 {
+		t.Errorf("%d, supposed to be %d", w.Code, 200)
+	}
+	// HEAD is not authorized as GET with the aliases disabled.
+	r.Method = "HEAD"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		return nil
+	}))
+	if w.Code != 403 {
+		t.Errorf("HEAD: %d, supposed to be %d", w.Code, 403)
+	}
+}
+
+func TestProvisionWaitsForPasswordFile(t *testing.T) {
+	config := `{
+		"admin": {"disabled": true, "config": {"persist": false}},
+		"apps": {"authz_provision_test": {"handler": {"auth_config": {
+			"model_path": "authz_model.conf",
+			"policy_path": "authz_policy.csv",
+			"password_file": "bcrypt.pass"
+		}}}}
+	}`
+	// Requests right after provisioning find the users, every time.
+	for i := 0; i < 10; i++ {
+		if err := caddy.Load([]byte(config), true); err != nil {
+			t.Fatalf("Load: %s", err)
+		}
+		r, _ := http.NewRequest("GET", "/dataset1/resource1", nil)
+		r.SetBasicAuth("alice", "123")
+		w := httptest.NewRecorder()
+		provisionedHandler.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+			return nil
+		}))
+		caddy.Stop()
+		if w.Code != 200 {
+			t.Fatalf("load %d: %d, supposed to be %d", i, w.Code, 200)
+		}
+	}
+}
+
+func TestMultiplePasswordFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	team := filepath.Join(dir, "team.pass")
+	var content string
+	for user, password := range map[string]string{"alice": "team", "dave": "123"} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("GenerateFromPassword: %s", err)
+		}
+		content += user + ":" + string(hash) + "\n"
+	}
+	if err := ioutil.WriteFile(team, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	handler, _ := loadCaddyfile(t, `authz {
+		model authz_model.conf
+		policy authz_policy.csv
+		password_file bcrypt.pass `+team+`
+	}`)
+	defer caddy.Stop()
+	if handler.AuthConfig.PasswordFile != "bcrypt.pass" || len(handler.AuthConfig.PasswordFiles) != 1 {
+		t.Fatalf("password files %q and %q", handler.AuthConfig.PasswordFile, handler.AuthConfig.PasswordFiles)
+	}
+
+	// bob is in the first file, dave in the second one.
+	testRequest(t, *handler, "bob", "/dataset2/resource1", "GET", 200)
+	testRequest(t, *handler, "dave", "/dataset2/resource1", "GET", 403)
+	// The entry of alice in the last file wins.
+	testRequest(t, *handler, "alice", "/dataset1/resource1", "GET", 401)
+	r, _ := http.NewRequest("GET", "/dataset1/resource1", nil)
+	r.SetBasicAuth("alice", "team")
+	if w := serve(*handler, r); w.Code != 200 {
+		t.Errorf("alice of the last file: %d, supposed to be %d", w.Code, 200)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := (&Authorizer{}).Validate(); err == nil {
+		t.Errorf("handler without Enforcer accepted")
+	}
+	a := Authorizer{Enforcer: casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")}
+	if err := a.Validate(); err == nil {
+		t.Errorf("handler without PasswordCheck accepted")
+	}
+	a.PasswordCheck = testAuthProvider(t)
+	if err := a.Validate(); err != nil {
+		t.Errorf("Validate: %s", err)
+	}
+}
+
+func TestProvisionTrustedUserHeader(t *testing.T) {
+	for _, conflict := range []string{
+		`"identity_source": "jwt", "jwt_secret": "0123456789abcdef0123456789abcdef"`,
+		`"basic_auth_mode": "token"`,
+		`"login_path": "/login", "session_key": "0123456789abcdef0123456789abcdef"`,
+	} {
+		config := `{
+			"admin": {"disabled": true, "config": {"persist": false}},
+			"apps": {"authz_provision_test": {"handler": {"auth_config": {
+				"model_path": "authz_model.conf",
+				"policy_path": "authz_policy.csv",
+				"password_file": "bcrypt.pass",
+				"trusted_user_header": "X-Remote-User",
+				` + conflict + `
+			}}}}
+		}`
+		err := caddy.Load([]byte(config), true)
+		if err == nil {
+			caddy.Stop()
+			t.Errorf("trusted user header with %s accepted", conflict)
+		} else if !strings.Contains(err.Error(), "trusted user header") {
+			t.Errorf("trusted user header with %s: %s", conflict, err)
+		}
+	}
+}
+
+func TestProvisionIncludeClientIP(t *testing.T) {
+	config := `{
+		"admin": {"disabled": true, "config": {"persist": false}},
+		"apps": {"authz_provision_test": {"handler": {"auth_config": {
+			"model_path": "authz_model.conf",
+			"policy_path": "authz_policy.csv",
+			"password_file": "bcrypt.pass",
+			"include_client_ip": true
+		}}}}
+	}`
+	err := caddy.Load([]byte(config), true)
+	if err == nil {
+		caddy.Stop()
+		t.Fatalf("client IP accepted for a model with three request arguments")
+	}
+	if !strings.Contains(err.Error(), "4 request arguments") {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	config := `{
+		"admin": {"disabled": true, "config": {"persist": false}},
+		"apps": {"authz_provision_test": {"handler": {"auth_config": {
+			"model_path": "authz_model.conf",
+			"policy_path": "authz_policy.csv",
+			"password_file": "bcrypt.pass"
+		}}}}
+	}`
+	openFiles := func() int {
+		fds, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			return -1
+		}
+		return len(fds)
+	}
+	cycle := func() {
+		if err := caddy.Load([]byte(config), true); err != nil {
+			t.Fatalf("Load: %s", err)
+		}
+		caddy.Stop()
+	}
+	// The first cycle starts goroutines of Caddy itself that stay.
+	cycle()
+	time.Sleep(100 * time.Millisecond)
+	goroutines, fds := runtime.NumGoroutine(), openFiles()
+
+	for i := 0; i < 5; i++ {
+		cycle()
+	}
+	// A killed password check lets go of the service after a while.
+	if !waitFor(5*time.Second, func() bool { return runtime.NumGoroutine() <= goroutines }) {
+		t.Errorf("%d goroutines after cleanup, supposed to be %d", runtime.NumGoroutine(), goroutines)
+	}
+	if n := openFiles(); n > fds {
+		t.Errorf("%d open files after cleanup, supposed to be %d", n, fds)
+	}
+}
+
+func TestSharedPasswordCheck(t *testing.T) {
+	handler := func(realm string, cost int) string {
+		return fmt.Sprintf(`{"auth_config": {
+			"model_path": "authz_model.conf",
+			"policy_path": "authz_policy.csv",
+			"realm": %q,
+			"password_file": "bcrypt.pass",
+			"cost": %d
+		}}`, realm, cost)
+	}
+	config := `{
+		"admin": {"disabled": true, "config": {"persist": false}},
+		"apps": {"authz_provision_test": {"handlers": [` +
+		handler("One", 0) + `, ` + handler("Two", 0) + `, ` + handler("Three", 4) + `]}}
+	}`
+	if err := caddy.Load([]byte(config), true); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	one, two, three := provisionedHandlers[0].(*Authorizer), provisionedHandlers[1].(*Authorizer), provisionedHandlers[2].(*Authorizer)
+	if one.passwordBackend != two.passwordBackend || one.PasswordCheck != two.PasswordCheck {
+		t.Errorf("handlers of the same password file don't share the password check")
+	}
+	if one.passwordBackend == three.passwordBackend {
+		t.Errorf("handlers with different costs share the password check")
+	}
+	sharedPasswordChecks.Lock()
+	if n := len(sharedPasswordChecks.byKey); n != 2 {
+		t.Errorf("%d password checks, supposed to be 2", n)
+	}
+	sharedPasswordChecks.Unlock()
+
+	// The password check stays until the last handler goes away.
+	one.Cleanup()
+	testRequest(t, *two, "alice", "/dataset1/resource1", "GET", 200)
+	two.Cleanup()
+	three.Cleanup()
+	sharedPasswordChecks.Lock()
+	if n := len(sharedPasswordChecks.byKey); n != 0 {
+		t.Errorf("%d password checks after cleanup, supposed to be none", n)
+	}
+	sharedPasswordChecks.Unlock()
+	caddy.Stop()
+}
+
+func TestProvisionModelCheck(t *testing.T) {
+	const model = `[request_definition]
+r = %s
+
+[policy_definition]
+p = sub, obj, act, eft
+
+[policy_effect]
+e = some(where (p.eft == allow)) && !some(where (p.eft == deny))
+
+[matchers]
+m = %s`
+	for _, test := range []struct {
+		request, matcher string
+		err              string
+	}{
+		{"sub, obj, act", "r.sub == p.sub && keyMatch(r.obj, p.obj) && r.act == p.act", ""},
+		{"sub, obj", "r.sub == p.sub && keyMatch(r.obj, p.obj)", "3 request arguments (subject, object, action), but the model has 2 (r = sub, obj)"},
+		{"sub, obj, act", "r.sub == p.sub && r.dom == p.obj", "uses r.dom, which the definition r = sub, obj, act doesn't have"},
+		{"sub, obj, act", `r.sub == p.sub && r.obj == "r.dom" && p.act != "p.x"`, ""},
+		{"sub, obj, act", "r.sub == p.sub && nosuchMatch(r.obj, p.obj)", "the matcher of the model fails"},
+	} {
+		modelText, _ := json.Marshal(fmt.Sprintf(model, test.request, test.matcher))
+		config := `{
+			"admin": {"disabled": true, "config": {"persist": false}},
+			"apps": {"authz_provision_test": {"handler": {"auth_config": {
+				"model_text": ` + string(modelText) + `,
+				"policy_path": "authz_policy.csv",
+				"password_file": "bcrypt.pass"
+			}}}}
+		}`
+		err := caddy.Load([]byte(config), true)
+		if err == nil {
+			caddy.Stop()
+		}
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %s", test.matcher, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%s: model accepted", test.matcher)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%s: unexpected error: %s", test.matcher, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package authz
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// wildcards are the policy values matching any path or action with the
+// matcher functions of the models of this package: "*" for keyMatch and
+// equality with "*", ".*" and "^.*" for regexMatch.
+var wildcards = map[string]bool{"*": true, ".*": true, "^.*": true}
+
+// allowEffects are the policy effects under which a rule allowing access
+// can't be overridden but by a deny rule.
+var allowEffects = map[string]bool{
+	"some(where (p_eft == allow))":                                 true,
+	"some(where (p_eft == allow)) && !some(where (p_eft == deny))": true,
+}
+
+// publicProbes are requests checked against the policy before it is taken
+// as public, in case the matcher doesn't treat the wildcards as such.
+var publicProbes = []enforceArgs{
+	{path: "/", method: "GET"},
+	{path: "/index.html", method: "HEAD"},
+	{path: "/a/b/c.json", method: "POST"},
+	{path: "/a%2Fb/?q=1", method: "DELETE"},
+	{path: "", method: "OPTIONS"},
+}
+
+// updatePublic finds out whether the policy allows the anonymous subject
+// every path and action, see publicPolicy. It is called with the policy
+// loaded and locked against reloads, by Provision and ReloadPolicy.
+func (a *Authorizer) updatePublic() {
+	var public int32
+	if a.publicPolicy() {
+		public = 1
+	}
+	if atomic.SwapInt32(&a.public, public) != public {
+		a.getLogger().Info("public policy fast path", zap.Bool("enabled", public == 1))
+	}
+}
+
+// publicPolicy reports whether every request is allowed anonymously: the
+// policy has a rule allowing the anonymous subject wildcard paths and
+// actions, no rule can deny it, and the probes are allowed. Only handlers
+// whose decision depends on nothing but the policy qualify; a decision hook,
+// an audit log, and request arguments besides path and action rule it out,
+// as does a policy changed by others than ReloadPolicy, in Redis or SQL.
+func (a *Authorizer) publicPolicy() bool {
+	if a.Enforcer == nil || a.decisionHook != nil || a.auditLog != nil ||
+		a.AuthConfig.ABAC || a.AuthConfig.DomainSource != "" || a.AuthConfig.IncludeClientIP ||
+		a.AuthConfig.RedisAddress != "" || a.AuthConfig.SQLDriver != "" {
+		return false
+	}
+	model := a.Enforcer.GetModel()
+	effect, ok := model["e"]["e"]
+	if !ok || !allowEffects[effect.Value] {
+		return false
+	}
+	p, ok := model["p"]["p"]
+	if !ok {
+		return false
+	}
+	eft := -1
+	for i, token := range p.Tokens {
+		if token == "p_eft" {
+			eft = i
+		}
+	}
+	anonymous := a.anonymousSubject()
+	allowed := false
+	for _, rule := range p.Policy {
+		if eft >= 0 && eft < len(rule) && rule[eft] != "allow" {
+			if rule[eft] == "deny" {
+				return false
+			}
+			continue
+		}
+		if len(rule) == 0 || rule[0] != anonymous {
+			continue
+		}
+		wildcard := true
+		for i, value := range rule[1:] {
+			if i+1 != eft && !wildcards[value] {
+				wildcard = false
+			}
+		}
+		allowed = allowed || wildcard
+	}
+	if !allowed {
+		return false
+	}
+	for _, probe := range publicProbes {
+		if !a.enforceLocked(a.requestValues(anonymous, probe)...) {
+			return false
+		}
+	}
+	return true
+}
+
+// anonymousRequest reports whether r carries no credentials at all, so it
+// is checked as the anonymous subject. Malformed credentials count as
+// credentials; the full check decides on them.
+func (a *Authorizer) anonymousRequest(r *http.Request) bool {
+	if a.AuthConfig.TrustedUserHeader != "" {
+		return r.Header.Get(a.AuthConfig.TrustedUserHeader) == ""
+	}
+	if a.clientCertIdentity() {
+		return r.TLS == nil || len(r.TLS.VerifiedChains) == 0
+	}
+	if r.Header.Get("Authorization") != "" {
+		return false
+	}
+	if a.sessionsEnabled() {
+		if _, err := r.Cookie(a.sessionCookieName()); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// servePublic lets an anonymous request of a public policy through without
+// checking it, see updatePublic. It reports whether it did. Requests are
+// still checked while decisions are logged at debug level.
+func (a *Authorizer) servePublic(r *http.Request) bool {
+	if atomic.LoadInt32(&a.public) == 0 || !a.anonymousRequest(r) ||
+		a.getLogger().Core().Enabled(zap.DebugLevel) {
+		return false
+	}
+	a.identify(r, "")
+	return true
+}
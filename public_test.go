@@ -0,0 +1,175 @@
+package authz
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/casbin/casbin"
+)
+
+func TestPublicPolicy(t *testing.T) {
+	const keyMatch = `
+[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = r.sub == p.sub && keyMatch(r.obj, p.obj) && (r.act == p.act || p.act == "*")
+`
+	for _, test := range []struct {
+		name   string
+		model  string
+		rules  string
+		domain bool
+		public bool
+	}{
+		{"allow all", "authz_model.conf", "nobody, .*, *, allow", false, true},
+		{"allow all anchored", "authz_model.conf", "alice, ^/dataset1/, GET, allow\nnobody, ^.*, *, allow", false, true},
+		{"deny rule", "authz_model.conf", "nobody, .*, *, allow\nalice, ^/admin, *, deny", false, false},
+		{"some paths", "authz_model.conf", "nobody, ^/public/, *, allow", false, false},
+		{"some actions", "authz_model.conf", "nobody, .*, GET, allow", false, false},
+		{"no wildcard action", "authz_model.conf", "nobody, .*, .*, allow", false, false},
+		{"other subject", "authz_model.conf", "alice, .*, *, allow", false, false},
+		{"not a regexp", "authz_model.conf", "nobody, *, *, allow", false, false},
+		{"domain", "authz_model.conf", "nobody, .*, *, allow", true, false},
+		{"keyMatch", keyMatch, "nobody, *, *", false, true},
+		{"keyMatch regexp", keyMatch, "nobody, .*, *", false, false},
+	} {
+		var e *casbin.Enforcer
+		if test.model == keyMatch {
+			e = casbin.NewEnforcer(casbin.NewModel(keyMatch))
+		} else {
+			e = casbin.NewEnforcer(test.model)
+		}
+		for _, rule := range strings.Split(test.rules, "\n") {
+			fields := strings.Split(rule, ", ")
+			params := make([]interface{}, len(fields))
+			for i, field := range fields {
+				params[i] = field
+			}
+			e.AddPolicy(params...)
+		}
+		a := Authorizer{Enforcer: e}
+		if test.domain {
+			a.AuthConfig.DomainSource = "host"
+		}
+		if public := a.publicPolicy(); public != test.public {
+			t.Errorf("%s: public %t, supposed to be %t", test.name, public, test.public)
+		}
+	}
+}
+
+func TestPublicPolicyTightened(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policyPath := filepath.Join(dir, "policy.csv")
+	if err := ioutil.WriteFile(policyPath, []byte("p, nobody, .*, *, allow\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := `{
+		"admin": {"disabled": true, "config": {"persist": false}},
+		"apps": {"authz_provision_test": {"handler": {"auth_config": {
+			"model_path": "authz_model.conf",
+			"policy_path": ` + strconv.Quote(policyPath) + `,
+			"password_file": "bcrypt.pass",
+			"policy_watch_interval": 10000000
+		}}}}
+	}`
+	if err := caddy.Load([]byte(config), true); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	defer caddy.Stop()
+	handler := provisionedHandler.(*Authorizer)
+	request := func(user, password string) int {
+		r, _ := http.NewRequest("GET", "/dataset1/resource1", nil)
+		if user != "" {
+			r.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+			return nil
+		}))
+		return w.Code
+	}
+	if atomic.LoadInt32(&handler.public) != 1 {
+		t.Fatalf("public policy not detected")
+	}
+	if code := request("", ""); code != 200 {
+		t.Errorf("anonymous request to the public policy: %d, supposed to be 200", code)
+	}
+	// Requests with credentials are checked as before.
+	if code := request("alice", "wrong"); code != 401 {
+		t.Errorf("invalid credentials on the public policy: %d, supposed to be 401", code)
+	}
+
+	policy, err := ioutil.ReadFile("authz_policy.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(policyPath, policy, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(2*time.Second, func() bool { return atomic.LoadInt32(&handler.public) == 0 }) {
+		t.Fatalf("public policy still detected after the policy change")
+	}
+	if code := request("", ""); code != 401 {
+		t.Errorf("anonymous request after the policy change: %d, supposed to be 401", code)
+	}
+	if code := request("alice", "123"); code != 200 {
+		t.Errorf("user request after the policy change: %d, supposed to be 200", code)
+	}
+}
+
+func BenchmarkPublicPolicy(b *testing.B) {
+	for _, bench := range []struct {
+		name     string
+		fastPath bool
+	}{
+		{"fast path", true},
+		{"enforce", false},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+			e.AddPolicy("nobody", ".*", "*", "allow")
+			e.RemovePolicy("nobody", "/", "*", "deny")
+			handler := &Authorizer{Enforcer: e}
+			handler.updatePublic()
+			if atomic.LoadInt32(&handler.public) != 1 {
+				b.Fatalf("public policy not detected")
+			}
+			if !bench.fastPath {
+				handler.public = 0
+			}
+			r, _ := http.NewRequest("GET", "/dataset1/resource1", nil)
+			next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r, next)
+				if w.Code != 200 {
+					b.Fatalf("%d, supposed to be 200", w.Code)
+				}
+			}
+		})
+	}
+}
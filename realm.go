@@ -0,0 +1,55 @@
+package authz
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// DefaultRealm is the realm of requests without a host if no realm is
+// configured.
+const DefaultRealm = "Restricted"
+
+// requestReplacer returns the replacer of the request, or a new one outside
+// of a Caddy server.
+func requestReplacer(r *http.Request) *caddy.Replacer {
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		return repl
+	}
+	return caddy.NewReplacer()
+}
+
+// realm returns the realm of the challenges to r: the configured realm with
+// its placeholders replaced, or else the host of the request, or
+// DefaultRealm.
+func (a *Authorizer) realm(r *http.Request) string {
+	realm := ""
+	if a.AuthConfig.Realm != "" {
+		realm = sanitizeRealm(requestReplacer(r).ReplaceKnown(a.AuthConfig.Realm, ""))
+	}
+	if realm == "" {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		realm = sanitizeRealm(host)
+	}
+	if realm == "" {
+		realm = DefaultRealm
+	}
+	return realm
+}
+
+// sanitizeRealm drops quotes, backslashes and control characters, which
+// could end the quoted realm of the header or the header itself.
+func sanitizeRealm(realm string) string {
+	return strings.TrimSpace(strings.Map(func(c rune) rune {
+		if c == '"' || c == '\\' || unicode.IsControl(c) {
+			return -1
+		}
+		return c
+	}, realm))
+}
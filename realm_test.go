@@ -0,0 +1,49 @@
+package authz
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/casbin/casbin"
+)
+
+func TestRealm(t *testing.T) {
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+	for _, test := range []struct {
+		realm, host, challenge string
+	}{
+		{"Test", "example.com", `Basic realm="Test"`},
+		{"", "example.com:8080", `Basic realm="example.com"`},
+		{"", "", `Basic realm="Restricted"`},
+		{"Staff of {http.request.host}", "example.com:8080", `Basic realm="Staff of example.com"`},
+		{"{http.request.header.X-Realm}", "example.com", `Basic realm="example.com"`},
+		{`My "Realm"` + "\r\nSet-Cookie: x=y", "example.com", `Basic realm="My RealmSet-Cookie: x=y"`},
+		{`\"`, "example.com", `Basic realm="example.com"`},
+	} {
+		handler.AuthConfig.Realm = test.realm
+		r, _ := http.NewRequest("GET", "/dataset1/resource1", nil)
+		r.Host = test.host
+		r = caddyhttp.PrepareRequest(r, caddy.NewReplacer(), nil, nil)
+		w := serve(handler, r)
+		if challenge := w.Header().Get("WWW-Authenticate"); w.Code != 401 || challenge != test.challenge {
+			t.Errorf("realm %q, host %q: %d %q, supposed to be 401 %q", test.realm, test.host, w.Code, challenge, test.challenge)
+		}
+	}
+}
+
+func TestCaddyfileWithoutRealm(t *testing.T) {
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`authz model.conf policy.csv bcrypt.pass`)); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if a.AuthConfig.ModelPath != "model.conf" || a.AuthConfig.PolicyPath != "policy.csv" ||
+		a.AuthConfig.PasswordFile != "bcrypt.pass" || a.AuthConfig.Realm != "" {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+}
@@ -0,0 +1,238 @@
+package authz
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisDialTimeout limits connecting to Redis and each request on the
+// connection, except waiting for messages of a subscription.
+const redisDialTimeout = 5 * time.Second
+
+// redisOptions tell how to connect to a Redis server.
+type redisOptions struct {
+	address  string
+	password string
+	db       int
+}
+
+// redisError is an error reply of the Redis server. Unlike network errors,
+// it leaves the connection usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection to a Redis server speaking RESP, the Redis
+// protocol. It is not safe for concurrent use.
+//
+// The policy needs a handful of list, transaction and pub/sub commands, on
+// one connection per adapter and one per watcher, so this small client stands
+// in for a Redis library. It also lets the watcher see a lost subscription:
+// client libraries resubscribe on their own, hiding the gap in which policy
+// changes were missed and the policy has to be reloaded.
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// dialRedis connects to the server of opts, authenticates and selects the
+// database.
+func dialRedis(opts redisOptions) (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", opts.address, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+	if opts.password != "" {
+		if _, err := c.do("AUTH", opts.password); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	if opts.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(opts.db)); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and returns its reply. An error reply is returned as
+// redisError.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	replies, err := c.pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// pipeline sends all commands before reading their replies. If any reply is
+// an error, the first one is returned with the replies.
+func (c *redisConn) pipeline(cmds [][]string) ([]interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisDialTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	for _, cmd := range cmds {
+		c.send(cmd...)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	var replyErr error
+	for i := range cmds {
+		reply, err := c.receive()
+		if err != nil {
+			if _, ok := err.(redisError); !ok {
+				return nil, err
+			}
+			if replyErr == nil {
+				replyErr = err
+			}
+		}
+		replies[i] = reply
+	}
+	return replies, replyErr
+}
+
+// send writes a command to the buffer of the connection.
+func (c *redisConn) send(args ...string) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// receive reads a reply: a string for simple strings, int64 for integers,
+// []byte or nil for bulk strings and []interface{} or nil for arrays.
+func (c *redisConn) receive() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, text := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return text, nil
+	case '-':
+		return nil, redisError(text)
+	case ':':
+		return strconv.ParseInt(text, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", text)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length %q", text)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		elems := make([]interface{}, n)
+		for i := range elems {
+			elem, err := c.receive()
+			if err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+				elem = err
+			}
+			elems[i] = elem
+		}
+		return elems, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
+
+// close closes the connection.
+func (c *redisConn) close() error {
+	return c.conn.Close()
+}
+
+// redisStrings converts an array reply of bulk strings.
+func redisStrings(reply interface{}) ([]string, error) {
+	elems, ok := reply.([]interface{})
+	if !ok && reply != nil {
+		return nil, fmt.Errorf("redis: unexpected reply %T, expected array", reply)
+	}
+	strs := make([]string, 0, len(elems))
+	for _, elem := range elems {
+		b, ok := elem.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("redis: unexpected array element %T, expected bulk string", elem)
+		}
+		strs = append(strs, string(b))
+	}
+	return strs, nil
+}
+
+// redisClient runs commands on a connection that is opened on first use and
+// replaced when broken. It is safe for concurrent use.
+type redisClient struct {
+	opts  redisOptions
+	mutex sync.Mutex
+	conn  *redisConn
+}
+
+// do runs commands as one pipeline. A broken connection is replaced, and the
+// commands are tried again once.
+func (rc *redisClient) do(cmds ...[]string) ([]interface{}, error) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if rc.conn == nil {
+			if rc.conn, err = dialRedis(rc.opts); err != nil {
+				return nil, err
+			}
+		}
+		var replies []interface{}
+		if replies, err = rc.conn.pipeline(cmds); err == nil {
+			return replies, nil
+		}
+		if _, ok := err.(redisError); ok {
+			return nil, err
+		}
+		rc.conn.close()
+		rc.conn = nil
+	}
+	return nil, err
+}
+
+// close closes the connection.
+func (rc *redisClient) close() {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	if rc.conn != nil {
+		rc.conn.close()
+		rc.conn = nil
+	}
+}
@@ -0,0 +1,396 @@
+package authz
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/casbin/casbin"
+)
+
+// fakeRedis is a Redis server implementing the commands the policy adapter
+// and watcher use.
+type fakeRedis struct {
+	t        *testing.T
+	address  string
+	password string
+
+	mutex    sync.Mutex
+	delay    time.Duration // of LRANGE replies
+	listener net.Listener
+	lists    map[string][]string
+	subs     map[string][]*fakeRedisConn
+	conns    map[*fakeRedisConn]bool
+}
+
+type fakeRedisConn struct {
+	conn   net.Conn
+	mutex  sync.Mutex // serializes writes of replies and published messages.
+	authed bool
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	fr := &fakeRedis{t: t, address: "127.0.0.1:0", password: password, lists: make(map[string][]string)}
+	fr.start()
+	return fr
+}
+
+// start listens on the address, which is kept by a restart.
+func (fr *fakeRedis) start() {
+	l, err := net.Listen("tcp", fr.address)
+	if err != nil {
+		fr.t.Fatalf("Listen: %s", err)
+	}
+	fr.mutex.Lock()
+	fr.address = l.Addr().String()
+	fr.listener = l
+	fr.subs = make(map[string][]*fakeRedisConn)
+	fr.conns = make(map[*fakeRedisConn]bool)
+	fr.mutex.Unlock()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c := &fakeRedisConn{conn: conn, authed: fr.password == ""}
+			fr.mutex.Lock()
+			fr.conns[c] = true
+			fr.mutex.Unlock()
+			go fr.serve(c)
+		}
+	}()
+}
+
+// stop closes the listener and all connections, keeping the data.
+func (fr *fakeRedis) stop() {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+	fr.listener.Close()
+	for c := range fr.conns {
+		c.conn.Close()
+	}
+}
+
+func (fr *fakeRedis) serve(c *fakeRedisConn) {
+	defer c.conn.Close()
+	r := bufio.NewReader(c.conn)
+	var queued [][]string
+	inMulti := false
+	for {
+		cmd, err := readFakeRedisCommand(r)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(cmd[0])
+		switch {
+		case name == "AUTH":
+			c.authed = cmd[1] == fr.password
+			if !c.authed {
+				c.write("-WRONGPASS invalid password\r\n")
+				continue
+			}
+			c.write("+OK\r\n")
+		case !c.authed:
+			c.write("-NOAUTH Authentication required.\r\n")
+		case name == "MULTI":
+			inMulti = true
+			queued = nil
+			c.write("+OK\r\n")
+		case name == "EXEC":
+			replies := "*" + strconv.Itoa(len(queued)) + "\r\n"
+			fr.mutex.Lock()
+			for _, q := range queued {
+				replies += fr.exec(c, q)
+			}
+			fr.mutex.Unlock()
+			inMulti = false
+			c.write(replies)
+		case inMulti:
+			queued = append(queued, cmd)
+			c.write("+QUEUED\r\n")
+		default:
+			fr.mutex.Lock()
+			reply := fr.exec(c, cmd)
+			fr.mutex.Unlock()
+			c.write(reply)
+		}
+	}
+}
+
+// exec runs a command and returns the reply. The mutex must be held.
+func (fr *fakeRedis) exec(c *fakeRedisConn, cmd []string) string {
+	switch strings.ToUpper(cmd[0]) {
+	case "SELECT", "PING":
+		return "+OK\r\n"
+	case "LRANGE":
+		if fr.delay > 0 {
+			time.Sleep(fr.delay)
+		}
+		list := fr.lists[cmd[1]]
+		reply := "*" + strconv.Itoa(len(list)) + "\r\n"
+		for _, elem := range list {
+			reply += bulk(elem)
+		}
+		return reply
+	case "RPUSH":
+		fr.lists[cmd[1]] = append(fr.lists[cmd[1]], cmd[2:]...)
+		return ":" + strconv.Itoa(len(fr.lists[cmd[1]])) + "\r\n"
+	case "DEL":
+		_, ok := fr.lists[cmd[1]]
+		delete(fr.lists, cmd[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "LREM":
+		list := fr.lists[cmd[1]]
+		for i, elem := range list {
+			if elem == cmd[3] {
+				fr.lists[cmd[1]] = append(list[:i:i], list[i+1:]...)
+				return ":1\r\n"
+			}
+		}
+		return ":0\r\n"
+	case "PUBLISH":
+		subs := fr.subs[cmd[1]]
+		for _, sub := range subs {
+			go sub.write("*3\r\n" + bulk("message") + bulk(cmd[1]) + bulk(cmd[2]))
+		}
+		return ":" + strconv.Itoa(len(subs)) + "\r\n"
+	case "SUBSCRIBE":
+		fr.subs[cmd[1]] = append(fr.subs[cmd[1]], c)
+		return "*3\r\n" + bulk("subscribe") + bulk(cmd[1]) + ":1\r\n"
+	default:
+		return "-ERR unknown command '" + cmd[0] + "'\r\n"
+	}
+}
+
+func (c *fakeRedisConn) write(reply string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn.Write([]byte(reply))
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func readFakeRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	cmd := make([]string, n)
+	for i := range cmd {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		cmd[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return cmd, nil
+}
+
+// waitFor polls cond until it returns true or the timeout expires.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestRedisAdapter(t *testing.T) {
+	fr := newFakeRedis(t, "secret")
+	defer fr.stop()
+	opts := redisOptions{address: fr.address, password: "secret", db: 1}
+
+	fileEnforcer := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	adapter := newRedisAdapter(opts, "rules")
+	defer adapter.client.close()
+	if err := adapter.SavePolicy(fileEnforcer.GetModel()); err != nil {
+		t.Fatalf("SavePolicy: %s", err)
+	}
+	if len(fr.lists["rules"]) != len(fileEnforcer.GetPolicy()) {
+		t.Fatalf("saved rules: %v", fr.lists["rules"])
+	}
+
+	e := casbin.NewEnforcer("authz_model.conf", adapter)
+	if got, want := len(e.GetPolicy()), len(fileEnforcer.GetPolicy()); got != want {
+		t.Fatalf("loaded %d rules, supposed to be %d", got, want)
+	}
+	if !e.Enforce("alice", "/dataset1/resource1", "GET") || e.Enforce("alice", "/dataset1/resource1", "DELETE") {
+		t.Errorf("loaded policy differs")
+	}
+
+	e.AddPolicy("dave", "^/dave", "GET", "allow")
+	if fr.lists["rules"][len(fr.lists["rules"])-1] != "p, dave, ^/dave, GET, allow" {
+		t.Errorf("rule not added: %v", fr.lists["rules"])
+	}
+	e.RemovePolicy("dave", "^/dave", "GET", "allow")
+	e.RemoveFilteredPolicy(0, "bob")
+	for _, line := range fr.lists["rules"] {
+		if strings.Contains(line, "dave") || strings.Contains(line, "bob") {
+			t.Errorf("rule not removed: %s", line)
+		}
+	}
+
+	fr.stop()
+	if err := e.LoadPolicy(); err == nil {
+		t.Errorf("no error loading from stopped server")
+	}
+	if !e.Enforce("alice", "/dataset1/resource1", "GET") {
+		t.Errorf("last loaded policy not kept")
+	}
+	fr.start()
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("no reconnect after restart: %s", err)
+	}
+
+	bad := newRedisAdapter(redisOptions{address: fr.address, password: "wrong"}, "rules")
+	defer bad.client.close()
+	if err := bad.LoadPolicy(e.GetModel()); err == nil {
+		t.Errorf("wrong password accepted")
+	}
+}
+
+func TestRedisPolicySync(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	defer fr.stop()
+	seed := newRedisAdapter(redisOptions{address: fr.address}, DefaultRedisKey)
+	if err := seed.SavePolicy(casbin.NewEnforcer("authz_model.conf", "authz_policy.csv").GetModel()); err != nil {
+		t.Fatalf("SavePolicy: %s", err)
+	}
+
+	var nodes [2]*Authorizer
+	for i := range nodes {
+		a := &Authorizer{policyMutex: new(sync.RWMutex)}
+		a.roles = &fileRoles{policy: a.policyMutex}
+		a.AuthConfig.ModelPath = "authz_model.conf"
+		a.AuthConfig.RedisAddress = fr.address
+		e, err := a.newRedisEnforcer()
+		if err != nil {
+			t.Fatalf("newRedisEnforcer: %s", err)
+		}
+		a.Enforcer = e
+		defer a.Cleanup()
+		nodes[i] = a
+	}
+	// Wait for both watchers to subscribe.
+	if !waitFor(2*time.Second, func() bool {
+		fr.mutex.Lock()
+		defer fr.mutex.Unlock()
+		return len(fr.subs[DefaultRedisChannel]) == 2
+	}) {
+		t.Fatalf("watchers not subscribed")
+	}
+
+	nodes[0].policyMutex.Lock()
+	nodes[0].Enforcer.AddPolicy("dave", "^/dave", "GET", "allow")
+	nodes[0].policyMutex.Unlock()
+	if !waitFor(2*time.Second, func() bool { return nodes[1].enforce("dave", "/dave", "GET") }) {
+		t.Errorf("policy change not propagated")
+	}
+
+	fr.stop()
+	if !nodes[1].enforce("alice", "/dataset1/resource1", "GET") {
+		t.Errorf("last loaded policy not served while disconnected")
+	}
+	fr.mutex.Lock()
+	fr.lists[DefaultRedisKey] = append(fr.lists[DefaultRedisKey], "p, erin, ^/erin, GET, allow")
+	fr.mutex.Unlock()
+	fr.start()
+	if !waitFor(5*time.Second, func() bool { return nodes[1].enforce("erin", "/erin", "GET") }) {
+		t.Errorf("policy not reloaded after reconnect")
+	}
+}
+
+func TestRedisPolicyReloadKeepsServing(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	defer fr.stop()
+	seed := newRedisAdapter(redisOptions{address: fr.address}, DefaultRedisKey)
+	if err := seed.SavePolicy(casbin.NewEnforcer("authz_model.conf", "authz_policy.csv").GetModel()); err != nil {
+		t.Fatalf("SavePolicy: %s", err)
+	}
+	a := &Authorizer{policyMutex: new(sync.RWMutex)}
+	a.roles = &fileRoles{policy: a.policyMutex}
+	a.AuthConfig.ModelPath = "authz_model.conf"
+	a.AuthConfig.RedisAddress = fr.address
+	e, err := a.newRedisEnforcer()
+	if err != nil {
+		t.Fatalf("newRedisEnforcer: %s", err)
+	}
+	a.Enforcer = e
+	defer a.Cleanup()
+	if !waitFor(2*time.Second, func() bool {
+		fr.mutex.Lock()
+		defer fr.mutex.Unlock()
+		return len(fr.subs[DefaultRedisChannel]) == 1
+	}) {
+		t.Fatalf("watcher not subscribed")
+	}
+
+	// Announcements of other nodes reload the policy while requests are
+	// checked; the round trip to Redis is slow.
+	fr.mutex.Lock()
+	fr.delay = 50 * time.Millisecond
+	fr.mutex.Unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			a.redisWatcher.notify("other-node")
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if !a.enforce("alice", "/dataset1/resource1", "GET") {
+			t.Fatalf("request denied during a policy reload")
+		}
+	}
+}
+
+func TestCaddyfilePolicyRedis(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		policy_redis redis.internal:6379 {
+			password secret
+			db 2
+			key authz_rules
+			channel authz_changes
+		}
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if a.AuthConfig.RedisAddress != "redis.internal:6379" || a.AuthConfig.RedisPassword != "secret" ||
+		a.AuthConfig.RedisDB != 2 || a.AuthConfig.RedisKey != "authz_rules" || a.AuthConfig.RedisChannel != "authz_changes" {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+
+	d = caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		policy_redis redis.internal:6379 {
+			bogus
+		}
+	}`)
+	if err := a.UnmarshalCaddyfile(d); err == nil {
+		t.Errorf("unknown policy_redis subdirective accepted")
+	}
+}
@@ -0,0 +1,336 @@
+package authz
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/casbin/casbin"
+	"github.com/casbin/casbin/model"
+	"github.com/casbin/casbin/persist"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultRedisKey is the default Redis list holding the policy.
+	DefaultRedisKey = "casbin_rules"
+	// DefaultRedisChannel is the default Redis channel policy changes
+	// are announced on.
+	DefaultRedisChannel = "casbin_policy"
+
+	// redisMaxBackoff limits the wait between reconnects of the watcher.
+	redisMaxBackoff = 30 * time.Second
+)
+
+// redisAdapter is a Casbin adapter keeping the policy in a Redis list, one
+// rule per element in the format of a policy file line, e.g.
+// "p, alice, /data/*, GET, allow".
+type redisAdapter struct {
+	client *redisClient
+	key    string
+
+	mutex sync.Mutex
+	// lastGood are the rules of the last successful load.
+	lastGood []string
+}
+
+func newRedisAdapter(opts redisOptions, key string) *redisAdapter {
+	return &redisAdapter{client: &redisClient{opts: opts}, key: key}
+}
+
+// LoadPolicy implements persist.Adapter. If Redis can't be reached, the
+// rules of the last successful load are loaded and the error is returned, so
+// the enforcer keeps serving the last loaded policy.
+func (ra *redisAdapter) LoadPolicy(m model.Model) error {
+	if err := ra.load(m); err != nil {
+		ra.mutex.Lock()
+		lastGood := ra.lastGood
+		ra.mutex.Unlock()
+		for _, line := range lastGood {
+			persist.LoadPolicyLine(line, m)
+		}
+		return fmt.Errorf("loading policy from redis, keeping last loaded policy: %v", err)
+	}
+	return nil
+}
+
+// load loads the rules into m, leaving m alone if Redis can't be reached.
+func (ra *redisAdapter) load(m model.Model) error {
+	replies, err := ra.client.do([]string{"LRANGE", ra.key, "0", "-1"})
+	if err != nil {
+		return err
+	}
+	lines, err := redisStrings(replies[0])
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		persist.LoadPolicyLine(line, m)
+	}
+	ra.mutex.Lock()
+	ra.lastGood = lines
+	ra.mutex.Unlock()
+	return nil
+}
+
+// SavePolicy implements persist.Adapter, replacing the list in a transaction.
+func (ra *redisAdapter) SavePolicy(m model.Model) error {
+	push := []string{"RPUSH", ra.key}
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range m[sec] {
+			for _, rule := range ast.Policy {
+				push = append(push, policyLine(ptype, rule))
+			}
+		}
+	}
+	cmds := [][]string{{"MULTI"}, {"DEL", ra.key}}
+	if len(push) > 2 {
+		cmds = append(cmds, push)
+	}
+	cmds = append(cmds, []string{"EXEC"})
+	replies, err := ra.client.do(cmds...)
+	if err != nil {
+		return err
+	}
+	if replies[len(replies)-1] == nil {
+		return fmt.Errorf("redis: saving policy aborted")
+	}
+	return nil
+}
+
+// AddPolicy implements persist.Adapter.
+func (ra *redisAdapter) AddPolicy(sec string, ptype string, rule []string) error {
+	_, err := ra.client.do([]string{"RPUSH", ra.key, policyLine(ptype, rule)})
+	return err
+}
+
+// RemovePolicy implements persist.Adapter.
+func (ra *redisAdapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	_, err := ra.client.do([]string{"LREM", ra.key, "1", policyLine(ptype, rule)})
+	return err
+}
+
+// RemoveFilteredPolicy implements persist.Adapter.
+func (ra *redisAdapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	replies, err := ra.client.do([]string{"LRANGE", ra.key, "0", "-1"})
+	if err != nil {
+		return err
+	}
+	lines, err := redisStrings(replies[0])
+	if err != nil {
+		return err
+	}
+	var cmds [][]string
+	for _, line := range lines {
+		tokens := strings.Split(line, ",")
+		for i := range tokens {
+			tokens[i] = strings.TrimSpace(tokens[i])
+		}
+		if tokens[0] == ptype && ruleMatches(tokens[1:], fieldIndex, fieldValues) {
+			cmds = append(cmds, []string{"LREM", ra.key, "1", line})
+		}
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	_, err = ra.client.do(cmds...)
+	return err
+}
+
+// ruleMatches reports whether the fields of rule starting at fieldIndex
+// equal fieldValues, empty values matching any field.
+func ruleMatches(rule []string, fieldIndex int, fieldValues []string) bool {
+	for i, value := range fieldValues {
+		if value == "" {
+			continue
+		}
+		if fieldIndex+i >= len(rule) || rule[fieldIndex+i] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// policyLine formats a rule as a line of a policy file.
+func policyLine(ptype string, rule []string) string {
+	return ptype + ", " + strings.Join(rule, ", ")
+}
+
+// reloadRedisPolicy loads the policy of e from Redis into a scratch model and
+// puts its rules in place of the current ones. Requests are checked against
+// the current policy during the round trip to Redis and wait only for the
+// swap. If Redis can't be reached, the current policy stays.
+func (a *Authorizer) reloadRedisPolicy(e *casbin.Enforcer, adapter *redisAdapter) error {
+	m, err := a.newModel()
+	if err != nil {
+		return err
+	}
+	if err := adapter.load(m); err != nil {
+		return err
+	}
+	if a.policyMutex != nil {
+		a.policyMutex.Lock()
+		defer a.policyMutex.Unlock()
+	}
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range e.GetModel()[sec] {
+			ast.Policy = nil
+			if loaded, ok := m[sec][ptype]; ok {
+				ast.Policy = loaded.Policy
+			}
+		}
+	}
+	e.BuildRoleLinks()
+	if a.roles != nil {
+		a.roles.reapply()
+	}
+	return nil
+}
+
+// redisWatcher is a Casbin watcher announcing policy changes on a Redis
+// channel. Every node subscribes to the channel and reloads its policy when
+// another node announces a change. A lost subscription is reestablished, and
+// the policy is reloaded then, as changes may have been missed.
+type redisWatcher struct {
+	opts    redisOptions
+	channel string
+	id      string // identifies the announcements of this node.
+	logger  *zap.Logger
+
+	publisher *redisClient
+	mutex     sync.Mutex
+	callback  func(string)
+	sub       *redisConn
+	done      chan struct{}
+}
+
+func newRedisWatcher(opts redisOptions, channel string, logger *zap.Logger) (*redisWatcher, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	rw := &redisWatcher{
+		opts:      opts,
+		channel:   channel,
+		id:        hex.EncodeToString(id),
+		logger:    logger,
+		publisher: &redisClient{opts: opts},
+		done:      make(chan struct{}),
+	}
+	go rw.run()
+	return rw, nil
+}
+
+// SetUpdateCallback implements persist.Watcher.
+func (rw *redisWatcher) SetUpdateCallback(callback func(string)) error {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	rw.callback = callback
+	return nil
+}
+
+// Update implements persist.Watcher, announcing a change to the other nodes.
+func (rw *redisWatcher) Update() error {
+	_, err := rw.publisher.do([]string{"PUBLISH", rw.channel, rw.id})
+	return err
+}
+
+// Close implements persist.Watcher.
+func (rw *redisWatcher) Close() {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	select {
+	case <-rw.done:
+		return
+	default:
+	}
+	close(rw.done)
+	if rw.sub != nil {
+		rw.sub.close()
+	}
+	rw.publisher.close()
+}
+
+// notify calls the update callback.
+func (rw *redisWatcher) notify(msg string) {
+	rw.mutex.Lock()
+	callback := rw.callback
+	rw.mutex.Unlock()
+	if callback != nil {
+		callback(msg)
+	}
+}
+
+// run keeps a subscription to the channel until the watcher is closed.
+func (rw *redisWatcher) run() {
+	backoff := time.Second
+	for {
+		established, err := rw.subscribe()
+		select {
+		case <-rw.done:
+			return
+		default:
+		}
+		if established {
+			backoff = time.Second
+		}
+		rw.logger.Warn("redis subscription lost, serving the last loaded policy",
+			zap.String("address", rw.opts.address), zap.Duration("retry", backoff), zap.Error(err))
+		select {
+		case <-rw.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > redisMaxBackoff {
+			backoff = redisMaxBackoff
+		}
+	}
+}
+
+// subscribe subscribes to the channel and passes on announcements of other
+// nodes until the subscription fails. Once subscribed, the callback is called
+// to catch up on changes missed while not subscribed. It reports whether the
+// subscription was established.
+func (rw *redisWatcher) subscribe() (bool, error) {
+	c, err := dialRedis(rw.opts)
+	if err != nil {
+		return false, err
+	}
+	rw.mutex.Lock()
+	select {
+	case <-rw.done:
+		rw.mutex.Unlock()
+		c.close()
+		return false, nil
+	default:
+	}
+	rw.sub = c
+	rw.mutex.Unlock()
+	defer func() {
+		rw.mutex.Lock()
+		rw.sub = nil
+		rw.mutex.Unlock()
+		c.close()
+	}()
+
+	if _, err := c.do("SUBSCRIBE", rw.channel); err != nil {
+		return false, err
+	}
+	rw.notify("")
+	for {
+		reply, err := c.receive()
+		if err != nil {
+			return true, err
+		}
+		msg, err := redisStrings(reply)
+		if err != nil || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+		if msg[2] != rw.id {
+			rw.notify(msg[2])
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package authz
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/casbin/casbin"
+	"go.uber.org/zap"
+)
+
+// fileRoles applies the role assignments of the password file to the enforcer
+// as grouping policies. Every set replaces the rules applied before, so roles
+// removed from the file are revoked. Rules also present in the policy are left
+// alone.
+//
+// Changing the rules rebuilds the role links of the enforcer, so it happens
+// under the write lock of the policy, like a policy reload; a request checked
+// in between would see users without roles.
+type fileRoles struct {
+	mutex    sync.Mutex
+	enforcer *casbin.Enforcer
+	policy   *sync.RWMutex // the policy lock of the handler, may be nil.
+	roles    map[string][]string
+	applied  [][]string
+	logger   *zap.Logger
+}
+
+// lockPolicy write-locks the policy against requests and returns the unlock
+// function.
+func (f *fileRoles) lockPolicy() func() {
+	if f.policy == nil {
+		return func() {}
+	}
+	f.policy.Lock()
+	return f.policy.Unlock
+}
+
+// set replaces the role assignments, applying them if an enforcer is attached.
+// It is the roles handler of the password file backend.
+func (f *fileRoles) set(roles map[string][]string) {
+	defer f.lockPolicy()()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.roles = roles
+	f.apply()
+}
+
+// attach sets the enforcer and applies the current role assignments to it.
+func (f *fileRoles) attach(e *casbin.Enforcer) {
+	defer f.lockPolicy()()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.enforcer = e
+	f.applied = nil
+	f.apply()
+}
+
+// reapply applies the role assignments again after the policy of the
+// enforcer has been reloaded, which drops the previously applied rules. The
+// policy must be write-locked by the caller.
+func (f *fileRoles) reapply() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.applied = nil
+	f.apply()
+}
+
+// apply removes the previously applied rules and adds the current ones. The
+// rules are local to this instance and never saved by the adapter of the
+// enforcer. The mutex must be held.
+func (f *fileRoles) apply() {
+	if f.enforcer == nil {
+		return
+	}
+	f.enforcer.EnableAutoSave(false)
+	defer f.enforcer.EnableAutoSave(true)
+	for _, rule := range f.applied {
+		if _, err := f.enforcer.RemoveGroupingPolicySafe(rule); err != nil {
+			f.logger.Error("removing role from password file", zap.Strings("rule", rule), zap.Error(err))
+		}
+	}
+	f.applied = nil
+	if len(f.roles) == 0 {
+		return
+	}
+	g, ok := f.enforcer.GetModel()["g"]["g"]
+	if !ok {
+		f.logger.Error("password file assigns roles, but the model has no role definition")
+		return
+	}
+	if strings.Count(g.Value, "_") != 2 {
+		f.logger.Error("password file assigns roles, but the role definition of the model has domains")
+		return
+	}
+
+	users := make([]string, 0, len(f.roles))
+	for user := range f.roles {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		for _, role := range f.roles[user] {
+			rule := []string{user, role}
+			if f.enforcer.HasGroupingPolicy(rule) {
+				continue
+			}
+			added, err := f.enforcer.AddGroupingPolicySafe(rule)
+			if err != nil {
+				f.logger.Error("adding role from password file", zap.Strings("rule", rule), zap.Error(err))
+				continue
+			}
+			if added {
+				f.applied = append(f.applied, rule)
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package authz
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin"
+	"github.com/casbin/casbin/persist/file-adapter"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const rbacModel = `
+[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act, eft
+
+[role_definition]
+g = _, _
+
+[policy_effect]
+e = some(where (p.eft == allow)) && !some(where (p.eft == deny))
+
+[matchers]
+m = g(r.sub, p.sub) && regexMatch(r.obj, p.obj) && (r.act == p.act || p.act == "*")
+`
+
+func TestFileRoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	hash, err := bcrypt.GenerateFromPassword([]byte("123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %s", err)
+	}
+	passwordPath := filepath.Join(dir, "passwd")
+	writeUsers := func(users string) {
+		if err := ioutil.WriteFile(passwordPath, []byte(users), 0600); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+	}
+	policyPath := filepath.Join(dir, "policy.csv")
+	policy := "p, admin, ^/admin/, *, allow\n" +
+		"p, editor, ^/docs/, POST, allow\n" +
+		"p, alice, ^/home/, GET, allow\n" +
+		"g, bob, editor\n"
+	if err := ioutil.WriteFile(policyPath, []byte(policy), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	writeUsers("alice:" + string(hash) + ":admin,editor\n" +
+		"bob:" + string(hash) + "\n")
+	e := casbin.NewEnforcer(casbin.NewModel(rbacModel), fileadapter.NewAdapter(policyPath))
+	handler := Authorizer{Enforcer: e, policyMutex: new(sync.RWMutex)}
+	handler.AuthConfig.PasswordFile = passwordPath
+	handler.AuthConfig.PolicyPath = policyPath
+	handler.roles = &fileRoles{policy: handler.policyMutex, logger: zap.NewNop()}
+	authProvider, _, err := handler.newPasswordCheck(&sharedPasswordCheck{handlers: []*Authorizer{&handler}})
+	if err != nil {
+		t.Fatalf("newPasswordCheck: %s", err)
+	}
+	handler.PasswordCheck = authProvider
+	handler.roles.attach(e)
+
+	waitForRoles := func(user string, roles int) {
+		for deadline := time.Now().Add(2 * time.Second); ; {
+			unlock := handler.rlockPolicy()
+			have, _ := e.GetRolesForUser(user)
+			unlock()
+			if len(have) == roles {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("roles of %s: %v, supposed to be %d", user, have, roles)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForRoles("alice", 2)
+
+	testRequest(t, handler, "alice", "/admin/users", "DELETE", 200)
+	testRequest(t, handler, "alice", "/docs/a", "POST", 200)
+	testRequest(t, handler, "alice", "/home/a", "GET", 200)
+	testRequest(t, handler, "bob", "/docs/a", "POST", 200)
+	testRequest(t, handler, "bob", "/admin/users", "GET", 403)
+
+	// The file roles survive a policy reload.
+	if err := handler.ReloadPolicy(); err != nil {
+		t.Fatalf("ReloadPolicy: %s", err)
+	}
+	testRequest(t, handler, "alice", "/admin/users", "DELETE", 200)
+
+	// Changing the file revokes roles. A role also granted by the policy
+	// stays in place.
+	time.Sleep(10 * time.Millisecond) // make sure the modification time changes
+	writeUsers("alice:" + string(hash) + ":editor\n" +
+		"bob:" + string(hash) + ":editor\n")
+	authProvider.Update()
+	waitForRoles("alice", 1)
+	testRequest(t, handler, "alice", "/admin/users", "DELETE", 403)
+	testRequest(t, handler, "alice", "/docs/a", "POST", 200)
+
+	writeUsers("alice:" + string(hash) + "\n" +
+		"bob:" + string(hash) + "\n")
+	authProvider.Update()
+	waitForRoles("alice", 0)
+	testRequest(t, handler, "bob", "/docs/a", "POST", 200)
+}
+
+func TestFileRolesWhileServing(t *testing.T) {
+	e := casbin.NewEnforcer(casbin.NewModel(rbacModel))
+	e.AddPolicy("admin", "^/admin/", "*", "allow")
+	handler := Authorizer{Enforcer: e, PasswordCheck: testAuthProvider(t), policyMutex: new(sync.RWMutex)}
+	handler.roles = &fileRoles{policy: handler.policyMutex, logger: zap.NewNop()}
+	handler.roles.set(map[string][]string{"alice": {"admin"}})
+	handler.roles.attach(e)
+
+	// Every set replaces the rules, alice keeps the admin role throughout.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			handler.roles.set(map[string][]string{"alice": {"admin"}, "bob": {"admin"}})
+			handler.roles.set(map[string][]string{"alice": {"admin"}})
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		testRequest(t, handler, "alice", "/admin/users", "GET", 200)
+	}
+}
@@ -0,0 +1,167 @@
+package authz
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// DefaultSessionCookie is the name of the session cookie if none is configured.
+	DefaultSessionCookie = "authz_session"
+	// DefaultSessionTTL is the lifetime of a session if none is configured.
+	DefaultSessionTTL = time.Hour
+	// minSessionKeyLength is the minimum length of the session signing key.
+	minSessionKeyLength = 16
+)
+
+// sessionsEnabled reports whether session cookies are issued and accepted.
+func (a *Authorizer) sessionsEnabled() bool {
+	return a.AuthConfig.SessionKey != ""
+}
+
+// sessionCookieName returns the name of the session cookie.
+func (a *Authorizer) sessionCookieName() string {
+	if a.AuthConfig.SessionCookie == "" {
+		return DefaultSessionCookie
+	}
+	return a.AuthConfig.SessionCookie
+}
+
+// sessionTTL returns the lifetime of newly issued sessions.
+func (a *Authorizer) sessionTTL() time.Duration {
+	if a.AuthConfig.SessionTTL <= 0 {
+		return DefaultSessionTTL
+	}
+	return time.Duration(a.AuthConfig.SessionTTL)
+}
+
+// sessionSignature returns the HMAC-SHA256 of payload under the session key.
+func (a *Authorizer) sessionSignature(payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(a.AuthConfig.SessionKey))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// signSession encodes user and expiry into a signed cookie value of the form
+// base64(user).expiry.base64(signature).
+func (a *Authorizer) signSession(user string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(a.sessionSignature(payload))
+}
+
+// verifySession checks the signature of a cookie value created by signSession
+// and returns the user and the expiry of the session.
+func (a *Authorizer) verifySession(value string) (user string, expires time.Time, ok bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", time.Time{}, false
+	}
+	payload := value[:i]
+	signature, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil || !hmac.Equal(signature, a.sessionSignature(payload)) {
+		return "", time.Time{}, false
+	}
+	fields := strings.Split(payload, ".")
+	if len(fields) != 2 {
+		return "", time.Time{}, false
+	}
+	name, err := base64.RawURLEncoding.DecodeString(fields[0])
+	if err != nil || len(name) == 0 {
+		return "", time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return string(name), time.Unix(unix, 0), true
+}
+
+// getSessionUser returns the user of a valid, unexpired session cookie.
+func (a *Authorizer) getSessionUser(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(a.sessionCookieName())
+	if err != nil {
+		return "", false
+	}
+	user, expires, ok := a.verifySession(cookie.Value)
+	if !ok || !a.notExpired(r, expires) || a.userDenied(user) {
+		return "", false
+	}
+	return user, true
+}
+
+// notExpired reports whether a credential expiring at expires is accepted for
+// the request. Within the expiry grace period after the expiry, it is still
+// accepted for GET and HEAD requests.
+func (a *Authorizer) notExpired(r *http.Request, expires time.Time) bool {
+	now := a.getClock().Now()
+	if now.Before(expires) {
+		return true
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return now.Before(expires.Add(time.Duration(a.AuthConfig.ExpiryGrace)))
+	}
+	return false
+}
+
+// serveLogin handles the login endpoint. Credentials are taken from HTTP basic
+// authentication or from the "username" and "password" form fields. On success
+// a session cookie is issued, and the client is redirected to the local path
+// given in the "redirect" parameter, if any.
+func (a *Authorizer) serveLogin(w http.ResponseWriter, r *http.Request) error {
+	user, password, basic := r.BasicAuth()
+	ok := false
+	if basic {
+		user, ok = a.checkBasicAuth(r.Context(), user, password)
+	} else if r.Method == http.MethodPost {
+		user, password = a.normalizeUser(r.PostFormValue("username")), r.PostFormValue("password")
+		ok = user != "" && a.checkPassword(r.Context(), user, password)
+	}
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\""+a.realm(r)+"\"")
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	}
+
+	expires := a.getClock().Now().Add(a.sessionTTL())
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.sessionCookieName(),
+		Value:    a.signSession(user, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	if redirect := r.FormValue("redirect"); localRedirect(redirect) {
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return nil
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// localRedirect reports whether the login may redirect to redirect: an
+// absolute path without scheme or host. Browsers take a backslash for a slash,
+// so /\host is a host as much as //host; a redirect with a backslash or a
+// control character, encoded or not, is refused.
+func localRedirect(redirect string) bool {
+	u, err := url.Parse(redirect)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Opaque != "" {
+		return false
+	}
+	for _, s := range []string{redirect, u.Path} {
+		if !strings.HasPrefix(s, "/") || strings.HasPrefix(s, "//") ||
+			strings.ContainsRune(s, '\\') || strings.IndexFunc(s, unicode.IsControl) != -1 {
+			return false
+		}
+	}
+	return true
+}
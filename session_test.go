@@ -0,0 +1,167 @@
+package authz
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/casbin/casbin"
+)
+
+func sessionRequest(cookie *http.Cookie, path string) *http.Request {
+	r, _ := http.NewRequest("GET", path, nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+func TestSession(t *testing.T) {
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+	handler.AuthConfig.SessionKey = "0123456789abcdef0123456789abcdef"
+	handler.AuthConfig.LoginPath = "/login"
+
+	r, _ := http.NewRequest("POST", "/login", nil)
+	r.SetBasicAuth("alice", "wrong")
+	if w := serve(handler, r); w.Code != 401 || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("login with wrong password: %d, cookies %v", w.Code, w.Result().Cookies())
+	}
+
+	r, _ = http.NewRequest("POST", "/login", nil)
+	r.SetBasicAuth("alice", "123")
+	w := serve(handler, r)
+	if w.Code != 204 || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("login: %d, cookies %v", w.Code, w.Result().Cookies())
+	}
+	cookie := w.Result().Cookies()[0]
+	if cookie.Name != DefaultSessionCookie || !cookie.HttpOnly {
+		t.Errorf("unexpected cookie %v", cookie)
+	}
+
+	if w := serve(handler, sessionRequest(cookie, "/dataset1/resource1")); w.Code != 200 {
+		t.Errorf("session request: %d, supposed to be 200", w.Code)
+	}
+	if w := serve(handler, sessionRequest(cookie, "/dataset2/resource1")); w.Code != 403 {
+		t.Errorf("session request without permission: %d, supposed to be 403", w.Code)
+	}
+	if w := serve(handler, sessionRequest(nil, "/dataset1/resource1")); w.Code != 401 {
+		t.Errorf("request without session: %d, supposed to be 401", w.Code)
+	}
+
+	tampered := *cookie
+	tampered.Value = base64.RawURLEncoding.EncodeToString([]byte("bob")) + cookie.Value[strings.IndexByte(cookie.Value, '.'):]
+	if w := serve(handler, sessionRequest(&tampered, "/dataset1/resource1")); w.Code != 401 {
+		t.Errorf("tampered session: %d, supposed to be 401", w.Code)
+	}
+
+	expired := *cookie
+	expired.Value = handler.signSession("alice", time.Now().Add(-time.Second))
+	if w := serve(handler, sessionRequest(&expired, "/dataset1/resource1")); w.Code != 401 {
+		t.Errorf("expired session: %d, supposed to be 401", w.Code)
+	}
+
+	other := handler
+	other.AuthConfig.SessionKey = "fedcba9876543210fedcba9876543210"
+	if w := serve(other, sessionRequest(cookie, "/dataset1/resource1")); w.Code != 401 {
+		t.Errorf("session signed with another key: %d, supposed to be 401", w.Code)
+	}
+}
+
+func TestSessionExpiryGrace(t *testing.T) {
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+	handler.AuthConfig.SessionKey = "0123456789abcdef0123456789abcdef"
+
+	recent := &http.Cookie{Name: DefaultSessionCookie, Value: handler.signSession("alice", time.Now().Add(-10*time.Second))}
+	old := &http.Cookie{Name: DefaultSessionCookie, Value: handler.signSession("alice", time.Now().Add(-2*time.Minute))}
+	request := func(method string, cookie *http.Cookie) int {
+		r, _ := http.NewRequest(method, "/dataset1/resource1", nil)
+		r.AddCookie(cookie)
+		return serve(handler, r).Code
+	}
+
+	if code := request("GET", recent); code != 401 {
+		t.Errorf("expired session without grace: %d, supposed to be 401", code)
+	}
+
+	handler.AuthConfig.ExpiryGrace = caddy.Duration(time.Minute)
+	if code := request("GET", recent); code != 200 {
+		t.Errorf("GET within grace: %d, supposed to be 200", code)
+	}
+	if code := request("HEAD", recent); code != 200 {
+		t.Errorf("HEAD within grace, authorized as GET: %d, supposed to be 200", code)
+	}
+	if code := request("POST", recent); code != 401 {
+		t.Errorf("POST within grace: %d, supposed to be 401", code)
+	}
+	if code := request("GET", old); code != 401 {
+		t.Errorf("GET after grace: %d, supposed to be 401", code)
+	}
+}
+
+func TestSessionFormLogin(t *testing.T) {
+	handler := Authorizer{
+		Enforcer:      casbin.NewEnforcer("authz_model.conf", "authz_policy.csv"),
+		PasswordCheck: testAuthProvider(t),
+	}
+	handler.AuthConfig.SessionKey = "0123456789abcdef0123456789abcdef"
+	handler.AuthConfig.SessionCookie = "sid"
+	handler.AuthConfig.SessionTTL = caddy.Duration(time.Minute)
+	handler.AuthConfig.LoginPath = "/login"
+
+	form := url.Values{"username": {"bob"}, "password": {"123"}, "redirect": {"/dataset2/resource1"}}
+	r, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := serve(handler, r)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/dataset2/resource1" {
+		t.Fatalf("form login: %d, location %q", w.Code, w.Header().Get("Location"))
+	}
+	cookie := w.Result().Cookies()[0]
+	if cookie.Name != "sid" || cookie.Expires.After(time.Now().Add(time.Minute+time.Second)) {
+		t.Errorf("unexpected cookie %v", cookie)
+	}
+	if w := serve(handler, sessionRequest(cookie, "/dataset2/resource1")); w.Code != 200 {
+		t.Errorf("session request: %d, supposed to be 200", w.Code)
+	}
+
+	for _, redirect := range []string{
+		"//evil.example.com/", "/\\evil.example.com", "/%5Cevil.example.com", "/%2F/evil.example.com",
+		"https://evil.example.com/", "/\tevil.example.com", "/%0D%0Aevil", "dataset2/resource1",
+	} {
+		form.Set("redirect", redirect)
+		r, _ = http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if w := serve(handler, r); w.Code != 204 {
+			t.Errorf("login with foreign redirect %q: %d, supposed to be 204", redirect, w.Code)
+		}
+	}
+}
+
+func TestCaddyfileSession(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`authz model.conf policy.csv Realm bcrypt.pass {
+		session_key 0123456789abcdef
+		session_cookie sid
+		session_ttl 30m
+		login_path /login
+		expiry_grace 2m
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if a.AuthConfig.SessionKey != "0123456789abcdef" || a.AuthConfig.SessionCookie != "sid" ||
+		time.Duration(a.AuthConfig.SessionTTL) != 30*time.Minute || a.AuthConfig.LoginPath != "/login" ||
+		time.Duration(a.AuthConfig.ExpiryGrace) != 2*time.Minute {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+}
@@ -0,0 +1,186 @@
+package authz
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/dafanasiev/caddy-authz/v2/authfile"
+	"go.uber.org/zap"
+)
+
+// sharedPasswordChecks are the password checks of all handlers, by
+// passwordCheckKey. Handlers reading the same password files with the same
+// settings share one password check, instead of each reading and watching
+// the files and keeping the users in memory.
+var sharedPasswordChecks = struct {
+	sync.Mutex
+	byKey map[string]*sharedPasswordCheck
+}{byKey: make(map[string]*sharedPasswordCheck)}
+
+// sharedPasswordCheck is a password check with the handlers using it. The
+// roles, loads and errors of the password file are passed on to all of them.
+type sharedPasswordCheck struct {
+	service *authfile.InMemoryService
+	backend *authfile.FileBackend
+
+	mutex    sync.Mutex
+	handlers []*Authorizer
+	roles    map[string][]string // the roles of the last load.
+}
+
+// passwordCheckKey returns the key of the password check of the handler in
+// sharedPasswordChecks. It holds everything that goes into the password
+// check, so handlers differing in any of it get their own.
+func (a *Authorizer) passwordCheckKey() string {
+	files := make([]string, 0, 1+len(a.AuthConfig.PasswordFiles))
+	for _, file := range append([]string{a.AuthConfig.PasswordFile}, a.AuthConfig.PasswordFiles...) {
+		files = append(files, adminFileKey(file))
+	}
+	key, _ := json.Marshal(struct {
+		Files               []string
+		Format              string
+		Writable            bool
+		AllowInsecureHashes bool
+		KeepLastGood        bool
+		Lowercase           bool
+		Cost                int
+		MaxUsers            int
+		Users               map[string]string
+		LoadTimeout         int64
+		WatchInterval       int64
+	}{
+		Files:               files,
+		Format:              a.AuthConfig.PasswordFormat,
+		Writable:            a.AuthConfig.AdminAPI,
+		AllowInsecureHashes: a.AuthConfig.AllowInsecureHashes,
+		KeepLastGood:        a.AuthConfig.KeepLastGood,
+		Lowercase:           a.AuthConfig.CaseInsensitiveUsernames,
+		Cost:                a.AuthConfig.Cost,
+		MaxUsers:            a.AuthConfig.MaxUsers,
+		Users:               a.AuthConfig.Users,
+		LoadTimeout:         int64(a.loadTimeout()),
+		WatchInterval:       int64(a.watchInterval()),
+	})
+	return string(key)
+}
+
+// acquirePasswordCheck returns the password check of the handler, creating it
+// unless another handler with the same key has one already. A password check
+// that is reused reads the password file again, so a config reload still
+// picks up changes at once. Every acquire is paired with a release.
+func (a *Authorizer) acquirePasswordCheck() (*sharedPasswordCheck, error) {
+	key := a.passwordCheckKey()
+	sharedPasswordChecks.Lock()
+	defer sharedPasswordChecks.Unlock()
+	s, ok := sharedPasswordChecks.byKey[key]
+	if !ok {
+		// The handler is there before the first load, to get its roles
+		// and errors.
+		s = &sharedPasswordCheck{handlers: []*Authorizer{a}}
+		service, backend, err := a.newPasswordCheck(s)
+		if err != nil {
+			return nil, err
+		}
+		s.service, s.backend = service, backend
+		sharedPasswordChecks.byKey[key] = s
+		return s, nil
+	}
+
+	s.mutex.Lock()
+	s.handlers = append(s.handlers, a)
+	roles := s.roles
+	s.mutex.Unlock()
+	if a.roles != nil && roles != nil {
+		a.roles.set(roles)
+	}
+	s.service.Update()
+	return s, nil
+}
+
+// releasePasswordCheck lets go of the password check of the handler. The last
+// handler shuts it down and closes the password file.
+func (a *Authorizer) releasePasswordCheck(s *sharedPasswordCheck) {
+	sharedPasswordChecks.Lock()
+	s.mutex.Lock()
+	for i, h := range s.handlers {
+		if h == a {
+			s.handlers = append(s.handlers[:i], s.handlers[i+1:]...)
+			break
+		}
+	}
+	last := len(s.handlers) == 0
+	s.mutex.Unlock()
+	if last {
+		for key, shared := range sharedPasswordChecks.byKey {
+			if shared == s {
+				delete(sharedPasswordChecks.byKey, key)
+			}
+		}
+	}
+	sharedPasswordChecks.Unlock()
+
+	if last {
+		s.service.Shutdown()
+		s.backend.Close()
+	}
+}
+
+// current returns the handlers using the password check.
+func (s *sharedPasswordCheck) current() []*Authorizer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*Authorizer(nil), s.handlers...)
+}
+
+// setRoles passes the roles of the password file on to the handlers. It is the
+// roles handler of the password file backend.
+func (s *sharedPasswordCheck) setRoles(roles map[string][]string) {
+	s.mutex.Lock()
+	s.roles = roles
+	s.mutex.Unlock()
+	for _, a := range s.current() {
+		if a.roles != nil {
+			a.roles.set(roles)
+		}
+	}
+}
+
+// loaded passes the loaded entries on to the auth caches and token indexes of
+// the handlers. It is the load handler of the password file backend.
+func (s *sharedPasswordCheck) loaded(entries []authfile.Entry) {
+	for _, a := range s.current() {
+		if a.authCache != nil {
+			a.authCache.loaded(entries)
+		}
+		if a.tokens != nil {
+			a.tokens.loaded(entries)
+		}
+	}
+}
+
+// removeUser removes the cached verifications of user from the auth caches of
+// the handlers, once its password was changed or it was deleted other than by
+// a load of the password file.
+func (s *sharedPasswordCheck) removeUser(user string) {
+	for _, a := range s.current() {
+		if a.authCache != nil {
+			a.authCache.removeUser(user)
+		}
+	}
+}
+
+// reportError logs an error of the password file with the logger of one of
+// the handlers; they all log the same file. It is the error handler of the
+// password file backend.
+func (s *sharedPasswordCheck) reportError(err error) {
+	handlers := s.current()
+	if len(handlers) == 0 {
+		return
+	}
+	a := handlers[0]
+	if _, ok := err.(*authfile.DuplicateUsersError); ok {
+		a.getLogger().Warn("password file", zap.String("file", a.AuthConfig.PasswordFile), zap.Error(err))
+		return
+	}
+	a.getLogger().Error("password file", zap.String("file", a.AuthConfig.PasswordFile), zap.Error(err))
+}
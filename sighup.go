@@ -0,0 +1,57 @@
+package authz
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// sighupReloader reloads the password files whenever the process receives
+// SIGHUP. Caddy itself ignores the signal, so it is free for this.
+type sighupReloader struct {
+	signals chan os.Signal
+	reload  func() error
+	logger  *zap.Logger
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newSIGHUPReloader(reload func() error, logger *zap.Logger) *sighupReloader {
+	sr := &sighupReloader{
+		signals: make(chan os.Signal, 1),
+		reload:  reload,
+		logger:  logger,
+		done:    make(chan struct{}),
+	}
+	signal.Notify(sr.signals, syscall.SIGHUP)
+	go sr.run()
+	return sr
+}
+
+// run reloads on every signal until the reloader is closed. Signals arriving
+// during a reload are coalesced into one more reload.
+func (sr *sighupReloader) run() {
+	for {
+		select {
+		case <-sr.done:
+			return
+		case <-sr.signals:
+		}
+		if err := sr.reload(); err != nil {
+			sr.logger.Error("password file reload on SIGHUP failed", zap.Error(err))
+		} else {
+			sr.logger.Info("password file reloaded on SIGHUP")
+		}
+	}
+}
+
+// Close stops the reloader.
+func (sr *sighupReloader) Close() {
+	sr.once.Do(func() {
+		signal.Stop(sr.signals)
+		close(sr.done)
+	})
+}
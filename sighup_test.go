@@ -0,0 +1,51 @@
+package authz
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	const hash = "$2y$06$lcPirp7mnYIYBROnwnMvSu8hw2FBWKeHfFX63NtJ2ISoAK7s8PHNm" // 123
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	passwordPath := filepath.Join(dir, "passwd")
+	if err := ioutil.WriteFile(passwordPath, []byte("alice:"+hash+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	handler, _ := loadCaddyfile(t, `authz authz_model.conf authz_policy.csv Test `+passwordPath+` {
+		watch_interval 1h
+		reload_on_sighup
+	}`)
+	defer caddy.Stop()
+	testRequest(t, *handler, "alice", "/dataset1/resource1", "GET", 200)
+
+	// The file is replaced by a rename, which the change checks miss.
+	tmp := passwordPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte("alice:"+hash+"\ndave:"+hash+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if err := os.Rename(tmp, passwordPath); err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("FindProcess: %s", err)
+	}
+	if err := process.Signal(syscall.SIGHUP); err != nil {
+		t.Skipf("can't send SIGHUP: %s", err)
+	}
+	if !waitFor(5*time.Second, func() bool { return handler.PasswordCheck.Authenticate("dave", "123") == nil }) {
+		t.Errorf("password file not reloaded on SIGHUP")
+	}
+}
@@ -0,0 +1,8 @@
+package authz
+
+// The database/sql drivers of policy_sql linked into the Caddy build. Both
+// are pure Go, so they don't require cgo.
+import (
+	_ "github.com/go-sql-driver/mysql" // mysql
+	_ "github.com/lib/pq"              // postgres
+)
@@ -0,0 +1,222 @@
+package authz
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/casbin/casbin"
+	"github.com/casbin/casbin/model"
+	"github.com/casbin/casbin/persist"
+)
+
+const (
+	// DefaultSQLTable is the default table holding the policy, the table of
+	// the Casbin gorm adapter.
+	DefaultSQLTable = "casbin_rule"
+
+	// sqlConnectTimeout limits connecting to the database when the handler
+	// is provisioned.
+	sqlConnectTimeout = 10 * time.Second
+	// sqlFields is the number of rule fields of the table, v0 to v5.
+	sqlFields = 6
+)
+
+// sqlColumns are the columns of the policy table.
+const sqlColumns = "ptype, v0, v1, v2, v3, v4, v5"
+
+// sqlTableName matches the table names accepted in the configuration, as the
+// name is part of the statements.
+var sqlTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// sqlAdapter is a Casbin adapter keeping the policy in an SQL table with the
+// columns ptype and v0 to v5, the schema of the Casbin gorm adapter, so a
+// table managed by other applications with it can be shared. Unused fields
+// are empty strings. The postgres and mysql drivers are linked in by
+// sqldrivers.go, others must be linked into the Caddy build.
+type sqlAdapter struct {
+	db    *sql.DB
+	table string
+	// numbered selects the $1, $2, ... placeholders of PostgreSQL drivers
+	// instead of ?.
+	numbered bool
+}
+
+// newSQLAdapter opens the database and verifies that it can be reached.
+func newSQLAdapter(driver, dsn, table string) (*sqlAdapter, error) {
+	if !sqlTableName.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sqlConnectTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlAdapter{
+		db:       db,
+		table:    table,
+		numbered: driver == "postgres" || driver == "pgx",
+	}, nil
+}
+
+// Close closes the database.
+func (sa *sqlAdapter) Close() error {
+	return sa.db.Close()
+}
+
+// placeholder returns the placeholder of the nth argument, counting from 1.
+func (sa *sqlAdapter) placeholder(n int) string {
+	if sa.numbered {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// LoadPolicy implements persist.Adapter.
+func (sa *sqlAdapter) LoadPolicy(m model.Model) error {
+	rows, err := sa.db.Query("SELECT " + sqlColumns + " FROM " + sa.table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ptype string
+		var fields [sqlFields]sql.NullString
+		if err := rows.Scan(&ptype, &fields[0], &fields[1], &fields[2], &fields[3], &fields[4], &fields[5]); err != nil {
+			return err
+		}
+		rule := make([]string, 0, sqlFields)
+		for _, field := range fields {
+			rule = append(rule, field.String)
+		}
+		for len(rule) > 0 && rule[len(rule)-1] == "" {
+			rule = rule[:len(rule)-1]
+		}
+		persist.LoadPolicyLine(policyLine(ptype, rule), m)
+	}
+	return rows.Err()
+}
+
+// SavePolicy implements persist.Adapter, replacing the rows in a transaction.
+func (sa *sqlAdapter) SavePolicy(m model.Model) error {
+	tx, err := sa.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM " + sa.table); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range m[sec] {
+			for _, rule := range ast.Policy {
+				if err := sa.insert(tx, ptype, rule); err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// execer is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// insert adds a row for rule.
+func (sa *sqlAdapter) insert(db execer, ptype string, rule []string) error {
+	if len(rule) > sqlFields {
+		return fmt.Errorf("rule %s has more than %d fields", policyLine(ptype, rule), sqlFields)
+	}
+	args := []interface{}{ptype}
+	placeholders := []string{sa.placeholder(1)}
+	for i := 0; i < sqlFields; i++ {
+		field := ""
+		if i < len(rule) {
+			field = rule[i]
+		}
+		args = append(args, field)
+		placeholders = append(placeholders, sa.placeholder(i+2))
+	}
+	_, err := db.Exec("INSERT INTO "+sa.table+" ("+sqlColumns+") VALUES ("+strings.Join(placeholders, ", ")+")", args...)
+	return err
+}
+
+// AddPolicy implements persist.Adapter.
+func (sa *sqlAdapter) AddPolicy(sec string, ptype string, rule []string) error {
+	return sa.insert(sa.db, ptype, rule)
+}
+
+// RemovePolicy implements persist.Adapter.
+func (sa *sqlAdapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	fields := make([]string, sqlFields)
+	copy(fields, rule)
+	return sa.delete(ptype, 0, fields, false)
+}
+
+// RemoveFilteredPolicy implements persist.Adapter.
+func (sa *sqlAdapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	return sa.delete(ptype, fieldIndex, fieldValues, true)
+}
+
+// delete removes the rows of ptype whose fields starting at fieldIndex equal
+// values. If skipEmpty is set, empty values match any field.
+func (sa *sqlAdapter) delete(ptype string, fieldIndex int, values []string, skipEmpty bool) error {
+	conditions := []string{"ptype = " + sa.placeholder(1)}
+	args := []interface{}{ptype}
+	for i, value := range values {
+		if skipEmpty && value == "" {
+			continue
+		}
+		if fieldIndex+i >= sqlFields {
+			return fmt.Errorf("field %d out of range", fieldIndex+i)
+		}
+		args = append(args, value)
+		conditions = append(conditions, "v"+strconv.Itoa(fieldIndex+i)+" = "+sa.placeholder(len(args)))
+	}
+	_, err := sa.db.Exec("DELETE FROM "+sa.table+" WHERE "+strings.Join(conditions, " AND "), args...)
+	return err
+}
+
+// sqlTable returns the table holding the policy.
+func (a *Authorizer) sqlTable() string {
+	if a.AuthConfig.SQLTable == "" {
+		return DefaultSQLTable
+	}
+	return a.AuthConfig.SQLTable
+}
+
+// newSQLEnforcer returns an enforcer with the policy kept in an SQL database.
+// Unlike with Redis, provisioning fails if the database can't be reached or
+// the policy can't be loaded.
+func (a *Authorizer) newSQLEnforcer() (*casbin.Enforcer, error) {
+	adapter, err := newSQLAdapter(a.AuthConfig.SQLDriver, a.AuthConfig.SQLDSN, a.sqlTable())
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the policy database: %v", err)
+	}
+	a.sqlAdapter = adapter // set at once, so Cleanup closes it if provisioning fails.
+	m, err := a.newModel()
+	if err != nil {
+		return nil, err
+	}
+	e, err := casbin.NewEnforcerSafe(m)
+	if err != nil {
+		return nil, err
+	}
+	e.SetAdapter(adapter)
+	if err := loadPolicy(e); err != nil {
+		return nil, fmt.Errorf("loading the policy from the database: %v", err)
+	}
+	return e, nil
+}
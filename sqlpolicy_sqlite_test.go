@@ -0,0 +1,86 @@
+//go:build cgo
+// +build cgo
+
+package authz
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestSQLPolicySQLite runs the policy adapter against a real database, an
+// SQLite file in a temporary directory.
+func TestSQLPolicySQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "policy.db")
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer db.Close()
+	for _, stmt := range []string{
+		"CREATE TABLE authz_rules (ptype VARCHAR(100), v0 VARCHAR(100), v1 VARCHAR(100), " +
+			"v2 VARCHAR(100), v3 VARCHAR(100), v4 VARCHAR(100), v5 VARCHAR(100))",
+		"INSERT INTO authz_rules (ptype, v0, v1, v2, v3) VALUES ('p', 'alice', '/dataset1/resource1', 'GET', 'allow')",
+		"INSERT INTO authz_rules VALUES ('p', 'bob', '/dataset2/resource1', 'GET', 'allow', '', '')",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %s", stmt, err)
+		}
+	}
+	rows := func() int {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM authz_rules").Scan(&n); err != nil {
+			t.Fatalf("counting rows: %s", err)
+		}
+		return n
+	}
+
+	var a Authorizer
+	a.AuthConfig.ModelPath = "authz_model.conf"
+	a.AuthConfig.SQLDriver = "sqlite3"
+	a.AuthConfig.SQLDSN = dsn
+	a.AuthConfig.SQLTable = "authz_rules"
+	e, err := a.newSQLEnforcer()
+	if err != nil {
+		t.Fatalf("newSQLEnforcer: %s", err)
+	}
+	defer a.Cleanup()
+	if !e.Enforce("alice", "/dataset1/resource1", "GET") || !e.Enforce("bob", "/dataset2/resource1", "GET") ||
+		e.Enforce("alice", "/dataset2/resource1", "GET") {
+		t.Errorf("unexpected policy %v", e.GetPolicy())
+	}
+
+	e.AddPolicy("alice", "/dataset2/resource1", "GET", "allow")
+	e.RemoveFilteredPolicy(0, "bob")
+	if n := rows(); n != 2 {
+		t.Errorf("%d rows after changing rules, supposed to be 2", n)
+	}
+	if err := e.SavePolicy(); err != nil {
+		t.Fatalf("SavePolicy: %s", err)
+	}
+	if n := rows(); n != 2 {
+		t.Errorf("%d rows after saving the policy, supposed to be 2", n)
+	}
+
+	// The changes are there for the next handler.
+	var b Authorizer
+	b.AuthConfig = a.AuthConfig
+	reloaded, err := b.newSQLEnforcer()
+	if err != nil {
+		t.Fatalf("newSQLEnforcer: %s", err)
+	}
+	defer b.Cleanup()
+	if !reloaded.Enforce("alice", "/dataset2/resource1", "GET") || reloaded.Enforce("bob", "/dataset2/resource1", "GET") {
+		t.Errorf("unexpected policy after reload %v", reloaded.GetPolicy())
+	}
+}
@@ -0,0 +1,273 @@
+package authz
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	sql.Register("authztest", fakeSQLDriver{})
+}
+
+// fakeSQL holds the rows of the policy table of every fake database, by data
+// source name. A row is ptype followed by v0 to v5.
+var fakeSQL = struct {
+	sync.Mutex
+	tables map[string][][]string
+}{tables: make(map[string][][]string)}
+
+// fakeSQLDriver is a database/sql driver implementing the statements of the
+// policy adapter. The data source name "unreachable" fails to connect.
+type fakeSQLDriver struct{}
+
+func (fakeSQLDriver) Open(dsn string) (driver.Conn, error) {
+	if dsn == "unreachable" {
+		return nil, errors.New("connection refused")
+	}
+	return &fakeSQLConn{dsn: dsn}, nil
+}
+
+type fakeSQLConn struct {
+	dsn string
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{dsn: c.dsn, query: query}, nil
+}
+
+func (c *fakeSQLConn) Close() error              { return nil }
+func (c *fakeSQLConn) Begin() (driver.Tx, error) { return fakeSQLTx{}, nil }
+
+// fakeSQLTx applies statements at once, so a transaction can't be rolled
+// back.
+type fakeSQLTx struct{}
+
+func (fakeSQLTx) Commit() error   { return nil }
+func (fakeSQLTx) Rollback() error { return nil }
+
+type fakeSQLStmt struct {
+	dsn, query string
+}
+
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return -1 }
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	fakeSQL.Lock()
+	defer fakeSQL.Unlock()
+	rows := fakeSQL.tables[s.dsn]
+	switch {
+	case strings.HasPrefix(s.query, "INSERT INTO casbin_rule (ptype, v0, v1, v2, v3, v4, v5) VALUES "):
+		row := make([]string, len(args))
+		for i, arg := range args {
+			row[i] = arg.(string)
+		}
+		fakeSQL.tables[s.dsn] = append(rows, row)
+		return driver.RowsAffected(1), nil
+	case s.query == "DELETE FROM casbin_rule":
+		delete(fakeSQL.tables, s.dsn)
+		return driver.RowsAffected(len(rows)), nil
+	case strings.HasPrefix(s.query, "DELETE FROM casbin_rule WHERE "):
+		conditions := strings.Split(strings.TrimPrefix(s.query, "DELETE FROM casbin_rule WHERE "), " AND ")
+		if len(conditions) != len(args) {
+			return nil, fmt.Errorf("%d conditions, %d arguments", len(conditions), len(args))
+		}
+		columns := make([]int, len(conditions))
+		for i, condition := range conditions {
+			column := strings.SplitN(condition, " = ", 2)[0]
+			if column == "ptype" {
+				continue
+			}
+			n, err := strconv.Atoi(strings.TrimPrefix(column, "v"))
+			if err != nil {
+				return nil, fmt.Errorf("unexpected condition %q", condition)
+			}
+			columns[i] = n + 1
+		}
+		var kept [][]string
+		for _, row := range rows {
+			match := true
+			for i, column := range columns {
+				if row[column] != args[i].(string) {
+					match = false
+				}
+			}
+			if !match {
+				kept = append(kept, row)
+			}
+		}
+		fakeSQL.tables[s.dsn] = kept
+		return driver.RowsAffected(len(rows) - len(kept)), nil
+	}
+	return nil, fmt.Errorf("unexpected statement %q", s.query)
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.query != "SELECT ptype, v0, v1, v2, v3, v4, v5 FROM casbin_rule" {
+		return nil, fmt.Errorf("unexpected query %q", s.query)
+	}
+	fakeSQL.Lock()
+	defer fakeSQL.Unlock()
+	return &fakeSQLRows{rows: append([][]string(nil), fakeSQL.tables[s.dsn]...)}, nil
+}
+
+type fakeSQLRows struct {
+	rows [][]string
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	return []string{"ptype", "v0", "v1", "v2", "v3", "v4", "v5"}
+}
+
+func (r *fakeSQLRows) Close() error { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	for i, field := range r.rows[0] {
+		dest[i] = field
+	}
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// setFakeSQLRows replaces the rows of the fake database dsn.
+func setFakeSQLRows(dsn string, rows ...[]string) {
+	fakeSQL.Lock()
+	defer fakeSQL.Unlock()
+	fakeSQL.tables[dsn] = rows
+}
+
+// fakeSQLRowCount returns the number of rows of the fake database dsn.
+func fakeSQLRowCount(dsn string) int {
+	fakeSQL.Lock()
+	defer fakeSQL.Unlock()
+	return len(fakeSQL.tables[dsn])
+}
+
+func TestSQLAdapter(t *testing.T) {
+	const dsn = "TestSQLAdapter"
+	setFakeSQLRows(dsn,
+		[]string{"p", "alice", "/dataset1/resource1", "GET", "allow", "", ""},
+		[]string{"p", "bob", "/dataset2/resource1", "GET", "allow", "", ""},
+		[]string{"p", "bob", "/dataset2/resource2", "GET", "allow", "", ""},
+	)
+	var a Authorizer
+	a.AuthConfig.ModelPath = "authz_model.conf"
+	a.AuthConfig.SQLDriver = "authztest"
+	a.AuthConfig.SQLDSN = dsn
+	e, err := a.newSQLEnforcer()
+	if err != nil {
+		t.Fatalf("newSQLEnforcer: %s", err)
+	}
+	defer a.Cleanup()
+
+	if !e.Enforce("alice", "/dataset1/resource1", "GET") || e.Enforce("alice", "/dataset2/resource1", "GET") {
+		t.Errorf("unexpected policy %v", e.GetPolicy())
+	}
+	e.AddPolicy("alice", "/dataset2/resource1", "GET", "allow")
+	if n := fakeSQLRowCount(dsn); n != 4 {
+		t.Errorf("%d rows after adding a rule, supposed to be 4", n)
+	}
+	e.RemovePolicy("alice", "/dataset1/resource1", "GET", "allow")
+	e.RemoveFilteredPolicy(0, "bob")
+	if n := fakeSQLRowCount(dsn); n != 1 {
+		t.Errorf("%d rows after removing rules, supposed to be 1", n)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("LoadPolicy: %s", err)
+	}
+	if !e.Enforce("alice", "/dataset2/resource1", "GET") || e.Enforce("bob", "/dataset2/resource1", "GET") {
+		t.Errorf("unexpected policy after reload %v", e.GetPolicy())
+	}
+
+	e.AddPolicy("cathy", "/dataset1/", "*", "allow")
+	setFakeSQLRows(dsn)
+	if err := e.SavePolicy(); err != nil {
+		t.Fatalf("SavePolicy: %s", err)
+	}
+	if n := fakeSQLRowCount(dsn); n != 2 {
+		t.Errorf("%d rows after saving the policy, supposed to be 2", n)
+	}
+
+	// PostgreSQL placeholders are numbered.
+	a.sqlAdapter.numbered = true
+	e.RemoveFilteredPolicy(0, "cathy", "/dataset1/")
+	if n := fakeSQLRowCount(dsn); n != 1 {
+		t.Errorf("%d rows after removing a rule with numbered placeholders, supposed to be 1", n)
+	}
+}
+
+func TestSQLDrivers(t *testing.T) {
+	drivers := strings.Join(sql.Drivers(), " ")
+	for _, driver := range []string{"mysql", "postgres"} {
+		if !strings.Contains(" "+drivers+" ", " "+driver+" ") {
+			t.Errorf("driver %s not linked, have %s", driver, drivers)
+		}
+	}
+}
+
+func TestSQLTableName(t *testing.T) {
+	for table, valid := range map[string]bool{
+		"casbin_rule":         true,
+		"authz.casbin_rule":   true,
+		"rules; DROP TABLE x": false,
+		"":                    false,
+	} {
+		adapter, err := newSQLAdapter("authztest", "TestSQLTableName", table)
+		if (err == nil) != valid {
+			t.Errorf("table %q: %v", table, err)
+		}
+		if err == nil {
+			adapter.Close()
+		}
+	}
+}
+
+func TestProvisionSQLUnreachable(t *testing.T) {
+	config := `{
+		"admin": {"disabled": true, "config": {"persist": false}},
+		"apps": {"authz_provision_test": {"handler": {"auth_config": {
+			"model_path": "authz_model.conf",
+			"password_file": "bcrypt.pass",
+			"sql_driver": "authztest",
+			"sql_dsn": "unreachable"
+		}}}}
+	}`
+	err := caddy.Load([]byte(config), true)
+	if err == nil {
+		caddy.Stop()
+		t.Fatalf("unreachable policy database accepted")
+	}
+	if !strings.Contains(err.Error(), "connecting to the policy database: connection refused") {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestCaddyfilePolicySQL(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`authz {
+		model model.conf
+		password_file bcrypt.pass
+		policy_sql postgres "host=db dbname=authz" {
+			table authz_rules
+		}
+	}`)
+	var a Authorizer
+	if err := a.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("UnmarshalCaddyfile: %s", err)
+	}
+	if a.AuthConfig.SQLDriver != "postgres" || a.AuthConfig.SQLDSN != "host=db dbname=authz" || a.AuthConfig.SQLTable != "authz_rules" {
+		t.Errorf("unexpected config: %+v", a.AuthConfig)
+	}
+}
@@ -0,0 +1,183 @@
+package authz
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sort"
+	"sync"
+
+	"github.com/dafanasiev/caddy-authz/v2/authfile"
+)
+
+// tokenIndexMaxUnknown bounds the number of tokens remembered as matching no
+// entry.
+const tokenIndexMaxUnknown = 10000
+
+// tokenIndex finds the entry of a token of the token basic auth mode without
+// trying the token against every entry.
+//
+// The password file only has salted hashes, so the user of a token is only
+// known once the token has matched an entry. From then on the token is
+// indexed by its HMAC-SHA256, and further requests with it are verified
+// against that one entry. The index outlives the auth cache: an entry is only
+// dropped when the password hash of its user changes. Tokens matching no
+// entry are remembered too, until the next load. Tokens neither indexed nor
+// known to be unknown are tried against the entries one at a time, so a
+// flood of made-up tokens keeps a single hash comparison running and not
+// one per request.
+type tokenIndex struct {
+	key  []byte
+	scan chan struct{} // holds a value while the entries are scanned
+
+	mutex   sync.Mutex
+	users   map[string]string // user by token key
+	unknown map[string]bool   // token keys matching no entry
+	// hashes are fingerprints of the password hashes of the last load,
+	// by user, to find users whose password changed.
+	hashes map[string][sha256.Size]byte
+}
+
+// newTokenIndex creates an empty token index.
+func newTokenIndex() (*tokenIndex, error) {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &tokenIndex{
+		key:     key,
+		scan:    make(chan struct{}, 1),
+		users:   make(map[string]string),
+		unknown: make(map[string]bool),
+	}, nil
+}
+
+// tokenKey derives the index key of token.
+func (x *tokenIndex) tokenKey(token string) string {
+	mac := hmac.New(sha256.New, x.key)
+	mac.Write([]byte(token))
+	return string(mac.Sum(nil))
+}
+
+// lookup returns the user indexed for key and whether the token is known to
+// match no entry.
+func (x *tokenIndex) lookup(key string) (user string, unknown bool) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.users[key], x.unknown[key]
+}
+
+// store indexes key as the token of user, or as matching no entry if user is
+// empty.
+func (x *tokenIndex) store(key, user string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if user != "" {
+		x.users[key] = user
+		delete(x.unknown, key)
+		return
+	}
+	if len(x.unknown) >= tokenIndexMaxUnknown {
+		x.unknown = make(map[string]bool)
+	}
+	x.unknown[key] = true
+}
+
+// remove drops key from the index.
+func (x *tokenIndex) remove(key string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	delete(x.users, key)
+}
+
+// loaded drops the tokens of users whose password hash changed or who are
+// gone since the last load, and forgets the unknown tokens, which may match a
+// new entry. It is called with every load of the password file.
+func (x *tokenIndex) loaded(entries []authfile.Entry) {
+	hashes := make(map[string][sha256.Size]byte, len(entries))
+	for _, e := range entries {
+		hashes[e.Username] = sha256.Sum256(e.PasswordHash)
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	for key, user := range x.users {
+		if hash, ok := hashes[user]; !ok || hash != x.hashes[user] {
+			delete(x.users, key)
+		}
+	}
+	x.unknown = make(map[string]bool)
+	x.hashes = hashes
+}
+
+// checkToken finds the entry whose password is token and returns its user.
+// A token in the token index is verified against its entry alone; any other
+// token is tried against every entry, in order of the user names, by one
+// request at a time.
+func (a *Authorizer) checkToken(ctx context.Context, token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	if a.authCache != nil {
+		if user, ok := a.authCache.getToken(token); ok {
+			return user, true
+		}
+	}
+	key := a.tokens.tokenKey(token)
+	user, unknown := a.tokens.lookup(key)
+	if unknown {
+		return "", false
+	}
+	if user == "" {
+		select {
+		case a.tokens.scan <- struct{}{}:
+		case <-ctx.Done():
+			return "", false
+		}
+		user = a.scanTokens(ctx, key, token)
+		<-a.tokens.scan
+		if user == "" {
+			return "", false
+		}
+	} else if a.userDenied(user) {
+		return "", false
+	} else if a.PasswordCheck.AuthenticateContext(ctx, user, token) != nil {
+		a.tokens.remove(key)
+		return "", false
+	}
+	if a.authCache != nil {
+		a.authCache.putToken(token, user)
+	}
+	return user, true
+}
+
+// scanTokens tries token against every entry and indexes the result. It
+// returns the user of the matching entry, or "" if there is none. The scan
+// slot of the token index must be held.
+func (a *Authorizer) scanTokens(ctx context.Context, key, token string) string {
+	// Another request may have indexed the token while this one waited.
+	if user, unknown := a.tokens.lookup(key); user != "" || unknown {
+		return user
+	}
+	entries := a.PasswordCheck.List()
+	users := make([]string, 0, len(entries))
+	for _, e := range entries {
+		users = append(users, e.Username)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		if ctx.Err() != nil {
+			// Not known to be unknown, the scan was cut short.
+			return ""
+		}
+		if a.userDenied(user) {
+			continue
+		}
+		if a.PasswordCheck.AuthenticateContext(ctx, user, token) == nil {
+			a.tokens.store(key, user)
+			return user
+		}
+	}
+	a.tokens.store(key, "")
+	return ""
+}
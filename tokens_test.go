@@ -0,0 +1,114 @@
+package authz
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin"
+	"github.com/dafanasiev/caddy-authz/v2/authfile"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// countingCheck is a password check counting the password comparisons.
+type countingCheck struct {
+	authfile.IAuthenticationService
+	checks int64 // accessed atomically
+}
+
+func (c *countingCheck) AuthenticateContext(ctx context.Context, username, password string) error {
+	atomic.AddInt64(&c.checks, 1)
+	return c.IAuthenticationService.AuthenticateContext(ctx, username, password)
+}
+
+func TestTokenIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	const entries = 8
+	hashOf := func(token string) string {
+		hash, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("GenerateFromPassword: %s", err)
+		}
+		return string(hash)
+	}
+	var users string
+	for i := 0; i < entries; i++ {
+		users += fmt.Sprintf("bot-%d:%s\n", i, hashOf(fmt.Sprintf("tok-%d", i)))
+	}
+	passwordPath := filepath.Join(dir, "tokens")
+	if err := ioutil.WriteFile(passwordPath, []byte(users), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	e := casbin.NewEnforcer("authz_model.conf", "authz_policy.csv")
+	e.AddPolicy(fmt.Sprintf("bot-%d", entries-1), "^/builds/", "GET", "allow")
+	handler := Authorizer{Enforcer: e}
+	handler.AuthConfig.PasswordFile = passwordPath
+	handler.AuthConfig.BasicAuthMode = BasicAuthToken
+	if handler.tokens, err = newTokenIndex(); err != nil {
+		t.Fatalf("newTokenIndex: %s", err)
+	}
+	authProvider, _, err := handler.newPasswordCheck(&sharedPasswordCheck{handlers: []*Authorizer{&handler}})
+	if err != nil {
+		t.Fatalf("newPasswordCheck: %s", err)
+	}
+	defer authProvider.Shutdown()
+	check := &countingCheck{IAuthenticationService: authProvider}
+	handler.PasswordCheck = check
+	if !waitFor(time.Second, func() bool { return len(authProvider.List()) == entries }) {
+		t.Fatalf("password file not loaded")
+	}
+
+	// request returns the response code and the number of password
+	// comparisons of a request with token.
+	request := func(token string) (int, int64) {
+		before := atomic.LoadInt64(&check.checks)
+		r, _ := http.NewRequest("GET", "/builds/1", nil)
+		r.SetBasicAuth("", token)
+		code := serve(handler, r).Code
+		return code, atomic.LoadInt64(&check.checks) - before
+	}
+	token := fmt.Sprintf("tok-%d", entries-1)
+	if code, checks := request(token); code != 200 || checks != entries {
+		t.Errorf("first request: %d after %d checks, supposed to be 200 after %d", code, checks, entries)
+	}
+	if code, checks := request(token); code != 200 || checks != 1 {
+		t.Errorf("indexed token: %d after %d checks, supposed to be 200 after 1", code, checks)
+	}
+	if code, checks := request("made-up"); code != 401 || checks != entries {
+		t.Errorf("unknown token: %d after %d checks, supposed to be 401 after %d", code, checks, entries)
+	}
+	if code, checks := request("made-up"); code != 401 || checks != 0 {
+		t.Errorf("known unknown token: %d after %d checks, supposed to be 401 after 0", code, checks)
+	}
+
+	// A changed token of the user drops the old one from the index.
+	users = fmt.Sprintf("bot-%d:%s\n", entries-1, hashOf("tok-new"))
+	for i := 0; i < entries-1; i++ {
+		users += fmt.Sprintf("bot-%d:%s\n", i, hashOf(fmt.Sprintf("tok-%d", i)))
+	}
+	if err := ioutil.WriteFile(passwordPath, []byte(users), 0600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	authProvider.Update()
+	key := handler.tokens.tokenKey(token)
+	if !waitFor(2*time.Second, func() bool { user, _ := handler.tokens.lookup(key); return user == "" }) {
+		t.Fatalf("changed token still indexed")
+	}
+	if code, _ := request(token); code != 401 {
+		t.Errorf("changed token: %d, supposed to be 401", code)
+	}
+	if code, _ := request("tok-new"); code != 200 {
+		t.Errorf("new token: %d, supposed to be 200", code)
+	}
+}